@@ -0,0 +1,736 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// Error codes returned in the error envelope. Clients should branch on these
+// rather than on the human-readable message.
+const (
+	ErrCodeInvalidRequest   = "invalid_request"
+	ErrCodeInvalidParameter = "invalid_parameter"
+	ErrCodeValidationFailed = "validation_failed"
+	ErrCodeNoFile           = "no_file"
+	ErrCodeInvalidUpload    = "invalid_upload"
+	ErrCodeUnsupportedMedia = "unsupported_media_type"
+	ErrCodeNotFound         = "not_found"
+	ErrCodeUnauthorized     = "unauthorized"
+	ErrCodeForbidden        = "forbidden"
+	ErrCodeRateLimited      = "rate_limited"
+	ErrCodeQuotaExceeded    = "quota_exceeded"
+	ErrCodeConflict         = "conflict"
+	ErrCodeQueueFull        = "queue_full"
+	ErrCodeScanFailed       = "scan_failed"
+	ErrCodeInternal         = "internal_error"
+)
+
+// APIError is the body of every error response: {"error": {...}}
+type APIError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Details []FieldError `json:"details,omitempty"`
+}
+
+// FieldError points at the request field or parameter that failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func init() {
+	// Request bodies are checked against the schema: unknown fields are rejected
+	// and validation errors name the JSON field rather than the Go one
+	binding.EnableDecoderDisallowUnknownFields = true
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+			if name == "-" {
+				return ""
+			}
+			return name
+		})
+	}
+}
+
+// respondError aborts the request with an error envelope
+func respondError(c *gin.Context, status int, code, message string, details ...FieldError) {
+	c.AbortWithStatusJSON(status, gin.H{"error": APIError{Code: code, Message: message, Details: details}})
+}
+
+// respondInvalidParameter rejects a malformed query parameter
+func respondInvalidParameter(c *gin.Context, param, message string) {
+	respondError(c, 400, ErrCodeInvalidParameter, fmt.Sprintf("Invalid %s", param), FieldError{Field: param, Message: message})
+}
+
+// respondBindError rejects a request body that could not be decoded or validated
+func respondBindError(c *gin.Context, err error) {
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		respondError(c, 400, ErrCodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	details := make([]FieldError, 0, len(validationErrors))
+	for _, fieldErr := range validationErrors {
+		// Drop the struct name from the namespace: invoiceUpdate.line_items[0].amount
+		field := fieldErr.Namespace()
+		if i := strings.Index(field, "."); i >= 0 {
+			field = field[i+1:]
+		}
+		message := fmt.Sprintf("failed %q validation", fieldErr.Tag())
+		if fieldErr.Param() != "" {
+			message = fmt.Sprintf("failed %q validation (%s)", fieldErr.Tag(), fieldErr.Param())
+		}
+		details = append(details, FieldError{Field: field, Message: message})
+	}
+	respondError(c, 422, ErrCodeValidationFailed, "Request body failed validation", details...)
+}
+
+// InvoiceDTO is the API representation of an invoice
+type InvoiceDTO struct {
+	ID              uint           `json:"id"`
+	InvoiceNumber   string         `json:"invoice_number"`
+	Date            string         `json:"date"`
+	IssuedOn        *string        `json:"issued_on"`
+	TotalAmount     float64        `json:"total_amount"`
+	Currency        string         `json:"currency"`
+	VendorName      string         `json:"vendor_name"`
+	Vendor          *VendorRefDTO  `json:"vendor"`
+	GLCode          string         `json:"gl_code"`
+	PageCount       int            `json:"page_count"`
+	StartPage       int            `json:"start_page"`
+	EndPage         int            `json:"end_page"`
+	LineItems       []LineItemDTO  `json:"line_items"`
+	Documents       []DocumentDTO  `json:"documents,omitempty"`
+	ApprovedAt      *time.Time     `json:"approved_at"`
+	ApprovedBy      string         `json:"approved_by,omitempty"`
+	CorrectedFields []string       `json:"corrected_fields"`
+	Duplicates      []DuplicateDTO `json:"duplicates,omitempty"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+}
+
+// LineItemDTO is the API representation of a line item
+type LineItemDTO struct {
+	ID          uint    `json:"id"`
+	Page        int     `json:"page"`
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
+
+// DocumentDTO links to a file kept with an invoice
+type DocumentDTO struct {
+	ID          uint      `json:"id"`
+	Kind        string    `json:"kind"`
+	Page        *int      `json:"page"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	URL         string    `json:"url"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// VendorRefDTO names the vendor an invoice is linked to
+type VendorRefDTO struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// VendorDTO is the API representation of a vendor
+type VendorDTO struct {
+	ID              uint      `json:"id"`
+	Name            string    `json:"name"`
+	Aliases         []string  `json:"aliases"`
+	Domains         []string  `json:"domains"`
+	TaxID           string    `json:"tax_id"`
+	Address         string    `json:"address"`
+	DefaultCurrency string    `json:"default_currency"`
+	DefaultGLCode   string    `json:"default_gl_code"`
+	URL             string    `json:"url"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// VendorListDTO lists an organization's vendors
+type VendorListDTO struct {
+	Vendors []VendorDTO `json:"vendors"`
+}
+
+// UnmatchedVendorDTO is an entry of the vendor review list
+type UnmatchedVendorDTO struct {
+	ID           uint                 `json:"id"`
+	Names        []string             `json:"names"`
+	Domains      []string             `json:"domains"`
+	InvoiceCount int                  `json:"invoice_count"`
+	FirstSeenAt  time.Time            `json:"first_seen_at"`
+	LastSeenAt   time.Time            `json:"last_seen_at"`
+	Candidates   []VendorCandidateDTO `json:"candidates"`
+}
+
+// UnmatchedVendorListDTO is the vendor review list
+type UnmatchedVendorListDTO struct {
+	UnmatchedVendors []UnmatchedVendorDTO `json:"unmatched_vendors"`
+}
+
+// VendorCandidateDTO is a vendor a scanned name may belong to, with its score
+type VendorCandidateDTO struct {
+	Vendor      VendorRefDTO `json:"vendor"`
+	Score       float64      `json:"score"`
+	Method      string       `json:"method"`
+	MatchedName string       `json:"matched_name,omitempty"`
+}
+
+// VendorMatchDTO is the result of matching a vendor name and domains against the vendors
+type VendorMatchDTO struct {
+	Vendor     *VendorRefDTO        `json:"vendor"`
+	Method     string               `json:"method,omitempty"`
+	Candidates []VendorCandidateDTO `json:"candidates"`
+}
+
+// VendorLinkDTO is the result of resolving a review list entry to a vendor
+type VendorLinkDTO struct {
+	Vendor         VendorDTO `json:"vendor"`
+	InvoicesLinked int64     `json:"invoices_linked"`
+}
+
+// DuplicateDTO flags an invoice as a possible duplicate of an earlier one
+type DuplicateDTO struct {
+	ID                uint       `json:"id"`
+	InvoiceID         uint       `json:"invoice_id"`
+	OriginalInvoiceID uint       `json:"original_invoice_id"`
+	OriginalURL       string     `json:"original_url"`
+	Reason            string     `json:"reason"`
+	Detail            string     `json:"detail"`
+	Status            string     `json:"status"`
+	ReviewedAt        *time.Time `json:"reviewed_at"`
+	ReviewedBy        string     `json:"reviewed_by,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+// DuplicateReviewDTO is an entry of the duplicate review queue, showing both invoices
+type DuplicateReviewDTO struct {
+	DuplicateDTO
+	Invoice  InvoiceDTO `json:"invoice"`
+	Original InvoiceDTO `json:"original"`
+}
+
+// DuplicateListDTO is the duplicate review queue
+type DuplicateListDTO struct {
+	Duplicates []DuplicateReviewDTO `json:"duplicates"`
+}
+
+// InvoiceListDTO is one page of an invoice listing
+type InvoiceListDTO struct {
+	Invoices   []InvoiceDTO `json:"invoices"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// ScanResultDTO is the result of a synchronous scan of one invoice
+type ScanResultDTO struct {
+	Invoice            InvoiceDTO `json:"invoice"`
+	ProcessedImageURL  string     `json:"processed_image_url"`
+	ProcessedImageURLs []string   `json:"processed_image_urls"`
+	Formats            []string   `json:"formats"`
+}
+
+// SplitScanResultDTO is the result of scanning a stack of several invoices
+type SplitScanResultDTO struct {
+	Invoices           []InvoiceDTO `json:"invoices"`
+	ProcessedImageURLs []string     `json:"processed_image_urls"`
+	Formats            []string     `json:"formats"`
+}
+
+// ScanFailureDTO describes a synchronous scan that failed, for scan.failed
+// webhooks. Failed asynchronous jobs are described by a ScanJobDTO instead.
+type ScanFailureDTO struct {
+	Filenames    []string  `json:"filenames"`
+	ErrorMessage string    `json:"error_message"`
+	FailedAt     time.Time `json:"failed_at"`
+}
+
+// ScanJobDTO is the API representation of an asynchronous scan job. The result
+// fields are only set once the job is done, ErrorMessage once it has failed.
+type ScanJobDTO struct {
+	ID                 uint        `json:"id"`
+	Status             string      `json:"status"`
+	URL                string      `json:"url"`
+	EventsURL          string      `json:"events_url"`
+	CreatedAt          time.Time   `json:"created_at"`
+	UpdatedAt          time.Time   `json:"updated_at"`
+	Invoice            *InvoiceDTO `json:"invoice,omitempty"`
+	ProcessedImageURL  string      `json:"processed_image_url,omitempty"`
+	ProcessedImageURLs []string    `json:"processed_image_urls,omitempty"`
+	Formats            []string    `json:"formats,omitempty"`
+	ErrorMessage       string      `json:"error_message,omitempty"`
+}
+
+// BatchDTO summarizes a batch upload and the outcome of each of its files
+type BatchDTO struct {
+	ID        uint           `json:"id"`
+	Status    string         `json:"status"`
+	URL       string         `json:"url"`
+	Total     int            `json:"total"`
+	Counts    map[string]int `json:"counts"`
+	Files     []BatchFileDTO `json:"files"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// BatchFileDTO is the outcome of one file of a batch
+type BatchFileDTO struct {
+	Filename     string `json:"filename"`
+	JobID        uint   `json:"job_id"`
+	Status       string `json:"status"`
+	URL          string `json:"url"`
+	InvoiceID    *uint  `json:"invoice_id,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+// UserDTO describes a user account without its password hash
+type UserDTO struct {
+	ID             uint       `json:"id"`
+	OrganizationID uint       `json:"organization_id"`
+	Email          string     `json:"email"`
+	Name           string     `json:"name"`
+	Role           string     `json:"role"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DisabledAt     *time.Time `json:"disabled_at"`
+}
+
+// WebhookDTO describes a webhook endpoint without revealing its secret
+type WebhookDTO struct {
+	ID          uint      `json:"id"`
+	URL         string    `json:"url"`
+	Description string    `json:"description"`
+	Events      []string  `json:"events"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// WebhookCreatedDTO is returned once when an endpoint is registered and includes its signing secret
+type WebhookCreatedDTO struct {
+	WebhookDTO
+	Secret string `json:"secret"`
+}
+
+// WebhookListDTO lists the webhook endpoints
+type WebhookListDTO struct {
+	Webhooks []WebhookDTO `json:"webhooks"`
+}
+
+// WebhookDeliveryDTO is one entry of a webhook's delivery log
+type WebhookDeliveryDTO struct {
+	ID             uint       `json:"id"`
+	WebhookID      uint       `json:"webhook_id"`
+	EventID        string     `json:"event_id"`
+	Event          string     `json:"event"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	ResponseStatus *int       `json:"response_status"`
+	LastError      string     `json:"last_error,omitempty"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// WebhookDeliveryListDTO lists recent deliveries, newest first
+type WebhookDeliveryListDTO struct {
+	Deliveries []WebhookDeliveryDTO `json:"deliveries"`
+}
+
+// OrganizationDTO is the API representation of a tenant
+type OrganizationDTO struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OrganizationListDTO lists the tenants
+type OrganizationListDTO struct {
+	Organizations []OrganizationDTO `json:"organizations"`
+}
+
+// ReextractionDTO previews or reports re-running extraction over stored invoices.
+// Confirmation must be sent back to apply the previewed changes.
+type ReextractionDTO struct {
+	Checked      int                      `json:"invoices_checked"`
+	Changed      int                      `json:"invoices_changed"`
+	Applied      bool                     `json:"applied"`
+	Confirmation string                   `json:"confirmation,omitempty"`
+	Invoices     []InvoiceReextractionDTO `json:"invoices"`
+	Skipped      []ReextractionSkipDTO    `json:"skipped"`
+}
+
+// InvoiceReextractionDTO lists what re-extraction changes on one invoice
+type InvoiceReextractionDTO struct {
+	InvoiceID       uint             `json:"invoice_id"`
+	Changes         []FieldChangeDTO `json:"changes"`
+	KeptCorrections []string         `json:"kept_corrections"`
+}
+
+// FieldChangeDTO is the old and new value of one invoice field
+type FieldChangeDTO struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// ReextractionSkipDTO is an invoice re-extraction left alone, and why
+type ReextractionSkipDTO struct {
+	InvoiceID uint   `json:"invoice_id"`
+	Reason    string `json:"reason"`
+}
+
+// UserListDTO lists the user accounts
+type UserListDTO struct {
+	Users []UserDTO `json:"users"`
+}
+
+// APIKeyDTO describes an API key without revealing it
+type APIKeyDTO struct {
+	ID                 uint       `json:"id"`
+	OrganizationID     uint       `json:"organization_id"`
+	Name               string     `json:"name"`
+	Prefix             string     `json:"prefix"`
+	Scopes             []string   `json:"scopes"`
+	RateLimitPerMinute int        `json:"rate_limit_per_minute"`
+	RateLimitBurst     int        `json:"rate_limit_burst"`
+	MonthlyOCRQuota    int        `json:"monthly_ocr_quota"`
+	OCRPagesThisMonth  int        `json:"ocr_pages_this_month"`
+	CreatedAt          time.Time  `json:"created_at"`
+	LastUsedAt         *time.Time `json:"last_used_at"`
+	RevokedAt          *time.Time `json:"revoked_at"`
+}
+
+// APIKeyCreatedDTO is returned once when a key is issued and includes the key itself
+type APIKeyCreatedDTO struct {
+	APIKeyDTO
+	Key string `json:"key"`
+}
+
+// APIKeyListDTO lists the issued API keys
+type APIKeyListDTO struct {
+	Keys []APIKeyDTO `json:"keys"`
+}
+
+// toInvoiceDTO converts an invoice and its loaded line items
+func toInvoiceDTO(invoice Invoice) InvoiceDTO {
+	dto := InvoiceDTO{
+		ID:              invoice.ID,
+		InvoiceNumber:   invoice.InvoiceNumber,
+		Date:            invoice.Date,
+		TotalAmount:     invoice.TotalAmount,
+		Currency:        invoice.Currency,
+		VendorName:      invoice.VendorName,
+		GLCode:          invoice.GLCode,
+		PageCount:       invoice.PageCount,
+		StartPage:       invoice.StartPage,
+		EndPage:         invoice.EndPage,
+		LineItems:       make([]LineItemDTO, 0, len(invoice.LineItems)),
+		ApprovedAt:      invoice.ApprovedAt,
+		ApprovedBy:      invoice.ApprovedBy,
+		CorrectedFields: append([]string{}, invoice.CorrectedFields...),
+		CreatedAt:       invoice.CreatedAt,
+		UpdatedAt:       invoice.UpdatedAt,
+	}
+	if invoice.IssuedOn != "" {
+		issuedOn := invoice.IssuedOn
+		dto.IssuedOn = &issuedOn
+	}
+	if invoice.Vendor != nil {
+		ref := toVendorRefDTO(*invoice.Vendor)
+		dto.Vendor = &ref
+	}
+	for _, item := range invoice.LineItems {
+		dto.LineItems = append(dto.LineItems, LineItemDTO{
+			ID:          item.ID,
+			Page:        item.Page,
+			Description: item.Description,
+			Amount:      item.Amount,
+		})
+	}
+	for _, document := range invoice.Documents {
+		dto.Documents = append(dto.Documents, toDocumentDTO(document))
+	}
+	for _, duplicate := range invoice.Duplicates {
+		dto.Duplicates = append(dto.Duplicates, toDuplicateDTO(duplicate))
+	}
+	return dto
+}
+
+// toVendorDTO converts a vendor
+func toVendorDTO(vendor Vendor) VendorDTO {
+	return VendorDTO{
+		ID:              vendor.ID,
+		Name:            vendor.Name,
+		Aliases:         append([]string{}, vendor.Aliases...),
+		Domains:         append([]string{}, vendor.Domains...),
+		TaxID:           vendor.TaxID,
+		Address:         vendor.Address,
+		DefaultCurrency: vendor.DefaultCurrency,
+		DefaultGLCode:   vendor.DefaultGLCode,
+		URL:             fmt.Sprintf("/api/vendors/%d", vendor.ID),
+		CreatedAt:       vendor.CreatedAt,
+		UpdatedAt:       vendor.UpdatedAt,
+	}
+}
+
+// toVendorRefDTO converts a vendor to a reference
+func toVendorRefDTO(vendor Vendor) VendorRefDTO {
+	return VendorRefDTO{ID: vendor.ID, Name: vendor.Name, URL: fmt.Sprintf("/api/vendors/%d", vendor.ID)}
+}
+
+// toVendorCandidateDTOs converts ranked vendor candidates, rounding the scores
+func toVendorCandidateDTOs(candidates []vendorCandidate) []VendorCandidateDTO {
+	dtos := make([]VendorCandidateDTO, 0, len(candidates))
+	for _, candidate := range candidates {
+		dtos = append(dtos, VendorCandidateDTO{
+			Vendor:      toVendorRefDTO(*candidate.Vendor),
+			Score:       math.Round(candidate.Score*1000) / 1000,
+			Method:      candidate.Method,
+			MatchedName: candidate.MatchedName,
+		})
+	}
+	return dtos
+}
+
+// toVendorMatchDTO converts the result of matching a vendor
+func toVendorMatchDTO(match vendorMatch) VendorMatchDTO {
+	dto := VendorMatchDTO{Method: match.Method, Candidates: toVendorCandidateDTOs(match.Candidates)}
+	if match.Vendor != nil {
+		ref := toVendorRefDTO(*match.Vendor)
+		dto.Vendor = &ref
+	}
+	return dto
+}
+
+// toUnmatchedVendorDTO converts a vendor review list entry with the vendors it may belong to
+func toUnmatchedVendorDTO(entry UnmatchedVendor, candidates []vendorCandidate) UnmatchedVendorDTO {
+	return UnmatchedVendorDTO{
+		ID:           entry.ID,
+		Names:        append([]string{}, entry.Names...),
+		Domains:      append([]string{}, entry.Domains...),
+		InvoiceCount: entry.InvoiceCount,
+		FirstSeenAt:  entry.CreatedAt,
+		LastSeenAt:   entry.LastSeenAt,
+		Candidates:   toVendorCandidateDTOs(candidates),
+	}
+}
+
+// toDuplicateDTO converts a duplicate flag, linking to the original invoice
+func toDuplicateDTO(duplicate InvoiceDuplicate) DuplicateDTO {
+	return DuplicateDTO{
+		ID:                duplicate.ID,
+		InvoiceID:         duplicate.InvoiceID,
+		OriginalInvoiceID: duplicate.OriginalID,
+		OriginalURL:       fmt.Sprintf("/api/invoices/%d", duplicate.OriginalID),
+		Reason:            duplicate.Reason,
+		Detail:            duplicate.Detail,
+		Status:            duplicate.Status,
+		ReviewedAt:        duplicate.ReviewedAt,
+		ReviewedBy:        duplicate.ReviewedBy,
+		CreatedAt:         duplicate.CreatedAt,
+	}
+}
+
+// toDuplicateReviewDTO converts a duplicate flag loaded with both of its invoices
+func toDuplicateReviewDTO(duplicate InvoiceDuplicate) DuplicateReviewDTO {
+	return DuplicateReviewDTO{
+		DuplicateDTO: toDuplicateDTO(duplicate),
+		Invoice:      toInvoiceDTO(*duplicate.Invoice),
+		Original:     toInvoiceDTO(*duplicate.Original),
+	}
+}
+
+// toDocumentDTO converts an invoice document, linking to its download
+func toDocumentDTO(document InvoiceDocument) DocumentDTO {
+	dto := DocumentDTO{
+		ID:          document.ID,
+		Kind:        document.Kind,
+		Filename:    document.Filename,
+		ContentType: document.ContentType,
+		Size:        document.Size,
+		SHA256:      document.SHA256,
+		URL:         fmt.Sprintf("/api/invoices/%d/documents/%d", document.InvoiceID, document.ID),
+		CreatedAt:   document.CreatedAt,
+	}
+	if document.Page > 0 {
+		page := document.Page
+		dto.Page = &page
+	}
+	return dto
+}
+
+// toInvoiceDTOs converts a list of invoices
+func toInvoiceDTOs(invoices []Invoice) []InvoiceDTO {
+	dtos := make([]InvoiceDTO, 0, len(invoices))
+	for _, invoice := range invoices {
+		dtos = append(dtos, toInvoiceDTO(invoice))
+	}
+	return dtos
+}
+
+// toScanJobDTO converts a scan job, including its result once done, with its
+// page images signed by urls
+func toScanJobDTO(job ScanJob, urls *urlSigner) ScanJobDTO {
+	dto := ScanJobDTO{
+		ID:        job.ID,
+		Status:    job.Status,
+		URL:       fmt.Sprintf("/api/scans/%d", job.ID),
+		EventsURL: fmt.Sprintf("/api/scans/%d/events", job.ID),
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+	}
+	switch job.Status {
+	case ScanStatusDone:
+		if job.Invoice != nil {
+			invoice := toInvoiceDTO(*job.Invoice)
+			dto.Invoice = &invoice
+		}
+		dto.ProcessedImageURLs = urls.signAll(job.OrganizationID, job.DisplayKeys)
+		dto.Formats = job.Formats
+		if len(dto.ProcessedImageURLs) > 0 {
+			dto.ProcessedImageURL = dto.ProcessedImageURLs[0]
+		}
+	case ScanStatusFailed:
+		dto.ErrorMessage = job.Error
+	}
+	return dto
+}
+
+// toWebhookDTO converts a webhook endpoint
+func toWebhookDTO(endpoint WebhookEndpoint) WebhookDTO {
+	return WebhookDTO{
+		ID:          endpoint.ID,
+		URL:         endpoint.URL,
+		Description: endpoint.Description,
+		Events:      endpoint.Events,
+		CreatedAt:   endpoint.CreatedAt,
+	}
+}
+
+// toWebhookDeliveryDTO converts a webhook delivery
+func toWebhookDeliveryDTO(delivery WebhookDelivery) WebhookDeliveryDTO {
+	dto := WebhookDeliveryDTO{
+		ID:            delivery.ID,
+		WebhookID:     delivery.EndpointID,
+		EventID:       delivery.EventID,
+		Event:         delivery.Event,
+		Status:        delivery.Status,
+		Attempts:      delivery.Attempts,
+		LastError:     delivery.LastError,
+		NextAttemptAt: delivery.NextAttemptAt,
+		DeliveredAt:   delivery.DeliveredAt,
+		CreatedAt:     delivery.CreatedAt,
+	}
+	if delivery.ResponseStatus != 0 {
+		dto.ResponseStatus = &delivery.ResponseStatus
+	}
+	return dto
+}
+
+// toOrganizationDTO converts an organization
+func toOrganizationDTO(org Organization) OrganizationDTO {
+	return OrganizationDTO{ID: org.ID, Name: org.Name, Slug: org.Slug, CreatedAt: org.CreatedAt}
+}
+
+// toReextractionDTO converts a re-extraction plan
+func toReextractionDTO(plan *reextractionPlan, applied bool) ReextractionDTO {
+	dto := ReextractionDTO{
+		Checked:  plan.Checked,
+		Changed:  plan.Changed(),
+		Applied:  applied,
+		Invoices: make([]InvoiceReextractionDTO, 0, len(plan.Invoices)),
+		Skipped:  append([]ReextractionSkipDTO{}, plan.Skipped...),
+	}
+	if !applied && dto.Changed > 0 {
+		dto.Confirmation = plan.Confirmation()
+	}
+	for _, result := range plan.Invoices {
+		dto.Invoices = append(dto.Invoices, InvoiceReextractionDTO{
+			InvoiceID:       result.invoice.ID,
+			Changes:         append([]FieldChangeDTO{}, result.Changes...),
+			KeptCorrections: append([]string{}, result.Kept...),
+		})
+	}
+	return dto
+}
+
+// toUserDTO converts a user account
+func toUserDTO(user User) UserDTO {
+	return UserDTO{
+		ID:             user.ID,
+		OrganizationID: user.OrganizationID,
+		Email:          user.Email,
+		Name:           user.Name,
+		Role:           user.Role,
+		CreatedAt:      user.CreatedAt,
+		DisabledAt:     user.DisabledAt,
+	}
+}
+
+// toAPIKeyDTO converts an API key along with the OCR pages it used this month
+func toAPIKeyDTO(key APIKey, ocrPagesThisMonth int) APIKeyDTO {
+	return APIKeyDTO{
+		ID:                 key.ID,
+		OrganizationID:     key.OrganizationID,
+		Name:               key.Name,
+		Prefix:             key.Prefix,
+		Scopes:             key.Scopes,
+		RateLimitPerMinute: key.RateLimitPerMinute,
+		RateLimitBurst:     key.RateLimitBurst,
+		MonthlyOCRQuota:    key.MonthlyOCRQuota,
+		OCRPagesThisMonth:  ocrPagesThisMonth,
+		CreatedAt:          key.CreatedAt,
+		LastUsedAt:         key.LastUsedAt,
+		RevokedAt:          key.RevokedAt,
+	}
+}
+
+// toBatchDTO converts a batch with its jobs and their files loaded
+func toBatchDTO(batch ScanBatch) BatchDTO {
+	dto := BatchDTO{
+		ID:        batch.ID,
+		URL:       fmt.Sprintf("/api/batches/%d", batch.ID),
+		Total:     len(batch.Jobs),
+		Counts:    make(map[string]int),
+		Files:     make([]BatchFileDTO, 0, len(batch.Jobs)),
+		CreatedAt: batch.CreatedAt,
+		UpdatedAt: batch.UpdatedAt,
+	}
+
+	for _, job := range batch.Jobs {
+		dto.Counts[job.Status]++
+
+		file := BatchFileDTO{
+			JobID:     job.ID,
+			Status:    job.Status,
+			URL:       fmt.Sprintf("/api/scans/%d", job.ID),
+			InvoiceID: job.InvoiceID,
+		}
+		if len(job.Files) > 0 {
+			file.Filename = job.Files[0].Filename
+		}
+		if job.Status == ScanStatusFailed {
+			file.ErrorMessage = job.Error
+		}
+		dto.Files = append(dto.Files, file)
+	}
+
+	dto.Status = "processing"
+	if dto.Counts[ScanStatusDone]+dto.Counts[ScanStatusFailed] == dto.Total {
+		dto.Status = "completed"
+	}
+	return dto
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrAPIKeyNotFound is returned when no API key of the context's organization has the ID or hash
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKeyRepository stores API keys. Calls are scoped to the context's
+// organization like those of InvoiceRepository; the auth middleware looks keys
+// up by hash with an unscoped context.
+type APIKeyRepository interface {
+	// Create stores a new key
+	Create(ctx context.Context, key *APIKey) error
+	// Get returns a key
+	Get(ctx context.Context, id uint) (*APIKey, error)
+	// GetByHash returns the key with the hash, revoked or not
+	GetByHash(ctx context.Context, hash string) (*APIKey, error)
+	// List returns every key, including revoked ones, in the order they were issued
+	List(ctx context.Context) ([]APIKey, error)
+	// UpdateScopes saves the key's scopes
+	UpdateScopes(ctx context.Context, key *APIKey) error
+	// Touch records that the key was used at the time
+	Touch(ctx context.Context, key *APIKey, at time.Time) error
+	// Revoke records that the key was revoked at the time
+	Revoke(ctx context.Context, key *APIKey, at time.Time) error
+}
+
+// gormAPIKeyRepository keeps API keys in the SQL database
+type gormAPIKeyRepository struct {
+	db *gorm.DB
+}
+
+// newGormAPIKeyRepository returns a repository on the database. Tenant scoping
+// relies on the callbacks of registerTenantCallbacks.
+func newGormAPIKeyRepository(db *gorm.DB) *gormAPIKeyRepository {
+	return &gormAPIKeyRepository{db: db}
+}
+
+// Create inserts the key
+func (r *gormAPIKeyRepository) Create(ctx context.Context, key *APIKey) error {
+	return r.db.WithContext(ctx).Create(key).Error
+}
+
+// Get loads one key
+func (r *gormAPIKeyRepository) Get(ctx context.Context, id uint) (*APIKey, error) {
+	return r.first(r.db.WithContext(ctx).Where("id = ?", id))
+}
+
+// GetByHash loads the key with the hash
+func (r *gormAPIKeyRepository) GetByHash(ctx context.Context, hash string) (*APIKey, error) {
+	return r.first(r.db.WithContext(ctx).Where("hash = ?", hash))
+}
+
+// first loads the key the query selects
+func (r *gormAPIKeyRepository) first(query *gorm.DB) (*APIKey, error) {
+	var key APIKey
+	err := query.First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// List loads the keys in ID order
+func (r *gormAPIKeyRepository) List(ctx context.Context) ([]APIKey, error) {
+	var keys []APIKey
+	err := r.db.WithContext(ctx).Order("id").Find(&keys).Error
+	return keys, err
+}
+
+// UpdateScopes writes only the scopes column
+func (r *gormAPIKeyRepository) UpdateScopes(ctx context.Context, key *APIKey) error {
+	return r.db.WithContext(ctx).Model(key).Update("scopes", key.Scopes).Error
+}
+
+// Touch writes last_used_at without bumping updated_at
+func (r *gormAPIKeyRepository) Touch(ctx context.Context, key *APIKey, at time.Time) error {
+	key.LastUsedAt = &at
+	return r.db.WithContext(ctx).Model(key).UpdateColumn("last_used_at", at).Error
+}
+
+// Revoke writes revoked_at
+func (r *gormAPIKeyRepository) Revoke(ctx context.Context, key *APIKey, at time.Time) error {
+	key.RevokedAt = &at
+	result := r.db.WithContext(ctx).Model(key).Update("revoked_at", at)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// API key scopes. An admin key may do everything within its organization;
+// only platform keys may manage organizations.
+const (
+	ScopeScan     = "scan"
+	ScopeRead     = "read"
+	ScopeWrite    = "write"
+	ScopeApprove  = "approve"
+	ScopeExport   = "export"
+	ScopeAdmin    = "admin"
+	ScopePlatform = "platform"
+)
+
+// Defaults for keys issued without explicit limits
+const (
+	defaultRateLimitPerMinute = 60
+	defaultRateLimitBurst     = 20
+)
+
+// apiKeyPrefix marks our keys so they are easy to recognise in leaked secrets scans
+const apiKeyPrefix = "sk_"
+
+// apiKeyContextKey is where the middleware stores the authenticated key
+const apiKeyContextKey = "apiKey"
+
+// APIKey is a client credential. Only a SHA-256 hash of the key is stored; the
+// key itself is shown once when it is issued.
+type APIKey struct {
+	gorm.Model
+	OrganizationID     uint `gorm:"index"`
+	Name               string
+	Prefix             string   // first characters of the key, to tell keys apart
+	Hash               string   `gorm:"uniqueIndex"`
+	Scopes             []string `gorm:"serializer:json"`
+	RateLimitPerMinute int
+	RateLimitBurst     int
+	MonthlyOCRQuota    int // pages per calendar month (UTC), 0 for unlimited
+	LastUsedAt         *time.Time
+	RevokedAt          *time.Time
+}
+
+// APIKeyUsage counts the pages a key has sent to OCR in one month
+type APIKeyUsage struct {
+	ID       uint   `gorm:"primarykey"`
+	APIKeyID uint   `gorm:"uniqueIndex:idx_api_key_usage_month"`
+	Month    string `gorm:"uniqueIndex:idx_api_key_usage_month"` // YYYY-MM
+	OCRPages int
+}
+
+// HasScope reports whether the key grants scope
+func (k *APIKey) HasScope(scope string) bool {
+	if slices.Contains(k.Scopes, scope) {
+		return true
+	}
+	return scope != ScopePlatform && slices.Contains(k.Scopes, ScopeAdmin)
+}
+
+// hashToken returns the stored form of an API key or session token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKey returns a new random key
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// authHandlers authenticates requests and serves the login page and the
+// organization, user and API key admin endpoints
+type authHandlers struct {
+	orgs    OrganizationRepository
+	keys    APIKeyRepository
+	users   UserRepository
+	usage   UsageMeter
+	limiter *callerRateLimiter
+}
+
+// newAuthHandlers returns handlers backed by the given storage, with rate
+// limits of their own
+func newAuthHandlers(orgs OrganizationRepository, keys APIKeyRepository, users UserRepository, usage UsageMeter) *authHandlers {
+	return &authHandlers{
+		orgs:    orgs,
+		keys:    keys,
+		users:   users,
+		usage:   usage,
+		limiter: newCallerRateLimiter(),
+	}
+}
+
+// ensureBootstrapKey registers ADMIN_API_KEY as an admin and platform key of
+// the default organization so the first organizations and real keys can be set up
+func (h *authHandlers) ensureBootstrapKey(orgID uint) {
+	key := os.Getenv("ADMIN_API_KEY")
+	if key == "" {
+		return
+	}
+
+	ctx := context.Background()
+	hash := hashToken(key)
+	if existing, err := h.keys.GetByHash(ctx, hash); err == nil {
+		if !slices.Contains(existing.Scopes, ScopePlatform) {
+			existing.Scopes = append(existing.Scopes, ScopePlatform)
+			if err := h.keys.UpdateScopes(ctx, existing); err != nil {
+				log.Printf("Warning: Failed to give ADMIN_API_KEY the platform scope: %v", err)
+			}
+		}
+		return
+	}
+
+	bootstrap := APIKey{
+		Name:               "bootstrap admin",
+		Prefix:             keyDisplayPrefix(key),
+		Hash:               hash,
+		Scopes:             []string{ScopeAdmin, ScopePlatform},
+		RateLimitPerMinute: defaultRateLimitPerMinute,
+		RateLimitBurst:     defaultRateLimitBurst,
+	}
+	if err := h.keys.Create(withTenant(ctx, orgID), &bootstrap); err != nil {
+		log.Printf("Warning: Failed to register ADMIN_API_KEY: %v", err)
+	}
+}
+
+// keyDisplayPrefix returns the part of a key that is safe to show
+func keyDisplayPrefix(key string) string {
+	return key[:min(len(key), len(apiKeyPrefix)+6)]
+}
+
+// requestAPIKey reads the key from the X-API-Key or Authorization: Bearer header.
+// Keys are never read from the query string, which ends up in access logs and
+// browser history; the web UI opens event streams with its session cookie.
+func requestAPIKey(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// requireScope authenticates the request by API key or, for the web UI, by session
+// cookie, checks it grants scope and applies the caller's rate limit
+func (h *authHandlers) requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var limiterID string
+		var perMinute, burst int
+
+		if key := requestAPIKey(c); key != "" {
+			apiKey, err := h.keys.GetByHash(c.Request.Context(), hashToken(key))
+			if err != nil || apiKey.RevokedAt != nil {
+				respondError(c, 401, ErrCodeUnauthorized, "Invalid or revoked API key")
+				return
+			}
+			if !apiKey.HasScope(scope) {
+				respondError(c, 403, ErrCodeForbidden, fmt.Sprintf("API key lacks the %s scope", scope))
+				return
+			}
+
+			// Recording every request would mean a write per call; a minute is precise enough
+			now := time.Now()
+			if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > time.Minute {
+				if err := h.keys.Touch(c.Request.Context(), apiKey, now); err != nil {
+					log.Printf("Warning: Failed to record use of API key %d: %v", apiKey.ID, err)
+				}
+			}
+
+			c.Set(apiKeyContextKey, apiKey)
+			c.Set(orgContextKey, apiKey.OrganizationID)
+			limiterID = fmt.Sprintf("key:%d", apiKey.ID)
+			perMinute, burst = apiKey.RateLimitPerMinute, apiKey.RateLimitBurst
+		} else if user := h.sessionUser(c); user != nil {
+			if !user.HasScope(scope) {
+				respondError(c, 403, ErrCodeForbidden, fmt.Sprintf("The %s role may not %s", user.Role, scope))
+				return
+			}
+			if !sameOrigin(c) {
+				respondError(c, 403, ErrCodeForbidden, "Cross-site request rejected")
+				return
+			}
+
+			c.Set(userContextKey, user)
+			c.Set(orgContextKey, user.OrganizationID)
+			limiterID = fmt.Sprintf("user:%d", user.ID)
+			perMinute, burst = defaultRateLimitPerMinute, defaultRateLimitBurst
+		} else {
+			respondError(c, 401, ErrCodeUnauthorized, "Missing API key or session")
+			return
+		}
+
+		if wait, ok := h.limiter.allow(limiterID, perMinute, burst); !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			respondError(c, 429, ErrCodeRateLimited, "Rate limit exceeded")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// currentAPIKey returns the key the request was authenticated with
+func currentAPIKey(c *gin.Context) *APIKey {
+	if key, ok := c.Get(apiKeyContextKey); ok {
+		return key.(*APIKey)
+	}
+	return nil
+}
+
+// tokenBucket refills at rate tokens per second up to burst
+type tokenBucket struct {
+	tokens float64
+	rate   float64
+	burst  float64
+	last   time.Time
+}
+
+// full reports whether the bucket has refilled to its burst by now, making it
+// no different from a new one
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// bucketPruneInterval is how often the limiter drops the buckets of idle callers
+const bucketPruneInterval = time.Minute
+
+// callerRateLimiter holds a token bucket per API key or user. Buckets live in
+// memory, so limits apply per server process.
+type callerRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+// newCallerRateLimiter returns a limiter with no buckets yet
+func newCallerRateLimiter() *callerRateLimiter {
+	return &callerRateLimiter{buckets: make(map[string]*tokenBucket), lastPrune: time.Now()}
+}
+
+// allow takes a token from the caller's bucket, or reports how long until one is available
+func (l *callerRateLimiter) allow(id string, perMinute, burstSize int) (time.Duration, bool) {
+	rate := float64(perMinute) / 60
+	burst := float64(max(burstSize, 1))
+	if rate <= 0 {
+		rate = defaultRateLimitPerMinute / 60.0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) >= bucketPruneInterval {
+		l.prune(now)
+	}
+
+	bucket, ok := l.buckets[id]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		l.buckets[id] = bucket
+	}
+	// Limits may change between requests, e.g. when a key is reissued
+	bucket.rate, bucket.burst = rate, burst
+
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / rate * float64(time.Second)), false
+	}
+	bucket.tokens--
+	return 0, true
+}
+
+// prune drops the buckets that have refilled, so callers that stop making
+// requests, such as revoked keys, don't hold memory forever. The caller must
+// hold l.mu.
+func (l *callerRateLimiter) prune(now time.Time) {
+	for id, bucket := range l.buckets {
+		if bucket.full(now) {
+			delete(l.buckets, id)
+		}
+	}
+	l.lastPrune = now
+}
+
+// currentMonth returns the quota period for now
+func currentMonth() string {
+	return time.Now().UTC().Format("2006-01")
+}
+
+// UsageMeter counts the pages API keys send to OCR, against their monthly quotas
+type UsageMeter interface {
+	// PagesUsed returns the pages a key has sent to OCR this month
+	PagesUsed(keyID uint) int
+	// Reserve charges pages to a key's monthly usage unless that would take it
+	// over quota, checking and charging in one step so concurrent requests
+	// cannot overshoot. A quota of 0 is unlimited. It returns whether the
+	// reservation was made, and the pages used so far.
+	Reserve(keyID uint, pages, quota int) (int, bool, error)
+	// Record charges pages to a key's monthly usage, or with a negative count
+	// gives back pages reserved but not scanned. Scans made without a key are
+	// not metered.
+	Record(keyID *uint, pages int)
+}
+
+// gormUsageMeter keeps usage in the database, one row per key and month
+type gormUsageMeter struct {
+	db *gorm.DB
+}
+
+// newGormUsageMeter returns a meter on the database
+func newGormUsageMeter(db *gorm.DB) *gormUsageMeter {
+	return &gormUsageMeter{db: db}
+}
+
+// PagesUsed reads the key's row for the current month
+func (m *gormUsageMeter) PagesUsed(keyID uint) int {
+	var usage APIKeyUsage
+	m.db.Where("api_key_id = ? AND month = ?", keyID, currentMonth()).First(&usage)
+	return usage.OCRPages
+}
+
+// Reserve makes sure the key has a row for the current month, then adds to it
+// with an update whose condition holds the quota check. The database applies
+// the condition to the row as it is when the update locks it, so two
+// reservations cannot both see the same usage.
+func (m *gormUsageMeter) Reserve(keyID uint, pages, quota int) (int, bool, error) {
+	month := currentMonth()
+	usage := APIKeyUsage{APIKeyID: keyID, Month: month}
+	if err := m.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&usage).Error; err != nil {
+		return 0, false, err
+	}
+
+	query := m.db.Model(&APIKeyUsage{}).Where("api_key_id = ? AND month = ?", keyID, month)
+	if quota > 0 {
+		query = query.Where("ocr_pages + ? <= ?", pages, quota)
+	}
+	result := query.UpdateColumn("ocr_pages", gorm.Expr("ocr_pages + ?", pages))
+	if result.Error != nil {
+		return 0, false, result.Error
+	}
+	return m.PagesUsed(keyID), result.RowsAffected > 0, nil
+}
+
+// Record adds to the key's row for the current month in one upsert, so
+// concurrent scans don't lose pages. Pages given back only lower a row that
+// exists, and never below zero, in case the month turned since they were
+// reserved.
+func (m *gormUsageMeter) Record(keyID *uint, pages int) {
+	if keyID == nil || pages == 0 {
+		return
+	}
+	if pages < 0 {
+		err := m.db.Model(&APIKeyUsage{}).
+			Where("api_key_id = ? AND month = ?", *keyID, currentMonth()).
+			UpdateColumn("ocr_pages", gorm.Expr("CASE WHEN ocr_pages + ? > 0 THEN ocr_pages + ? ELSE 0 END", pages, pages)).Error
+		if err != nil {
+			log.Printf("Warning: Failed to release OCR usage for API key %d: %v", *keyID, err)
+		}
+		return
+	}
+	usage := APIKeyUsage{APIKeyID: *keyID, Month: currentMonth(), OCRPages: pages}
+	err := m.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "api_key_id"}, {Name: "month"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"ocr_pages": gorm.Expr("api_key_usages.ocr_pages + ?", pages)}),
+	}).Create(&usage).Error
+	if err != nil {
+		log.Printf("Warning: Failed to record OCR usage for API key %d: %v", *keyID, err)
+	}
+}
+
+// reserveOCRQuota charges pages to the request's key before they are scanned,
+// and rejects the request if that would exceed the key's monthly quota. The
+// caller counts every TIFF frame and PDF page with countPages, so a key cannot
+// scan more pages than it has left. Once the scan is done the caller settles
+// the reservation with Record, giving back pages that were not scanned. When
+// the quota cannot be checked the request is refused rather than scanned
+// unmetered.
+func reserveOCRQuota(c *gin.Context, usage UsageMeter, pages int) bool {
+	key := currentAPIKey(c)
+	if key == nil || pages == 0 {
+		return true
+	}
+	used, ok, err := usage.Reserve(key.ID, pages, key.MonthlyOCRQuota)
+	if err != nil {
+		log.Printf("Failed to reserve OCR usage for API key %d: %v", key.ID, err)
+		respondError(c, 503, ErrCodeInternal, "Could not check the OCR quota, try again later")
+		return false
+	}
+	if !ok {
+		respondError(c, 429, ErrCodeQuotaExceeded,
+			fmt.Sprintf("Upload of %d pages exceeds the monthly OCR quota of %d pages (%d used)", pages, key.MonthlyOCRQuota, used))
+		return false
+	}
+	return true
+}
+
+// currentActor names who is making the request, for audit fields
+func currentActor(c *gin.Context) string {
+	if user := currentUser(c); user != nil {
+		return user.Email
+	}
+	if key := currentAPIKey(c); key != nil {
+		return "api-key:" + key.Name
+	}
+	return ""
+}
+
+// currentAPIKeyID returns the ID of the request's key, for recording usage later
+func currentAPIKeyID(c *gin.Context) *uint {
+	if key := currentAPIKey(c); key != nil {
+		return &key.ID
+	}
+	return nil
+}
+
+// apiKeyCreate is the body of a request to issue a key
+type apiKeyCreate struct {
+	Name               string   `json:"name" binding:"required,max=100"`
+	Scopes             []string `json:"scopes" binding:"required,min=1,dive,oneof=scan read write approve export admin platform"`
+	RateLimitPerMinute *int     `json:"rate_limit_per_minute" binding:"omitempty,min=1"`
+	RateLimitBurst     *int     `json:"rate_limit_burst" binding:"omitempty,min=1"`
+	MonthlyOCRQuota    int      `json:"monthly_ocr_quota" binding:"min=0"`
+}
+
+// createAPIKey issues a new key. The key is only ever returned by this call.
+func (h *authHandlers) createAPIKey(c *gin.Context) {
+	orgID, ok := h.targetOrganization(c)
+	if !ok {
+		return
+	}
+
+	var request apiKeyCreate
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if slices.Contains(request.Scopes, ScopePlatform) {
+		if key := currentAPIKey(c); key == nil || !key.HasScope(ScopePlatform) {
+			respondError(c, 403, ErrCodeForbidden, "Only platform keys may issue platform keys")
+			return
+		}
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to generate API key")
+		return
+	}
+
+	apiKey := APIKey{
+		Name:               request.Name,
+		Prefix:             keyDisplayPrefix(key),
+		Hash:               hashToken(key),
+		Scopes:             request.Scopes,
+		RateLimitPerMinute: defaultRateLimitPerMinute,
+		RateLimitBurst:     defaultRateLimitBurst,
+		MonthlyOCRQuota:    request.MonthlyOCRQuota,
+	}
+	if request.RateLimitPerMinute != nil {
+		apiKey.RateLimitPerMinute = *request.RateLimitPerMinute
+	}
+	if request.RateLimitBurst != nil {
+		apiKey.RateLimitBurst = *request.RateLimitBurst
+	}
+
+	if err := h.keys.Create(withTenant(c.Request.Context(), orgID), &apiKey); err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to create API key")
+		return
+	}
+
+	log.Printf("Issued API key %d (%s) in organization %d with scopes %v", apiKey.ID, apiKey.Name, orgID, apiKey.Scopes)
+	c.JSON(201, APIKeyCreatedDTO{APIKeyDTO: toAPIKeyDTO(apiKey, 0), Key: key})
+}
+
+// listAPIKeys returns every key of the organization, including revoked ones,
+// with this month's usage
+func (h *authHandlers) listAPIKeys(c *gin.Context) {
+	orgID, ok := h.targetOrganization(c)
+	if !ok {
+		return
+	}
+
+	keys, err := h.keys.List(withTenant(c.Request.Context(), orgID))
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to list API keys")
+		return
+	}
+
+	dtos := make([]APIKeyDTO, 0, len(keys))
+	for _, key := range keys {
+		dtos = append(dtos, toAPIKeyDTO(key, h.usage.PagesUsed(key.ID)))
+	}
+	c.JSON(200, APIKeyListDTO{Keys: dtos})
+}
+
+// revokeAPIKey stops a key from being accepted. The record is kept for auditing.
+func (h *authHandlers) revokeAPIKey(c *gin.Context) {
+	orgID, ok := h.targetOrganization(c)
+	if !ok {
+		return
+	}
+
+	ctx := withTenant(c.Request.Context(), orgID)
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		respondError(c, 404, ErrCodeNotFound, "API key not found")
+		return
+	}
+	apiKey, err := h.keys.Get(ctx, uint(id))
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		respondError(c, 404, ErrCodeNotFound, "API key not found")
+		return
+	}
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to load API key")
+		return
+	}
+
+	if apiKey.RevokedAt == nil {
+		if err := h.keys.Revoke(ctx, apiKey, time.Now()); err != nil {
+			respondError(c, 500, ErrCodeInternal, "Failed to revoke API key")
+			return
+		}
+		log.Printf("Revoked API key %d (%s)", apiKey.ID, apiKey.Name)
+	}
+
+	c.JSON(200, toAPIKeyDTO(*apiKey, h.usage.PagesUsed(apiKey.ID)))
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScopesAreEnforced(t *testing.T) {
+	s := newTestServer(t)
+	reader, _ := s.issueKey(t, 1, ScopeRead)
+	admin, _ := s.issueKey(t, 1, ScopeAdmin)
+	platform, _ := s.issueKey(t, 1, ScopePlatform)
+
+	tests := []struct {
+		name   string
+		key    string
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"no key", "", "GET", "/api/invoices", "", 401, ErrCodeUnauthorized},
+		{"unknown key", apiKeyPrefix + "unknown", "GET", "/api/invoices", "", 401, ErrCodeUnauthorized},
+		{"read with read", reader, "GET", "/api/invoices", "", 200, ""},
+		{"write with read", reader, "PATCH", "/api/invoices/1", `{"vendor_name": "Initech"}`, 403, ErrCodeForbidden},
+		{"approve with read", reader, "POST", "/api/invoices/1/approve", "", 403, ErrCodeForbidden},
+		{"export with read", reader, "GET", "/api/invoices/export", "", 403, ErrCodeForbidden},
+		{"scan with read", reader, "POST", "/api/scans", "", 403, ErrCodeForbidden},
+		{"admin with read", reader, "GET", "/api/admin/keys", "", 403, ErrCodeForbidden},
+		{"admin with admin", admin, "GET", "/api/admin/keys", "", 200, ""},
+		{"read with admin", admin, "GET", "/api/invoices", "", 200, ""},
+		{"platform with admin", admin, "GET", "/api/platform/organizations", "", 403, ErrCodeForbidden},
+		{"platform with platform", platform, "GET", "/api/platform/organizations", "", 200, ""},
+		{"read with platform", platform, "GET", "/api/invoices", "", 403, ErrCodeForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.call(tt.key, request(tt.method, tt.path, tt.body))
+			if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.code) {
+				t.Errorf("%s %s: %d %s, want %d %s", tt.method, tt.path, w.Code, w.Body, tt.status, tt.code)
+			}
+		})
+	}
+
+	// The key may also come as a bearer token
+	req := request("GET", "/api/invoices", "")
+	req.Header.Set("Authorization", "Bearer "+reader)
+	if w := serve(s.router, req); w.Code != 200 {
+		t.Errorf("bearer token: %d %s", w.Code, w.Body)
+	}
+
+	// But never in the query string, where access logs would record it
+	req = request("GET", "/api/scans/1/events?api_key="+reader, "")
+	req.Header.Set("Accept", "text/event-stream")
+	if w := serve(s.router, req); w.Code != 401 {
+		t.Errorf("key in the query string: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestRateLimitRespondsWithRetryAfter(t *testing.T) {
+	s := newTestServer(t)
+	limited, _ := s.storeKey(t, APIKey{OrganizationID: 1, Name: "limited", Scopes: []string{ScopeRead}, RateLimitPerMinute: 60, RateLimitBurst: 2})
+	other, _ := s.issueKey(t, 1, ScopeRead)
+
+	for i := 0; i < 2; i++ {
+		if w := s.call(limited, request("GET", "/api/invoices", "")); w.Code != 200 {
+			t.Fatalf("request %d within the burst: %d %s", i+1, w.Code, w.Body)
+		}
+	}
+	w := s.call(limited, request("GET", "/api/invoices", ""))
+	if w.Code != 429 || !strings.Contains(w.Body.String(), ErrCodeRateLimited) {
+		t.Fatalf("request over the burst: %d %s", w.Code, w.Body)
+	}
+	// One token a second comes back within a second
+	if retry := w.Header().Get("Retry-After"); retry != "1" {
+		t.Errorf("Retry-After %q, want 1", retry)
+	}
+
+	// Every key has a bucket of its own
+	if w := s.call(other, request("GET", "/api/invoices", "")); w.Code != 200 {
+		t.Errorf("another key: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestRateLimiterPrunesIdleBuckets(t *testing.T) {
+	l := newCallerRateLimiter()
+	l.allow("idle", 60, 2)
+	l.allow("busy", 60, 2)
+	l.allow("busy", 60, 2)
+
+	// A second and a half later the idle bucket has refilled but the busy one,
+	// emptied, has not
+	past := time.Now().Add(-1500 * time.Millisecond)
+	for _, bucket := range l.buckets {
+		bucket.last = past
+	}
+	l.allow("new", 60, 2)
+	if _, ok := l.buckets["idle"]; !ok {
+		t.Fatal("idle bucket pruned before the prune interval passed")
+	}
+
+	l.lastPrune = time.Now().Add(-bucketPruneInterval)
+
+	l.allow("new", 60, 2)
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("idle bucket kept")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("busy bucket pruned before it refilled")
+	}
+
+	// A pruned caller starts again with a full bucket
+	for i := 0; i < 2; i++ {
+		if _, ok := l.allow("idle", 60, 2); !ok {
+			t.Errorf("request %d after pruning refused", i+1)
+		}
+	}
+}
+
+func TestOCRQuota(t *testing.T) {
+	s := newTestServer(t)
+	key, keyID := s.storeKey(t, APIKey{OrganizationID: 1, Name: "metered", Scopes: []string{ScopeScan, ScopeRead}, RateLimitPerMinute: 6000, RateLimitBurst: 1000, MonthlyOCRQuota: 3})
+	twoPages := func() *http.Request {
+		return multipartRequest(t, "/api/scans",
+			upload{"invoice", "page1.png", testPage(t, 800, 1)},
+			upload{"invoice", "page2.png", testPage(t, 800, 2)})
+	}
+	onePage := func() *http.Request {
+		return multipartRequest(t, "/api/scans", upload{"invoice", "page.png", testPage(t, 800, 1)})
+	}
+
+	var job ScanJobDTO
+	decode(t, s.call(key, twoPages()), 202, &job)
+	if used := s.usage.PagesUsed(keyID); used != 2 {
+		t.Fatalf("pages reserved by a queued job: %d", used)
+	}
+
+	w := s.call(key, twoPages())
+	if w.Code != 429 || !strings.Contains(w.Body.String(), ErrCodeQuotaExceeded) || !strings.Contains(w.Body.String(), "(2 used)") {
+		t.Fatalf("scan over quota: %d %s", w.Code, w.Body)
+	}
+
+	// A job the queue turns away gives its pages back
+	withScanQueue(s.invoiceHandlers, 0)
+	if w := s.call(key, onePage()); w.Code != 503 {
+		t.Fatalf("scan with a full queue: %d %s", w.Code, w.Body)
+	}
+	withScanQueue(s.invoiceHandlers, 10)
+	if used := s.usage.PagesUsed(keyID); used != 2 {
+		t.Errorf("pages used after a refused job: %d", used)
+	}
+
+	decode(t, s.call(key, onePage()), 202, nil)
+	if w := s.call(key, onePage()); w.Code != 429 {
+		t.Errorf("scan with the quota used up: %d %s", w.Code, w.Body)
+	}
+
+	// A job that scans nothing gives back what it reserved
+	s.ocrService.err = errors.New("OCR is down")
+	s.processScanJob(job.ID)
+	if used := s.usage.PagesUsed(keyID); used != 1 {
+		t.Errorf("pages used after a failed job: %d", used)
+	}
+}
+
+func TestOCRQuotaCountsPages(t *testing.T) {
+	s := newTestServer(t)
+	key, keyID := s.storeKey(t, APIKey{OrganizationID: 1, Name: "metered", Scopes: []string{ScopeScan, ScopeRead}, RateLimitPerMinute: 6000, RateLimitBurst: 1000, MonthlyOCRQuota: 3})
+	pdf := func(pages int) []byte {
+		images := make([][]byte, pages)
+		for i := range images {
+			images[i] = testPage(t, 800, int64(i+1))
+		}
+		return testPDF(t, images...)
+	}
+
+	// One file with more pages than the key has left is refused whole, on
+	// every endpoint that scans
+	for _, req := range []*http.Request{
+		multipartRequest(t, "/scan-invoice", upload{"invoice", "long.pdf", pdf(4)}),
+		multipartRequest(t, "/split-scan", upload{"pages", "long.pdf", pdf(4)}),
+		multipartRequest(t, "/api/scans", upload{"invoice", "long.pdf", pdf(4)}),
+		multipartRequest(t, "/api/batches", upload{"invoices", "a.pdf", pdf(2)}, upload{"invoices", "b.pdf", pdf(2)}),
+	} {
+		w := s.call(key, req)
+		if w.Code != 429 || !strings.Contains(w.Body.String(), "Upload of 4 pages") {
+			t.Errorf("%s over quota: %d %s", req.URL.Path, w.Code, w.Body)
+		}
+	}
+	if used := s.usage.PagesUsed(keyID); used != 0 {
+		t.Fatalf("pages used after refused uploads: %d", used)
+	}
+
+	// Each page is reserved up front and none is given back once scanned
+	var job ScanJobDTO
+	decode(t, s.call(key, multipartRequest(t, "/api/scans", upload{"invoice", "three.pdf", pdf(3)})), 202, &job)
+	if used := s.usage.PagesUsed(keyID); used != 3 {
+		t.Fatalf("pages reserved by a 3 page job: %d", used)
+	}
+	s.processScanJob(job.ID)
+	if used := s.usage.PagesUsed(keyID); used != 3 || s.ocrService.calls != 3 {
+		t.Errorf("%d pages used after %d OCR calls", used, s.ocrService.calls)
+	}
+}
+
+func TestOCRQuotaFailsClosed(t *testing.T) {
+	s := newTestServer(t)
+	key, _ := s.storeKey(t, APIKey{OrganizationID: 1, Name: "metered", Scopes: []string{ScopeScan}, RateLimitPerMinute: 6000, RateLimitBurst: 1000, MonthlyOCRQuota: 3})
+	if err := s.db.Migrator().DropTable(&APIKeyUsage{}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := s.call(key, multipartRequest(t, "/api/scans", upload{"invoice", "page.png", testPage(t, 800, 1)}))
+	if w.Code != 503 || !strings.Contains(w.Body.String(), ErrCodeInternal) {
+		t.Errorf("scan with the usage table gone: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestOCRQuotaHoldsUnderConcurrentScans(t *testing.T) {
+	s := newTestServer(t)
+	key, keyID := s.storeKey(t, APIKey{OrganizationID: 1, Name: "metered", Scopes: []string{ScopeScan}, RateLimitPerMinute: 6000, RateLimitBurst: 1000, MonthlyOCRQuota: 3})
+	page := testPage(t, 800, 1)
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 10)
+	for i := range statuses {
+		req := multipartRequest(t, "/api/scans", upload{"invoice", fmt.Sprintf("page%d.png", i), page})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i] = s.call(key, req).Code
+		}()
+	}
+	wg.Wait()
+
+	accepted := 0
+	for _, status := range statuses {
+		if status == 202 {
+			accepted++
+		} else if status != 429 {
+			t.Errorf("concurrent scan: status %d", status)
+		}
+	}
+	if accepted != 3 {
+		t.Errorf("%d scans accepted on a quota of 3 pages", accepted)
+	}
+	if used := s.usage.PagesUsed(keyID); used != 3 {
+		t.Errorf("pages used: %d", used)
+	}
+}
+
+func TestIssueAndRevokeKeys(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.issueKey(t, 1, ScopeAdmin)
+	otherAdmin, _ := s.issueKey(t, 2, ScopeAdmin)
+
+	var issued APIKeyCreatedDTO
+	decode(t, s.call(admin, request("POST", "/api/admin/keys",
+		`{"name": "ci", "scopes": ["read"], "rate_limit_burst": 5, "monthly_ocr_quota": 100}`)), 201, &issued)
+	if !strings.HasPrefix(issued.Key, apiKeyPrefix) || issued.OrganizationID != 1 || issued.Prefix != keyDisplayPrefix(issued.Key) {
+		t.Fatalf("issued key %+v", issued)
+	}
+	if issued.RateLimitPerMinute != defaultRateLimitPerMinute || issued.RateLimitBurst != 5 || issued.MonthlyOCRQuota != 100 {
+		t.Errorf("issued limits %+v", issued.APIKeyDTO)
+	}
+
+	// The new key works with the scopes it was given and no others
+	if w := s.call(issued.Key, request("GET", "/api/invoices", "")); w.Code != 200 {
+		t.Errorf("issued key reading: %d %s", w.Code, w.Body)
+	}
+	if w := s.call(issued.Key, request("GET", "/api/admin/keys", "")); w.Code != 403 {
+		t.Errorf("issued key listing keys: %d %s", w.Code, w.Body)
+	}
+
+	// Only platform keys issue platform keys, and bad requests are refused
+	if w := s.call(admin, request("POST", "/api/admin/keys", `{"name": "root", "scopes": ["platform"]}`)); w.Code != 403 {
+		t.Errorf("admin issuing a platform key: %d %s", w.Code, w.Body)
+	}
+	if w := s.call(admin, request("POST", "/api/admin/keys", `{"name": "bad", "scopes": ["everything"]}`)); w.Code != 422 {
+		t.Errorf("issuing an unknown scope: %d %s", w.Code, w.Body)
+	}
+
+	// The listing shows the key but never its secret
+	w := s.call(admin, request("GET", "/api/admin/keys", ""))
+	var list APIKeyListDTO
+	decode(t, w, 200, &list)
+	if len(list.Keys) != 2 || list.Keys[1].ID != issued.ID || strings.Contains(w.Body.String(), issued.Key) {
+		t.Errorf("key listing %s", w.Body)
+	}
+
+	// Another organization can neither see nor revoke it
+	revokePath := fmt.Sprintf("/api/admin/keys/%d", issued.ID)
+	if w := s.call(otherAdmin, request("DELETE", revokePath, "")); w.Code != 404 {
+		t.Errorf("revoking another organization's key: %d %s", w.Code, w.Body)
+	}
+	if w := s.call(issued.Key, request("GET", "/api/invoices", "")); w.Code != 200 {
+		t.Errorf("key after a refused revocation: %d %s", w.Code, w.Body)
+	}
+
+	var revoked APIKeyDTO
+	decode(t, s.call(admin, request("DELETE", revokePath, "")), 200, &revoked)
+	if revoked.RevokedAt == nil {
+		t.Errorf("revoked key %+v", revoked)
+	}
+	if w := s.call(issued.Key, request("GET", "/api/invoices", "")); w.Code != 401 || !strings.Contains(w.Body.String(), ErrCodeUnauthorized) {
+		t.Errorf("revoked key: %d %s", w.Code, w.Body)
+	}
+	// Revoking twice changes nothing
+	decode(t, s.call(admin, request("DELETE", revokePath, "")), 200, nil)
+}
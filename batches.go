@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Limits on the ZIP archives of one batch. Archives compress well, so a small
+// upload could otherwise unpack to more than the server has memory for.
+const (
+	maxArchiveEntrySize = 64 << 20  // uncompressed bytes of a single file
+	maxArchiveSize      = 512 << 20 // uncompressed bytes of every file in the batch's archives
+	maxArchiveEntries   = 1000      // entries in the batch's archives
+)
+
+// archiveBudget is what the archives of a batch may still unpack
+type archiveBudget struct {
+	entries int
+	size    uint64
+}
+
+// ScanBatch groups the scan jobs of one batch upload. Every file becomes its own
+// job, so a file that fails does not affect the others.
+type ScanBatch struct {
+	gorm.Model
+	OrganizationID uint      `gorm:"index"`
+	Jobs           []ScanJob `gorm:"foreignKey:BatchID"`
+}
+
+// createBatch accepts many invoices at once, either as files in the `invoices`
+// field or as ZIP archives, and queues one scan job per invoice
+func (h *invoiceHandlers) createBatch(c *gin.Context) {
+	uploads, ok := formUploads(c, "invoices", "No files uploaded")
+	if !ok {
+		return
+	}
+
+	batch := ScanBatch{}
+	budget := &archiveBudget{entries: maxArchiveEntries, size: maxArchiveSize}
+	for _, upload := range uploads {
+		if !isZipArchive(upload) {
+			batch.Jobs = append(batch.Jobs, newScanJob(upload))
+			continue
+		}
+
+		entries, err := unpackArchive(upload, budget)
+		if err != nil {
+			batch.Jobs = append(batch.Jobs, failedScanJob(upload.Filename, err.Error()))
+			continue
+		}
+		batch.Jobs = append(batch.Jobs, entries...)
+	}
+
+	if len(batch.Jobs) == 0 {
+		respondError(c, 400, ErrCodeNoFile, "No invoices found in upload")
+		return
+	}
+
+	// Every frame and page of a queued file is reserved, file by file so that
+	// a job the queue turns away gives back its own
+	queued, reserved, pages := 0, 0, make([]int, len(batch.Jobs))
+	for i := range batch.Jobs {
+		batch.Jobs[i].APIKeyID = currentAPIKeyID(c)
+		h.leaseScanJob(&batch.Jobs[i])
+		if batch.Jobs[i].Status == ScanStatusQueued {
+			queued++
+			pages[i] = countPages(scanJobUploads(&batch.Jobs[i]))
+			reserved += pages[i]
+		}
+	}
+	// Refuse early a batch that cannot fit; jobs that still find the queue full
+	// when they are sent fail on their own below
+	if len(h.queue)+queued > scanQueueSize {
+		respondError(c, 503, ErrCodeQueueFull, "Scan queue is full, try again later")
+		return
+	}
+	if !reserveOCRQuota(c, h.usage, reserved) {
+		return
+	}
+
+	ctx := tenantContext(c)
+	if err := h.jobs.CreateBatch(ctx, &batch); err != nil {
+		h.usage.Record(currentAPIKeyID(c), -reserved)
+		respondError(c, 500, ErrCodeInternal, "Failed to create batch")
+		return
+	}
+
+	for i, job := range batch.Jobs {
+		if job.Status != ScanStatusQueued || h.enqueueScanJob(job.ID) {
+			continue
+		}
+		queued--
+		h.usage.Record(job.APIKeyID, -pages[i])
+		batch.Jobs[i].Status, batch.Jobs[i].Error = ScanStatusFailed, errScanQueueFull
+		if err := h.jobs.Fail(ctx, job.ID, errScanQueueFull); err != nil {
+			log.Printf("Warning: Failed to record scan job %d failure: %v", job.ID, err)
+		}
+	}
+
+	log.Printf("Batch %d: queued %d of %d files", batch.ID, queued, len(batch.Jobs))
+
+	c.JSON(202, toBatchDTO(batch))
+}
+
+// getBatch reports the outcome of every file in a batch
+func (h *invoiceHandlers) getBatch(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		respondError(c, 404, ErrCodeNotFound, "Batch not found")
+		return
+	}
+	batch, err := h.jobs.GetBatch(tenantContext(c), uint(id))
+	if errors.Is(err, ErrBatchNotFound) {
+		respondError(c, 404, ErrCodeNotFound, "Batch not found")
+		return
+	}
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to load batch")
+		return
+	}
+
+	c.JSON(200, toBatchDTO(*batch))
+}
+
+// newScanJob returns a queued job for a single uploaded invoice
+func newScanJob(upload Upload) ScanJob {
+	return ScanJob{
+		Status: ScanStatusQueued,
+		Files:  []ScanJobFile{{Filename: upload.Filename, Data: upload.Data}},
+	}
+}
+
+// failedScanJob records a file that could not be queued, so it still shows up in
+// the batch summary
+func failedScanJob(filename, reason string) ScanJob {
+	return ScanJob{
+		Status: ScanStatusFailed,
+		Error:  reason,
+		Files:  []ScanJobFile{{Filename: filename}},
+	}
+}
+
+// isZipArchive reports whether an upload is a ZIP archive rather than an image
+func isZipArchive(upload Upload) bool {
+	return bytes.HasPrefix(upload.Data, []byte("PK\x03\x04")) ||
+		strings.EqualFold(path.Ext(upload.Filename), ".zip")
+}
+
+// unpackArchive returns one job per file in a ZIP archive. Directories and hidden
+// files such as macOS resource forks are skipped; unreadable entries become
+// failed jobs so the rest of the archive is still processed. An archive
+// with more entries or uncompressed bytes than the budget has left is refused
+// as a whole before anything is unpacked; the zip package won't inflate an
+// entry past the size its header declares, so the check can trust the headers.
+func unpackArchive(upload Upload, budget *archiveBudget) ([]ScanJob, error) {
+	reader, err := zip.NewReader(bytes.NewReader(upload.Data), int64(len(upload.Data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ZIP archive: %v", err)
+	}
+
+	if len(reader.File) > budget.entries {
+		return nil, fmt.Errorf("archives hold more than %d files", maxArchiveEntries)
+	}
+	var size uint64
+	for _, entry := range reader.File {
+		if entry.UncompressedSize64 <= maxArchiveEntrySize {
+			size += entry.UncompressedSize64
+		}
+	}
+	if size > budget.size {
+		return nil, fmt.Errorf("archives unpack to more than %d MB", maxArchiveSize>>20)
+	}
+	budget.entries -= len(reader.File)
+	budget.size -= size
+
+	var jobs []ScanJob
+	for _, entry := range reader.File {
+		name := upload.Filename + "/" + entry.Name
+		base := path.Base(entry.Name)
+		if entry.FileInfo().IsDir() || strings.HasPrefix(base, ".") || strings.HasPrefix(entry.Name, "__MACOSX/") {
+			continue
+		}
+
+		if entry.UncompressedSize64 > maxArchiveEntrySize {
+			jobs = append(jobs, failedScanJob(name, "file is too large"))
+			continue
+		}
+
+		data, err := readArchiveEntry(entry)
+		if err != nil {
+			jobs = append(jobs, failedScanJob(name, err.Error()))
+			continue
+		}
+
+		jobs = append(jobs, newScanJob(Upload{Filename: name, Data: data}))
+	}
+	return jobs, nil
+}
+
+// readArchiveEntry reads a ZIP entry, refusing to inflate it past the size limit
+func readArchiveEntry(entry *zip.File) ([]byte, error) {
+	f, err := entry.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open: %v", err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxArchiveEntrySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read: %v", err)
+	}
+	if len(data) > maxArchiveEntrySize {
+		return nil, fmt.Errorf("file is too large")
+	}
+	return data, nil
+}
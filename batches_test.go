@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// zipEntry is a file to put in a test archive
+type zipEntry struct {
+	name string
+	data []byte
+}
+
+// zipArchive returns a ZIP archive of the entries, stored uncompressed so their
+// contents can be found in the raw bytes
+func zipArchive(t *testing.T, entries ...zipEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: entry.name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(entry.data)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBatchWithPDFs(t *testing.T) {
+	h := newTestHandlers(t)
+	conn := openTestDB(t)
+	h.invoices = newGormInvoiceRepository(conn)
+	h.jobs = newGormScanJobRepository(conn)
+	r := scanJobRouter(h)
+	pdf := testPDF(t, testPage(t, 800, 1), testPage(t, 810, 2))
+
+	// A PDF is a file like any other, whether uploaded as it is or in an
+	// archive, even when its header is near the start of the archive
+	archive := zipArchive(t, zipEntry{"invoice.pdf", pdf}, zipEntry{"page.png", testPage(t, 800, 1)})
+	var batch BatchDTO
+	decode(t, serve(r, multipartRequest(t, "/api/batches",
+		upload{"invoices", "scans.zip", archive},
+		upload{"invoices", "other.pdf", pdf})), 202, &batch)
+	if len(batch.Files) != 3 {
+		t.Fatalf("batch files %+v", batch.Files)
+	}
+	for i, name := range []string{"scans.zip/invoice.pdf", "scans.zip/page.png", "other.pdf"} {
+		if file := batch.Files[i]; file.Status != ScanStatusQueued || file.Filename != name {
+			t.Errorf("file %d: %s %s %q, want %s queued", i, file.Filename, file.Status, file.ErrorMessage, name)
+		}
+	}
+
+	// Each PDF is scanned as one invoice of all its pages
+	ctx := withTenant(t.Context(), 1)
+	h.processScanJob(batch.Files[0].JobID)
+	job, err := h.jobs.Get(ctx, batch.Files[0].JobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != ScanStatusDone || job.InvoiceID == nil || len(job.DisplayKeys) != 2 || !slices.Equal(job.Formats, []string{"pdf"}) {
+		t.Fatalf("PDF job: %s %q, %d pages of %v", job.Status, job.Error, len(job.DisplayKeys), job.Formats)
+	}
+	if invoice, err := h.invoices.Get(ctx, *job.InvoiceID); err != nil || invoice.PageCount != 2 {
+		t.Errorf("PDF invoice: %v, %+v", err, invoice)
+	}
+}
+
+// declaredArchive returns a ZIP archive of count empty entries whose headers
+// claim size uncompressed bytes each, which the size checks trust
+func declaredArchive(t *testing.T, count int, size uint64) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for i := 0; i < count; i++ {
+		_, err := archive.CreateRaw(&zip.FileHeader{Name: fmt.Sprintf("page%d.png", i), Method: zip.Store, UncompressedSize64: size})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBatchArchiveLimits(t *testing.T) {
+	h := newTestHandlers(t)
+	h.jobs = newGormScanJobRepository(openTestDB(t))
+	r := scanJobRouter(h)
+	page := upload{"invoices", "page.png", testPage(t, 800, 1)}
+
+	tests := []struct {
+		name     string
+		archives [][]byte
+		failures []string // error of each archive refused as a whole
+	}{
+		{"too many entries", [][]byte{declaredArchive(t, maxArchiveEntries+1, 0)}, []string{"archives hold more than 1000 files"}},
+		{"too many bytes", [][]byte{declaredArchive(t, 9, 60<<20)}, []string{"archives unpack to more than 512 MB"}},
+		{"too many bytes across archives", [][]byte{declaredArchive(t, 5, 60<<20), declaredArchive(t, 5, 60<<20)}, []string{"", "archives unpack to more than 512 MB"}},
+		{"too many entries across archives", [][]byte{declaredArchive(t, 600, 0), declaredArchive(t, 600, 0)}, []string{"", "archives hold more than 1000 files"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := []upload{page}
+			for i, archive := range tt.archives {
+				files = append(files, upload{"invoices", fmt.Sprintf("scans%d.zip", i), archive})
+			}
+			var batch BatchDTO
+			decode(t, serve(r, multipartRequest(t, "/api/batches", files...)), 202, &batch)
+
+			if batch.Files[0].Status != ScanStatusQueued {
+				t.Errorf("image next to the archives: %s %q", batch.Files[0].Status, batch.Files[0].ErrorMessage)
+			}
+			refused := map[string]string{}
+			for _, file := range batch.Files[1:] {
+				if strings.HasSuffix(file.Filename, ".zip") {
+					refused[file.Filename] = file.ErrorMessage
+				}
+			}
+			for i, failure := range tt.failures {
+				name := fmt.Sprintf("scans%d.zip", i)
+				if message, ok := refused[name]; message != failure || ok != (failure != "") {
+					t.Errorf("%s: refused %v with %q, want %q", name, ok, message, failure)
+				}
+			}
+		})
+	}
+}
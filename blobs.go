@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"scan-in/pkg/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Key prefixes of the blobs the app stores
+const (
+	displayBlobPrefix  = "display"   // cropped page images shown after a scan
+	documentBlobPrefix = "documents" // files kept with invoices
+)
+
+// blobRetention expires display images after a day, as the old static image
+// cleanup did. Invoice documents are kept indefinitely.
+var blobRetention = []storage.RetentionRule{
+	{Prefix: displayBlobPrefix + "/", MaxAge: 24 * time.Hour},
+}
+
+// openBlobStore opens the store selected by BLOB_STORE: "s3" for an
+// S3-compatible bucket configured by the S3_* variables, otherwise a local
+// directory (BLOB_DIR, default data/blobs)
+func openBlobStore() storage.BlobStore {
+	if os.Getenv("BLOB_STORE") == "s3" {
+		store, err := storage.NewS3Store(storage.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			UseSSL:    os.Getenv("S3_USE_SSL") != "false",
+		})
+		if err != nil {
+			log.Fatalf("Failed to open S3 blob store: %v", err)
+		}
+		return store
+	}
+
+	dir := os.Getenv("BLOB_DIR")
+	if dir == "" {
+		dir = "data/blobs"
+	}
+	store, err := storage.NewLocalStore(dir)
+	if err != nil {
+		log.Fatalf("Failed to open blob directory %s: %v", dir, err)
+	}
+	return store
+}
+
+// cleanupOldBlobs periodically applies the blob retention rules to the store
+func cleanupOldBlobs(store storage.BlobStore) {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		removed, err := storage.ApplyRetention(context.Background(), store, blobRetention)
+		if err != nil {
+			log.Printf("Error applying blob retention: %v", err)
+		}
+		if removed > 0 {
+			log.Printf("Cleaned up %d expired blobs", removed)
+		}
+	}
+}
+
+// serveBlob streams a blob from the store to the client, or responds 404 if it is gone
+func serveBlob(c *gin.Context, store storage.BlobStore, key, contentType string) {
+	reader, info, err := store.Get(c.Request.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidKey) {
+		respondError(c, 404, ErrCodeNotFound, "File not found")
+		return
+	}
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to read file")
+		return
+	}
+	defer reader.Close()
+
+	if contentType == "" {
+		contentType = info.ContentType
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.DataFromReader(200, info.Size, contentType, reader, nil)
+}
+
+// defaultSignedURLTTL is how long a signed file URL stays valid unless SIGNED_URL_TTL says otherwise
+const defaultSignedURLTTL = 1 * time.Hour
+
+// urlSigner signs file URLs for an organization and checks their signatures
+type urlSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+// newURLSigner returns a signer whose URLs are valid for ttl
+func newURLSigner(key []byte, ttl time.Duration) *urlSigner {
+	return &urlSigner{key: key, ttl: ttl}
+}
+
+// loadURLSigner returns a signer with the key in URL_SIGNING_KEY and the TTL in
+// SIGNED_URL_TTL. Without a key a random one is used and URLs stop working when
+// the server restarts.
+func loadURLSigner() *urlSigner {
+	ttl := defaultSignedURLTTL
+	if value, err := time.ParseDuration(os.Getenv("SIGNED_URL_TTL")); err == nil && value > 0 {
+		ttl = value
+	}
+	if key := os.Getenv("URL_SIGNING_KEY"); key != "" {
+		return newURLSigner([]byte(key), ttl)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to generate URL signing key: %v", err)
+	}
+	log.Printf("Warning: URL_SIGNING_KEY is not set; signed file URLs will not survive a restart")
+	return newURLSigner(key, ttl)
+}
+
+// signature returns the HMAC-SHA256 of an organization, blob key and expiry time
+func (s *urlSigner) signature(orgID uint, key string, expires int64) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	fmt.Fprintf(mac, "%d\n%s\n%d", orgID, key, expires)
+	return mac.Sum(nil)
+}
+
+// sign returns a URL that serves a blob to callers of the organization until
+// the TTL has passed
+func (s *urlSigner) sign(orgID uint, key string) string {
+	expires := time.Now().Add(s.ttl).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", base64.RawURLEncoding.EncodeToString(s.signature(orgID, key, expires)))
+	return "/files/" + key + "?" + query.Encode()
+}
+
+// signAll signs a list of blob keys for the organization
+func (s *urlSigner) signAll(orgID uint, keys []string) []string {
+	urls := make([]string, 0, len(keys))
+	for _, key := range keys {
+		urls = append(urls, s.sign(orgID, key))
+	}
+	return urls
+}
+
+// serveSignedBlob serves a blob if the URL carries a valid, unexpired signature
+// made for the caller's organization. It runs behind the auth middleware, so the
+// web UI's session cookie or an API key must come with the URL: a leaked link
+// is of no use outside the organization it was issued to.
+func (h *invoiceHandlers) serveSignedBlob(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil {
+		respondError(c, 403, ErrCodeForbidden, "Invalid file URL")
+		return
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(c.Query("sig"))
+	if err != nil || !hmac.Equal(signature, h.urls.signature(c.GetUint(orgContextKey), key, expires)) {
+		respondError(c, 403, ErrCodeForbidden, "Invalid file URL")
+		return
+	}
+	if time.Now().Unix() > expires {
+		respondError(c, 403, ErrCodeForbidden, "File URL has expired")
+		return
+	}
+
+	c.Header("Cache-Control", "private, max-age="+strconv.FormatInt(expires-time.Now().Unix(), 10))
+	serveBlob(c, h.blobs, key, "")
+}
+
+// removeLegacyStaticImages deletes display images written to the public static
+// directory before they moved to the blob store
+func removeLegacyStaticImages() {
+	dir := "web/static/img"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "processed-") && !strings.HasPrefix(name, "temp-") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			log.Printf("Warning: Failed to remove %s: %v", name, err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Removed %d scanned images from the public static directory", removed)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fileRouter serves signed file URLs to a user of the organization
+func fileRouter(h *testHandlers, orgID uint) *gin.Engine {
+	r := h.testRouter(orgID)
+	r.GET("/files/*key", h.serveSignedBlob)
+	return r
+}
+
+// fileURL is a file URL for the key signed for the organization as of the expiry
+func fileURL(urls *urlSigner, orgID uint, key string, expires time.Time) string {
+	signature := base64.RawURLEncoding.EncodeToString(urls.signature(orgID, key, expires.Unix()))
+	return fmt.Sprintf("/files/%s?expires=%d&sig=%s", key, expires.Unix(), signature)
+}
+
+func TestSignedBlobURLs(t *testing.T) {
+	h := newTestHandlers(t)
+	if err := h.store.Put(t.Context(), "display/page.jpg", []byte("page"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	get := func(orgID uint, url string) *httptest.ResponseRecorder {
+		return serve(fileRouter(h, orgID), httptest.NewRequest("GET", url, nil))
+	}
+
+	url := h.urls.sign(1, "display/page.jpg")
+	if w := get(1, url); w.Code != 200 || w.Body.String() != "page" || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("signed URL: %d %s %q", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+
+	// A URL issued to one organization is no use to another
+	if w := get(2, url); w.Code != 403 {
+		t.Errorf("URL of another organization: %d", w.Code)
+	}
+
+	later, earlier := time.Now().Add(time.Hour), time.Now().Add(-time.Minute)
+	for name, url := range map[string]string{
+		"signed for another organization": fileURL(h.urls, 2, "display/page.jpg", later),
+		"signed for another key":          "/files/display/other.jpg" + fileURL(h.urls, 1, "display/page.jpg", later)[len("/files/display/page.jpg"):],
+		"expired":                         fileURL(h.urls, 1, "display/page.jpg", earlier),
+		"unsigned":                        "/files/display/page.jpg",
+		"garbled signature":               fmt.Sprintf("/files/display/page.jpg?expires=%d&sig=%%21%%21", later.Unix()),
+	} {
+		if w := get(1, url); w.Code != 403 {
+			t.Errorf("URL %s: %d %s", name, w.Code, w.Body)
+		}
+	}
+
+	if err := h.store.Delete(t.Context(), "display/page.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(1, url); w.Code != 404 {
+		t.Errorf("URL of a deleted file: %d", w.Code)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"scan-in/pkg/migrations"
+
+	"gorm.io/gorm"
+)
+
+// commands are the maintenance tasks that can be run instead of the server,
+// as "scan-in <command> [flags]". migrate is run before the schema check, in main.
+var commands = map[string]func(h *invoiceHandlers, args []string){
+	"reextract": (*invoiceHandlers).reextractCommand,
+}
+
+// commandUsage lists the commands for the usage message
+const commandUsage = `Commands:
+  migrate     show or change the database schema version
+  reextract   re-run extraction over stored invoices
+`
+
+// runCommand runs the named command, or exits with usage if it is unknown
+func runCommand(h *invoiceHandlers, args []string) {
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", args[0], commandUsage)
+		os.Exit(2)
+	}
+	command(h, args[1:])
+}
+
+// migrateUsage describes the migrate command
+const migrateUsage = `Usage:
+  scan-in migrate status      show the schema version and pending migrations
+  scan-in migrate up          apply all pending migrations
+  scan-in migrate down [n]    revert the last n migrations (default 1)
+  scan-in migrate to <n>      migrate up or down to version n
+`
+
+// dataSteps are the Go parts of the data migrations
+var dataSteps = []migrations.DataStep{
+	{Version: 8, Run: backfillIssuedOn},
+}
+
+// newMigrator loads the migrations for the database
+func newMigrator(db *gorm.DB) *migrations.Migrator {
+	migrator, err := migrations.New(db, dataSteps...)
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %v", err)
+	}
+	return migrator
+}
+
+// requireCurrentSchema stops the server unless the schema is at the version this build expects
+func requireCurrentSchema(db *gorm.DB) {
+	err := newMigrator(db).Check()
+	if errors.Is(err, migrations.ErrSchemaMismatch) {
+		log.Fatalf("%v; run \"scan-in migrate up\" (or \"migrate to\" an older version with a newer build)", err)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read the database schema version: %v", err)
+	}
+}
+
+// migrateCommand shows or changes the schema version
+func migrateCommand(db *gorm.DB, args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+	migrator := newMigrator(db)
+	before, err := migrator.Version()
+	if err != nil {
+		log.Fatalf("Failed to read the database schema version: %v", err)
+	}
+
+	var ran []migrations.Migration
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		printMigrationStatus(migrator)
+		return
+	case args[0] == "up" && len(args) == 1:
+		ran, err = migrator.Up()
+	case args[0] == "down" && len(args) <= 2:
+		steps := 1
+		if len(args) == 2 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("down takes a positive number of migrations, not %q", args[1])
+			}
+		}
+		ran, err = migrator.Down(steps)
+	case args[0] == "to" && len(args) == 2:
+		target, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			log.Fatalf("to takes a version number, not %q", args[1])
+		}
+		ran, err = migrator.To(target)
+	default:
+		fmt.Fprint(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+
+	action := "Reverted"
+	if len(ran) > 0 && ran[0].Version > before {
+		action = "Applied"
+	}
+	for _, migration := range ran {
+		fmt.Printf("%s %04d_%s\n", action, migration.Version, migration.Name)
+	}
+	if err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+	printMigrationStatus(migrator)
+}
+
+// printMigrationStatus shows the schema version and the migrations not yet applied
+func printMigrationStatus(migrator *migrations.Migrator) {
+	version, err := migrator.Version()
+	if err != nil {
+		log.Fatalf("Failed to read the database schema version: %v", err)
+	}
+	fmt.Printf("Schema version %d of %d\n", version, migrator.Latest())
+	for _, migration := range migrator.Migrations() {
+		if migration.Version > version {
+			fmt.Printf("Pending %04d_%s\n", migration.Version, migration.Name)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// defaultDatabaseURL is used when DATABASE_URL is not set, so a single-user
+// install needs no database server
+const defaultDatabaseURL = "sqlite:data/scan-in.db"
+
+// databaseDialector picks the driver from the DATABASE_URL scheme:
+//
+//	postgres://... or postgresql://...   Postgres (as do key=value DSNs)
+//	sqlite:path/to/file.db                SQLite file, created if missing
+//	sqlite::memory:                       SQLite in memory, gone on exit
+func databaseDialector(databaseURL string) (gorm.Dialector, error) {
+	scheme, rest, found := strings.Cut(databaseURL, ":")
+	switch {
+	case !found || strings.Contains(scheme, "="):
+		return postgres.Open(databaseURL), nil
+	case scheme == "postgres" || scheme == "postgresql":
+		return postgres.Open(databaseURL), nil
+	case scheme == "sqlite":
+		return sqlite.Open(sqliteDSN(strings.TrimPrefix(rest, "//"))), nil
+	default:
+		return nil, fmt.Errorf("unsupported database URL scheme %q", scheme)
+	}
+}
+
+// sqliteDSN adds the connection settings SQLite needs for concurrent
+// use: foreign keys on, WAL so readers don't block the writer, a busy timeout
+// instead of immediate "database is locked" errors, and transactions that
+// take the write lock up front so they cannot deadlock upgrading it.
+func sqliteDSN(path string) string {
+	if path == ":memory:" {
+		// Connections of the pool must share one in-memory database
+		path = "file::memory:?cache=shared"
+	} else if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			log.Printf("Warning: Failed to create database directory %s: %v", dir, err)
+		}
+	}
+
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return path + separator + "_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_txlock=immediate"
+}
+
+// openDatabase connects to the database named by DATABASE_URL
+func openDatabase() *gorm.DB {
+	databaseURL := os.Getenv("DATABASE_URL")
+	if databaseURL == "" {
+		databaseURL = defaultDatabaseURL
+		log.Printf("DATABASE_URL is not set; using %s", databaseURL)
+	}
+	dialector, err := databaseDialector(databaseURL)
+	if err != nil {
+		log.Fatalf("Invalid DATABASE_URL: %v", err)
+	}
+	conn, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	return conn
+}
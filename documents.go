@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"scan-in/pkg/storage"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Kinds of document kept with an invoice
+const (
+	DocumentOriginal  = "original"  // the file as it was uploaded
+	DocumentProcessed = "processed" // the enhanced page image sent to OCR
+	DocumentOCR       = "ocr"       // the raw OCR response for a page
+)
+
+// InvoiceDocument is a file kept with an invoice for auditing and re-extraction.
+// The contents live in the blob store under a content-addressed key.
+type InvoiceDocument struct {
+	gorm.Model
+	OrganizationID uint `gorm:"index"`
+	InvoiceID      uint `gorm:"index"`
+	Kind           string
+	Page           int // page within the scan, 0 for originals
+	Filename       string
+	ContentType    string
+	Size           int64
+	SHA256         string
+	BlobKey        string
+}
+
+// ScannedPage is one page as it went through the scan pipeline
+type ScannedPage struct {
+	Number     int
+	Upload     int // index of the upload the page was read from
+	TextLines  []TextLine
+	DisplayKey string // blob key of the cropped display image
+	ImageHash  string // perceptual hash of the display image
+	Processed  []byte // enhanced JPEG that was sent to OCR
+	OCRResult  []byte // raw OCR response as JSON
+}
+
+// ScanOutput is everything scanPages produces for a set of uploads
+type ScanOutput struct {
+	TextLines   []TextLine
+	DisplayKeys []string
+	Formats     []string
+	Pages       []ScannedPage
+}
+
+// attachInvoiceDocuments stores the originals, processed images and OCR output
+// of the invoice's pages in the blob store and adds their records to
+// invoice.Documents, to be saved with the invoice. Blobs that cannot be stored
+// are logged and skipped; the invoice is kept either way.
+func attachInvoiceDocuments(store storage.BlobStore, invoice *Invoice, uploads []Upload, pages []ScannedPage) {
+	saved := make(map[int]bool)
+	for _, page := range pages {
+		if page.Number < invoice.StartPage || page.Number > invoice.EndPage {
+			continue
+		}
+		if !saved[page.Upload] {
+			saved[page.Upload] = true
+			upload := uploads[page.Upload]
+			ext := strings.ToLower(filepath.Ext(upload.Filename))
+			contentType := mime.TypeByExtension(ext)
+			if contentType == "" {
+				contentType = http.DetectContentType(upload.Data)
+			}
+			appendDocument(store, invoice, DocumentOriginal, 0, upload.Filename, ext, contentType, upload.Data)
+		}
+		appendDocument(store, invoice, DocumentProcessed, page.Number,
+			fmt.Sprintf("processed-page-%d.jpg", page.Number), ".jpg", "image/jpeg", page.Processed)
+		appendDocument(store, invoice, DocumentOCR, page.Number,
+			fmt.Sprintf("ocr-page-%d.json", page.Number), ".json", "application/json", page.OCRResult)
+	}
+}
+
+// appendDocument stores one document and adds its record to the invoice, or
+// logs and skips it if it cannot be stored
+func appendDocument(store storage.BlobStore, invoice *Invoice, kind string, page int, filename, ext, contentType string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	key := storage.ContentKey(documentBlobPrefix, data, ext)
+	if err := store.Put(context.Background(), key, data, contentType); err != nil {
+		log.Printf("Warning: Failed to save %s document %s: %v", kind, filename, err)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	invoice.Documents = append(invoice.Documents, InvoiceDocument{
+		Kind:        kind,
+		Page:        page,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		SHA256:      hex.EncodeToString(sum[:]),
+		BlobKey:     key,
+	})
+}
+
+// getInvoiceDocument downloads one of an invoice's documents
+func (h *invoiceHandlers) getInvoiceDocument(c *gin.Context) {
+	invoice := h.loadInvoice(c)
+	if invoice == nil {
+		return
+	}
+	i := slices.IndexFunc(invoice.Documents, func(document InvoiceDocument) bool {
+		return strconv.FormatUint(uint64(document.ID), 10) == c.Param("document_id")
+	})
+	if i < 0 {
+		respondError(c, 404, ErrCodeNotFound, "Document not found")
+		return
+	}
+	document := invoice.Documents[i]
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": document.Filename}))
+	serveBlob(c, h.blobs, document.BlobKey, document.ContentType)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Layers of duplicate detection, strongest first
+const (
+	DuplicateExact = "exact" // same vendor and invoice number
+	DuplicateFuzzy = "fuzzy" // same vendor, with amount and date within tolerance
+	DuplicateImage = "image" // first page looks the same
+)
+
+// Review states of a suspected duplicate
+const (
+	DuplicatePending   = "pending"
+	DuplicateConfirmed = "confirmed"
+	DuplicateDismissed = "dismissed"
+)
+
+// Tolerances of the fuzzy and image layers
+const (
+	duplicateAmountTolerance = 0.01 // fraction of the total amount
+	duplicateDateTolerance   = 3    // days either side of the invoice date
+	duplicateImageDistance   = 12   // differing bits out of the 64 of an image hash
+)
+
+// maxDuplicateFlags bounds the flags raised for one invoice, so a vendor whose
+// invoices all look alike can't flood the review queue
+const maxDuplicateFlags = 10
+
+// ErrDuplicateNotFound is returned when no duplicate flag of the context's organization has the ID
+var ErrDuplicateNotFound = errors.New("duplicate not found")
+
+// InvoiceDuplicate flags an invoice as a possible duplicate of an earlier one.
+// Flags are raised when the invoice is scanned and wait in the review queue
+// until someone confirms or dismisses them.
+type InvoiceDuplicate struct {
+	gorm.Model
+	OrganizationID uint     `gorm:"index"`
+	InvoiceID      uint     `gorm:"index"` // the later invoice, suspected to be a duplicate
+	Invoice        *Invoice `gorm:"foreignKey:InvoiceID"`
+	OriginalID     uint     `gorm:"index"`
+	Original       *Invoice `gorm:"foreignKey:OriginalID"`
+	Reason         string   // the detection layer that matched
+	Detail         string   // what matched, for the reviewer
+	Status         string   `gorm:"index"`
+	ReviewedAt     *time.Time
+	ReviewedBy     string // user email or API key name that reviewed the flag
+}
+
+// knownValue reports whether an extracted field was actually read
+func knownValue(value string) bool {
+	value = strings.TrimSpace(value)
+	return value != "" && value != "UNKNOWN"
+}
+
+// checkDuplicates fingerprints the invoice's first page and flags the earlier
+// invoices it may duplicate, to be saved with it. Detection never blocks a scan:
+// if it fails the invoice is stored unflagged.
+func checkDuplicates(ctx context.Context, invoices InvoiceRepository, invoice *Invoice, pages []ScannedPage) {
+	// The date is normalized when the invoice is saved, which is too late for the fuzzy layer
+	invoice.IssuedOn = normalizeInvoiceDate(invoice.Date)
+	for _, page := range pages {
+		if page.Number == invoice.StartPage {
+			invoice.ImageHash = page.ImageHash
+			break
+		}
+	}
+
+	duplicates, err := findDuplicates(ctx, invoices, *invoice)
+	if err != nil {
+		log.Printf("Warning: Failed to check invoice %s for duplicates: %v", invoice.InvoiceNumber, err)
+		return
+	}
+	for _, duplicate := range duplicates {
+		log.Printf("Invoice %s may duplicate invoice %d (%s: %s)", invoice.InvoiceNumber, duplicate.OriginalID, duplicate.Reason, duplicate.Detail)
+	}
+	invoice.Duplicates = duplicates
+}
+
+// findDuplicates checks an invoice against the stored invoices of its
+// organization. Each earlier invoice is flagged at most once, by the strongest
+// layer that matched it.
+func findDuplicates(ctx context.Context, invoices InvoiceRepository, invoice Invoice) ([]InvoiceDuplicate, error) {
+	var duplicates []InvoiceDuplicate
+	flag := func(originalID uint, reason, detail string) {
+		if originalID == invoice.ID || len(duplicates) >= maxDuplicateFlags {
+			return
+		}
+		for _, duplicate := range duplicates {
+			if duplicate.OriginalID == originalID {
+				return
+			}
+		}
+		duplicates = append(duplicates, InvoiceDuplicate{
+			OriginalID: originalID,
+			Reason:     reason,
+			Detail:     detail,
+			Status:     DuplicatePending,
+		})
+	}
+
+	vendor := strings.TrimSpace(invoice.VendorName)
+	number := strings.TrimSpace(invoice.InvoiceNumber)
+	if knownValue(vendor) && knownValue(number) {
+		err := invoices.Each(ctx, InvoiceFilter{Query: number, Vendor: vendor}, func(candidate Invoice) error {
+			if strings.EqualFold(strings.TrimSpace(candidate.InvoiceNumber), number) {
+				flag(candidate.ID, DuplicateExact, fmt.Sprintf("same vendor and invoice number %s", candidate.InvoiceNumber))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if issued, err := time.Parse("2006-01-02", invoice.IssuedOn); err == nil && knownValue(vendor) && invoice.TotalAmount > 0 {
+		tolerance := invoice.TotalAmount * duplicateAmountTolerance
+		low, high := invoice.TotalAmount-tolerance, invoice.TotalAmount+tolerance
+		filter := InvoiceFilter{
+			Vendor:    vendor,
+			MinAmount: &low,
+			MaxAmount: &high,
+			From:      issued.AddDate(0, 0, -duplicateDateTolerance).Format("2006-01-02"),
+			To:        issued.AddDate(0, 0, duplicateDateTolerance).Format("2006-01-02"),
+		}
+		err := invoices.Each(ctx, filter, func(candidate Invoice) error {
+			// Invoices in different currencies are not the same bill
+			if candidate.Currency != "" && invoice.Currency != "" && !strings.EqualFold(candidate.Currency, invoice.Currency) {
+				return nil
+			}
+			flag(candidate.ID, DuplicateFuzzy, fmt.Sprintf("same vendor, amount %.2f %s on %s", candidate.TotalAmount, candidate.Currency, candidate.IssuedOn))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if invoice.ImageHash != "" {
+		similar, err := invoices.SimilarImages(ctx, invoice.ImageHash, duplicateImageDistance)
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]uint, 0, len(similar))
+		for id := range similar {
+			ids = append(ids, id)
+		}
+		// Closest images first
+		slices.SortFunc(ids, func(a, b uint) int {
+			return cmp.Or(cmp.Compare(similar[a], similar[b]), cmp.Compare(a, b))
+		})
+		for _, id := range ids {
+			flag(id, DuplicateImage, fmt.Sprintf("first page differs in %d of 64 image hash bits", similar[id]))
+		}
+	}
+
+	return duplicates, nil
+}
+
+// imageHash returns a 64-bit perceptual hash of an image as hex. The image is
+// shrunk to 32x32 grey pixels and each bit records whether one of the lowest
+// 8x8 frequencies of its cosine transform is above their median. Those describe
+// the layout of the page rather than its detail, so rescans of the same page
+// give hashes a few bits apart while unrelated pages differ in about half.
+func imageHash(img image.Image) string {
+	const size, frequencies = 32, 8
+	small := toGray(imaging.Resize(img, size, size, imaging.Box))
+
+	var cosines [frequencies][size]float64
+	for u := range cosines {
+		for x := range cosines[u] {
+			cosines[u][x] = math.Cos(float64((2*x+1)*u) * math.Pi / (2 * size))
+		}
+	}
+
+	// Transform the rows, then the columns of the result
+	var rows [size][frequencies]float64
+	for y := 0; y < size; y++ {
+		for u := 0; u < frequencies; u++ {
+			for x := 0; x < size; x++ {
+				rows[y][u] += float64(small.GrayAt(x, y).Y) * cosines[u][x]
+			}
+		}
+	}
+	coefficients := make([]float64, 0, frequencies*frequencies)
+	for v := 0; v < frequencies; v++ {
+		for u := 0; u < frequencies; u++ {
+			sum := 0.0
+			for y := 0; y < size; y++ {
+				sum += rows[y][u] * cosines[v][y]
+			}
+			coefficients = append(coefficients, sum)
+		}
+	}
+
+	// The first coefficient is the overall brightness, which says nothing about the layout
+	sorted := slices.Clone(coefficients[1:])
+	slices.Sort(sorted)
+	median := sorted[len(sorted)/2]
+
+	hash := make([]byte, len(coefficients)/8)
+	for i, coefficient := range coefficients {
+		if coefficient > median {
+			hash[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return hex.EncodeToString(hash)
+}
+
+// hashDistance counts the bits in which two image hashes differ, or returns -1
+// if they can't be compared
+func hashDistance(a, b string) int {
+	x, errX := hex.DecodeString(a)
+	y, errY := hex.DecodeString(b)
+	if errX != nil || errY != nil || len(x) == 0 || len(x) != len(y) {
+		return -1
+	}
+	distance := 0
+	for i := range x {
+		distance += bits.OnesCount8(x[i] ^ y[i])
+	}
+	return distance
+}
+
+// emitInvoiceScanned notifies webhooks of a newly scanned invoice, and of the
+// duplicates it was flagged as
+func (h *invoiceHandlers) emitInvoiceScanned(invoice Invoice) {
+	h.webhooks.Emit(invoice.OrganizationID, EventInvoiceScanned, toInvoiceDTO(invoice))
+	if len(invoice.Duplicates) > 0 {
+		h.webhooks.Emit(invoice.OrganizationID, EventInvoiceDuplicate, toInvoiceDTO(invoice))
+	}
+}
+
+// emitScanFailed queues scan.failed webhooks for a synchronous scan of the
+// uploads that failed with message
+func (h *invoiceHandlers) emitScanFailed(c *gin.Context, uploads []Upload, message string) {
+	filenames := make([]string, 0, len(uploads))
+	for _, upload := range uploads {
+		filenames = append(filenames, upload.Filename)
+	}
+	h.webhooks.Emit(c.GetUint(orgContextKey), EventScanFailed, ScanFailureDTO{
+		Filenames:    filenames,
+		ErrorMessage: message,
+		FailedAt:     time.Now().UTC(),
+	})
+}
+
+// listDuplicates returns the review queue: the duplicate flags in one state,
+// pending unless another is asked for, with both invoices of each
+func (h *invoiceHandlers) listDuplicates(c *gin.Context) {
+	status := c.DefaultQuery("status", DuplicatePending)
+	if status != DuplicatePending && status != DuplicateConfirmed && status != DuplicateDismissed {
+		respondInvalidParameter(c, "status", "must be pending, confirmed or dismissed")
+		return
+	}
+
+	duplicates, err := h.invoices.ListDuplicates(tenantContext(c), status)
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to list duplicates")
+		return
+	}
+
+	dtos := make([]DuplicateReviewDTO, 0, len(duplicates))
+	for _, duplicate := range duplicates {
+		dtos = append(dtos, toDuplicateReviewDTO(duplicate))
+	}
+	c.JSON(200, DuplicateListDTO{Duplicates: dtos})
+}
+
+// confirmDuplicate records that an invoice is a duplicate, which keeps it from being approved
+func (h *invoiceHandlers) confirmDuplicate(c *gin.Context) {
+	h.reviewDuplicate(c, DuplicateConfirmed)
+}
+
+// dismissDuplicate records that a flagged invoice is not a duplicate after all
+func (h *invoiceHandlers) dismissDuplicate(c *gin.Context) {
+	h.reviewDuplicate(c, DuplicateDismissed)
+}
+
+// reviewDuplicate sets the state of the duplicate flag named by the path. A
+// reviewed flag may be reviewed again to correct a mistake.
+func (h *invoiceHandlers) reviewDuplicate(c *gin.Context, status string) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		respondError(c, 404, ErrCodeNotFound, "Duplicate not found")
+		return
+	}
+
+	duplicate, err := h.invoices.ReviewDuplicate(tenantContext(c), uint(id), status, currentActor(c))
+	if errors.Is(err, ErrDuplicateNotFound) {
+		respondError(c, 404, ErrCodeNotFound, "Duplicate not found")
+		return
+	}
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to review duplicate")
+		return
+	}
+
+	log.Printf("Duplicate flag %d on invoice %d %s by %s", duplicate.ID, duplicate.InvoiceID, status, duplicate.ReviewedBy)
+	c.JSON(200, toDuplicateDTO(*duplicate))
+}
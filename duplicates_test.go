@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// duplicateRepositories are the invoice repositories duplicate detection is tested on
+var duplicateRepositories = []struct {
+	name string
+	open func(t *testing.T) InvoiceRepository
+}{
+	{"memory", func(t *testing.T) InvoiceRepository { return newMemoryInvoiceRepository() }},
+	{"gorm", func(t *testing.T) InvoiceRepository { return newGormInvoiceRepository(openTestDB(t)) }},
+}
+
+// flags returns the reasons an invoice was flagged for, by the original invoice's ID
+func flags(invoice InvoiceDTO) map[uint]string {
+	reasons := make(map[uint]string)
+	for _, duplicate := range invoice.Duplicates {
+		reasons[duplicate.OriginalInvoiceID] = duplicate.Reason
+	}
+	return reasons
+}
+
+func TestScanFlagsDuplicates(t *testing.T) {
+	for _, repository := range duplicateRepositories {
+		t.Run(repository.name, func(t *testing.T) {
+			h := newTestHandlers(t)
+			h.invoices = repository.open(t)
+			ocr := h.ocrService
+			ocr.page(800, invoiceText("Acme Corp", "100234", "03/05/2024", 250)...)
+			ocr.page(810, invoiceText("Acme Corp", "100234", "04/01/2024", 990)...)
+			ocr.page(820, invoiceText("Acme Corp", "100777", "03/07/2024", 250.50)...)
+			ocr.page(830, invoiceText("Acme Corp", "100888", "03/12/2024", 250)...)
+			ocr.page(840, invoiceText("Acme Corp", "100999", "03/06/2024", 250)...)
+			ocr.page(850, invoiceText("Globex Corporation", "555555", "05/01/2024", 10)...)
+
+			original := scanInvoice(t, h, 1, testPage(t, 800, 1))
+			if len(original.Duplicates) != 0 {
+				t.Fatalf("first invoice flagged: %+v", original.Duplicates)
+			}
+
+			tests := []struct {
+				name  string
+				width int
+				seed  int64
+				want  map[uint]string
+			}{
+				{"same number", 810, 2, map[uint]string{original.ID: DuplicateExact}},
+				{"amount and date close", 820, 3, map[uint]string{original.ID: DuplicateFuzzy}},
+				{"a week later", 830, 4, map[uint]string{}},
+				{"same page", 850, 1, map[uint]string{original.ID: DuplicateImage}},
+			}
+			for _, test := range tests {
+				invoice := scanInvoice(t, h, 1, testPage(t, test.width, test.seed))
+				if got := flags(invoice); !maps.Equal(got, test.want) {
+					t.Errorf("%s: flagged %v, want %v", test.name, got, test.want)
+				}
+			}
+
+			// Another organization's invoices are never matched
+			if invoice := scanInvoice(t, h, 2, testPage(t, 840, 1)); len(invoice.Duplicates) != 0 {
+				t.Errorf("invoice of another organization flagged: %+v", invoice.Duplicates)
+			}
+
+			want := []string{
+				EventInvoiceScanned,
+				EventInvoiceScanned, EventInvoiceDuplicate,
+				EventInvoiceScanned, EventInvoiceDuplicate,
+				EventInvoiceScanned,
+				EventInvoiceScanned, EventInvoiceDuplicate,
+				EventInvoiceScanned,
+			}
+			if types := h.events.types(); !slices.Equal(types, want) {
+				t.Errorf("events %v, want %v", types, want)
+			}
+		})
+	}
+}
+
+func TestDuplicateReviewQueue(t *testing.T) {
+	for _, repository := range duplicateRepositories {
+		t.Run(repository.name, func(t *testing.T) {
+			h := newTestHandlers(t)
+			h.invoices = repository.open(t)
+			h.ocrService.page(800, invoiceText("Acme Corp", "100234", "03/05/2024", 250)...)
+			h.ocrService.page(810, invoiceText("Acme Corp", "100234", "04/01/2024", 990)...)
+			h.ocrService.page(820, invoiceText("Acme Corp", "100777", "03/06/2024", 250)...)
+			original := scanInvoice(t, h, 1, testPage(t, 800, 1))
+			exact := scanInvoice(t, h, 1, testPage(t, 810, 2))
+			fuzzy := scanInvoice(t, h, 1, testPage(t, 820, 3))
+			r := h.testRouter(1)
+
+			var queue DuplicateListDTO
+			decode(t, serve(r, httptest.NewRequest("GET", "/api/duplicates", nil)), 200, &queue)
+			if len(queue.Duplicates) != 2 {
+				t.Fatalf("review queue holds %d flags, want 2", len(queue.Duplicates))
+			}
+			for _, entry := range queue.Duplicates {
+				if entry.Original.ID != original.ID || entry.Status != DuplicatePending {
+					t.Errorf("flag %d on invoice %d: original %d, status %s", entry.ID, entry.Invoice.ID, entry.Original.ID, entry.Status)
+				}
+			}
+			if w := serve(h.testRouter(2), httptest.NewRequest("GET", "/api/duplicates", nil)); w.Body.String() != `{"duplicates":[]}` {
+				t.Errorf("other organization's review queue: %s", w.Body)
+			}
+
+			// Flagged invoices can't be approved until the flag is reviewed
+			approve := func(invoice InvoiceDTO) int {
+				return serve(r, httptest.NewRequest("POST", fmt.Sprintf("/api/invoices/%d/approve", invoice.ID), nil)).Code
+			}
+			if code := approve(exact); code != 409 {
+				t.Errorf("approving a flagged invoice: %d", code)
+			}
+
+			var reviewed DuplicateDTO
+			decode(t, serve(r, httptest.NewRequest("POST", fmt.Sprintf("/api/duplicates/%d/confirm", exact.Duplicates[0].ID), nil)), 200, &reviewed)
+			if reviewed.Status != DuplicateConfirmed || reviewed.ReviewedBy != "clerk@org1.test" || reviewed.ReviewedAt == nil {
+				t.Errorf("confirmed flag: %+v", reviewed)
+			}
+			decode(t, serve(r, httptest.NewRequest("POST", fmt.Sprintf("/api/duplicates/%d/dismiss", fuzzy.Duplicates[0].ID), nil)), 200, &reviewed)
+			if reviewed.Status != DuplicateDismissed {
+				t.Errorf("dismissed flag: %+v", reviewed)
+			}
+
+			if code := approve(exact); code != 409 {
+				t.Errorf("approving a confirmed duplicate: %d", code)
+			}
+			if code := approve(fuzzy); code != 200 {
+				t.Errorf("approving an invoice whose flag was dismissed: %d", code)
+			}
+
+			decode(t, serve(r, httptest.NewRequest("GET", "/api/duplicates", nil)), 200, &queue)
+			if len(queue.Duplicates) != 0 {
+				t.Errorf("review queue still holds %d flags", len(queue.Duplicates))
+			}
+			decode(t, serve(r, httptest.NewRequest("GET", "/api/duplicates?status=confirmed", nil)), 200, &queue)
+			if len(queue.Duplicates) != 1 || queue.Duplicates[0].Invoice.ID != exact.ID {
+				t.Errorf("confirmed flags: %+v", queue.Duplicates)
+			}
+
+			if w := serve(r, httptest.NewRequest("GET", "/api/duplicates?status=open", nil)); w.Code != 400 {
+				t.Errorf("unknown status: %d", w.Code)
+			}
+			other := fmt.Sprintf("/api/duplicates/%d/confirm", exact.Duplicates[0].ID)
+			if w := serve(h.testRouter(2), httptest.NewRequest("POST", other, nil)); w.Code != 404 {
+				t.Errorf("other organization confirming a flag: %d", w.Code)
+			}
+		})
+	}
+}
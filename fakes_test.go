@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"scan-in/pkg/storage"
+
+	"github.com/Azure/azure-sdk-for-go/services/cognitiveservices/v3.0/computervision"
+	"github.com/gin-gonic/gin"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// fakeOCR reads pages by their width: the scan pipeline keeps the size of the
+// uploaded image, so a test tells its pages apart by drawing them at different
+// widths and gives the text of each
+type fakeOCR struct {
+	mu    sync.Mutex
+	pages map[int][]string // text lines by page width
+	calls int
+	err   error
+}
+
+// newFakeOCR returns an OCR service that knows no pages yet
+func newFakeOCR() *fakeOCR {
+	return &fakeOCR{pages: make(map[int][]string)}
+}
+
+// page registers the text of the page of the given width
+func (f *fakeOCR) page(width int, lines ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pages[width] = lines
+}
+
+// Recognize lays the page's lines out top to bottom, one per 40 pixels
+func (f *fakeOCR) Recognize(ctx context.Context, imageData []byte) (computervision.OcrResult, error) {
+	config, err := jpeg.DecodeConfig(bytes.NewReader(imageData))
+	if err != nil {
+		return computervision.OcrResult{}, fmt.Errorf("fake OCR: %v", err)
+	}
+
+	f.mu.Lock()
+	f.calls++
+	lines, failure := f.pages[config.Width], f.err
+	f.mu.Unlock()
+	if failure != nil {
+		return computervision.OcrResult{}, failure
+	}
+
+	ocrLines := make([]computervision.OcrLine, 0, len(lines))
+	for i, text := range lines {
+		var words []computervision.OcrWord
+		for _, word := range strings.Fields(text) {
+			words = append(words, computervision.OcrWord{Text: &word})
+		}
+		box := fmt.Sprintf("%d,%d,%d,%d", 40, 40+40*i, 12*len(text), 20)
+		ocrLines = append(ocrLines, computervision.OcrLine{BoundingBox: &box, Words: &words})
+	}
+	regions := []computervision.OcrRegion{{Lines: &ocrLines}}
+	return computervision.OcrResult{Regions: &regions}, nil
+}
+
+// testPage draws a page of the given width with blocks laid out by the seed,
+// encoded as PNG. The layout is relative to the width, so pages of one seed
+// have close image hashes whatever their width, and pages of different seeds
+// unrelated ones.
+func testPage(t testing.TB, width int, seed int64) []byte {
+	t.Helper()
+	const height = 600
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	random := rand.New(rand.NewSource(seed))
+	for block := 0; block < 12; block++ {
+		x, y := random.Intn(520)*width/600, random.Intn(height-60)
+		w, h := (20+random.Intn(60))*width/600, 10+random.Intn(50)
+		for py := y; py < y+h; py++ {
+			for px := x; px < x+w; px++ {
+				img.Set(px, py, color.Black)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testPDF returns a PDF with one page per image, the way scanners write them
+func testPDF(t testing.TB, pages ...[]byte) []byte {
+	t.Helper()
+	readers := make([]io.Reader, 0, len(pages))
+	for _, page := range pages {
+		readers = append(readers, bytes.NewReader(page))
+	}
+	var buf bytes.Buffer
+	if err := api.ImportImages(nil, &buf, readers, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// fakeVendorRepository keeps vendors and the review list in memory, with the
+// tenant scoping of the SQL repository
+type fakeVendorRepository struct {
+	mu        sync.Mutex
+	vendors   []Vendor
+	unmatched []UnmatchedVendor
+	nextID    uint
+}
+
+// newFakeVendorRepository returns a repository holding the vendors
+func newFakeVendorRepository(vendors ...Vendor) *fakeVendorRepository {
+	return &fakeVendorRepository{vendors: vendors, nextID: 1000}
+}
+
+func (r *fakeVendorRepository) Create(ctx context.Context, vendor *Vendor) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	vendor.ID = r.nextID
+	vendor.OrganizationID, _ = tenantFromContext(ctx)
+	r.vendors = append(r.vendors, *vendor)
+	return nil
+}
+
+func (r *fakeVendorRepository) List(ctx context.Context) ([]Vendor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var vendors []Vendor
+	for _, vendor := range r.vendors {
+		if orgID, ok := tenantFromContext(ctx); !ok || vendor.OrganizationID == orgID {
+			vendors = append(vendors, vendor)
+		}
+	}
+	return vendors, nil
+}
+
+func (r *fakeVendorRepository) Get(ctx context.Context, id uint) (*Vendor, error) {
+	vendors, _ := r.List(ctx)
+	for _, vendor := range vendors {
+		if vendor.ID == id {
+			return &vendor, nil
+		}
+	}
+	return nil, ErrVendorNotFound
+}
+
+func (r *fakeVendorRepository) Update(ctx context.Context, vendor *Vendor) error {
+	if _, err := r.Get(ctx, vendor.ID); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.vendors {
+		if r.vendors[i].ID == vendor.ID {
+			r.vendors[i] = *vendor
+		}
+	}
+	return nil
+}
+
+func (r *fakeVendorRepository) UpdateAliases(ctx context.Context, vendor *Vendor) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.vendors {
+		if r.vendors[i].ID == vendor.ID {
+			r.vendors[i].Aliases = slices.Clone(vendor.Aliases)
+			return nil
+		}
+	}
+	return ErrVendorNotFound
+}
+
+func (r *fakeVendorRepository) RecordUnmatched(ctx context.Context, nameKey, name string, domains []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	orgID, _ := tenantFromContext(ctx)
+	for i := range r.unmatched {
+		entry := &r.unmatched[i]
+		if entry.OrganizationID == orgID && entry.NameKey == nameKey {
+			entry.Names = appendVariants(entry.Names, name)
+			entry.Domains = appendVariants(entry.Domains, domains...)
+			entry.InvoiceCount++
+			return nil
+		}
+	}
+	r.nextID++
+	entry := UnmatchedVendor{OrganizationID: orgID, NameKey: nameKey, InvoiceCount: 1}
+	entry.ID = r.nextID
+	entry.Names = appendVariants(nil, name)
+	entry.Domains = appendVariants(nil, domains...)
+	r.unmatched = append(r.unmatched, entry)
+	return nil
+}
+
+func (r *fakeVendorRepository) ListUnmatched(ctx context.Context) ([]UnmatchedVendor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var entries []UnmatchedVendor
+	for _, entry := range r.unmatched {
+		if orgID, ok := tenantFromContext(ctx); !ok || entry.OrganizationID == orgID {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (r *fakeVendorRepository) GetUnmatched(ctx context.Context, id uint) (*UnmatchedVendor, error) {
+	entries, _ := r.ListUnmatched(ctx)
+	for _, entry := range entries {
+		if entry.ID == id {
+			return &entry, nil
+		}
+	}
+	return nil, ErrUnmatchedVendorNotFound
+}
+
+func (r *fakeVendorRepository) DeleteUnmatched(ctx context.Context, id uint) error {
+	if _, err := r.GetUnmatched(ctx, id); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unmatched = slices.DeleteFunc(r.unmatched, func(entry UnmatchedVendor) bool { return entry.ID == id })
+	return nil
+}
+
+// fakeUsageMeter counts OCR pages per API key
+type fakeUsageMeter struct {
+	mu    sync.Mutex
+	pages map[uint]int
+}
+
+func (m *fakeUsageMeter) PagesUsed(keyID uint) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pages[keyID]
+}
+
+func (m *fakeUsageMeter) Reserve(keyID uint, pages, quota int) (int, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	used := m.pages[keyID]
+	if quota > 0 && used+pages > quota {
+		return used, false, nil
+	}
+	if m.pages == nil {
+		m.pages = make(map[uint]int)
+	}
+	m.pages[keyID] += pages
+	return m.pages[keyID], true, nil
+}
+
+func (m *fakeUsageMeter) Record(keyID *uint, pages int) {
+	if keyID == nil || pages == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pages == nil {
+		m.pages = make(map[uint]int)
+	}
+	m.pages[*keyID] = max(m.pages[*keyID]+pages, 0)
+}
+
+// emittedEvent is a webhook event a handler emitted
+type emittedEvent struct {
+	OrgID uint
+	Type  string
+	Data  interface{}
+}
+
+// webhookRecorder keeps the emitted events instead of delivering them
+type webhookRecorder struct {
+	mu     sync.Mutex
+	events []emittedEvent
+}
+
+func (w *webhookRecorder) Emit(orgID uint, eventType string, data interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.events = append(w.events, emittedEvent{orgID, eventType, data})
+}
+
+// types returns the types of the events emitted so far, in order
+func (w *webhookRecorder) types() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var types []string
+	for _, event := range w.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+// failingInvoiceRepository fails to store invoices
+type failingInvoiceRepository struct {
+	InvoiceRepository
+}
+
+func (failingInvoiceRepository) Create(ctx context.Context, invoice *Invoice) error {
+	return errors.New("disk full")
+}
+
+// testHandlers are invoice handlers on in-memory fakes, with the fakes at hand
+type testHandlers struct {
+	*invoiceHandlers
+	invoiceRepo *memoryInvoiceRepository
+	vendorRepo  *fakeVendorRepository
+	ocrService  *fakeOCR
+	store       *storage.LocalStore
+	meter       *fakeUsageMeter
+	events      *webhookRecorder
+}
+
+// newTestHandlers returns handlers whose repositories, OCR, blob store, usage
+// meter and webhooks are all fakes. Scan jobs are not faked; tests of the job
+// endpoints use the gorm repository on openTestDB.
+func newTestHandlers(t testing.TB) *testHandlers {
+	t.Helper()
+	store, err := storage.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &testHandlers{
+		invoiceRepo: newMemoryInvoiceRepository(),
+		vendorRepo:  newFakeVendorRepository(),
+		ocrService:  newFakeOCR(),
+		store:       store,
+		meter:       &fakeUsageMeter{},
+		events:      &webhookRecorder{},
+	}
+	urls := newURLSigner([]byte("test signing key"), time.Hour)
+	h.invoiceHandlers = newInvoiceHandlers(h.invoiceRepo, h.vendorRepo, nil, h.ocrService, store, urls, h.meter, h.events,
+		make(chan uint, scanQueueSize), newScanEventHub())
+	return h
+}
+
+// asOrganization stands in for the auth middleware, acting as a user of the organization
+func asOrganization(orgID uint) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(orgContextKey, orgID)
+		c.Set(userContextKey, &User{Email: fmt.Sprintf("clerk@org%d.test", orgID), Role: RoleAdmin})
+		c.Next()
+	}
+}
+
+// testRouter routes the invoice endpoints to the handlers for a user of the
+// organization, without authentication or any of the HTML pages
+func (h *invoiceHandlers) testRouter(orgID uint) *gin.Engine {
+	r := gin.New()
+	r.Use(asOrganization(orgID))
+	r.POST("/scan-invoice", h.scan)
+	r.POST("/split-scan", h.splitScan)
+	r.GET("/api/invoices", h.list)
+	r.GET("/api/invoices/:id", h.get)
+	r.PATCH("/api/invoices/:id", h.update)
+	r.DELETE("/api/invoices/:id", h.delete)
+	r.POST("/api/invoices/:id/approve", h.approve)
+	r.GET("/api/invoices/:id/documents/:document_id", h.getInvoiceDocument)
+	r.GET("/api/vendors/unmatched", h.listUnmatchedVendors)
+	r.GET("/api/duplicates", h.listDuplicates)
+	r.POST("/api/duplicates/:id/confirm", h.confirmDuplicate)
+	r.POST("/api/duplicates/:id/dismiss", h.dismissDuplicate)
+	return r
+}
+
+// upload is a file of a multipart test request
+type upload struct {
+	field    string
+	filename string
+	data     []byte
+}
+
+// multipartRequest builds a POST of the files as a multipart form
+func multipartRequest(t testing.TB, path string, files ...upload) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, file := range files {
+		part, err := form.CreateFormFile(file.field, file.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(file.data)
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", path, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+// serve runs a request through the router and returns the recorded response
+func serve(r http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// invoiceText returns the OCR lines of a simple invoice
+func invoiceText(vendor, number, date string, total float64) []string {
+	return []string{
+		vendor,
+		"Invoice Number: " + number,
+		"Invoice Date: " + date,
+		"Description Amount",
+		fmt.Sprintf("Consulting services %.2f", total),
+		fmt.Sprintf("Total: $%.2f", total),
+	}
+}
+
+// waitFor polls until the condition holds or a few seconds have passed
+func waitFor(t testing.TB, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvoiceNotFound is returned when no invoice of the context's organization has the ID
+var ErrInvoiceNotFound = errors.New("invoice not found")
+
+// InvoiceRepository stores invoices with their line items, documents and
+// duplicate flags. Implementations scope every call to the organization
+// carried by the context (see withTenant); without one they see all
+// organizations.
+type InvoiceRepository interface {
+	// List returns one page of the invoices matching the filter, and whether more follow
+	List(ctx context.Context, filter InvoiceFilter, page InvoicePage) ([]Invoice, bool, error)
+	// Each calls fn for every invoice matching the filter in ID order, with line items and documents
+	Each(ctx context.Context, filter InvoiceFilter, fn func(Invoice) error) error
+	// Get returns an invoice with its line items, documents and duplicate flags
+	Get(ctx context.Context, id uint) (*Invoice, error)
+	// Create stores a new invoice along with its line items, documents and duplicate flags
+	Create(ctx context.Context, invoice *Invoice) error
+	// Update saves the invoice's fields, and its line items if replaceLineItems is set
+	Update(ctx context.Context, invoice *Invoice, replaceLineItems bool) error
+	// Delete removes an invoice, its line items and the duplicate flags involving it
+	Delete(ctx context.Context, id uint) error
+	// SimilarImages returns the IDs of invoices whose image hash is within
+	// maxDistance bits of the hash, with their distances
+	SimilarImages(ctx context.Context, hash string, maxDistance int) (map[uint]int, error)
+	// ListDuplicates returns the duplicate flags in a review state in ID order,
+	// with both invoices loaded but not their line items or documents
+	ListDuplicates(ctx context.Context, status string) ([]InvoiceDuplicate, error)
+	// ReviewDuplicate sets the review state of a duplicate flag
+	ReviewDuplicate(ctx context.Context, id uint, status, reviewer string) (*InvoiceDuplicate, error)
+	// AssignVendor links the invoices without a vendor whose vendor name is one
+	// of the names to the vendor, giving those without a GL code the vendor's
+	// default, and returns how many were linked
+	AssignVendor(ctx context.Context, vendorNames []string, vendor Vendor) (int64, error)
+}
+
+// InvoiceFilter selects invoices by the search and filter parameters of the list endpoint
+type InvoiceFilter struct {
+	Query     string // words that must each appear in the invoice number or vendor name
+	Vendor    string // vendor name as scanned
+	VendorID  *uint
+	Currency  string
+	MinAmount *float64
+	MaxAmount *float64
+	From      string // YYYY-MM-DD, inclusive
+	To        string
+	Approved  *bool
+}
+
+// InvoicePage selects one page of a sorted invoice listing
+type InvoicePage struct {
+	SortKey    string // a key of invoiceSortColumns
+	Descending bool
+	Limit      int
+	After      *invoiceCursor // last invoice of the previous page
+}
+
+// parseInvoiceFilter reads the search and filter parameters, returning the
+// offending parameter if one is malformed
+func parseInvoiceFilter(params url.Values) (InvoiceFilter, *FieldError) {
+	filter := InvoiceFilter{
+		Query:    strings.TrimSpace(params.Get("q")),
+		Vendor:   params.Get("vendor"),
+		Currency: params.Get("currency"),
+	}
+
+	if value := params.Get("vendor_id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 0)
+		if err != nil {
+			return filter, &FieldError{Field: "vendor_id", Message: "must be a vendor ID"}
+		}
+		vendorID := uint(id)
+		filter.VendorID = &vendorID
+	}
+
+	for param, bound := range map[string]**float64{"min_amount": &filter.MinAmount, "max_amount": &filter.MaxAmount} {
+		value := params.Get(param)
+		if value == "" {
+			continue
+		}
+		amount, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return filter, &FieldError{Field: param, Message: "must be a number"}
+		}
+		*bound = &amount
+	}
+
+	for param, bound := range map[string]*string{"from": &filter.From, "to": &filter.To} {
+		value := params.Get(param)
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", value); err != nil {
+			return filter, &FieldError{Field: param, Message: "must be a date in YYYY-MM-DD format"}
+		}
+		*bound = value
+	}
+
+	switch params.Get("approved") {
+	case "":
+	case "true", "false":
+		approved := params.Get("approved") == "true"
+		filter.Approved = &approved
+	default:
+		return filter, &FieldError{Field: "approved", Message: "must be true or false"}
+	}
+
+	return filter, nil
+}
+
+// gormInvoiceRepository keeps invoices in the SQL database, Postgres or SQLite
+type gormInvoiceRepository struct {
+	db *gorm.DB
+}
+
+// newGormInvoiceRepository returns a repository on the database. Tenant scoping
+// relies on the callbacks of registerTenantCallbacks.
+func newGormInvoiceRepository(db *gorm.DB) *gormInvoiceRepository {
+	return &gormInvoiceRepository{db: db}
+}
+
+// filtered returns a query for the invoices matching the filter
+func (r *gormInvoiceRepository) filtered(ctx context.Context, filter InvoiceFilter) *gorm.DB {
+	query := r.db.WithContext(ctx).Model(&Invoice{})
+	// Every word has to appear in either the invoice number or the vendor name
+	for _, word := range strings.Fields(strings.ToLower(filter.Query)) {
+		pattern := "%" + escapeLike(word) + "%"
+		query = query.Where("(LOWER(invoice_number) LIKE ? ESCAPE '\\' OR LOWER(vendor_name) LIKE ? ESCAPE '\\')", pattern, pattern)
+	}
+	if filter.Vendor != "" {
+		query = query.Where("LOWER(vendor_name) = ?", strings.ToLower(filter.Vendor))
+	}
+	if filter.VendorID != nil {
+		query = query.Where("vendor_id = ?", *filter.VendorID)
+	}
+	if filter.Currency != "" {
+		query = query.Where("UPPER(currency) = ?", strings.ToUpper(filter.Currency))
+	}
+	if filter.MinAmount != nil {
+		query = query.Where("total_amount >= ?", *filter.MinAmount)
+	}
+	if filter.MaxAmount != nil {
+		query = query.Where("total_amount <= ?", *filter.MaxAmount)
+	}
+	// Invoices whose date could not be read never match a date range
+	if filter.From != "" {
+		query = query.Where("issued_on >= ? AND issued_on <> ''", filter.From)
+	}
+	if filter.To != "" {
+		query = query.Where("issued_on <= ? AND issued_on <> ''", filter.To)
+	}
+	if filter.Approved != nil && *filter.Approved {
+		query = query.Where("approved_at IS NOT NULL")
+	} else if filter.Approved != nil {
+		query = query.Where("approved_at IS NULL")
+	}
+	return query
+}
+
+// withAssociations preloads the vendor, and line items, documents and duplicate
+// flags in a stable order
+func withAssociations(query *gorm.DB) *gorm.DB {
+	return query.Preload("Vendor").Preload("LineItems", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("id")
+	}).Preload("Documents", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("page, id")
+	}).Preload("Duplicates", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("id")
+	})
+}
+
+// List uses keyset pagination: it continues after the last row of the previous
+// page, using the ID to break ties between equal sort values
+func (r *gormInvoiceRepository) List(ctx context.Context, filter InvoiceFilter, page InvoicePage) ([]Invoice, bool, error) {
+	column, ok := invoiceSortColumns[page.SortKey]
+	if !ok {
+		return nil, false, fmt.Errorf("unknown sort key %q", page.SortKey)
+	}
+	direction, comparison := "ASC", ">"
+	if page.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	query := r.filtered(ctx, filter)
+	if page.After != nil {
+		query = query.Where(
+			fmt.Sprintf("((%s %s ?) OR (%s = ? AND id %s ?))", column, comparison, column, comparison),
+			page.After.Value, page.After.Value, page.After.ID,
+		)
+	}
+
+	var invoices []Invoice
+	err := query.Preload("Vendor").Preload("LineItems", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("id")
+	}).
+		Order(fmt.Sprintf("%s %s, id %s", column, direction, direction)).
+		Limit(page.Limit + 1).
+		Find(&invoices).Error
+	if err != nil {
+		return nil, false, err
+	}
+	if len(invoices) > page.Limit {
+		return invoices[:page.Limit], true, nil
+	}
+	return invoices, false, nil
+}
+
+// Each loads the invoices in batches so large exports don't hold them all in memory
+func (r *gormInvoiceRepository) Each(ctx context.Context, filter InvoiceFilter, fn func(Invoice) error) error {
+	var invoices []Invoice
+	return withAssociations(r.filtered(ctx, filter)).Order("id").FindInBatches(&invoices, 500, func(tx *gorm.DB, batch int) error {
+		for _, invoice := range invoices {
+			if err := fn(invoice); err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+// Get loads an invoice with its line items, documents and duplicate flags
+func (r *gormInvoiceRepository) Get(ctx context.Context, id uint) (*Invoice, error) {
+	var invoice Invoice
+	err := withAssociations(r.db.WithContext(ctx)).First(&invoice, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvoiceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// Create inserts the invoice, its line items, documents and duplicate flags in
+// one transaction. The vendor is only referenced, never written.
+func (r *gormInvoiceRepository) Create(ctx context.Context, invoice *Invoice) error {
+	return r.db.WithContext(ctx).Omit("Vendor").Create(invoice).Error
+}
+
+// Update saves the invoice and, if asked, replaces its line items in one transaction
+func (r *gormInvoiceRepository) Update(ctx context.Context, invoice *Invoice, replaceLineItems bool) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Select("*") writes zero values too, and unlike Save never falls back to an insert
+		result := tx.Model(invoice).Select("*").Omit("Vendor", "LineItems", "Documents", "Duplicates").Updates(invoice)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvoiceNotFound
+		}
+		if !replaceLineItems {
+			return nil
+		}
+
+		if err := tx.Where("invoice_id = ?", invoice.ID).Delete(&LineItem{}).Error; err != nil {
+			return err
+		}
+		for i := range invoice.LineItems {
+			invoice.LineItems[i].ID = 0
+			invoice.LineItems[i].InvoiceID = invoice.ID
+		}
+		if len(invoice.LineItems) == 0 {
+			return nil
+		}
+		return tx.Create(&invoice.LineItems).Error
+	})
+}
+
+// Delete looks the invoice up first so line items and flags are only deleted
+// for an invoice of the context's organization
+func (r *gormInvoiceRepository) Delete(ctx context.Context, id uint) error {
+	var invoice Invoice
+	err := r.db.WithContext(ctx).Select("id").First(&invoice, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrInvoiceNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Flags naming the invoice as the original go with it
+		if err := tx.Where("original_id = ?", invoice.ID).Delete(&InvoiceDuplicate{}).Error; err != nil {
+			return err
+		}
+		return tx.Select("LineItems", "Duplicates").Delete(&invoice).Error
+	})
+}
+
+// SimilarImages compares the hash with every stored one. Hamming distance can't
+// be indexed portably, but the hashes are small and are read in batches.
+func (r *gormInvoiceRepository) SimilarImages(ctx context.Context, hash string, maxDistance int) (map[uint]int, error) {
+	similar := make(map[uint]int)
+	var invoices []Invoice
+	err := r.db.WithContext(ctx).Select("id", "image_hash").Where("image_hash <> ''").
+		FindInBatches(&invoices, 1000, func(tx *gorm.DB, batch int) error {
+			for _, invoice := range invoices {
+				if distance := hashDistance(hash, invoice.ImageHash); distance >= 0 && distance <= maxDistance {
+					similar[invoice.ID] = distance
+				}
+			}
+			return nil
+		}).Error
+	return similar, err
+}
+
+// ListDuplicates loads the flags with both invoices
+func (r *gormInvoiceRepository) ListDuplicates(ctx context.Context, status string) ([]InvoiceDuplicate, error) {
+	var duplicates []InvoiceDuplicate
+	err := r.db.WithContext(ctx).Preload("Invoice").Preload("Original").
+		Where("status = ?", status).Order("id").Find(&duplicates).Error
+	if err != nil {
+		return nil, err
+	}
+	// Flags are deleted with their invoices, so both should always be there
+	return slices.DeleteFunc(duplicates, func(duplicate InvoiceDuplicate) bool {
+		return duplicate.Invoice == nil || duplicate.Original == nil
+	}), nil
+}
+
+// ReviewDuplicate records the review on the flag
+func (r *gormInvoiceRepository) ReviewDuplicate(ctx context.Context, id uint, status, reviewer string) (*InvoiceDuplicate, error) {
+	var duplicate InvoiceDuplicate
+	err := r.db.WithContext(ctx).First(&duplicate, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDuplicateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	duplicate.Status, duplicate.ReviewedAt, duplicate.ReviewedBy = status, &now, reviewer
+	err = r.db.WithContext(ctx).Model(&duplicate).Select("status", "reviewed_at", "reviewed_by").Updates(&duplicate).Error
+	if err != nil {
+		return nil, err
+	}
+	return &duplicate, nil
+}
+
+// AssignVendor links the unassigned invoices in one statement
+func (r *gormInvoiceRepository) AssignVendor(ctx context.Context, vendorNames []string, vendor Vendor) (int64, error) {
+	if len(vendorNames) == 0 {
+		return 0, nil
+	}
+	result := r.db.WithContext(ctx).Model(&Invoice{}).
+		Where("vendor_id IS NULL AND vendor_name IN ?", vendorNames).
+		Updates(map[string]interface{}{
+			"vendor_id": vendor.ID,
+			"gl_code":   gorm.Expr("CASE WHEN gl_code = '' THEN ? ELSE gl_code END", vendor.DefaultGLCode),
+		})
+	return result.RowsAffected, result.Error
+}
+
+// backfillIssuedOn fills in the normalized date of invoices saved before it
+// existed. It is the Go step of the migration that added it, so it runs once,
+// across organizations and on the table as it was at that version.
+func backfillIssuedOn(tx *gorm.DB) error {
+	var invoices []struct {
+		ID   uint
+		Date string
+	}
+	if err := tx.Table("invoices").Select("id", "date").Where("issued_on = '' AND date <> ''").Find(&invoices).Error; err != nil {
+		return err
+	}
+	for _, invoice := range invoices {
+		if issuedOn := normalizeInvoiceDate(invoice.Date); issuedOn != "" {
+			if err := tx.Table("invoices").Where("id = ?", invoice.ID).Update("issued_on", issuedOn).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryInvoiceRepository keeps invoices in memory. It behaves like the SQL
+// repository, including tenant scoping, so handlers can be tested without a
+// database.
+type memoryInvoiceRepository struct {
+	mu              sync.Mutex
+	invoices        map[uint]Invoice
+	nextID          uint
+	nextDuplicateID uint
+}
+
+// newMemoryInvoiceRepository returns an empty in-memory repository
+func newMemoryInvoiceRepository() *memoryInvoiceRepository {
+	return &memoryInvoiceRepository{invoices: make(map[uint]Invoice), nextID: 1, nextDuplicateID: 1}
+}
+
+// copyInvoice returns an invoice that shares no slices with the original
+func copyInvoice(invoice Invoice) Invoice {
+	invoice.LineItems = slices.Clone(invoice.LineItems)
+	invoice.Documents = slices.Clone(invoice.Documents)
+	invoice.CorrectedFields = slices.Clone(invoice.CorrectedFields)
+	invoice.Duplicates = slices.Clone(invoice.Duplicates)
+	return invoice
+}
+
+// visible reports whether the context's organization may see the invoice
+func visible(ctx context.Context, invoice Invoice) bool {
+	orgID, ok := tenantFromContext(ctx)
+	return !ok || invoice.OrganizationID == orgID
+}
+
+// matches reports whether an invoice passes the filter, with the same
+// semantics as the SQL conditions
+func (f InvoiceFilter) matches(invoice Invoice) bool {
+	for _, word := range strings.Fields(strings.ToLower(f.Query)) {
+		if !strings.Contains(strings.ToLower(invoice.InvoiceNumber), word) &&
+			!strings.Contains(strings.ToLower(invoice.VendorName), word) {
+			return false
+		}
+	}
+	switch {
+	case f.Vendor != "" && !strings.EqualFold(invoice.VendorName, f.Vendor),
+		f.VendorID != nil && (invoice.VendorID == nil || *invoice.VendorID != *f.VendorID),
+		f.Currency != "" && !strings.EqualFold(invoice.Currency, f.Currency),
+		f.MinAmount != nil && invoice.TotalAmount < *f.MinAmount,
+		f.MaxAmount != nil && invoice.TotalAmount > *f.MaxAmount,
+		f.From != "" && (invoice.IssuedOn == "" || invoice.IssuedOn < f.From),
+		f.To != "" && (invoice.IssuedOn == "" || invoice.IssuedOn > f.To),
+		f.Approved != nil && *f.Approved != (invoice.ApprovedAt != nil):
+		return false
+	}
+	return true
+}
+
+// compareSortValues orders two sort values, which are numbers or strings
+// depending on the sort key. Cursor values come back from JSON as float64.
+func compareSortValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case string:
+		s, _ := b.(string)
+		return strings.Compare(a, s)
+	default:
+		return cmp.Compare(toFloat(a), toFloat(b))
+	}
+}
+
+// toFloat converts a numeric sort value
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case uint:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// matching returns copies of the visible invoices passing the filter, in ID order
+func (r *memoryInvoiceRepository) matching(ctx context.Context, filter InvoiceFilter) []Invoice {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var invoices []Invoice
+	for _, invoice := range r.invoices {
+		if visible(ctx, invoice) && filter.matches(invoice) {
+			invoices = append(invoices, copyInvoice(invoice))
+		}
+	}
+	slices.SortFunc(invoices, func(a, b Invoice) int { return cmp.Compare(a.ID, b.ID) })
+	return invoices
+}
+
+// List sorts and pages the matching invoices the way the SQL repository does
+func (r *memoryInvoiceRepository) List(ctx context.Context, filter InvoiceFilter, page InvoicePage) ([]Invoice, bool, error) {
+	if _, ok := invoiceSortColumns[page.SortKey]; !ok {
+		return nil, false, fmt.Errorf("unknown sort key %q", page.SortKey)
+	}
+	order := func(a, b Invoice) int {
+		c := cmp.Or(compareSortValues(invoiceSortValue(a, page.SortKey), invoiceSortValue(b, page.SortKey)), cmp.Compare(a.ID, b.ID))
+		if page.Descending {
+			return -c
+		}
+		return c
+	}
+
+	invoices := r.matching(ctx, filter)
+	slices.SortFunc(invoices, order)
+	if page.After != nil {
+		invoices = slices.DeleteFunc(invoices, func(invoice Invoice) bool {
+			c := cmp.Or(compareSortValues(invoiceSortValue(invoice, page.SortKey), page.After.Value), cmp.Compare(invoice.ID, page.After.ID))
+			if page.Descending {
+				return c >= 0
+			}
+			return c <= 0
+		})
+	}
+	for i := range invoices {
+		invoices[i].Documents, invoices[i].Duplicates = nil, nil
+	}
+	if len(invoices) > page.Limit {
+		return invoices[:page.Limit], true, nil
+	}
+	return invoices, false, nil
+}
+
+// Each calls fn on a snapshot, so fn may use the repository
+func (r *memoryInvoiceRepository) Each(ctx context.Context, filter InvoiceFilter, fn func(Invoice) error) error {
+	for _, invoice := range r.matching(ctx, filter) {
+		if err := fn(invoice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns a copy of the invoice
+func (r *memoryInvoiceRepository) Get(ctx context.Context, id uint) (*Invoice, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	invoice, ok := r.invoices[id]
+	if !ok || !visible(ctx, invoice) {
+		return nil, ErrInvoiceNotFound
+	}
+	invoice = copyInvoice(invoice)
+	return &invoice, nil
+}
+
+// Create assigns IDs and timestamps and stamps the context's organization, as
+// the database and the tenant callbacks would
+func (r *memoryInvoiceRepository) Create(ctx context.Context, invoice *Invoice) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if orgID, ok := tenantFromContext(ctx); ok {
+		invoice.OrganizationID = orgID
+	}
+	now := time.Now()
+	invoice.ID = r.nextID
+	r.nextID++
+	invoice.CreatedAt, invoice.UpdatedAt = now, now
+	invoice.IssuedOn = normalizeInvoiceDate(invoice.Date)
+	for i := range invoice.LineItems {
+		invoice.LineItems[i].ID = uint(i + 1)
+		invoice.LineItems[i].InvoiceID = invoice.ID
+	}
+	for i := range invoice.Documents {
+		invoice.Documents[i].ID = uint(i + 1)
+		invoice.Documents[i].InvoiceID = invoice.ID
+		invoice.Documents[i].OrganizationID = invoice.OrganizationID
+	}
+	for i := range invoice.Duplicates {
+		invoice.Duplicates[i].ID = r.nextDuplicateID
+		r.nextDuplicateID++
+		invoice.Duplicates[i].InvoiceID = invoice.ID
+		invoice.Duplicates[i].OrganizationID = invoice.OrganizationID
+		invoice.Duplicates[i].CreatedAt, invoice.Duplicates[i].UpdatedAt = now, now
+	}
+	r.invoices[invoice.ID] = copyInvoice(*invoice)
+	return nil
+}
+
+// Update replaces the stored fields; documents and duplicate flags are kept as they were
+func (r *memoryInvoiceRepository) Update(ctx context.Context, invoice *Invoice, replaceLineItems bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.invoices[invoice.ID]
+	if !ok || !visible(ctx, stored) {
+		return ErrInvoiceNotFound
+	}
+	invoice.UpdatedAt = time.Now()
+	invoice.IssuedOn = normalizeInvoiceDate(invoice.Date)
+	if replaceLineItems {
+		for i := range invoice.LineItems {
+			invoice.LineItems[i].ID = uint(i + 1)
+			invoice.LineItems[i].InvoiceID = invoice.ID
+		}
+	}
+
+	updated := copyInvoice(*invoice)
+	updated.OrganizationID, updated.CreatedAt = stored.OrganizationID, stored.CreatedAt
+	updated.Documents, updated.Duplicates = stored.Documents, stored.Duplicates
+	if !replaceLineItems {
+		updated.LineItems = stored.LineItems
+	}
+	r.invoices[invoice.ID] = updated
+	return nil
+}
+
+// Delete removes the invoice and the flags naming it as the original
+func (r *memoryInvoiceRepository) Delete(ctx context.Context, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	invoice, ok := r.invoices[id]
+	if !ok || !visible(ctx, invoice) {
+		return ErrInvoiceNotFound
+	}
+	delete(r.invoices, id)
+	for otherID, other := range r.invoices {
+		other.Duplicates = slices.DeleteFunc(slices.Clone(other.Duplicates), func(duplicate InvoiceDuplicate) bool {
+			return duplicate.OriginalID == id
+		})
+		r.invoices[otherID] = other
+	}
+	return nil
+}
+
+// SimilarImages compares the hash with those of the visible invoices
+func (r *memoryInvoiceRepository) SimilarImages(ctx context.Context, hash string, maxDistance int) (map[uint]int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	similar := make(map[uint]int)
+	for _, invoice := range r.invoices {
+		if !visible(ctx, invoice) || invoice.ImageHash == "" {
+			continue
+		}
+		if distance := hashDistance(hash, invoice.ImageHash); distance >= 0 && distance <= maxDistance {
+			similar[invoice.ID] = distance
+		}
+	}
+	return similar, nil
+}
+
+// ListDuplicates collects the flags of the visible invoices
+func (r *memoryInvoiceRepository) ListDuplicates(ctx context.Context, status string) ([]InvoiceDuplicate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Listed invoices come without associations, as from the SQL repository
+	bare := func(invoice Invoice) *Invoice {
+		invoice.LineItems, invoice.Documents, invoice.Duplicates = nil, nil, nil
+		invoice.CorrectedFields = slices.Clone(invoice.CorrectedFields)
+		return &invoice
+	}
+
+	var duplicates []InvoiceDuplicate
+	for _, invoice := range r.invoices {
+		if !visible(ctx, invoice) {
+			continue
+		}
+		for _, duplicate := range invoice.Duplicates {
+			original, ok := r.invoices[duplicate.OriginalID]
+			if duplicate.Status != status || !ok {
+				continue
+			}
+			duplicate.Invoice, duplicate.Original = bare(invoice), bare(original)
+			duplicates = append(duplicates, duplicate)
+		}
+	}
+	slices.SortFunc(duplicates, func(a, b InvoiceDuplicate) int { return cmp.Compare(a.ID, b.ID) })
+	return duplicates, nil
+}
+
+// ReviewDuplicate records the review on the stored flag
+func (r *memoryInvoiceRepository) ReviewDuplicate(ctx context.Context, id uint, status, reviewer string) (*InvoiceDuplicate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for invoiceID, invoice := range r.invoices {
+		if !visible(ctx, invoice) {
+			continue
+		}
+		for i, duplicate := range invoice.Duplicates {
+			if duplicate.ID != id {
+				continue
+			}
+			now := time.Now()
+			duplicate.Status, duplicate.ReviewedAt, duplicate.ReviewedBy = status, &now, reviewer
+			duplicate.UpdatedAt = now
+			invoice.Duplicates = slices.Clone(invoice.Duplicates)
+			invoice.Duplicates[i] = duplicate
+			r.invoices[invoiceID] = invoice
+			return &duplicate, nil
+		}
+	}
+	return nil, ErrDuplicateNotFound
+}
+
+// AssignVendor links the matching unassigned invoices
+func (r *memoryInvoiceRepository) AssignVendor(ctx context.Context, vendorNames []string, vendor Vendor) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var linked int64
+	for id, invoice := range r.invoices {
+		if !visible(ctx, invoice) || invoice.VendorID != nil || !slices.Contains(vendorNames, invoice.VendorName) {
+			continue
+		}
+		vendor := vendor
+		invoice.VendorID, invoice.Vendor = &vendor.ID, &vendor
+		if invoice.GLCode == "" {
+			invoice.GLCode = vendor.DefaultGLCode
+		}
+		invoice.UpdatedAt = time.Now()
+		r.invoices[id] = invoice
+		linked++
+	}
+	return linked, nil
+}
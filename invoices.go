@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"scan-in/pkg/storage"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Page sizes for invoice listings
+const (
+	defaultInvoicePageSize = 50
+	maxInvoicePageSize     = 200
+)
+
+// invoiceSortColumns maps the sort keys accepted by the list endpoint to columns.
+// Every column is NOT NULL so it can be used for keyset pagination.
+var invoiceSortColumns = map[string]string{
+	"created_at":     "id",
+	"date":           "issued_on",
+	"total_amount":   "total_amount",
+	"vendor_name":    "vendor_name",
+	"invoice_number": "invoice_number",
+}
+
+// invoiceDateLayouts are the date formats the extractor recognises, most common first.
+// Ambiguous numeric dates such as 03/04/2024 are read month first.
+var invoiceDateLayouts = []string{
+	"2006-01-02", "2006/01/02", "2006.01.02",
+	"1/2/2006", "1-2-2006", "1.2.2006",
+	"2/1/2006", "2-1-2006", "2.1.2006",
+	"1/2/06", "1-2-06", "1.2.06",
+	"Jan 2 2006", "January 2 2006", "Jan 2 06",
+	"2 Jan 2006", "2 January 2006", "2 Jan 06",
+}
+
+// normalizeInvoiceDate converts an extracted date to YYYY-MM-DD, or returns an
+// empty string if it is not in a recognised format
+func normalizeInvoiceDate(date string) string {
+	// Drop commas and the dot of abbreviated months, as in "Jan. 5, 2024"
+	fields := strings.Fields(strings.ReplaceAll(date, ",", " "))
+	for i, field := range fields {
+		fields[i] = strings.TrimSuffix(field, ".")
+	}
+	date = strings.Join(fields, " ")
+
+	for _, layout := range invoiceDateLayouts {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t.Format("2006-01-02")
+		}
+	}
+	return ""
+}
+
+// BeforeSave keeps the normalized date in step with the extracted one
+func (i *Invoice) BeforeSave(tx *gorm.DB) error {
+	i.IssuedOn = normalizeInvoiceDate(i.Date)
+	return nil
+}
+
+// invoiceCursor marks the last invoice of a page in the sort order it was
+// listed in. The sort is recorded so a cursor is never applied to another
+// order, where its value could be of the wrong type for the column.
+type invoiceCursor struct {
+	Sort  string      `json:"s"` // the sort parameter, with its - for descending
+	Value interface{} `json:"v"`
+	ID    uint        `json:"id"`
+}
+
+// invoiceSortValue returns the value an invoice is sorted by for a sort key
+func invoiceSortValue(invoice Invoice, sortKey string) interface{} {
+	switch sortKey {
+	case "date":
+		return invoice.IssuedOn
+	case "total_amount":
+		return invoice.TotalAmount
+	case "vendor_name":
+		return invoice.VendorName
+	case "invoice_number":
+		return invoice.InvoiceNumber
+	}
+	return invoice.ID
+}
+
+// encodeCursor returns the opaque cursor for the page after invoice in the
+// order of the sort parameter
+func encodeCursor(invoice Invoice, sort string) string {
+	value := invoiceSortValue(invoice, strings.TrimPrefix(sort, "-"))
+	data, _ := json.Marshal(invoiceCursor{Sort: sort, Value: value, ID: invoice.ID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// errCursorSort is returned for a cursor of another sort order
+var errCursorSort = errors.New("cursor belongs to another sort order")
+
+// decodeCursor parses a cursor returned by encodeCursor for the same sort
+// parameter, checking its value has the type the sort key's column holds
+func decodeCursor(cursor, sort string) (*invoiceCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var decoded invoiceCursor
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	if decoded.Sort != sort {
+		return nil, errCursorSort
+	}
+
+	_, wantString := invoiceSortValue(Invoice{}, strings.TrimPrefix(sort, "-")).(string)
+	switch decoded.Value.(type) {
+	case string:
+		if !wantString {
+			return nil, errors.New("cursor value is not a number")
+		}
+	case float64:
+		if wantString {
+			return nil, errors.New("cursor value is not a string")
+		}
+	default:
+		return nil, errors.New("cursor value is missing")
+	}
+	return &decoded, nil
+}
+
+// invoiceHandlers serves the invoice, scan and vendor review endpoints and runs
+// the scan workers. Everything it stores, reads or notifies goes through the
+// dependencies it is given, so tests can substitute fakes for any of them.
+type invoiceHandlers struct {
+	invoices InvoiceRepository
+	vendors  VendorRepository
+	jobs     ScanJobRepository
+	ocr      OCRService
+	blobs    storage.BlobStore
+	urls     *urlSigner
+	usage    UsageMeter
+	webhooks WebhookEmitter
+	queue    chan uint     // IDs of stored scan jobs waiting for a worker
+	events   *scanEventHub // progress of running scan jobs
+	instance string        // owner of the leases this process holds on scan jobs
+}
+
+// newInvoiceHandlers returns handlers backed by the given storage and services.
+// Scan jobs are handed to the workers through queue and report their progress
+// to events.
+func newInvoiceHandlers(invoices InvoiceRepository, vendors VendorRepository, jobs ScanJobRepository, ocr OCRService,
+	blobs storage.BlobStore, urls *urlSigner, usage UsageMeter, webhooks WebhookEmitter,
+	queue chan uint, events *scanEventHub) *invoiceHandlers {
+	return &invoiceHandlers{
+		invoices: invoices,
+		vendors:  vendors,
+		jobs:     jobs,
+		ocr:      ocr,
+		blobs:    blobs,
+		urls:     urls,
+		usage:    usage,
+		webhooks: webhooks,
+		queue:    queue,
+		events:   events,
+		instance: scanInstanceID(),
+	}
+}
+
+// invoiceFilter reads the search and filter query parameters shared by the
+// list, export and re-extraction endpoints. It responds with an error and
+// returns false if a parameter is malformed.
+func invoiceFilter(c *gin.Context) (InvoiceFilter, bool) {
+	filter, fieldErr := parseInvoiceFilter(c.Request.URL.Query())
+	if fieldErr != nil {
+		respondInvalidParameter(c, fieldErr.Field, fieldErr.Message)
+		return filter, false
+	}
+	return filter, true
+}
+
+// invoiceID reads the invoice ID path parameter, responding 404 if it is not one
+func invoiceID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		respondError(c, 404, ErrCodeNotFound, "Invoice not found")
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// loadInvoice fetches the invoice named by the path, responding with an error
+// and returning nil if there is none
+func (h *invoiceHandlers) loadInvoice(c *gin.Context) *Invoice {
+	id, ok := invoiceID(c)
+	if !ok {
+		return nil
+	}
+	invoice, err := h.invoices.Get(tenantContext(c), id)
+	if errors.Is(err, ErrInvoiceNotFound) {
+		respondError(c, 404, ErrCodeNotFound, "Invoice not found")
+		return nil
+	}
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to load invoice")
+		return nil
+	}
+	return invoice
+}
+
+// list returns one page of invoices. Query parameters:
+//
+//	q                   search invoice number and vendor name
+//	vendor, currency    exact match, case-insensitive
+//	min_amount, max_amount
+//	from, to            invoice date range, YYYY-MM-DD, inclusive
+//	approved            true or false
+//	sort                created_at, date, total_amount, vendor_name or invoice_number;
+//	                    prefix with - for descending (default -created_at)
+//	limit, cursor       page size and the next_cursor of the previous page
+func (h *invoiceHandlers) list(c *gin.Context) {
+	filter, ok := invoiceFilter(c)
+	if !ok {
+		return
+	}
+
+	sortKey := c.DefaultQuery("sort", "-created_at")
+	page := InvoicePage{SortKey: strings.TrimPrefix(sortKey, "-"), Descending: strings.HasPrefix(sortKey, "-")}
+	if _, ok := invoiceSortColumns[page.SortKey]; !ok {
+		respondInvalidParameter(c, "sort", "must be one of created_at, date, total_amount, vendor_name or invoice_number, optionally prefixed with -")
+		return
+	}
+
+	page.Limit = defaultInvoicePageSize
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			respondInvalidParameter(c, "limit", "must be a positive integer")
+			return
+		}
+		page.Limit = min(n, maxInvoicePageSize)
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		after, err := decodeCursor(cursor, sortKey)
+		if errors.Is(err, errCursorSort) {
+			respondInvalidParameter(c, "cursor", "was returned for another sort; list again without a cursor after changing sort")
+			return
+		}
+		if err != nil {
+			respondInvalidParameter(c, "cursor", "must be a next_cursor returned by a previous page")
+			return
+		}
+		page.After = after
+	}
+
+	invoices, more, err := h.invoices.List(tenantContext(c), filter, page)
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to list invoices")
+		return
+	}
+
+	var nextCursor string
+	if more {
+		nextCursor = encodeCursor(invoices[len(invoices)-1], sortKey)
+	}
+	c.JSON(200, InvoiceListDTO{Invoices: toInvoiceDTOs(invoices), NextCursor: nextCursor})
+}
+
+// markCorrected records that a person set a field, so re-extraction leaves it alone
+func (i *Invoice) markCorrected(field string) {
+	if !slices.Contains(i.CorrectedFields, field) {
+		i.CorrectedFields = append(i.CorrectedFields, field)
+	}
+}
+
+// escapeLike escapes the LIKE wildcards in a search term
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// get returns a single invoice with its line items
+func (h *invoiceHandlers) get(c *gin.Context) {
+	invoice := h.loadInvoice(c)
+	if invoice == nil {
+		return
+	}
+	c.JSON(200, toInvoiceDTO(*invoice))
+}
+
+// invoiceUpdate holds the fields of an invoice a client may correct. Omitted
+// fields are left unchanged; line_items, if present, replaces all line items.
+type invoiceUpdate struct {
+	InvoiceNumber *string           `json:"invoice_number" binding:"omitempty,max=100"`
+	Date          *string           `json:"date" binding:"omitempty,max=50"`
+	TotalAmount   *float64          `json:"total_amount"`
+	Currency      *string           `json:"currency" binding:"omitempty,len=3,alpha"`
+	VendorName    *string           `json:"vendor_name" binding:"omitempty,max=200"`
+	GLCode        *string           `json:"gl_code" binding:"omitempty,max=50"`
+	LineItems     *[]lineItemUpdate `json:"line_items" binding:"omitempty,max=1000,dive"`
+}
+
+// lineItemUpdate is one line item in an invoice update
+type lineItemUpdate struct {
+	Page        int     `json:"page" binding:"gte=0"`
+	Description string  `json:"description" binding:"required,max=500"`
+	Amount      float64 `json:"amount"`
+}
+
+// update applies corrections to an invoice. Correcting a field the approval
+// covers withdraws the invoice's approval.
+func (h *invoiceHandlers) update(c *gin.Context) {
+	invoice := h.loadInvoice(c)
+	if invoice == nil {
+		return
+	}
+
+	var update invoiceUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	// financial records whether a field the approval covers actually changed
+	financial := false
+	if update.InvoiceNumber != nil {
+		financial = financial || invoice.InvoiceNumber != *update.InvoiceNumber
+		invoice.InvoiceNumber = *update.InvoiceNumber
+		invoice.markCorrected("invoice_number")
+	}
+	if update.Date != nil {
+		financial = financial || invoice.Date != *update.Date
+		invoice.Date = *update.Date
+		invoice.markCorrected("date")
+	}
+	if update.TotalAmount != nil {
+		financial = financial || invoice.TotalAmount != *update.TotalAmount
+		invoice.TotalAmount = *update.TotalAmount
+		invoice.markCorrected("total_amount")
+	}
+	if update.Currency != nil {
+		financial = financial || invoice.Currency != strings.ToUpper(*update.Currency)
+		invoice.Currency = strings.ToUpper(*update.Currency)
+		invoice.markCorrected("currency")
+	}
+	if update.VendorName != nil {
+		financial = financial || invoice.VendorName != *update.VendorName
+		invoice.VendorName = *update.VendorName
+		invoice.markCorrected("vendor_name")
+	}
+	// The GL code is never extracted, so setting it is not a correction
+	if update.GLCode != nil {
+		invoice.GLCode = *update.GLCode
+	}
+	if update.LineItems != nil {
+		items := make([]LineItem, 0, len(*update.LineItems))
+		for _, item := range *update.LineItems {
+			items = append(items, LineItem{
+				Page:        item.Page,
+				Description: item.Description,
+				Amount:      item.Amount,
+			})
+		}
+		financial = financial || !sameLineItems(invoice.LineItems, items)
+		invoice.LineItems = items
+		invoice.markCorrected("line_items")
+	}
+
+	// Changing what was approved for payment withdraws the approval, so the
+	// invoice has to be approved again by someone allowed to
+	if financial && invoice.ApprovedAt != nil {
+		log.Printf("Invoice %d changed by %s after %s approved it; approval withdrawn", invoice.ID, currentActor(c), invoice.ApprovedBy)
+		invoice.ApprovedAt = nil
+		invoice.ApprovedBy = ""
+	}
+
+	if err := h.invoices.Update(tenantContext(c), invoice, update.LineItems != nil); err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to update invoice")
+		return
+	}
+
+	h.webhooks.Emit(invoice.OrganizationID, EventInvoiceCorrected, toInvoiceDTO(*invoice))
+	c.JSON(200, toInvoiceDTO(*invoice))
+}
+
+// sameLineItems reports whether two lists hold the same line items in the same order
+func sameLineItems(a, b []LineItem) bool {
+	return slices.EqualFunc(a, b, func(x, y LineItem) bool {
+		return x.Page == y.Page && x.Description == y.Description && x.Amount == y.Amount
+	})
+}
+
+// delete removes an invoice and its line items
+func (h *invoiceHandlers) delete(c *gin.Context) {
+	id, ok := invoiceID(c)
+	if !ok {
+		return
+	}
+
+	err := h.invoices.Delete(tenantContext(c), id)
+	if errors.Is(err, ErrInvoiceNotFound) {
+		respondError(c, 404, ErrCodeNotFound, "Invoice not found")
+		return
+	}
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to delete invoice")
+		return
+	}
+	c.Status(204)
+}
+
+// approve marks an invoice as approved for payment
+func (h *invoiceHandlers) approve(c *gin.Context) {
+	invoice := h.loadInvoice(c)
+	if invoice == nil {
+		return
+	}
+
+	if invoice.ApprovedAt == nil {
+		// A flagged invoice can't be paid until the flag is dismissed
+		for _, duplicate := range invoice.Duplicates {
+			switch duplicate.Status {
+			case DuplicateConfirmed:
+				respondError(c, 409, ErrCodeConflict, fmt.Sprintf("Invoice is a confirmed duplicate of invoice %d", duplicate.OriginalID))
+				return
+			case DuplicatePending:
+				respondError(c, 409, ErrCodeConflict, fmt.Sprintf("Invoice may duplicate invoice %d; confirm or dismiss duplicate %d first", duplicate.OriginalID, duplicate.ID))
+				return
+			}
+		}
+
+		now := time.Now()
+		invoice.ApprovedAt = &now
+		invoice.ApprovedBy = currentActor(c)
+		if err := h.invoices.Update(tenantContext(c), invoice, false); err != nil {
+			respondError(c, 500, ErrCodeInternal, "Failed to approve invoice")
+			return
+		}
+		log.Printf("Invoice %d approved by %s", invoice.ID, invoice.ApprovedBy)
+		h.webhooks.Emit(invoice.OrganizationID, EventInvoiceApproved, toInvoiceDTO(*invoice))
+	}
+
+	c.JSON(200, toInvoiceDTO(*invoice))
+}
+
+// export streams the invoices matching the list filters as CSV
+func (h *invoiceHandlers) export(c *gin.Context) {
+	filter, ok := invoiceFilter(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="invoices-%s.csv"`, time.Now().Format("2006-01-02")))
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "invoice_number", "date", "issued_on", "vendor_name", "total_amount", "currency", "page_count", "approved_at", "approved_by", "created_at", "vendor", "gl_code"})
+
+	written := 0
+	err := h.invoices.Each(tenantContext(c), filter, func(invoice Invoice) error {
+		approvedAt := ""
+		if invoice.ApprovedAt != nil {
+			approvedAt = invoice.ApprovedAt.UTC().Format(time.RFC3339)
+		}
+		vendor := ""
+		if invoice.Vendor != nil {
+			vendor = invoice.Vendor.Name
+		}
+		w.Write([]string{
+			strconv.FormatUint(uint64(invoice.ID), 10),
+			csvSafe(invoice.InvoiceNumber),
+			csvSafe(invoice.Date),
+			invoice.IssuedOn,
+			csvSafe(invoice.VendorName),
+			strconv.FormatFloat(invoice.TotalAmount, 'f', 2, 64),
+			csvSafe(invoice.Currency),
+			strconv.Itoa(invoice.PageCount),
+			approvedAt,
+			csvSafe(invoice.ApprovedBy),
+			invoice.CreatedAt.UTC().Format(time.RFC3339),
+			csvSafe(vendor),
+			csvSafe(invoice.GLCode),
+		})
+		// Flush every 500 rows so large exports stream
+		if written++; written%500 == 0 {
+			w.Flush()
+		}
+		return w.Error()
+	})
+	if err != nil {
+		// Headers are already sent, so all we can do is stop and log
+		log.Printf("Warning: Invoice export failed: %v", err)
+	}
+	w.Flush()
+}
+
+// csvSafe stops spreadsheet programs from treating OCR'd text as a formula
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// decode unmarshals a recorded JSON response, failing the test on a bad status
+func decode(t testing.TB, w *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status %d, want %d: %s", w.Code, status, w.Body)
+	}
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode %s: %v", w.Body, err)
+	}
+}
+
+// scanInvoice uploads one page and returns the stored invoice
+func scanInvoice(t testing.TB, h *testHandlers, orgID uint, page []byte) InvoiceDTO {
+	t.Helper()
+	var result ScanResultDTO
+	w := serve(h.testRouter(orgID), multipartRequest(t, "/scan-invoice", upload{"invoice", "invoice.png", page}))
+	decode(t, w, 200, &result)
+	return result.Invoice
+}
+
+func TestScanStoresInvoice(t *testing.T) {
+	h := newTestHandlers(t)
+	h.ocrService.page(800, invoiceText("Acme Corp", "100234", "03/05/2024", 250)...)
+
+	var result ScanResultDTO
+	w := serve(h.testRouter(1), multipartRequest(t, "/scan-invoice", upload{"invoice", "march.png", testPage(t, 800, 1)}))
+	decode(t, w, 200, &result)
+
+	invoice := result.Invoice
+	if invoice.ID == 0 || invoice.InvoiceNumber != "100234" || invoice.TotalAmount != 250 {
+		t.Errorf("scanned invoice %d %q %.2f, want 100234 for 250.00", invoice.ID, invoice.InvoiceNumber, invoice.TotalAmount)
+	}
+	if invoice.PageCount != 1 || len(result.ProcessedImageURLs) != 1 || !slices.Equal(result.Formats, []string{"png"}) {
+		t.Errorf("scan result has %d pages, image URLs %v, formats %v", invoice.PageCount, result.ProcessedImageURLs, result.Formats)
+	}
+	if got := h.ocrService.calls; got != 1 {
+		t.Errorf("OCR called %d times, want 1", got)
+	}
+
+	// Kept in the repository for the organization, with its documents in the blob store
+	stored, err := h.invoiceRepo.Get(withTenant(t.Context(), 1), invoice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, document := range stored.Documents {
+		kinds = append(kinds, document.Kind)
+		if _, _, err := h.store.Get(t.Context(), document.BlobKey); err != nil {
+			t.Errorf("%s document %s not in the blob store: %v", document.Kind, document.BlobKey, err)
+		}
+	}
+	if !slices.Equal(kinds, []string{DocumentOriginal, DocumentProcessed, DocumentOCR}) {
+		t.Errorf("document kinds %v", kinds)
+	}
+
+	// The vendor is unknown, so it goes on the review list
+	entries, _ := h.vendorRepo.ListUnmatched(withTenant(t.Context(), 1))
+	if len(entries) != 1 || !slices.Equal(entries[0].Names, []string{invoice.VendorName}) {
+		t.Errorf("review list %+v, want the scanned vendor %q", entries, invoice.VendorName)
+	}
+	if types := h.events.types(); !slices.Equal(types, []string{EventInvoiceScanned}) {
+		t.Errorf("events %v, want %s", types, EventInvoiceScanned)
+	}
+}
+
+func TestScanResolvesVendor(t *testing.T) {
+	h := newTestHandlers(t)
+	h.vendorRepo.vendors = []Vendor{{OrganizationID: 1, Name: "Acme Corp", DefaultGLCode: "6100", DefaultCurrency: "EUR"}}
+	h.vendorRepo.vendors[0].ID = 7
+	h.ocrService.page(800, "ACME C0RP", "Invoice Number: 100234", "Invoice Date: 2024-03-05", "Total: 250.00")
+
+	invoice := scanInvoice(t, h, 1, testPage(t, 800, 1))
+	if invoice.Vendor == nil || invoice.Vendor.ID != 7 || invoice.GLCode != "6100" || invoice.Currency != "EUR" {
+		t.Errorf("invoice vendor %+v, GL code %q, currency %q; want vendor 7 and its defaults", invoice.Vendor, invoice.GLCode, invoice.Currency)
+	}
+	if entries, _ := h.vendorRepo.ListUnmatched(t.Context()); len(entries) != 0 {
+		t.Errorf("resolved vendor put on the review list: %+v", entries)
+	}
+}
+
+func TestScanErrors(t *testing.T) {
+	h := newTestHandlers(t)
+
+	w := serve(h.testRouter(1), multipartRequest(t, "/scan-invoice"))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), ErrCodeNoFile) {
+		t.Errorf("scan without a file: %d %s", w.Code, w.Body)
+	}
+
+	w = serve(h.testRouter(1), multipartRequest(t, "/scan-invoice", upload{"invoice", "notes.txt", []byte("not an image")}))
+	if w.Code != 500 || !strings.Contains(w.Body.String(), ErrCodeScanFailed) {
+		t.Errorf("scan of a text file: %d %s", w.Code, w.Body)
+	}
+
+	// A PDF that cannot be read fails before anything reaches OCR
+	pdf := []byte("%PDF-1.7\n1 0 obj << /Type /Catalog >> endobj\n%%EOF\n")
+	w = serve(h.testRouter(1), multipartRequest(t, "/scan-invoice", upload{"invoice", "invoice.pdf", pdf}))
+	if w.Code != 500 || !strings.Contains(w.Body.String(), ErrCodeScanFailed) {
+		t.Errorf("scan of a broken PDF: %d %s", w.Code, w.Body)
+	}
+	if h.ocrService.calls != 0 {
+		t.Errorf("unreadable files reached OCR %d times", h.ocrService.calls)
+	}
+
+	h.ocrService.err = fmt.Errorf("service unavailable")
+	w = serve(h.testRouter(1), multipartRequest(t, "/scan-invoice", upload{"invoice", "invoice.png", testPage(t, 800, 1)}))
+	if w.Code != 500 || !strings.Contains(w.Body.String(), ErrCodeScanFailed) {
+		t.Errorf("scan with OCR down: %d %s", w.Code, w.Body)
+	}
+	h.ocrService.err = nil
+
+	h.invoices = failingInvoiceRepository{h.invoiceRepo}
+	w = serve(h.testRouter(1), multipartRequest(t, "/scan-invoice", upload{"invoice", "invoice.png", testPage(t, 800, 1)}))
+	if w.Code != 500 || !strings.Contains(w.Body.String(), ErrCodeInternal) {
+		t.Errorf("scan with the repository failing: %d %s", w.Code, w.Body)
+	}
+
+	// Every scan that failed is reported, requests refused up front are not
+	want := []string{EventScanFailed, EventScanFailed, EventScanFailed, EventScanFailed}
+	if types := h.events.types(); !slices.Equal(types, want) {
+		t.Fatalf("events emitted for failed scans: %v, want %v", types, want)
+	}
+	failure, ok := h.events.events[2].Data.(ScanFailureDTO)
+	if !ok || !slices.Equal(failure.Filenames, []string{"invoice.png"}) || failure.ErrorMessage == "" || h.events.events[2].OrgID != 1 {
+		t.Errorf("scan.failed for OCR down: %d %+v", h.events.events[2].OrgID, h.events.events[2].Data)
+	}
+}
+
+func TestSplitScan(t *testing.T) {
+	h := newTestHandlers(t)
+	h.ocrService.page(800, invoiceText("Acme Corp", "100234", "03/05/2024", 250)...)
+	h.ocrService.page(810, "Terms and conditions apply", "Page 2 of 2")
+	h.ocrService.page(820, invoiceText("Globex Corporation", "778899", "03/06/2024", 99.5)...)
+
+	req := multipartRequest(t, "/split-scan",
+		upload{"pages", "1.png", testPage(t, 800, 1)},
+		upload{"pages", "2.png", testPage(t, 810, 2)},
+		upload{"pages", "3.png", testPage(t, 820, 3)})
+	var result SplitScanResultDTO
+	decode(t, serve(h.testRouter(1), req), 200, &result)
+
+	if len(result.Invoices) != 2 || len(result.ProcessedImageURLs) != 3 {
+		t.Fatalf("split into %d invoices with %d images, want 2 with 3", len(result.Invoices), len(result.ProcessedImageURLs))
+	}
+	first, second := result.Invoices[0], result.Invoices[1]
+	if first.InvoiceNumber != "100234" || first.StartPage != 1 || first.EndPage != 2 {
+		t.Errorf("first invoice %s on pages %d-%d", first.InvoiceNumber, first.StartPage, first.EndPage)
+	}
+	if second.InvoiceNumber != "778899" || second.StartPage != 3 || second.EndPage != 3 {
+		t.Errorf("second invoice %s on pages %d-%d", second.InvoiceNumber, second.StartPage, second.EndPage)
+	}
+
+	// The scanner's single PDF of the stack splits the same way
+	pdf := testPDF(t, testPage(t, 800, 1), testPage(t, 810, 2), testPage(t, 820, 3))
+	decode(t, serve(h.testRouter(1), multipartRequest(t, "/split-scan", upload{"pages", "stack.pdf", pdf})), 200, &result)
+	if len(result.Invoices) != 2 || len(result.ProcessedImageURLs) != 3 || !slices.Equal(result.Formats, []string{"pdf"}) {
+		t.Fatalf("PDF split into %d invoices with %d images from %v", len(result.Invoices), len(result.ProcessedImageURLs), result.Formats)
+	}
+	first, second = result.Invoices[0], result.Invoices[1]
+	if first.StartPage != 1 || first.EndPage != 2 || second.StartPage != 3 || second.EndPage != 3 {
+		t.Errorf("PDF invoices on pages %d-%d and %d-%d", first.StartPage, first.EndPage, second.StartPage, second.EndPage)
+	}
+}
+
+func TestInvoiceCRUD(t *testing.T) {
+	h := newTestHandlers(t)
+	h.ocrService.page(800, invoiceText("Acme Corp", "100234", "03/05/2024", 250)...)
+	invoice := scanInvoice(t, h, 1, testPage(t, 800, 1))
+	r := h.testRouter(1)
+	path := fmt.Sprintf("/api/invoices/%d", invoice.ID)
+
+	var list InvoiceListDTO
+	decode(t, serve(r, httptest.NewRequest("GET", "/api/invoices?q=100234", nil)), 200, &list)
+	if len(list.Invoices) != 1 || list.Invoices[0].ID != invoice.ID {
+		t.Errorf("search found %+v", list.Invoices)
+	}
+
+	var got InvoiceDTO
+	decode(t, serve(r, httptest.NewRequest("GET", path, nil)), 200, &got)
+	if got.InvoiceNumber != "100234" || len(got.Documents) != 3 {
+		t.Errorf("get returned %s with %d documents", got.InvoiceNumber, len(got.Documents))
+	}
+
+	// Documents download from the blob store
+	for _, document := range got.Documents {
+		w := serve(r, httptest.NewRequest("GET", fmt.Sprintf("%s/documents/%d", path, document.ID), nil))
+		if w.Code != 200 || int64(w.Body.Len()) != document.Size || w.Header().Get("Content-Type") != document.ContentType {
+			t.Errorf("%s document: %d, %d bytes of %s", document.Kind, w.Code, w.Body.Len(), w.Header().Get("Content-Type"))
+		}
+	}
+	if w := serve(r, httptest.NewRequest("GET", path+"/documents/999", nil)); w.Code != 404 {
+		t.Errorf("unknown document: %d", w.Code)
+	}
+
+	req := httptest.NewRequest("PATCH", path, bytes.NewBufferString(`{"total_amount": 275, "gl_code": "6200"}`))
+	req.Header.Set("Content-Type", "application/json")
+	decode(t, serve(r, req), 200, &got)
+	if got.TotalAmount != 275 || got.GLCode != "6200" || !slices.Equal(got.CorrectedFields, []string{"total_amount"}) {
+		t.Errorf("updated invoice %.2f %q corrected %v", got.TotalAmount, got.GLCode, got.CorrectedFields)
+	}
+
+	req = httptest.NewRequest("PATCH", path, bytes.NewBufferString(`{"currency": "euro"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if w := serve(r, req); w.Code != 422 {
+		t.Errorf("invalid currency: %d %s", w.Code, w.Body)
+	}
+
+	decode(t, serve(r, httptest.NewRequest("POST", path+"/approve", nil)), 200, &got)
+	if got.ApprovedAt == nil || got.ApprovedBy != "clerk@org1.test" {
+		t.Errorf("approved at %v by %q", got.ApprovedAt, got.ApprovedBy)
+	}
+
+	want := []string{EventInvoiceScanned, EventInvoiceCorrected, EventInvoiceApproved}
+	if types := h.events.types(); !slices.Equal(types, want) {
+		t.Errorf("events %v, want %v", types, want)
+	}
+
+	if w := serve(r, httptest.NewRequest("DELETE", path, nil)); w.Code != 204 {
+		t.Errorf("delete: %d %s", w.Code, w.Body)
+	}
+	if w := serve(r, httptest.NewRequest("GET", path, nil)); w.Code != 404 {
+		t.Errorf("get after delete: %d", w.Code)
+	}
+	if w := serve(r, httptest.NewRequest("DELETE", path, nil)); w.Code != 404 {
+		t.Errorf("second delete: %d", w.Code)
+	}
+}
+
+func TestCorrectionWithdrawsApproval(t *testing.T) {
+	h := newTestHandlers(t)
+	h.ocrService.page(800, invoiceText("Acme Corp", "100234", "03/05/2024", 250)...)
+	invoice := scanInvoice(t, h, 1, testPage(t, 800, 1))
+	r := h.testRouter(1)
+	path := fmt.Sprintf("/api/invoices/%d", invoice.ID)
+
+	patch := func(body string) InvoiceDTO {
+		t.Helper()
+		req := httptest.NewRequest("PATCH", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		var got InvoiceDTO
+		decode(t, serve(r, req), 200, &got)
+		return got
+	}
+
+	for _, tc := range []struct {
+		body      string
+		withdrawn bool
+	}{
+		{`{"gl_code": "6200"}`, false},
+		{`{"total_amount": 250, "vendor_name": "Acme Corp"}`, false},
+		{`{"total_amount": 2500}`, true},
+		{`{"vendor_name": "Acme Holdings"}`, true},
+		{`{"currency": "eur"}`, true},
+		{`{"line_items": [{"page": 1, "description": "Consulting", "amount": 2500}]}`, true},
+	} {
+		var approved InvoiceDTO
+		decode(t, serve(r, httptest.NewRequest("POST", path+"/approve", nil)), 200, &approved)
+		if approved.ApprovedAt == nil {
+			t.Fatalf("%s: not approved", tc.body)
+		}
+
+		got := patch(tc.body)
+		if withdrawn := got.ApprovedAt == nil && got.ApprovedBy == ""; withdrawn != tc.withdrawn {
+			t.Errorf("%s: approved at %v by %q, want withdrawn %v", tc.body, got.ApprovedAt, got.ApprovedBy, tc.withdrawn)
+		}
+		decode(t, serve(r, httptest.NewRequest("GET", path, nil)), 200, &got)
+		if withdrawn := got.ApprovedAt == nil; withdrawn != tc.withdrawn {
+			t.Errorf("%s: stored approval %v, want withdrawn %v", tc.body, got.ApprovedAt, tc.withdrawn)
+		}
+	}
+}
+
+func TestInvoicesOfOtherOrganizationsAreNotFound(t *testing.T) {
+	h := newTestHandlers(t)
+	h.ocrService.page(800, invoiceText("Acme Corp", "100234", "03/05/2024", 250)...)
+	invoice := scanInvoice(t, h, 1, testPage(t, 800, 1))
+	path := fmt.Sprintf("/api/invoices/%d", invoice.ID)
+	other := h.testRouter(2)
+
+	var list InvoiceListDTO
+	decode(t, serve(other, httptest.NewRequest("GET", "/api/invoices", nil)), 200, &list)
+	if len(list.Invoices) != 0 {
+		t.Errorf("other organization lists %d invoices", len(list.Invoices))
+	}
+	for _, req := range []*httptest.ResponseRecorder{
+		serve(other, httptest.NewRequest("GET", path, nil)),
+		serve(other, httptest.NewRequest("PATCH", path, bytes.NewBufferString(`{"gl_code": "1"}`))),
+		serve(other, httptest.NewRequest("POST", path+"/approve", nil)),
+		serve(other, httptest.NewRequest("GET", path+"/documents/1", nil)),
+		serve(other, httptest.NewRequest("DELETE", path, nil)),
+	} {
+		if req.Code != 404 {
+			t.Errorf("other organization got %d: %s", req.Code, req.Body)
+		}
+	}
+	if _, err := h.invoiceRepo.Get(withTenant(t.Context(), 1), invoice.ID); err != nil {
+		t.Errorf("invoice gone after the other organization's requests: %v", err)
+	}
+}
+
+func TestInvoiceListCursor(t *testing.T) {
+	for _, repository := range duplicateRepositories {
+		t.Run(repository.name, func(t *testing.T) {
+			h := newTestHandlers(t)
+			h.invoices = repository.open(t)
+			r := h.testRouter(1)
+			for _, vendor := range []string{"Initech", "Acme Corp", "Umbrella", "Globex", "Hooli"} {
+				invoice := Invoice{VendorName: vendor, InvoiceNumber: "INV-" + vendor}
+				if err := h.invoices.Create(withTenant(t.Context(), 1), &invoice); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Pages follow one another in the sort order
+			var vendors []string
+			var byID InvoiceListDTO
+			path := "/api/invoices?sort=vendor_name&limit=2"
+			for path != "" {
+				var list InvoiceListDTO
+				decode(t, serve(r, httptest.NewRequest("GET", path, nil)), 200, &list)
+				for _, invoice := range list.Invoices {
+					vendors = append(vendors, invoice.VendorName)
+				}
+				path = ""
+				if list.NextCursor != "" {
+					path = "/api/invoices?sort=vendor_name&limit=2&cursor=" + list.NextCursor
+				}
+			}
+			if want := []string{"Acme Corp", "Globex", "Hooli", "Initech", "Umbrella"}; !slices.Equal(vendors, want) {
+				t.Errorf("paged through %v, want %v", vendors, want)
+			}
+
+			// A cursor only continues the sort it was returned for
+			decode(t, serve(r, httptest.NewRequest("GET", "/api/invoices?limit=2", nil)), 200, &byID)
+			for _, path := range []string{
+				"/api/invoices?sort=vendor_name&cursor=" + byID.NextCursor,
+				"/api/invoices?sort=created_at&cursor=" + byID.NextCursor,
+				"/api/invoices?sort=-vendor_name&cursor=" + encodeCursor(Invoice{VendorName: "Globex"}, "vendor_name"),
+				"/api/invoices?sort=vendor_name&cursor=" + base64.RawURLEncoding.EncodeToString([]byte(`{"s":"vendor_name","v":3,"id":3}`)),
+				"/api/invoices?cursor=" + base64.RawURLEncoding.EncodeToString([]byte(`{"s":"-created_at","v":"3","id":3}`)),
+				"/api/invoices?cursor=not-a-cursor",
+			} {
+				w := serve(r, httptest.NewRequest("GET", path, nil))
+				if w.Code != 400 || !strings.Contains(w.Body.String(), ErrCodeInvalidParameter) {
+					t.Errorf("%s: %d %s", path, w.Code, w.Body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// testServer is the full router on a test database, with the real auth
+// middleware in front of the handlers
+type testServer struct {
+	*testHandlers
+	auth            *authHandlers
+	webhookHandlers *webhookHandlers
+	router          *gin.Engine
+	db              *gorm.DB
+}
+
+// newTestServer returns the app's router on a fresh database with two
+// organizations, 1 and 2
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	conn := openTestDB(t)
+	h := newTestHandlers(t)
+	h.invoices = newGormInvoiceRepository(conn)
+	h.vendors = newGormVendorRepository(conn)
+	h.jobs = newGormScanJobRepository(conn)
+	h.usage = newGormUsageMeter(conn)
+
+	auth := newAuthHandlers(newGormOrganizationRepository(conn), newGormAPIKeyRepository(conn), newGormUserRepository(conn), h.usage)
+	webhooks := newWebhookHandlers(newGormWebhookRepository(conn))
+
+	for _, name := range []string{"Acme", "Globex"} {
+		if err := conn.Create(&Organization{Name: name, Slug: slugify(name)}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &testServer{
+		testHandlers:    h,
+		auth:            auth,
+		webhookHandlers: webhooks,
+		router:          newRouter(h.invoiceHandlers, auth, webhooks),
+		db:              conn,
+	}
+}
+
+// issueKey stores an API key of the organization with the scopes and returns
+// it with its ID
+func (s *testServer) issueKey(t *testing.T, orgID uint, scopes ...string) (string, uint) {
+	t.Helper()
+	return s.storeKey(t, APIKey{
+		OrganizationID:     orgID,
+		Name:               fmt.Sprintf("org %d %v", orgID, scopes),
+		Scopes:             scopes,
+		RateLimitPerMinute: 6000,
+		RateLimitBurst:     1000,
+	})
+}
+
+// storeKey stores the API key with a new secret and returns the secret with
+// the key's ID
+func (s *testServer) storeKey(t *testing.T, apiKey APIKey) (string, uint) {
+	t.Helper()
+	key, err := generateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKey.Prefix, apiKey.Hash = keyDisplayPrefix(key), hashToken(key)
+	if err := s.db.Create(&apiKey).Error; err != nil {
+		t.Fatal(err)
+	}
+	return key, apiKey.ID
+}
+
+// call serves a request made with the API key, or without one if key is empty
+func (s *testServer) call(key string, req *http.Request) *httptest.ResponseRecorder {
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	return serve(s.router, req)
+}
+
+// request builds a request with an optional JSON body
+func request(method, path, body string) *http.Request {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req
+}
+
+func TestOrganizationsAreIsolated(t *testing.T) {
+	s := newTestServer(t)
+	acme, _ := s.issueKey(t, 1, ScopeAdmin)
+	globex, _ := s.issueKey(t, 2, ScopeAdmin)
+	s.ocrService.page(800, invoiceText("Initech", "100234", "03/05/2024", 250)...)
+
+	var scanned ScanResultDTO
+	decode(t, s.call(acme, multipartRequest(t, "/scan-invoice", upload{"invoice", "invoice.png", testPage(t, 800, 1)})), 200, &scanned)
+	invoice := scanned.Invoice
+	if len(invoice.Documents) == 0 || scanned.ProcessedImageURL == "" {
+		t.Fatalf("scan stored documents %+v and image %q", invoice.Documents, scanned.ProcessedImageURL)
+	}
+	var job ScanJobDTO
+	decode(t, s.call(acme, multipartRequest(t, "/api/scans", upload{"invoice", "queued.png", testPage(t, 800, 1)})), 202, &job)
+	var batch BatchDTO
+	decode(t, s.call(acme, multipartRequest(t, "/api/batches", upload{"invoices", "batched.png", testPage(t, 800, 1)})), 202, &batch)
+
+	invoicePath := fmt.Sprintf("/api/invoices/%d", invoice.ID)
+	owned := []*http.Request{
+		request("GET", invoicePath, ""),
+		request("PATCH", invoicePath, `{"vendor_name": "Hijacked"}`),
+		request("POST", invoicePath+"/approve", ""),
+		request("GET", invoice.Documents[0].URL, ""),
+		request("GET", job.URL, ""),
+		request("GET", job.EventsURL, ""),
+		request("GET", batch.URL, ""),
+		request("DELETE", invoicePath, ""),
+	}
+	for _, req := range owned {
+		if w := s.call(globex, req); w.Code != 404 {
+			t.Errorf("%s %s by another organization: %d %s", req.Method, req.URL.Path, w.Code, w.Body)
+		}
+	}
+
+	var list InvoiceListDTO
+	decode(t, s.call(globex, request("GET", "/api/invoices", "")), 200, &list)
+	if len(list.Invoices) != 0 {
+		t.Errorf("another organization lists %+v", list.Invoices)
+	}
+	decode(t, s.call(acme, request("GET", "/api/invoices", "")), 200, &list)
+	if len(list.Invoices) != 1 || list.Invoices[0].VendorName != invoice.VendorName {
+		t.Errorf("owner lists %+v after the other organization's attempts", list.Invoices)
+	}
+
+	// Signed file URLs need a caller, and one of the organization they were issued to
+	if w := s.call("", request("GET", scanned.ProcessedImageURL, "")); w.Code != 401 {
+		t.Errorf("file URL without credentials: %d", w.Code)
+	}
+	if w := s.call(globex, request("GET", scanned.ProcessedImageURL, "")); w.Code != 403 {
+		t.Errorf("file URL fetched by another organization: %d", w.Code)
+	}
+	if w := s.call(acme, request("GET", scanned.ProcessedImageURL, "")); w.Code != 200 {
+		t.Errorf("file URL fetched by its organization: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestAPIKeysAreIsolated(t *testing.T) {
+	s := newTestServer(t)
+	acme, acmeID := s.issueKey(t, 1, ScopeAdmin)
+	reader, _ := s.issueKey(t, 1, ScopeRead)
+	globex, globexID := s.issueKey(t, 2, ScopeAdmin)
+
+	var keys APIKeyListDTO
+	decode(t, s.call(globex, request("GET", "/api/admin/keys", "")), 200, &keys)
+	if len(keys.Keys) != 1 || keys.Keys[0].ID != globexID {
+		t.Errorf("another organization lists keys %+v", keys.Keys)
+	}
+
+	// Keys of another organization can be neither revoked nor reached through
+	// organization_id, which only platform keys may use
+	if w := s.call(globex, request("DELETE", fmt.Sprintf("/api/admin/keys/%d", acmeID), "")); w.Code != 404 {
+		t.Errorf("revoking another organization's key: %d %s", w.Code, w.Body)
+	}
+	if w := s.call(globex, request("GET", "/api/admin/keys?organization_id=1", "")); w.Code != 403 {
+		t.Errorf("listing another organization's keys by organization_id: %d", w.Code)
+	}
+	if w := s.call(globex, request("POST", "/api/admin/keys?organization_id=1", `{"name": "planted", "scopes": ["read"]}`)); w.Code != 403 {
+		t.Errorf("issuing a key in another organization: %d", w.Code)
+	}
+
+	// A key issued by an admin belongs to the admin's organization
+	var created APIKeyCreatedDTO
+	decode(t, s.call(globex, request("POST", "/api/admin/keys", `{"name": "reports", "scopes": ["read"]}`)), 201, &created)
+	var stored APIKey
+	if err := s.db.First(&stored, created.ID).Error; err != nil || stored.OrganizationID != 2 {
+		t.Errorf("issued key belongs to organization %d, %v", stored.OrganizationID, err)
+	}
+
+	decode(t, s.call(acme, request("GET", "/api/admin/keys", "")), 200, &keys)
+	if len(keys.Keys) != 2 || keys.Keys[0].ID != acmeID || keys.Keys[0].RevokedAt != nil {
+		t.Errorf("owner lists keys %+v", keys.Keys)
+	}
+	if w := s.call(reader, request("GET", "/api/invoices", "")); w.Code != 200 {
+		t.Errorf("key of the organization after the other's attempts: %d", w.Code)
+	}
+}
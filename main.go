@@ -3,41 +3,72 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	_ "image/png"
 	"io"
+	"io/fs"
 	"log"
 	"math"
+	"mime/multipart"
+	"net/http"
 	"os"
-	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"image/color"
 
+	"scan-in/pkg/imageio"
+	"scan-in/pkg/layout"
+	"scan-in/pkg/services/ocr"
+	"scan-in/pkg/storage"
+
 	"github.com/Azure/azure-sdk-for-go/services/cognitiveservices/v3.0/computervision"
-	"github.com/Azure/go-autorest/autorest"
 	"github.com/disintegration/imaging"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
 type Invoice struct {
 	gorm.Model
-	InvoiceNumber string
-	Date          string
-	TotalAmount   float64
-	Currency      string
-	VendorName    string
+	OrganizationID  uint `gorm:"index"`
+	InvoiceNumber   string
+	Date            string
+	IssuedOn        string `gorm:"index;not null;default:''"` // Date as YYYY-MM-DD, empty if it could not be parsed
+	TotalAmount     float64
+	Currency        string
+	VendorName      string // as scanned
+	VendorID        *uint  `gorm:"index"` // the vendor the name resolved to, if any
+	Vendor          *Vendor
+	GLCode          string `gorm:"not null;default:''"` // general ledger account, from the vendor's default
+	PageCount       int
+	StartPage       int // first page of this invoice within the uploaded scan
+	EndPage         int // last page of this invoice within the uploaded scan
+	LineItems       []LineItem
+	Documents       []InvoiceDocument // originals, processed images and OCR output
+	ApprovedAt      *time.Time
+	ApprovedBy      string             // user email or API key name that approved the invoice
+	CorrectedFields []string           `gorm:"serializer:json"`      // fields set by hand, which re-extraction must keep
+	ImageHash       string             `gorm:"not null;default:''"`  // perceptual hash of the first page, see imageHash
+	Duplicates      []InvoiceDuplicate `gorm:"foreignKey:InvoiceID"` // earlier invoices this one may duplicate
 }
 
-var db *gorm.DB
+// LineItem is a single billed row of an invoice, tagged with the page it was read from
+type LineItem struct {
+	gorm.Model
+	InvoiceID   uint
+	Page        int
+	Description string
+	Amount      float64
+}
 
 // DocumentSection represents a logical section of the document
 type DocumentSection struct {
@@ -48,25 +79,94 @@ type DocumentSection struct {
 }
 
 func main() {
-	// Load environment variables
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
+	// Load environment variables; without a .env file they come from the environment
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatalf("Error loading .env file: %v", err)
 	}
 
 	// Set up database connection
-	dbURL := os.Getenv("DATABASE_URL")
-	db, err = gorm.Open(postgres.Open(dbURL), &gorm.Config{})
-	if err != nil {
-		log.Fatal("Failed to connect to database")
+	db := openDatabase()
+	registerTenantCallbacks(db)
+
+	// The schema is changed only by "scan-in migrate"; everything else needs it current
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrateCommand(db, os.Args[2:])
+		return
 	}
+	requireCurrentSchema(db)
+
+	blobs := openBlobStore()
+	removeLegacyStaticImages()
+
+	invoiceRepo := newGormInvoiceRepository(db)
+	webhookRepo := newGormWebhookRepository(db)
+	usage := newGormUsageMeter(db)
+	auth := newAuthHandlers(newGormOrganizationRepository(db), newGormAPIKeyRepository(db), newGormUserRepository(db), usage)
+	webhooks := newWebhookHandlers(webhookRepo)
+	invoices := newInvoiceHandlers(
+		invoiceRepo,
+		newGormVendorRepository(db),
+		newGormScanJobRepository(db),
+		ocr.NewService(os.Getenv("AZURE_ENDPOINT"), os.Getenv("AZURE_API_KEY")),
+		blobs,
+		loadURLSigner(),
+		usage,
+		newQueuedWebhookEmitter(webhookRepo),
+		make(chan uint, scanQueueSize),
+		newScanEventHub(),
+	)
+
+	defaultOrgID := ensureDefaultOrganization(auth.orgs)
+	auth.ensureBootstrapKey(defaultOrgID)
+	auth.ensureBootstrapAdmin(defaultOrgID)
+
+	// Run a maintenance command instead of the server
+	if len(os.Args) > 1 {
+		runCommand(invoices, os.Args[1:])
+		return
+	}
+
+	r := newRouter(invoices, auth, webhooks)
 
-	// Auto migrate the schema
-	db.AutoMigrate(&Invoice{})
+	// Start the scan workers, picking up any jobs interrupted by a restart
+	invoices.startScanWorkers()
+	webhooks.startDelivery()
+
+	// Start the blob retention goroutine
+	go cleanupOldBlobs(blobs)
+	go auth.cleanupExpiredSessions()
+
+	// Start the server
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	r.Run(":" + port)
+}
+
+// trustedProxies reads the comma-separated addresses or CIDR ranges of the
+// reverse proxies in front of the server from TRUSTED_PROXIES. None are trusted
+// by default.
+func trustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
 
-	// Set up Gin router
+// newRouter sets up the pages and API routes
+func newRouter(invoices *invoiceHandlers, auth *authHandlers, webhooks *webhookHandlers) *gin.Engine {
 	r := gin.Default()
 
+	// Client addresses, which login attempts are limited by, come from
+	// X-Forwarded-For only when a trusted proxy sent the request
+	if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	// Serve static files
 	r.Static("/static", "./web/static")
 
@@ -74,150 +174,472 @@ func main() {
 	r.LoadHTMLGlob("web/templates/*")
 
 	// Define routes
-	r.GET("/", func(c *gin.Context) {
+	r.GET("/", auth.requireLogin, func(c *gin.Context) {
+		user := currentUser(c)
 		c.HTML(200, "index.html", gin.H{
 			"title": "Invoice Scanner",
+			"user":  user,
+			"can": gin.H{
+				"scan":   user.HasScope(ScopeScan),
+				"read":   user.HasScope(ScopeRead),
+				"export": user.HasScope(ScopeExport),
+			},
 		})
 	})
+	r.GET("/login", auth.showLogin)
+	r.POST("/login", auth.login)
+	r.POST("/logout", auth.logout)
+
+	scan, read, write := auth.requireScope(ScopeScan), auth.requireScope(ScopeRead), auth.requireScope(ScopeWrite)
+	approve, export := auth.requireScope(ScopeApprove), auth.requireScope(ScopeExport)
+
+	r.POST("/scan-invoice", scan, invoices.scan)
+	r.POST("/split-scan", scan, invoices.splitScan)
+	r.GET("/invoices", read, invoices.list)
+
+	r.POST("/api/scans", scan, invoices.createScanJob)
+	r.GET("/api/scans/:id", read, invoices.getScanJob)
+	r.GET("/api/scans/:id/events", read, invoices.streamScanEvents)
+	r.POST("/api/batches", scan, invoices.createBatch)
+	r.GET("/api/batches/:id", read, invoices.getBatch)
+
+	r.GET("/api/invoices", read, invoices.list)
+	r.GET("/api/invoices/export", export, invoices.export)
+	r.GET("/api/invoices/:id", read, invoices.get)
+	r.PATCH("/api/invoices/:id", write, invoices.update)
+	r.DELETE("/api/invoices/:id", write, invoices.delete)
+	r.POST("/api/invoices/:id/approve", approve, invoices.approve)
+	r.GET("/api/invoices/:id/documents/:document_id", read, invoices.getInvoiceDocument)
+	r.GET("/api/vendors", read, invoices.listVendors)
+	r.POST("/api/vendors", write, invoices.createVendor)
+	r.GET("/api/vendors/match", read, invoices.matchVendors)
+	r.GET("/api/vendors/unmatched", read, invoices.listUnmatchedVendors)
+	r.POST("/api/vendors/unmatched/:id/link", write, invoices.linkUnmatchedVendor)
+	r.DELETE("/api/vendors/unmatched/:id", write, invoices.dismissUnmatchedVendor)
+	r.GET("/api/vendors/:id", read, invoices.getVendor)
+	r.PATCH("/api/vendors/:id", write, invoices.updateVendor)
+	r.GET("/api/duplicates", read, invoices.listDuplicates)
+	r.POST("/api/duplicates/:id/confirm", approve, invoices.confirmDuplicate)
+	r.POST("/api/duplicates/:id/dismiss", approve, invoices.dismissDuplicate)
+
+	admin := r.Group("/api/admin", auth.requireScope(ScopeAdmin))
+	admin.POST("/keys", auth.createAPIKey)
+	admin.GET("/keys", auth.listAPIKeys)
+	admin.DELETE("/keys/:id", auth.revokeAPIKey)
+	admin.POST("/users", auth.createUser)
+	admin.GET("/users", auth.listUsers)
+	admin.PATCH("/users/:id", auth.updateUser)
+	admin.POST("/webhooks", webhooks.createWebhook)
+	admin.GET("/webhooks", webhooks.listWebhooks)
+	admin.DELETE("/webhooks/:id", webhooks.deleteWebhook)
+	admin.GET("/webhooks/:id/deliveries", webhooks.listWebhookDeliveries)
+	admin.POST("/webhooks/:id/deliveries/:delivery_id/redeliver", webhooks.redeliverWebhook)
+	admin.POST("/invoices/reextract", invoices.reextract)
+
+	platform := r.Group("/api/platform", auth.requireScope(ScopePlatform))
+	platform.POST("/organizations", auth.createOrganization)
+	platform.GET("/organizations", auth.listOrganizations)
+
+	r.GET("/files/*key", read, invoices.serveSignedBlob)
+	r.GET("/openapi.json", serveOpenAPI)
+
+	return r
+}
 
-	r.POST("/scan-invoice", scanInvoice)
-	r.GET("/invoices", getInvoices)
+// scan OCRs the uploaded pages of one invoice and stores it
+func (h *invoiceHandlers) scan(c *gin.Context) {
+	// Get the files from the request; each file is one page of the same document
+	uploads, ok := formUploads(c, "invoice", "No file uploaded")
+	if !ok {
+		return
+	}
+	pages := countPages(uploads)
+	if !reserveOCRQuota(c, h.usage, pages) {
+		return
+	}
 
-	// Start the image cleanup goroutine
-	go cleanupOldImages()
+	scan, err := scanPages(c.Request.Context(), h.ocr, h.blobs, uploads, nil)
+	h.usage.Record(currentAPIKeyID(c), len(scan.DisplayKeys)-pages)
+	if err != nil {
+		h.emitScanFailed(c, uploads, err.Error())
+		respondScanError(c, err)
+		return
+	}
 
-	// Start the server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Extract invoice details
+	invoice := extractInvoiceDetails(scan.TextLines)
+	invoice.PageCount = len(scan.DisplayKeys)
+	invoice.StartPage = 1
+	invoice.EndPage = len(scan.DisplayKeys)
+
+	// Debug output
+	log.Printf("Extracted Invoice Details:")
+	log.Printf("  Vendor Name: %s", invoice.VendorName)
+	log.Printf("  Invoice Number: %s", invoice.InvoiceNumber)
+	log.Printf("  Date: %s", invoice.Date)
+	log.Printf("  Amount: %.2f %s", invoice.TotalAmount, invoice.Currency)
+	log.Printf("  Pages: %d, Line Items: %d", invoice.PageCount, len(invoice.LineItems))
+
+	// Save the invoice with its vendor, documents and any duplicates it was flagged as
+	assignVendor(tenantContext(c), h.vendors, &invoice, scan.TextLines)
+	attachInvoiceDocuments(h.blobs, &invoice, uploads, scan.Pages)
+	checkDuplicates(tenantContext(c), h.invoices, &invoice, scan.Pages)
+	if err := h.invoices.Create(tenantContext(c), &invoice); err != nil {
+		log.Printf("Error saving scanned invoice: %v", err)
+		h.emitScanFailed(c, uploads, "Failed to save invoice")
+		respondError(c, 500, ErrCodeInternal, "Failed to save invoice")
+		return
 	}
-	r.Run(":" + port)
+	h.emitInvoiceScanned(invoice)
+
+	// Return the invoice data and signed URLs of the processed images
+	displayURLs := h.urls.signAll(c.GetUint(orgContextKey), scan.DisplayKeys)
+	c.JSON(200, ScanResultDTO{
+		Invoice:            toInvoiceDTO(invoice),
+		ProcessedImageURL:  displayURLs[0],
+		ProcessedImageURLs: displayURLs,
+		Formats:            scan.Formats,
+	})
 }
 
-func scanInvoice(c *gin.Context) {
-	// Get the file from the request
-	file, err := c.FormFile("invoice")
-	if err != nil {
-		c.JSON(400, gin.H{"error": "No file uploaded"})
+// splitScan handles a scanner batch holding several invoices: the pages are scanned in
+// order, split at detected document boundaries, and each invoice is stored separately
+func (h *invoiceHandlers) splitScan(c *gin.Context) {
+	uploads, ok := formUploads(c, "pages", "No pages uploaded")
+	if !ok {
+		return
+	}
+	pages := countPages(uploads)
+	if !reserveOCRQuota(c, h.usage, pages) {
 		return
 	}
 
-	// Save the uploaded file temporarily
-	tempPath := "temp-invoice.jpg"
-	if err := c.SaveUploadedFile(file, tempPath); err != nil {
-		c.JSON(500, gin.H{"error": "Failed to save file"})
+	scan, err := scanPages(c.Request.Context(), h.ocr, h.blobs, uploads, nil)
+	h.usage.Record(currentAPIKeyID(c), len(scan.DisplayKeys)-pages)
+	if err != nil {
+		h.emitScanFailed(c, uploads, err.Error())
+		respondScanError(c, err)
 		return
 	}
-	defer os.Remove(tempPath)
 
-	// Process the image to enhance it for OCR
-	processedPath, err := enhanceImageForOCR(tempPath)
+	// Extract and save one invoice per detected document
+	var invoices []Invoice
+	for _, document := range splitDocuments(scan.TextLines) {
+		invoice := extractInvoiceDetails(document.TextLines)
+		invoice.StartPage = document.StartPage
+		invoice.EndPage = document.EndPage
+		invoice.PageCount = document.EndPage - document.StartPage + 1
+
+		log.Printf("Split invoice pages %d-%d: %s %s", invoice.StartPage, invoice.EndPage, invoice.VendorName, invoice.InvoiceNumber)
+
+		assignVendor(tenantContext(c), h.vendors, &invoice, document.TextLines)
+		attachInvoiceDocuments(h.blobs, &invoice, uploads, scan.Pages)
+		// Invoices earlier in the stack are already saved, so duplicates within it are caught too
+		checkDuplicates(tenantContext(c), h.invoices, &invoice, scan.Pages)
+		if err := h.invoices.Create(tenantContext(c), &invoice); err != nil {
+			// Invoices saved before the failure are kept; the client sees the error
+			log.Printf("Error saving split invoice pages %d-%d: %v", invoice.StartPage, invoice.EndPage, err)
+			message := fmt.Sprintf("Failed to save invoice of pages %d-%d", invoice.StartPage, invoice.EndPage)
+			h.emitScanFailed(c, uploads, message)
+			respondError(c, 500, ErrCodeInternal, message)
+			return
+		}
+		h.emitInvoiceScanned(invoice)
+		invoices = append(invoices, invoice)
+	}
+
+	c.JSON(200, SplitScanResultDTO{
+		Invoices:           toInvoiceDTOs(invoices),
+		ProcessedImageURLs: h.urls.signAll(c.GetUint(orgContextKey), scan.DisplayKeys),
+		Formats:            scan.Formats,
+	})
+}
+
+// Upload is an uploaded file held in memory
+type Upload struct {
+	Filename string
+	Data     []byte
+}
+
+// maxUploadSize bounds the body of an upload request. It is a variable so tests
+// can lower it.
+var maxUploadSize int64 = 256 << 20
+
+// formUploads reads the files of a multipart field into memory. It answers 413
+// for a body over maxUploadSize and 400 when the field holds no file or a file
+// cannot be read, and then returns false.
+func formUploads(c *gin.Context, field, noFileMessage string) ([]Upload, bool) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize)
+	form, err := c.MultipartForm()
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondError(c, 413, ErrCodeInvalidUpload, fmt.Sprintf("Upload is larger than %d MB", maxUploadSize>>20))
+		return nil, false
+	}
+	if err != nil || len(form.File[field]) == 0 {
+		respondError(c, 400, ErrCodeNoFile, noFileMessage)
+		return nil, false
+	}
+
+	uploads, err := readUploads(form.File[field])
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to process image: " + err.Error()})
+		respondUploadError(c, err)
+		return nil, false
+	}
+	return uploads, true
+}
+
+// readUploads reads the uploaded files into memory, preserving their order
+func readUploads(files []*multipart.FileHeader) ([]Upload, error) {
+	var uploads []Upload
+	for _, file := range files {
+		f, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to open upload: %v", file.Filename, err)
+		}
+
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to read upload: %v", file.Filename, err)
+		}
+
+		uploads = append(uploads, Upload{Filename: file.Filename, Data: data})
+	}
+	return uploads, nil
+}
+
+// respondUploadError rejects an upload readUploads could not accept
+func respondUploadError(c *gin.Context, err error) {
+	respondError(c, 400, ErrCodeInvalidUpload, err.Error())
+}
+
+// respondScanError answers a scan that failed. A PDF without scanned pages or
+// a page too large to decode is the client's to fix, so it is told apart from
+// failures of the pipeline.
+func respondScanError(c *gin.Context, err error) {
+	if errors.Is(err, imageio.ErrUnscannedPDF) {
+		respondError(c, 415, ErrCodeUnsupportedMedia, err.Error())
 		return
 	}
-	defer os.Remove(processedPath)
+	if errors.Is(err, imageio.ErrImageTooLarge) {
+		respondError(c, 413, ErrCodeInvalidUpload, err.Error())
+		return
+	}
+	respondError(c, 500, ErrCodeScanFailed, err.Error())
+}
 
-	// Create a unique filename for the display image using a timestamp
-	timestamp := time.Now().UnixNano()
-	displayFilename := fmt.Sprintf("processed-invoice-%d.jpg", timestamp)
-	displayPath := fmt.Sprintf("web/static/img/%s", displayFilename)
+// OCRService reads the printed text of an encoded page image. *ocr.Service
+// implements it with Azure Computer Vision.
+type OCRService interface {
+	Recognize(ctx context.Context, imageData []byte) (computervision.OcrResult, error)
+}
+
+// countPages returns how many pages the uploads send to OCR: one for each TIFF
+// frame or PDF page, counted from the headers without decoding them. A file that
+// cannot be opened counts as one page; its scan fails before it reaches OCR.
+func countPages(uploads []Upload) int {
+	pages := 0
+	for _, upload := range uploads {
+		if doc, err := imageio.Open(upload.Data); err == nil {
+			pages += doc.Pages
+		} else {
+			pages++
+		}
+	}
+	return pages
+}
+
+// scanPages scans every uploaded file in order, tagging the text lines with their
+// page number. Multi-frame files such as scanner TIFFs contribute one page per frame,
+// decoded only once the page before it is scanned so that a long document is never
+// held in memory whole. It returns the lines, the blob keys of the display images
+// kept in store, the detected format of each file and the processed image and OCR
+// output of each page. progress, if not nil, is told about each step as the pages
+// move through the pipeline.
+func scanPages(ctx context.Context, recognizer OCRService, store storage.BlobStore, uploads []Upload, progress ProgressFunc) (*ScanOutput, error) {
+	if progress == nil {
+		progress = func(ScanEvent) {}
+	}
+
+	output := &ScanOutput{}
+	page := 0
+	for index, upload := range uploads {
+		doc, err := imageio.Open(upload.Data)
+		if err != nil {
+			return output, fmt.Errorf("%s: %w", upload.Filename, err)
+		}
+		output.Formats = append(output.Formats, doc.Format)
+		progress(ScanEvent{
+			Stage: ScanStatusPreprocessing,
+			Event: "decoded",
+			Detail: map[string]interface{}{
+				"filename": upload.Filename,
+				"format":   doc.Format,
+				"frames":   doc.Pages,
+			},
+		})
+
+		for i := 0; i < doc.Pages; i++ {
+			frame, err := doc.Page(i)
+			if err != nil {
+				return output, fmt.Errorf("%s: %w", upload.Filename, err)
+			}
+			page++
+			scanned, err := scanPage(ctx, recognizer, store, frame, page, progress)
+			if err != nil {
+				return output, fmt.Errorf("page %d: %v", page, err)
+			}
+			scanned.Upload = index
+			output.Pages = append(output.Pages, scanned)
+			output.TextLines = append(output.TextLines, scanned.TextLines...)
+			output.DisplayKeys = append(output.DisplayKeys, scanned.DisplayKey)
+		}
+	}
 
-	// Create a cropped version for display
-	if err := createDisplayImage(tempPath, displayPath); err != nil {
+	return output, nil
+}
+
+// scanPage enhances and OCRs a single decoded page, returning its text lines, the
+// blob key of its display image, and the processed image and raw OCR output. The
+// page is passed in memory throughout, so concurrent scans never share any files.
+func scanPage(ctx context.Context, recognizer OCRService, store storage.BlobStore, frame image.Image, page int, progress ProgressFunc) (ScannedPage, error) {
+	scanned := ScannedPage{Number: page}
+
+	// Process the image to enhance it for OCR
+	processedImg := enhanceImageForOCR(frame)
+	progress(ScanEvent{Stage: ScanStatusPreprocessing, Event: "enhanced", Page: page})
+
+	// Create a cropped version for display, and fingerprint it for duplicate detection
+	display := cropForDisplay(frame)
+	scanned.ImageHash = imageHash(display)
+	displayKey, err := createDisplayImage(store, display)
+	scanned.DisplayKey = displayKey
+	if err != nil {
 		log.Printf("Warning: Failed to create display image: %v", err)
 		// Continue processing even if display image creation fails
 	}
 
-	// Open the processed image for section detection
-	processedImg, err := imaging.Open(processedPath)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to open processed image for section detection"})
-		return
+	// Detect ruled tables and the document sections they form
+	grids := layout.DetectGrids(toGray(processedImg))
+	for _, grid := range grids {
+		log.Printf("Table %d on page %d: %dx%d cells at %v", grid.Index, page, grid.RowCount(), grid.ColCount(), grid.Bounds)
 	}
 
-	// Detect document sections
-	sections, err := detectDocumentSections(processedImg)
+	sections, err := detectDocumentSections(processedImg, grids)
 	if err != nil {
 		log.Printf("Warning: Failed to detect document sections: %v", err)
 		// Continue with regular processing
 	} else {
-		log.Printf("Detected %d document sections", len(sections))
+		log.Printf("Detected %d document sections on page %d", len(sections), page)
 		for _, section := range sections {
 			log.Printf("Section %d: Bounds=%v", section.ID, section.Bounds)
 		}
+		progress(ScanEvent{
+			Stage:  ScanStatusPreprocessing,
+			Event:  "sections_detected",
+			Page:   page,
+			Detail: map[string]interface{}{"sections": len(sections), "tables": len(grids)},
+		})
 	}
 
-	// Create the client
-	client := computervision.New(os.Getenv("AZURE_ENDPOINT"))
-	auth := autorest.NewCognitiveServicesAuthorizer(os.Getenv("AZURE_API_KEY"))
-	client.Authorizer = auth
-
-	// Read the processed image file
-	imageData, err := os.ReadFile(processedPath)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to read processed file"})
-		return
+	// Encode the processed image for upload; uploads in any format are normalized to JPEG here
+	var imageData bytes.Buffer
+	if err := imaging.Encode(&imageData, processedImg, imaging.JPEG); err != nil {
+		return scanned, fmt.Errorf("failed to encode processed image: %v", err)
 	}
-
-	// Create a ReadCloser from the image data
-	imageReader := io.NopCloser(bytes.NewReader(imageData))
+	scanned.Processed = imageData.Bytes()
 
 	// Extract text
-	result, err := client.RecognizePrintedTextInStream(
-		context.Background(),
-		true,
-		imageReader,
-		computervision.OcrLanguages(computervision.En),
-	)
+	progress(ScanEvent{Stage: ScanStatusOCR, Event: "ocr_started", Page: page})
+	result, err := recognizer.Recognize(ctx, scanned.Processed)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to extract text"})
-		return
+		log.Printf("OCR of page %d failed: %v", page, err)
+		return scanned, fmt.Errorf("failed to extract text")
+	}
+	if scanned.OCRResult, err = json.Marshal(result); err != nil {
+		log.Printf("Warning: Failed to encode OCR result of page %d: %v", page, err)
 	}
 
-	// Extract text from the OCR result
-	textLines := extractTextFromOCRResult(result)
-
-	// Extract invoice details
-	invoice := extractInvoiceDetails(textLines)
+	// Extract text from the OCR result and place each line in its table cell
+	scanned.TextLines = extractTextFromOCRResult(result, page)
+	assignTableCells(scanned.TextLines, grids)
+	progress(ScanEvent{
+		Stage:  ScanStatusOCR,
+		Event:  "ocr_done",
+		Page:   page,
+		Detail: map[string]interface{}{"lines": len(scanned.TextLines)},
+	})
 
-	// Debug output
-	log.Printf("Extracted Invoice Details:")
-	log.Printf("  Vendor Name: %s", invoice.VendorName)
-	log.Printf("  Invoice Number: %s", invoice.InvoiceNumber)
-	log.Printf("  Date: %s", invoice.Date)
-	log.Printf("  Amount: %.2f %s", invoice.TotalAmount, invoice.Currency)
+	return scanned, nil
+}
 
-	// Save the invoice to the database
-	if err := db.Create(&invoice).Error; err != nil {
-		log.Printf("Warning: Failed to save invoice to database: %v", err)
-		// Continue even if database save fails
+// assignTableCells records the ruled table cell that contains the centre of each text line
+func assignTableCells(textLines []TextLine, grids []*layout.Grid) {
+	for i := range textLines {
+		line := &textLines[i]
+		center := image.Pt(line.X+line.Width/2, line.Y+line.Height/2)
+		for _, grid := range grids {
+			if cell, ok := grid.CellAt(center); ok {
+				line.Cell = &cell
+				break
+			}
+		}
 	}
-
-	// Return the invoice data and processed image URL with the unique filename
-	c.JSON(200, gin.H{
-		"invoice":             invoice,
-		"processed_image_url": fmt.Sprintf("/static/img/%s", displayFilename),
-	})
 }
 
 // TextLine represents a line of text with its position
 type TextLine struct {
 	Text   string
+	Page   int // 1-based page number within the document
 	X      int
 	Y      int
 	Width  int
 	Height int
+	Cell   *layout.Cell // ruled table cell holding the line, nil outside tables
 }
 
-// enhanceImageForOCR enhances the image for better OCR results
-func enhanceImageForOCR(imagePath string) (string, error) {
-	// Open the image
-	src, err := imaging.Open(imagePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to open image: %v", err)
+// pageBounds returns the first and last page numbers present in the text lines
+func pageBounds(textLines []TextLine) (int, int) {
+	if len(textLines) == 0 {
+		return 0, 0
 	}
 
+	first, last := textLines[0].Page, textLines[0].Page
+	for _, line := range textLines {
+		if line.Page < first {
+			first = line.Page
+		}
+		if line.Page > last {
+			last = line.Page
+		}
+	}
+	return first, last
+}
+
+// linesOnPage returns the text lines that were read from the given page
+func linesOnPage(textLines []TextLine, page int) []TextLine {
+	var pageLines []TextLine
+	for _, line := range textLines {
+		if line.Page == page {
+			pageLines = append(pageLines, line)
+		}
+	}
+	return pageLines
+}
+
+// sortLinesByPosition orders text lines page by page, top to bottom
+func sortLinesByPosition(textLines []TextLine) {
+	sort.SliceStable(textLines, func(i, j int) bool {
+		if textLines[i].Page != textLines[j].Page {
+			return textLines[i].Page < textLines[j].Page
+		}
+		return textLines[i].Y < textLines[j].Y
+	})
+}
+
+// enhanceImageForOCR enhances the image for better OCR results
+func enhanceImageForOCR(src image.Image) *image.NRGBA {
 	// Apply a series of image processing operations to enhance the document
 	// 1. Convert to grayscale for better contrast
 	img := imaging.Grayscale(src)
@@ -234,21 +656,12 @@ func enhanceImageForOCR(imagePath string) (string, error) {
 	// 5. Apply gamma correction to enhance details
 	img = imaging.AdjustGamma(img, 1.2)
 
-	// Save the processed image
-	processedPath := "processed-invoice.jpg"
-	err = imaging.Save(img, processedPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to save processed image: %v", err)
-	}
-
-	return processedPath, nil
+	return img
 }
 
 func parseInvoiceTextWithPosition(textLines []TextLine) Invoice {
-	// Sort lines by Y position for top-to-bottom processing
-	sort.Slice(textLines, func(i, j int) bool {
-		return textLines[i].Y < textLines[j].Y
-	})
+	// Sort lines by page and Y position for top-to-bottom processing
+	sortLinesByPosition(textLines)
 
 	// Extract vendor name from the top lines (typically top left)
 	vendorName := extractVendorNameFromPosition(textLines)
@@ -257,6 +670,7 @@ func parseInvoiceTextWithPosition(textLines []TextLine) Invoice {
 	invoiceNumber := extractInvoiceNumberFromPosition(textLines)
 	date := extractDateFromPosition(textLines)
 	totalAmount, currency := extractAmountFromPosition(textLines)
+	lineItems := extractLineItems(textLines)
 
 	invoice := Invoice{
 		InvoiceNumber: invoiceNumber,
@@ -264,21 +678,23 @@ func parseInvoiceTextWithPosition(textLines []TextLine) Invoice {
 		TotalAmount:   totalAmount,
 		Currency:      currency,
 		VendorName:    vendorName,
+		LineItems:     lineItems,
 	}
 
 	return invoice
 }
 
 func extractVendorNameFromPosition(textLines []TextLine) string {
-	// Look at the top 30% of the document for vendor name
+	// Look at the top 30% of the first page for vendor name
 	if len(textLines) == 0 {
 		return "UNKNOWN"
 	}
+	firstPage, _ := pageBounds(textLines)
 
-	// Find the maximum Y value to determine document height
+	// Find the maximum Y value to determine the first page's height
 	maxY := 0
 	maxX := 0
-	for _, line := range textLines {
+	for _, line := range linesOnPage(textLines, firstPage) {
 		if line.Y > maxY {
 			maxY = line.Y
 		}
@@ -296,61 +712,17 @@ func extractVendorNameFromPosition(textLines []TextLine) string {
 	// Find lines in the top area
 	var topLines []TextLine
 	var topLeftLines []TextLine
-	var websiteDomains []string
-	var emailDomains []string
-	var domainMainParts []string // Store main parts of domains for comparison
 
-	// Extract website and email domains from the entire document
-	websiteRegex := regexp.MustCompile(`(?i)www\.([a-z0-9][-a-z0-9]*\.)+[a-z0-9][-a-z0-9]*`)
-	emailRegex := regexp.MustCompile(`(?i)@([a-z0-9][-a-z0-9]*\.)+[a-z0-9][-a-z0-9]*`)
-	domainRegex := regexp.MustCompile(`(?i)https?://([a-z0-9][-a-z0-9]*\.)+[a-z0-9][-a-z0-9]*`)
+	// Website and email domains from the entire document, and their main parts for comparison
+	domains := extractDomains(textLines)
+	var domainMainParts []string
+	for _, domain := range domains {
+		domainMainParts = append(domainMainParts, strings.Split(domain, ".")[0])
+	}
 
 	for _, line := range textLines {
-		// Extract website domains
-		websiteMatches := websiteRegex.FindAllStringSubmatch(line.Text, -1)
-		for _, match := range websiteMatches {
-			if len(match) > 0 {
-				domain := strings.TrimPrefix(match[0], "www.")
-				websiteDomains = append(websiteDomains, domain)
-
-				// Extract main part of domain
-				parts := strings.Split(domain, ".")
-				if len(parts) > 0 {
-					domainMainParts = append(domainMainParts, parts[0])
-				}
-			}
-		}
-
-		// Extract email domains
-		emailMatches := emailRegex.FindAllStringSubmatch(line.Text, -1)
-		for _, match := range emailMatches {
-			if len(match) > 1 {
-				emailDomains = append(emailDomains, match[1])
-
-				// Extract main part of domain
-				parts := strings.Split(match[1], ".")
-				if len(parts) > 0 {
-					domainMainParts = append(domainMainParts, parts[0])
-				}
-			}
-		}
-
-		// Extract domains from URLs
-		domainMatches := domainRegex.FindAllStringSubmatch(line.Text, -1)
-		for _, match := range domainMatches {
-			if len(match) > 1 {
-				websiteDomains = append(websiteDomains, match[1])
-
-				// Extract main part of domain
-				parts := strings.Split(match[1], ".")
-				if len(parts) > 0 {
-					domainMainParts = append(domainMainParts, parts[0])
-				}
-			}
-		}
-
-		// Check if the line is in the top 30%
-		if line.Y < topThreshold {
+		// Check if the line is in the top 30% of the first page
+		if line.Page == firstPage && line.Y < topThreshold {
 			topLines = append(topLines, line)
 
 			// Check if it's also in the left half
@@ -476,13 +848,10 @@ func extractVendorNameFromPosition(textLines []TextLine) string {
 	}
 
 	// If no good match found yet, try to extract from domains
-	if len(websiteDomains) > 0 || len(emailDomains) > 0 {
-		// Combine all domains
-		allDomains := append(websiteDomains, emailDomains...)
-
+	if len(domains) > 0 {
 		// Remove duplicates
 		uniqueDomains := make(map[string]bool)
-		for _, domain := range allDomains {
+		for _, domain := range domains {
 			uniqueDomains[domain] = true
 		}
 
@@ -561,6 +930,31 @@ func extractVendorNameFromPosition(textLines []TextLine) string {
 	return "UNKNOWN"
 }
 
+// extractDomains returns the website and email domains mentioned anywhere in
+// the document in the order they appear, lowercased and without "www."
+func extractDomains(textLines []TextLine) []string {
+	websiteRegex := regexp.MustCompile(`(?i)www\.(?:[a-z0-9][-a-z0-9]*\.)+[a-z0-9][-a-z0-9]*`)
+	emailRegex := regexp.MustCompile(`(?i)@((?:[a-z0-9][-a-z0-9]*\.)+[a-z0-9][-a-z0-9]*)`)
+	urlRegex := regexp.MustCompile(`(?i)https?://((?:[a-z0-9][-a-z0-9]*\.)+[a-z0-9][-a-z0-9]*)`)
+
+	var domains []string
+	add := func(domain string) {
+		domains = append(domains, strings.TrimPrefix(strings.ToLower(domain), "www."))
+	}
+	for _, line := range textLines {
+		for _, match := range websiteRegex.FindAllString(line.Text, -1) {
+			add(match)
+		}
+		for _, match := range emailRegex.FindAllStringSubmatch(line.Text, -1) {
+			add(match[1])
+		}
+		for _, match := range urlRegex.FindAllStringSubmatch(line.Text, -1) {
+			add(match[1])
+		}
+	}
+	return domains
+}
+
 func cleanTextForComparison(text string) string {
 	// Convert to lowercase
 	text = strings.ToLower(text)
@@ -640,6 +1034,11 @@ func extractInvoiceNumberFromPosition(textLines []TextLine) string {
 		const horizontalTolerance = 300 // Allow numbers to be up to 300 pixels to the right
 
 		for _, line := range textLines {
+			// Positions are only comparable on the same page
+			if line.Page != numberLine.Page {
+				continue
+			}
+
 			// Check if the line is within vertical tolerance
 			verticalDiff := line.Y - numberLine.Y
 			if verticalDiff >= -verticalTolerance && verticalDiff <= verticalTolerance {
@@ -713,19 +1112,21 @@ func extractDateFromPosition(textLines []TextLine) string {
 		}
 	}
 
-	// Find the maximum Y value to determine document height
+	// Find the maximum Y value to determine the first page's height
+	firstPage, _ := pageBounds(textLines)
+	firstPageLines := linesOnPage(textLines, firstPage)
 	maxY := 0
-	for _, line := range textLines {
+	for _, line := range firstPageLines {
 		if line.Y > maxY {
 			maxY = line.Y
 		}
 	}
 
-	// Consider lines in the top half
+	// Consider lines in the top half of the first page
 	topHalfThreshold := maxY / 2
 
 	// Check top half for dates
-	for _, line := range textLines {
+	for _, line := range firstPageLines {
 		if line.Y < topHalfThreshold {
 			for _, pattern := range patterns {
 				re := regexp.MustCompile(pattern)
@@ -807,16 +1208,25 @@ func extractAmountFromPosition(textLines []TextLine) (float64, string) {
 		currency = documentCurrency
 	}
 
-	// Find the maximum Y value to determine document height
+	// Totals are printed at the end of the document, so search from the last page backwards
+	_, lastPage := pageBounds(textLines)
+	lastPageLines := linesOnPage(textLines, lastPage)
+	linesLastPageFirst := make([]TextLine, len(textLines))
+	copy(linesLastPageFirst, textLines)
+	sort.SliceStable(linesLastPageFirst, func(i, j int) bool {
+		return linesLastPageFirst[i].Page > linesLastPageFirst[j].Page
+	})
+
+	// Find the maximum Y value to determine the last page's height
 	maxY := 0
-	for _, line := range textLines {
+	for _, line := range lastPageLines {
 		if line.Y > maxY {
 			maxY = line.Y
 		}
 	}
 
 	// First look for lines containing "total" or "amount" keywords
-	for _, line := range textLines {
+	for _, line := range linesLastPageFirst {
 		lowerText := strings.ToLower(line.Text)
 		if strings.Contains(lowerText, "total") ||
 			strings.Contains(lowerText, "amount") ||
@@ -879,12 +1289,12 @@ func extractAmountFromPosition(textLines []TextLine) (float64, string) {
 		}
 	}
 
-	// Consider lines in the bottom 30% of the document for total amounts
+	// Consider lines in the bottom 30% of the last page for total amounts
 	bottomThreshold := maxY * 7 / 10
 	var largestAmount float64
 	var largestAmountCurrency string
 
-	for _, line := range textLines {
+	for _, line := range lastPageLines {
 		if line.Y > bottomThreshold {
 			// Try patterns with currency symbols first
 			for _, pattern := range patterns {
@@ -1066,6 +1476,14 @@ func parseAmount(amountStr string) (float64, error) {
 
 // Helper function to detect the primary currency used in the document
 func detectDocumentCurrency(textLines []TextLine) string {
+	if currency := statedCurrency(textLines); currency != "" {
+		return currency
+	}
+	return "EUR" // Default to EUR if no currency is detected
+}
+
+// statedCurrency returns the currency the document mentions most, or "" if it mentions none
+func statedCurrency(textLines []TextLine) string {
 	// Count occurrences of each currency
 	currencyCount := map[string]int{
 		"USD": 0,
@@ -1103,7 +1521,7 @@ func detectDocumentCurrency(textLines []TextLine) string {
 
 	// Find the most frequent currency
 	maxCount := 0
-	mostFrequentCurrency := "EUR" // Default to EUR if no currency is detected
+	mostFrequentCurrency := ""
 
 	for currency, count := range currencyCount {
 		if count > maxCount {
@@ -1115,6 +1533,254 @@ func detectDocumentCurrency(textLines []TextLine) string {
 	return mostFrequentCurrency
 }
 
+// extractLineItems reads the billed rows between the table header and the totals,
+// continuing the table across page breaks so multi-page invoices yield one list
+func extractLineItems(textLines []TextLine) []LineItem {
+	headerKeywords := []string{"description", "item", "qty", "quantity", "unit price", "price", "amount"}
+	totalsRegex := regexp.MustCompile(`(?i)\b(sub\s*total|total|amount\s*due|balance\s*due)\b`)
+	pageMarkerRegex := regexp.MustCompile(`(?i)(page\s+\d+\s*(of|/)\s*\d+|continued)`)
+	amountRegex := regexp.MustCompile(`([\$€£])?\s*(\d{1,3}(?:[.,]\d{3})*[.,]\d{2})\s*([\$€£]|EUR|USD|GBP)?\s*$`)
+	trailingNumbersRegex := regexp.MustCompile(`(\s+[\$€£]?\d[\d.,]*)+$`)
+	letterRegex := regexp.MustCompile(`[A-Za-z]`)
+
+	var lineItems []LineItem
+	inTable := false
+
+	for _, row := range groupLinesIntoRows(textLines) {
+		lowerText := strings.ToLower(row.Text)
+
+		// Skip page footers such as "Page 1 of 3" or "Continued"
+		if pageMarkerRegex.MatchString(row.Text) {
+			continue
+		}
+
+		// A row naming several columns is the table header; it is repeated on continuation pages
+		headerMatches := 0
+		for _, keyword := range headerKeywords {
+			if strings.Contains(lowerText, keyword) {
+				headerMatches++
+			}
+		}
+		if headerMatches >= 2 {
+			inTable = true
+			continue
+		}
+
+		if !inTable {
+			continue
+		}
+
+		// The totals block ends the table
+		if totalsRegex.MatchString(row.Text) {
+			break
+		}
+
+		// A line item ends with its amount
+		loc := amountRegex.FindStringSubmatchIndex(row.Text)
+		if loc == nil {
+			continue
+		}
+		amount, err := parseAmount(row.Text[loc[4]:loc[5]])
+		if err != nil {
+			continue
+		}
+
+		// Strip quantity and unit price columns from the description
+		description := strings.TrimSpace(row.Text[:loc[0]])
+		description = strings.TrimSpace(trailingNumbersRegex.ReplaceAllString(description, ""))
+		if !letterRegex.MatchString(description) {
+			continue
+		}
+
+		lineItems = append(lineItems, LineItem{
+			Page:        row.Page,
+			Description: description,
+			Amount:      amount,
+		})
+	}
+
+	return lineItems
+}
+
+// groupLinesIntoRows merges text lines that sit on the same visual row of a page,
+// since OCR often splits a table row into separate description and amount lines.
+// Inside ruled tables the grid decides, so wrapped cell text stays in its row.
+func groupLinesIntoRows(textLines []TextLine) []TextLine {
+	sorted := make([]TextLine, len(textLines))
+	copy(sorted, textLines)
+	sortLinesByPosition(sorted)
+
+	var rows [][]TextLine
+	for _, line := range sorted {
+		if n := len(rows); n > 0 && sameRow(rows[n-1][0], line) {
+			rows[n-1] = append(rows[n-1], line)
+			continue
+		}
+		rows = append(rows, []TextLine{line})
+	}
+
+	var merged []TextLine
+	for _, row := range rows {
+		// Join the pieces left to right, keeping wrapped lines of a cell in reading order
+		sort.SliceStable(row, func(i, j int) bool {
+			if row[i].Cell != nil && row[j].Cell != nil {
+				return row[i].Cell.Col < row[j].Cell.Col
+			}
+			return row[i].X < row[j].X
+		})
+
+		texts := make([]string, 0, len(row))
+		height := 0
+		for _, line := range row {
+			texts = append(texts, line.Text)
+			height = max(height, line.Height)
+		}
+
+		last := row[len(row)-1]
+		merged = append(merged, TextLine{
+			Text:   strings.Join(texts, " "),
+			Page:   row[0].Page,
+			X:      row[0].X,
+			Y:      row[0].Y,
+			Width:  last.X + last.Width - row[0].X,
+			Height: height,
+		})
+	}
+
+	return merged
+}
+
+// sameRow reports whether two text lines belong to the same row of the page
+func sameRow(first, line TextLine) bool {
+	if first.Page != line.Page {
+		return false
+	}
+
+	// Lines in the same ruled table share a row when their cells overlap vertically
+	if first.Cell != nil && line.Cell != nil && first.Cell.Table == line.Cell.Table {
+		return line.Cell.Row < first.Cell.Row+first.Cell.RowSpan &&
+			first.Cell.Row < line.Cell.Row+line.Cell.RowSpan
+	}
+
+	tolerance := max(first.Height, line.Height) / 2
+	return line.Y-first.Y <= tolerance
+}
+
+// ScannedDocument is one invoice found within a multi-invoice scan batch
+type ScannedDocument struct {
+	StartPage int
+	EndPage   int
+	TextLines []TextLine
+}
+
+// splitDocuments groups the pages of a scan batch into separate invoices. A page starts
+// a new invoice when it carries a "Page 1 of N" marker, when the previous invoice has
+// already reached its N pages, when it shows a different invoice number, or when it
+// has an invoice header naming a different vendor. "Page k of N" markers with k > 1
+// always continue the current invoice.
+func splitDocuments(textLines []TextLine) []ScannedDocument {
+	if len(textLines) == 0 {
+		return nil
+	}
+	firstPage, lastPage := pageBounds(textLines)
+
+	var documents []ScannedDocument
+	var current *ScannedDocument
+	currentNumber := "UNKNOWN"
+	currentVendor := "UNKNOWN"
+	expectedPages := 0
+
+	for page := firstPage; page <= lastPage; page++ {
+		pageLines := linesOnPage(textLines, page)
+		if len(pageLines) == 0 && current != nil {
+			// Blank pages (e.g. empty reverse sides) stay with the current invoice
+			current.EndPage = page
+			continue
+		}
+
+		pageNumber, pageTotal, hasMarker := findPageMarker(pageLines)
+		invoiceNumber := extractInvoiceNumberFromPosition(pageLines)
+		vendorName := "UNKNOWN"
+		if hasInvoiceHeader(pageLines) {
+			vendorName = extractVendorNameFromPosition(pageLines)
+		}
+
+		startsNew := current == nil
+		if !startsNew {
+			pagesSoFar := current.EndPage - current.StartPage + 1
+			switch {
+			case hasMarker:
+				startsNew = pageNumber == 1
+			case expectedPages > 0 && pagesSoFar >= expectedPages:
+				startsNew = true
+			case invoiceNumber != "UNKNOWN" && currentNumber != "UNKNOWN" && invoiceNumber != currentNumber:
+				startsNew = true
+			case vendorName != "UNKNOWN" && currentVendor != "UNKNOWN" &&
+				cleanTextForComparison(vendorName) != cleanTextForComparison(currentVendor):
+				startsNew = true
+			}
+		}
+
+		if startsNew {
+			documents = append(documents, ScannedDocument{StartPage: page, EndPage: page})
+			current = &documents[len(documents)-1]
+			currentNumber = "UNKNOWN"
+			currentVendor = "UNKNOWN"
+			expectedPages = 0
+		}
+
+		current.EndPage = page
+		current.TextLines = append(current.TextLines, pageLines...)
+		if currentNumber == "UNKNOWN" {
+			currentNumber = invoiceNumber
+		}
+		if currentVendor == "UNKNOWN" {
+			currentVendor = vendorName
+		}
+		if hasMarker {
+			expectedPages = pageTotal
+		}
+	}
+
+	log.Printf("Split %d pages into %d invoices", lastPage-firstPage+1, len(documents))
+	return documents
+}
+
+// findPageMarker looks for a "Page k of N" style marker and returns k and N
+func findPageMarker(textLines []TextLine) (int, int, bool) {
+	markerRegex := regexp.MustCompile(`(?i)page\s*(\d+)\s*(?:of|/)\s*(\d+)`)
+	for _, line := range textLines {
+		if matches := markerRegex.FindStringSubmatch(line.Text); len(matches) > 2 {
+			pageNumber, err1 := strconv.Atoi(matches[1])
+			pageTotal, err2 := strconv.Atoi(matches[2])
+			if err1 == nil && err2 == nil && pageNumber >= 1 && pageNumber <= pageTotal {
+				return pageNumber, pageTotal, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// hasInvoiceHeader reports whether the top 30% of the page carries an invoice heading,
+// which is what separates a new vendor letterhead from a continuation page
+func hasInvoiceHeader(textLines []TextLine) bool {
+	maxY := 0
+	for _, line := range textLines {
+		if line.Y > maxY {
+			maxY = line.Y
+		}
+	}
+
+	topThreshold := maxY * 3 / 10
+	for _, line := range textLines {
+		lowerText := strings.ToLower(line.Text)
+		if line.Y < topThreshold && (strings.Contains(lowerText, "invoice") || strings.Contains(lowerText, "bill")) {
+			return true
+		}
+	}
+	return false
+}
+
 func parseInvoiceText(text string) Invoice {
 	// Convert text to lowercase for easier matching
 	text = strings.ToLower(text)
@@ -1200,20 +1866,24 @@ func extractVendorName(lines []string) string {
 	return "UNKNOWN"
 }
 
-func getInvoices(c *gin.Context) {
-	var invoices []Invoice
-	db.Find(&invoices)
-	c.JSON(200, invoices)
-}
+// createDisplayImage stores the cropped display version of the invoice in the
+// blob store and returns its key
+func createDisplayImage(store storage.BlobStore, display *image.NRGBA) (string, error) {
+	var data bytes.Buffer
+	if err := imaging.Encode(&data, display, imaging.JPEG); err != nil {
+		return "", err
+	}
 
-// createDisplayImage creates a cropped and enhanced version of the invoice for display
-func createDisplayImage(sourcePath, destPath string) error {
-	// Open the source image
-	src, err := imaging.Open(sourcePath)
-	if err != nil {
-		return err
+	key := storage.ContentKey(displayBlobPrefix, data.Bytes(), ".jpg")
+	if err := store.Put(context.Background(), key, data.Bytes(), "image/jpeg"); err != nil {
+		return "", err
 	}
+	return key, nil
+}
 
+// cropForDisplay crops the invoice to the detected document edges and applies
+// mild enhancement for display
+func cropForDisplay(src image.Image) *image.NRGBA {
 	// Get image dimensions
 	width := src.Bounds().Dx()
 	height := src.Bounds().Dy()
@@ -1227,96 +1897,56 @@ func createDisplayImage(sourcePath, destPath string) error {
 	edgeImg := imaging.Sharpen(gray, 0.7)
 	edgeImg = imaging.AdjustContrast(edgeImg, 50)
 
-	// Stage 2: Generate a binary image with adaptive threshold
-	binary := imaging.New(width, height, color.White)
-	for y := 0; y < height; y++ {
-		// Calculate local threshold based on average intensity in the row
-		var rowSum uint32
-		for x := 0; x < width; x++ {
-			r, _, _, _ := edgeImg.At(x, y).RGBA()
-			pixel := uint8(r >> 8)
-			rowSum += uint32(pixel)
-		}
-		avgIntensity := rowSum / uint32(width)
-
-		// Apply adaptive threshold
-		threshold := avgIntensity - 30 // Adjust based on testing
-		if threshold < 100 {
-			threshold = 100
-		}
-
-		for x := 0; x < width; x++ {
-			r, _, _, _ := edgeImg.At(x, y).RGBA()
-			pixel := uint8(r >> 8)
-			if uint32(pixel) < threshold {
-				binary.Set(x, y, color.Black)
-			}
-		}
-	}
-
-	// Stage 3: Compute horizontal and vertical gradients
-	horizontalGradient := imaging.New(width, height, color.White)
-	verticalGradient := imaging.New(width, height, color.White)
-
-	// Compute vertical gradient (for horizontal edges)
-	for y := 1; y < height-1; y++ {
-		for x := 0; x < width; x++ {
-			left, _, _, _ := edgeImg.At(x-1, y).RGBA()
-			right, _, _, _ := edgeImg.At(x+1, y).RGBA()
-
-			// Compute gradient (Sobel-like)
-			gradient := int32(left>>8) - int32(right>>8)
-			if gradient < 0 {
-				gradient = -gradient
-			}
-
-			if gradient > 30 { // Threshold for edges
-				verticalGradient.Set(x, y, color.Black)
-			}
-		}
-	}
-
-	// Compute horizontal gradient (for vertical edges)
-	for y := 0; y < height; y++ {
-		for x := 1; x < width-1; x++ {
-			left, _, _, _ := edgeImg.At(x-1, y).RGBA()
-			right, _, _, _ := edgeImg.At(x+1, y).RGBA()
-
-			// Compute gradient (Sobel-like)
-			gradient := int32(left>>8) - int32(right>>8)
-			if gradient < 0 {
-				gradient = -gradient
-			}
-
-			if gradient > 30 { // Threshold for edges
-				horizontalGradient.Set(x, y, color.Black)
-			}
-		}
-	}
+	edgeGray := toGray(edgeImg)
+
+	// Stage 2: Compute horizontal gradients and project them onto both axes.
+	// Pixels outside the image count as black, so the first and last columns
+	// compare against zero. Rows are processed in parallel, each worker keeping
+	// its own column counts which are merged afterwards.
+	horizontalProjection := make([]int, height) // edge pixels per row (for top/bottom edges)
+	verticalProjection := make([]int, width)    // edge pixels per column (for left/right edges)
+	var projectionMu sync.Mutex
+
+	parallelRows(height, func(startY, endY int) {
+		columnCounts := make([]int, width)
+		for y := startY; y < endY; y++ {
+			row := edgeGray.Pix[y*edgeGray.Stride : y*edgeGray.Stride+width]
+			rowCount := 0
+			for x := 0; x < width; x++ {
+				var left, right int32
+				if x > 0 {
+					left = int32(row[x-1])
+				}
+				if x < width-1 {
+					right = int32(row[x+1])
+				}
 
-	// Stage 4: Analyze horizontal and vertical projections
-	horizontalProjection := make([]int, height)
-	verticalProjection := make([]int, width)
+				// Compute gradient (Sobel-like)
+				gradient := left - right
+				if gradient < 0 {
+					gradient = -gradient
+				}
 
-	// Calculate horizontal projection (for top/bottom edges)
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			r, _, _, _ := verticalGradient.At(x, y).RGBA()
-			if r == 0 { // Black pixel
-				horizontalProjection[y]++
+				if gradient > 30 { // Threshold for edges
+					// Vertical gradient image skips the first and last rows
+					if y > 0 && y < height-1 {
+						rowCount++
+					}
+					// Horizontal gradient image skips the first and last columns
+					if x > 0 && x < width-1 {
+						columnCounts[x]++
+					}
+				}
 			}
+			horizontalProjection[y] = rowCount
 		}
-	}
 
-	// Calculate vertical projection (for left/right edges)
-	for x := 0; x < width; x++ {
-		for y := 0; y < height; y++ {
-			r, _, _, _ := horizontalGradient.At(x, y).RGBA()
-			if r == 0 { // Black pixel
-				verticalProjection[x]++
-			}
+		projectionMu.Lock()
+		for x, count := range columnCounts {
+			verticalProjection[x] += count
 		}
-	}
+		projectionMu.Unlock()
+	})
 
 	// Stage 5: Document boundary detection with sophisticated analysis
 	// Default margins
@@ -1455,13 +2085,7 @@ func createDisplayImage(sourcePath, destPath string) error {
 	result = imaging.AdjustContrast(result, 5) // Very mild contrast
 	result = imaging.Sharpen(result, 0.2)      // Minimal sharpening
 
-	// Save the result
-	err = imaging.Save(result, destPath)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return result
 }
 
 // Helper function for Go versions before 1.21 which don't have built-in min for ints
@@ -1480,8 +2104,9 @@ func max(a, b int) int {
 	return b
 }
 
-// extractTextFromOCRResult extracts text lines with position information from OCR result
-func extractTextFromOCRResult(result computervision.OcrResult) []TextLine {
+// extractTextFromOCRResult extracts text lines with position information from OCR result,
+// tagging each line with the page it was read from
+func extractTextFromOCRResult(result computervision.OcrResult, page int) []TextLine {
 	var textLines []TextLine
 	for _, region := range *result.Regions {
 		for _, line := range *region.Lines {
@@ -1506,6 +2131,7 @@ func extractTextFromOCRResult(result computervision.OcrResult) []TextLine {
 			if len(boundingBox) >= 4 {
 				textLines = append(textLines, TextLine{
 					Text:   strings.TrimSpace(lineText.String()),
+					Page:   page,
 					X:      boundingBox[0],
 					Y:      boundingBox[1],
 					Width:  boundingBox[2],
@@ -1519,10 +2145,27 @@ func extractTextFromOCRResult(result computervision.OcrResult) []TextLine {
 
 // extractInvoiceDetails extracts invoice details from text lines
 func extractInvoiceDetails(textLines []TextLine) Invoice {
+	return extractInvoiceDetailsReporting(textLines, nil)
+}
+
+// extractInvoiceDetailsReporting extracts invoice details from text lines, calling
+// report (if not nil) with each field as soon as it has been extracted
+func extractInvoiceDetailsReporting(textLines []TextLine, report func(field string, value interface{})) Invoice {
+	if report == nil {
+		report = func(string, interface{}) {}
+	}
+
 	vendorName := extractVendorNameFromPosition(textLines)
+	report("vendor_name", vendorName)
 	invoiceNumber := extractInvoiceNumberFromPosition(textLines)
+	report("invoice_number", invoiceNumber)
 	date := extractDateFromPosition(textLines)
+	report("date", date)
 	totalAmount, currency := extractAmountFromPosition(textLines)
+	report("total_amount", totalAmount)
+	report("currency", currency)
+	lineItems := extractLineItems(textLines)
+	report("line_items", len(lineItems))
 
 	invoice := Invoice{
 		InvoiceNumber: invoiceNumber,
@@ -1530,173 +2173,36 @@ func extractInvoiceDetails(textLines []TextLine) Invoice {
 		TotalAmount:   totalAmount,
 		Currency:      currency,
 		VendorName:    vendorName,
+		LineItems:     lineItems,
 	}
 
 	return invoice
 }
 
-// cleanupOldImages removes processed invoice images older than the specified duration
-func cleanupOldImages() {
-	ticker := time.NewTicker(1 * time.Hour) // Run cleanup every hour
-	defer ticker.Stop()
-
-	for range ticker.C {
-		log.Println("Running image cleanup...")
-		cleanupImages()
-	}
-}
-
-// cleanupImages removes processed invoice images older than 24 hours
-func cleanupImages() {
-	imgDir := "web/static/img"
-	files, err := os.ReadDir(imgDir)
-	if err != nil {
-		log.Printf("Error reading image directory: %v", err)
-		return
-	}
-
-	// Get current time
-	now := time.Now()
-
-	// Keep track of how many files were removed
-	removedCount := 0
-
-	for _, file := range files {
-		// Skip if not a processed invoice image
-		if !strings.HasPrefix(file.Name(), "processed-invoice-") {
-			continue
-		}
-
-		// Get file info
-		info, err := file.Info()
-		if err != nil {
-			log.Printf("Error getting file info for %s: %v", file.Name(), err)
-			continue
-		}
-
-		// Check if file is older than 24 hours
-		if now.Sub(info.ModTime()) > 24*time.Hour {
-			// Remove the file
-			err := os.Remove(filepath.Join(imgDir, file.Name()))
-			if err != nil {
-				log.Printf("Error removing old image %s: %v", file.Name(), err)
-			} else {
-				removedCount++
-			}
-		}
-	}
-
-	if removedCount > 0 {
-		log.Printf("Cleaned up %d old processed images", removedCount)
-	}
-}
-
-// detectDocumentSections analyzes the image and returns detected sections
-func detectDocumentSections(img image.Image) ([]DocumentSection, error) {
-	bounds := img.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
-
-	// Convert to grayscale for analysis
-	gray := imaging.Grayscale(img)
-
-	// Create maps to store horizontal and vertical lines
-	horizontalLines := make(map[int]bool)
-	verticalLines := make(map[int]bool)
-
-	// Detect horizontal lines by looking for consistent light/dark transitions
-	for y := 0; y < height; y++ {
-		linePixels := 0
-		for x := 0; x < width; x++ {
-			r, _, _, _ := gray.At(x, y).RGBA()
-			pixel := uint8(r >> 8)
-			if x > 0 {
-				prevR, _, _, _ := gray.At(x-1, y).RGBA()
-				prevPixel := uint8(prevR >> 8)
-				if math.Abs(float64(pixel)-float64(prevPixel)) > 30 {
-					linePixels++
-				}
-			}
-		}
-		// If we found enough transitions, consider it a line
-		if linePixels > width/3 {
-			horizontalLines[y] = true
-		}
-	}
-
-	// Detect vertical lines
-	for x := 0; x < width; x++ {
-		linePixels := 0
-		for y := 0; y < height; y++ {
-			r, _, _, _ := gray.At(x, y).RGBA()
-			pixel := uint8(r >> 8)
-			if y > 0 {
-				prevR, _, _, _ := gray.At(x, y-1).RGBA()
-				prevPixel := uint8(prevR >> 8)
-				if math.Abs(float64(pixel)-float64(prevPixel)) > 30 {
-					linePixels++
-				}
-			}
-		}
-		if linePixels > height/3 {
-			verticalLines[x] = true
-		}
-	}
-
-	// Group nearby lines to avoid over-segmentation
-	const lineProximityThreshold = 10
-	consolidatedHLines := consolidateLines(horizontalLines, lineProximityThreshold)
-	consolidatedVLines := consolidateLines(verticalLines, lineProximityThreshold)
-
-	// Create sections based on line intersections
+// detectDocumentSections analyzes the image and returns detected sections. Each cell
+// of a ruled table becomes a section; a page without tables is a single section.
+func detectDocumentSections(img image.Image, grids []*layout.Grid) ([]DocumentSection, error) {
 	var sections []DocumentSection
 	sectionID := 1
 
-	// Sort line positions
-	hLinePositions := make([]int, 0, len(consolidatedHLines))
-	for pos := range consolidatedHLines {
-		hLinePositions = append(hLinePositions, pos)
-	}
-	sort.Ints(hLinePositions)
-
-	vLinePositions := make([]int, 0, len(consolidatedVLines))
-	for pos := range consolidatedVLines {
-		vLinePositions = append(vLinePositions, pos)
-	}
-	sort.Ints(vLinePositions)
-
-	// Add document boundaries
-	if len(hLinePositions) == 0 || hLinePositions[0] > 0 {
-		hLinePositions = append([]int{0}, hLinePositions...)
-	}
-	if len(hLinePositions) == 0 || hLinePositions[len(hLinePositions)-1] < height {
-		hLinePositions = append(hLinePositions, height)
-	}
-
-	if len(vLinePositions) == 0 || vLinePositions[0] > 0 {
-		vLinePositions = append([]int{0}, vLinePositions...)
-	}
-	if len(vLinePositions) == 0 || vLinePositions[len(vLinePositions)-1] < width {
-		vLinePositions = append(vLinePositions, width)
-	}
-
-	// Create sections between lines
-	for i := 0; i < len(hLinePositions)-1; i++ {
-		for j := 0; j < len(vLinePositions)-1; j++ {
-			section := DocumentSection{
-				ID: sectionID,
-				Bounds: image.Rect(
-					vLinePositions[j],
-					hLinePositions[i],
-					vLinePositions[j+1],
-					hLinePositions[i+1],
-				),
-			}
-			sections = append(sections, section)
+	for _, grid := range grids {
+		for _, cell := range grid.Cells {
+			sections = append(sections, DocumentSection{
+				ID:     sectionID,
+				Bounds: cell.Bounds,
+			})
 			sectionID++
 		}
 	}
 
+	if len(sections) == 0 {
+		sections = append(sections, DocumentSection{
+			ID:     sectionID,
+			Bounds: img.Bounds(),
+		})
+		sectionID++
+	}
+
 	// Analyze color variations within each section
 	for i := range sections {
 		section := &sections[i]
@@ -1731,30 +2237,67 @@ func detectDocumentSections(img image.Image) ([]DocumentSection, error) {
 	return sections, nil
 }
 
-// consolidateLines groups nearby lines to avoid over-segmentation
-func consolidateLines(lines map[int]bool, threshold int) map[int]bool {
-	consolidated := make(map[int]bool)
-	var positions []int
-	for pos := range lines {
-		positions = append(positions, pos)
-	}
-	sort.Ints(positions)
-
-	if len(positions) == 0 {
-		return consolidated
+// toGray returns the luminance of img as an *image.Gray with bounds starting at the
+// origin, so callers can index the pixel slice directly instead of going through At
+func toGray(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	gray := image.NewGray(image.Rect(0, 0, width, height))
+
+	switch src := img.(type) {
+	case *image.NRGBA:
+		// imaging returns NRGBA; use the standard luminance weights in fixed point
+		parallelRows(height, func(startY, endY int) {
+			for y := startY; y < endY; y++ {
+				srcRow := src.Pix[(y+bounds.Min.Y-src.Rect.Min.Y)*src.Stride+(bounds.Min.X-src.Rect.Min.X)*4:]
+				dstRow := gray.Pix[y*gray.Stride:]
+				for x := 0; x < width; x++ {
+					r, g, b, a := uint32(srcRow[x*4]), uint32(srcRow[x*4+1]), uint32(srcRow[x*4+2]), uint32(srcRow[x*4+3])
+					lum := (19595*r + 38470*g + 7471*b + 1<<15) >> 16
+					if a != 0xff {
+						// Premultiply by alpha to match what At(x, y).RGBA() reports
+						lum = lum * a / 0xff
+					}
+					dstRow[x] = uint8(lum)
+				}
+			}
+		})
+	default:
+		parallelRows(height, func(startY, endY int) {
+			for y := startY; y < endY; y++ {
+				for x := 0; x < width; x++ {
+					gray.Set(x, y, img.At(x+bounds.Min.X, y+bounds.Min.Y))
+				}
+			}
+		})
 	}
 
-	currentGroup := positions[0]
-	consolidated[currentGroup] = true
+	return gray
+}
 
-	for i := 1; i < len(positions); i++ {
-		if positions[i]-currentGroup > threshold {
-			currentGroup = positions[i]
-			consolidated[currentGroup] = true
-		}
+// parallelRows splits the rows [0, height) into contiguous bands and calls fn for
+// each band on its own goroutine, returning once every band is done
+func parallelRows(height int, fn func(startY, endY int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > height {
+		workers = height
+	}
+	if workers <= 1 {
+		fn(0, height)
+		return
 	}
 
-	return consolidated
+	bandSize := (height + workers - 1) / workers
+	var wg sync.WaitGroup
+	for startY := 0; startY < height; startY += bandSize {
+		endY := min(startY+bandSize, height)
+		wg.Add(1)
+		go func(startY, endY int) {
+			defer wg.Done()
+			fn(startY, endY)
+		}(startY, endY)
+	}
+	wg.Wait()
 }
 
 // detectSignificantColorChange checks for significant color variations within a region
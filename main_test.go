@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"scan-in/pkg/imageio"
+	"scan-in/pkg/layout"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestConcurrentScans(t *testing.T) {
+	h := newTestHandlers(t)
+	const scans = 8
+	pages := make([][]byte, scans)
+	for i := range pages {
+		width := 800 + 10*i
+		h.ocrService.page(width, invoiceText(fmt.Sprintf("Vendor %c Supplies", 'A'+i), fmt.Sprintf("%d", 500000+i), "03/05/2024", float64(100+i))...)
+		pages[i] = testPage(t, width, int64(i+1))
+	}
+	r := h.testRouter(1)
+	requests := make([]*http.Request, scans)
+	for i := range requests {
+		requests[i] = multipartRequest(t, "/scan-invoice", upload{"invoice", fmt.Sprintf("page-%d.png", i), pages[i]})
+	}
+
+	// Every scan must get back its own page's invoice and images, however the requests interleave
+	var wg sync.WaitGroup
+	results := make([]ScanResultDTO, scans)
+	codes := make([]int, scans)
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := serve(r, requests[i])
+			codes[i] = w.Code
+			if err := json.Unmarshal(w.Body.Bytes(), &results[i]); err != nil {
+				t.Errorf("scan %d: %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	imageURLs := make(map[string]int)
+	for i, result := range results {
+		if codes[i] != 200 {
+			t.Errorf("scan %d: status %d", i, codes[i])
+			continue
+		}
+		invoice := result.Invoice
+		if want := fmt.Sprintf("%d", 500000+i); invoice.InvoiceNumber != want || invoice.TotalAmount != float64(100+i) {
+			t.Errorf("scan %d returned invoice %s for %.2f, want %s for %d.00", i, invoice.InvoiceNumber, invoice.TotalAmount, want, 100+i)
+		}
+		if len(invoice.Documents) == 0 || invoice.Documents[0].Filename != fmt.Sprintf("page-%d.png", i) {
+			t.Errorf("scan %d stored documents %+v", i, invoice.Documents)
+		}
+		if other, ok := imageURLs[result.ProcessedImageURL]; ok {
+			t.Errorf("scans %d and %d returned the same processed image", other, i)
+		}
+		imageURLs[result.ProcessedImageURL] = i
+	}
+	if h.ocrService.calls != scans {
+		t.Errorf("OCR called %d times for %d scans", h.ocrService.calls, scans)
+	}
+}
+
+func TestUploadSizeLimit(t *testing.T) {
+	h := newTestHandlers(t)
+	h.jobs = newGormScanJobRepository(openTestDB(t))
+	h.ocrService.page(800, invoiceText("Acme Supplies", "100234", "03/05/2024", 120)...)
+	r := scanJobRouter(h)
+	saved := maxUploadSize
+	maxUploadSize = 1 << 20
+	t.Cleanup(func() { maxUploadSize = saved })
+
+	tests := []struct {
+		path  string
+		field string
+		code  int // status of an upload under the limit
+	}{
+		{"/scan-invoice", "invoice", 200},
+		{"/split-scan", "pages", 200},
+		{"/api/scans", "invoice", 202},
+		{"/api/batches", "invoices", 202},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			large := bytes.Repeat([]byte{0}, 2<<20)
+			w := serve(r, multipartRequest(t, tt.path, upload{tt.field, "page.png", large}))
+			if w.Code != 413 || !strings.Contains(w.Body.String(), ErrCodeInvalidUpload) {
+				t.Errorf("upload over the limit: %d %s", w.Code, w.Body)
+			}
+
+			decode(t, serve(r, multipartRequest(t, tt.path, upload{tt.field, "page.png", testPage(t, 800, 1)})), tt.code, nil)
+		})
+	}
+}
+
+// benchmarkSamples are scans once kept under web/static/img: an upload as it
+// came from the phone and the processed image of another invoice
+var benchmarkSamples = []string{"temp-20250303-204427.jpg", "processed-invoice.jpg"}
+
+// loadSample decodes a sample scan from testdata
+func loadSample(b *testing.B, name string) image.Image {
+	b.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		b.Fatalf("%s: %v", name, err)
+	}
+	return img
+}
+
+func BenchmarkCropForDisplay(b *testing.B) {
+	for _, name := range benchmarkSamples {
+		img := loadSample(b, name)
+		b.Run(name, func(b *testing.B) {
+			for b.Loop() {
+				cropForDisplay(img)
+			}
+		})
+	}
+}
+
+// BenchmarkDetectDocumentSections times section detection as scanPage runs it,
+// on the image enhanced for OCR
+func BenchmarkDetectDocumentSections(b *testing.B) {
+	for _, name := range benchmarkSamples {
+		processed := enhanceImageForOCR(loadSample(b, name))
+		b.Run(name, func(b *testing.B) {
+			for b.Loop() {
+				grids := layout.DetectGrids(toGray(processed))
+				if _, err := detectDocumentSections(processed, grids); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRespondScanError(t *testing.T) {
+	tests := []struct {
+		respond func(*gin.Context, error)
+		err     error
+		status  int
+		code    string
+	}{
+		{respondUploadError, errors.New("invoice.png: failed to read upload: unexpected EOF"), 400, ErrCodeInvalidUpload},
+		{respondScanError, fmt.Errorf("invoice.pdf: page 2: %w", imageio.ErrUnscannedPDF), 415, ErrCodeUnsupportedMedia},
+		{respondScanError, fmt.Errorf("invoice.tiff: tiff frame 3: %w", imageio.ErrImageTooLarge), 413, ErrCodeInvalidUpload},
+		{respondScanError, errors.New("invoice.png: unsupported image format: image: unknown format"), 500, ErrCodeScanFailed},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		test.respond(c, test.err)
+
+		var body struct{ Error APIError }
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != test.status || body.Error.Code != test.code {
+			t.Errorf("%v: %d %s, want %d %s", test.err, w.Code, w.Body, test.status, test.code)
+		}
+	}
+}
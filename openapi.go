@@ -0,0 +1,17 @@
+package main
+
+import (
+	_ "embed"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPISpec describes every endpoint. Keep it in step with the DTOs in api.go.
+//
+//go:embed api/openapi.json
+var openAPISpec []byte
+
+// serveOpenAPI returns the OpenAPI document
+func serveOpenAPI(c *gin.Context) {
+	c.Data(200, "application/json", openAPISpec)
+}
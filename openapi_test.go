@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// undocumentedRoutes are the browser pages, which are not part of the API
+var undocumentedRoutes = []string{
+	"GET /",
+	"GET /login",
+	"POST /login",
+	"POST /logout",
+	"GET /static/{filepath}",
+	"HEAD /static/{filepath}",
+}
+
+// routeParam matches a gin path parameter or wildcard
+var routeParam = regexp.MustCompile(`[:*]([^/]+)`)
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("invalid OpenAPI document: %v", err)
+	}
+	documented := make(map[string]bool)
+	for path, item := range spec.Paths {
+		for method := range item {
+			switch method {
+			case "get", "put", "post", "delete", "patch", "head", "options":
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+
+	served := make(map[string]bool)
+	for _, route := range newTestServer(t).router.Routes() {
+		served[route.Method+" "+routeParam.ReplaceAllString(route.Path, "{$1}")] = true
+	}
+
+	for route := range served {
+		if !documented[route] && !slices.Contains(undocumentedRoutes, route) {
+			t.Errorf("%s is served but not in api/openapi.json", route)
+		}
+	}
+	for route := range documented {
+		if !served[route] {
+			t.Errorf("%s is in api/openapi.json but not served", route)
+		}
+	}
+	for _, route := range undocumentedRoutes {
+		if !served[route] {
+			t.Errorf("%s is listed as undocumented but not served", route)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// ErrOrganizationNotFound is returned when no organization has the ID
+var ErrOrganizationNotFound = errors.New("organization not found")
+
+// OrganizationRepository stores the tenants. Organizations belong to no
+// organization themselves, so calls are never tenant-scoped.
+type OrganizationRepository interface {
+	// Create stores a new organization
+	Create(ctx context.Context, org *Organization) error
+	// Get returns an organization
+	Get(ctx context.Context, id uint) (*Organization, error)
+	// First returns the organization created first
+	First(ctx context.Context) (*Organization, error)
+	// List returns every organization in the order they were created
+	List(ctx context.Context) ([]Organization, error)
+	// SlugTaken reports whether an organization has the slug
+	SlugTaken(ctx context.Context, slug string) (bool, error)
+	// AdoptOrphans assigns the organization every tenant-owned row saved before
+	// organizations existed, and returns how many there were
+	AdoptOrphans(ctx context.Context, orgID uint) (int64, error)
+}
+
+// gormOrganizationRepository keeps organizations in the SQL database
+type gormOrganizationRepository struct {
+	db *gorm.DB
+}
+
+// newGormOrganizationRepository returns a repository on the database
+func newGormOrganizationRepository(db *gorm.DB) *gormOrganizationRepository {
+	return &gormOrganizationRepository{db: db}
+}
+
+// Create inserts the organization
+func (r *gormOrganizationRepository) Create(ctx context.Context, org *Organization) error {
+	return r.db.WithContext(ctx).Create(org).Error
+}
+
+// Get loads one organization
+func (r *gormOrganizationRepository) Get(ctx context.Context, id uint) (*Organization, error) {
+	return r.first(r.db.WithContext(ctx).Where("id = ?", id))
+}
+
+// First loads the organization with the lowest ID
+func (r *gormOrganizationRepository) First(ctx context.Context) (*Organization, error) {
+	return r.first(r.db.WithContext(ctx).Order("id"))
+}
+
+// first loads the organization the query selects
+func (r *gormOrganizationRepository) first(query *gorm.DB) (*Organization, error) {
+	var org Organization
+	err := query.First(&org).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrOrganizationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+// List loads the organizations in ID order
+func (r *gormOrganizationRepository) List(ctx context.Context) ([]Organization, error) {
+	var orgs []Organization
+	err := r.db.WithContext(ctx).Order("id").Find(&orgs).Error
+	return orgs, err
+}
+
+// SlugTaken counts the organizations with the slug
+func (r *gormOrganizationRepository) SlugTaken(ctx context.Context, slug string) (bool, error) {
+	var count int64
+	err := r.db.WithContext(ctx).Model(&Organization{}).Where("slug = ?", slug).Count(&count).Error
+	return count > 0, err
+}
+
+// AdoptOrphans updates the rows of tenantTables without an organization. A
+// table that fails does not stop the others.
+func (r *gormOrganizationRepository) AdoptOrphans(ctx context.Context, orgID uint) (int64, error) {
+	var adopted int64
+	var errs []error
+	for _, model := range tenantTables {
+		result := r.db.WithContext(ctx).Model(model).
+			Where("organization_id IS NULL OR organization_id = 0").
+			UpdateColumn("organization_id", orgID)
+		if result.Error != nil {
+			errs = append(errs, fmt.Errorf("%T: %w", model, result.Error))
+			continue
+		}
+		adopted += result.RowsAffected
+	}
+	return adopted, errors.Join(errs...)
+}
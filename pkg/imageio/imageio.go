@@ -0,0 +1,324 @@
+package imageio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+
+	"github.com/disintegration/imaging"
+	"github.com/gen2brain/heic"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// tiffOrientationTag is the EXIF/TIFF tag holding the image orientation
+const tiffOrientationTag = 274
+
+// MaxPixels bounds the pixels of a page. Compressed formats declare their size
+// up front, so a small upload could otherwise decode to more memory than the
+// server has; 100 megapixels is an A3 page scanned at 1200 dpi.
+const MaxPixels = 100_000_000
+
+// ErrImageTooLarge is returned for a page with more than MaxPixels pixels
+var ErrImageTooLarge = fmt.Errorf("image is larger than %d megapixels", MaxPixels/1_000_000)
+
+// checkPixels refuses a page too large to decode, before its pixels are
+func checkPixels(width, height int) error {
+	if width < 0 || height < 0 || int64(width)*int64(height) > MaxPixels {
+		return fmt.Errorf("%dx%d pixels: %w", width, height, ErrImageTooLarge)
+	}
+	return nil
+}
+
+func init() {
+	// The heic package only registers the "heic" brand; iPhones and other
+	// encoders also write "heix", "hevc" and the generic "mif1" brand
+	for _, brand := range []string{"heix", "hevc", "hevx", "mif1", "msf1"} {
+		image.RegisterFormat("heic", "????ftyp"+brand, heic.Decode, heic.DecodeConfig)
+	}
+}
+
+// Document is an uploaded image or PDF opened for decoding. Its pages are
+// decoded one at a time by Page, so a long document is never held in memory
+// all at once.
+type Document struct {
+	// Format is the detected format, such as "jpeg", "tiff" or "pdf"
+	Format string
+	// Pages is the number of pages: one per TIFF frame or PDF page, else one
+	Pages int
+
+	page func(index int) (image.Image, error)
+}
+
+// Open detects the format of an uploaded image (JPEG, PNG, GIF, BMP, WebP,
+// HEIC or single or multi-frame TIFF) or scanned PDF and counts its pages,
+// without decoding any pixels yet. A document with a page of more than
+// MaxPixels is refused with ErrImageTooLarge.
+func Open(data []byte) (*Document, error) {
+	if isTIFF(data) {
+		return openTIFF(data)
+	}
+
+	// Detect the format first so it can be reported back to the client
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil && isPDF(data) {
+		return openPDF(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unsupported image format: %v", err)
+	}
+	if err := checkPixels(config.Width, config.Height); err != nil {
+		return nil, err
+	}
+
+	return &Document{Format: format, Pages: 1, page: func(int) (image.Image, error) {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s image: %v", format, err)
+		}
+		return applyOrientation(img, exifOrientation(format, data)), nil
+	}}, nil
+}
+
+// Page decodes a page, counting from 0, and turns it upright
+func (d *Document) Page(index int) (image.Image, error) {
+	if index < 0 || index >= d.Pages {
+		return nil, fmt.Errorf("%s has no page %d", d.Format, index+1)
+	}
+	return d.page(index)
+}
+
+// exifOrientation returns the EXIF orientation of a JPEG, PNG or WebP image, or 1
+// if it has none. HEIC images are turned upright by the decoder itself from their
+// irot and imir boxes, which take precedence over any EXIF copy of the tag.
+func exifOrientation(format string, data []byte) int {
+	var exif []byte
+	switch format {
+	case "jpeg":
+		exif = jpegEXIF(data)
+	case "png":
+		exif = pngEXIF(data)
+	case "webp":
+		exif = webpEXIF(data)
+	}
+
+	// EXIF data is a TIFF file whose first IFD holds the orientation
+	if len(exif) < 8 || !isTIFF(exif) {
+		return 1
+	}
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	if exif[0] == 'M' {
+		byteOrder = binary.BigEndian
+	}
+	offset := int64(byteOrder.Uint32(exif[4:8]))
+	if offset+2 > int64(len(exif)) {
+		return 1
+	}
+	entries := exif[offset+2:]
+	return tiffOrientation(entries[:min(len(entries), int(byteOrder.Uint16(exif[offset:]))*12)], byteOrder)
+}
+
+// jpegEXIF returns the EXIF data of the APP1 segment of a JPEG image
+func jpegEXIF(data []byte) []byte {
+	const (
+		markerAPP1 = 0xe1
+		markerSOS  = 0xda
+		markerEOI  = 0xd9
+	)
+
+	// Segments follow the SOI marker until the scan data starts
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		if marker == 0xff {
+			// Fill byte before a marker
+			i++
+			continue
+		}
+		if marker == markerSOS || marker == markerEOI {
+			break
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:i+4]))
+		if end > len(data) {
+			break
+		}
+		if segment := data[i+4 : end]; marker == markerAPP1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		i = end
+	}
+	return nil
+}
+
+// pngEXIF returns the contents of the eXIf chunk of a PNG image
+func pngEXIF(data []byte) []byte {
+	// Chunks are a length, a type, the data and a CRC, after the 8 byte signature
+	for i := 8; i+12 <= len(data); {
+		length := int64(binary.BigEndian.Uint32(data[i : i+4]))
+		end := int64(i) + 12 + length
+		if end > int64(len(data)) {
+			break
+		}
+		switch string(data[i+4 : i+8]) {
+		case "eXIf":
+			return data[i+8 : end-4]
+		case "IEND":
+			return nil
+		}
+		i = int(end)
+	}
+	return nil
+}
+
+// webpEXIF returns the contents of the EXIF chunk of an extended WebP image
+func webpEXIF(data []byte) []byte {
+	// RIFF chunks are a type, a little endian length and the data padded to even
+	for i := 12; i+8 <= len(data); {
+		length := int64(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+		end := int64(i) + 8 + length
+		if end > int64(len(data)) {
+			break
+		}
+		if string(data[i:i+4]) == "EXIF" {
+			// Some encoders keep the JPEG APP1 prefix
+			return bytes.TrimPrefix(data[i+8:end], []byte("Exif\x00\x00"))
+		}
+		i = int(end + end%2)
+	}
+	return nil
+}
+
+// isTIFF reports whether data starts with a little or big endian TIFF header
+func isTIFF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*"))
+}
+
+// tiffFrame is one frame of a multi-frame TIFF
+type tiffFrame struct {
+	offset      uint32
+	orientation int
+}
+
+// openTIFF finds the frames of a TIFF by following its chain of IFDs
+func openTIFF(data []byte) (*Document, error) {
+	if len(data) < 8 {
+		return nil, errors.New("tiff: truncated header")
+	}
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		byteOrder = binary.BigEndian
+	}
+
+	var frames []tiffFrame
+	seen := make(map[uint32]bool)
+	offset := byteOrder.Uint32(data[4:8])
+
+	for offset != 0 {
+		// Guard against truncated files and IFD chains that loop back on themselves
+		if seen[offset] || int64(offset)+2 > int64(len(data)) {
+			break
+		}
+		seen[offset] = true
+
+		entryCount := int(byteOrder.Uint16(data[offset : offset+2]))
+		entriesEnd := int(offset) + 2 + entryCount*12
+		if entriesEnd+4 > len(data) {
+			break
+		}
+
+		// Every frame declares its own size
+		config, err := tiff.DecodeConfig(tiffFrameReader(data, byteOrder, offset))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tiff frame %d: %v", len(frames)+1, err)
+		}
+		if err := checkPixels(config.Width, config.Height); err != nil {
+			return nil, fmt.Errorf("tiff frame %d: %w", len(frames)+1, err)
+		}
+
+		frames = append(frames, tiffFrame{
+			offset:      offset,
+			orientation: tiffOrientation(data[offset+2:entriesEnd], byteOrder),
+		})
+		offset = byteOrder.Uint32(data[entriesEnd : entriesEnd+4])
+	}
+
+	if len(frames) == 0 {
+		return nil, errors.New("tiff: no decodable frames")
+	}
+
+	return &Document{Format: "tiff", Pages: len(frames), page: func(index int) (image.Image, error) {
+		frame := frames[index]
+		img, err := tiff.Decode(tiffFrameReader(data, byteOrder, frame.offset))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode tiff frame %d: %v", index+1, err)
+		}
+		return applyOrientation(img, frame.orientation), nil
+	}}, nil
+}
+
+// tiffFrameReader reads a TIFF as if its header pointed at the IFD at offset.
+// The standard decoder only reads the first IFD, so every other frame is read
+// through a header of its own, in front of the file's data rather than a copy.
+func tiffFrameReader(data []byte, byteOrder binary.ByteOrder, offset uint32) *io.SectionReader {
+	header := make([]byte, 8)
+	copy(header, data[:4])
+	byteOrder.PutUint32(header[4:], offset)
+	return io.NewSectionReader(headerReaderAt{header: header, data: data}, 0, int64(len(data)))
+}
+
+// headerReaderAt reads data with its first bytes replaced by header
+type headerReaderAt struct {
+	header, data []byte
+}
+
+func (r headerReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[off:])
+	if off < int64(len(r.header)) {
+		copy(p, r.header[off:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// tiffOrientation reads the orientation tag from a block of 12-byte IFD entries
+func tiffOrientation(entries []byte, byteOrder binary.ByteOrder) int {
+	for i := 0; i+12 <= len(entries); i += 12 {
+		if byteOrder.Uint16(entries[i:i+2]) == tiffOrientationTag {
+			// SHORT values are stored left-aligned in the value field
+			return int(byteOrder.Uint16(entries[i+8 : i+10]))
+		}
+	}
+	return 1
+}
+
+// applyOrientation transforms the image so that an EXIF orientation of 1 results
+func applyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
@@ -0,0 +1,320 @@
+package imageio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// decodedPages is a document with every page decoded
+type decodedPages struct {
+	Format string
+	Frames []image.Image
+}
+
+// decodeAll opens a document and decodes each of its pages in turn
+func decodeAll(data []byte) (*decodedPages, error) {
+	doc, err := Open(data)
+	if err != nil {
+		return nil, err
+	}
+	decoded := &decodedPages{Format: doc.Format}
+	for i := 0; i < doc.Pages; i++ {
+		page, err := doc.Page(i)
+		if err != nil {
+			return nil, err
+		}
+		decoded.Frames = append(decoded.Frames, page)
+	}
+	return decoded, nil
+}
+
+// differingPixels returns how many pixels of two images differ, or -1 if their
+// sizes do
+func differingPixels(a, b image.Image) int {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return -1
+	}
+	differing := 0
+	for y := 0; y < a.Bounds().Dy(); y++ {
+		for x := 0; x < a.Bounds().Dx(); x++ {
+			r1, g1, b1, a1 := a.At(a.Bounds().Min.X+x, a.Bounds().Min.Y+y).RGBA()
+			r2, g2, b2, a2 := b.At(b.Bounds().Min.X+x, b.Bounds().Min.Y+y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				differing++
+			}
+		}
+	}
+	return differing
+}
+
+// exifWithOrientation returns little endian EXIF data holding only an orientation
+func exifWithOrientation(orientation int) []byte {
+	exif := []byte("II*\x00\x08\x00\x00\x00\x01\x00")
+	exif = binary.LittleEndian.AppendUint16(exif, tiffOrientationTag)
+	exif = binary.LittleEndian.AppendUint16(exif, 3) // SHORT
+	exif = binary.LittleEndian.AppendUint32(exif, 1)
+	exif = binary.LittleEndian.AppendUint16(exif, uint16(orientation))
+	return append(exif, 0, 0, 0, 0, 0, 0)
+}
+
+// withOrientation embeds an EXIF orientation in a JPEG, PNG or WebP image the way
+// cameras and phones store it
+func withOrientation(t *testing.T, format string, data []byte, orientation int) []byte {
+	t.Helper()
+	exif := exifWithOrientation(orientation)
+
+	var out []byte
+	switch format {
+	case "jpeg":
+		// An APP1 segment right after SOI
+		out = append(out, data[:2]...)
+		out = append(out, 0xff, 0xe1)
+		out = binary.BigEndian.AppendUint16(out, uint16(2+6+len(exif)))
+		out = append(out, "Exif\x00\x00"...)
+		out = append(out, exif...)
+		out = append(out, data[2:]...)
+	case "png":
+		// An eXIf chunk right after the 25 byte IHDR chunk
+		chunk := append([]byte("eXIf"), exif...)
+		out = append(out, data[:33]...)
+		out = binary.BigEndian.AppendUint32(out, uint32(len(exif)))
+		out = append(out, chunk...)
+		out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(chunk))
+		out = append(out, data[33:]...)
+	case "webp":
+		// A simple WebP becomes an extended one: a VP8X header announcing
+		// EXIF, the image chunk and the EXIF chunk
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, "RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x08\x00\x00\x00"...)
+		// The canvas size less one, in 24 bits
+		for _, size := range []int{config.Width - 1, config.Height - 1} {
+			out = append(out, byte(size), byte(size>>8), byte(size>>16))
+		}
+		out = append(out, data[12:]...)
+		out = append(out, "EXIF"...)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(exif)))
+		out = append(out, exif...)
+		binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	default:
+		t.Fatalf("no EXIF for %s", format)
+	}
+	return out
+}
+
+func TestDecodeFormats(t *testing.T) {
+	tests := []struct {
+		fixture string
+		format  string
+		sizes   []image.Point
+	}{
+		{"page.bmp", "bmp", []image.Point{{96, 73}}},
+		{"page.webp", "webp", []image.Point{{75, 100}}},
+		{"page.heic", "heic", []image.Point{{512, 512}}},
+		{"page-rotated.heic", "heic", []image.Point{{512, 512}}},
+		{"pages.tiff", "tiff", []image.Point{{40, 60}, {40, 60}, {50, 60}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			decoded, err := decodeAll(readFixture(t, tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Format != tt.format || len(decoded.Frames) != len(tt.sizes) {
+				t.Fatalf("decoded %s with %d frames, want %s with %d", decoded.Format, len(decoded.Frames), tt.format, len(tt.sizes))
+			}
+			for i, frame := range decoded.Frames {
+				if size := frame.Bounds().Size(); size != tt.sizes[i] {
+					t.Errorf("frame %d is %v, want %v", i+1, size, tt.sizes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeTIFFOrientation(t *testing.T) {
+	// Each page of the fixture is stored with a different orientation tag (1, 6
+	// and 3) and shows a black top left corner once upright
+	decoded, err := decodeAll(readFixture(t, "pages.tiff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range decoded.Frames {
+		width, height := frame.Bounds().Dx(), frame.Bounds().Dy()
+		if !isDark(frame, 2, 2) || isDark(frame, width-3, height-3) {
+			t.Errorf("frame %d is not upright", i+1)
+		}
+	}
+}
+
+func TestDecodeHEICOrientation(t *testing.T) {
+	// The rotated fixture is the plain one with an irot box turning it a quarter
+	// anti-clockwise. The decoder renders a few pixels along the edge differently
+	// once rotated, so only most of the picture has to match.
+	plain, err := decodeAll(readFixture(t, "page.heic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := decodeAll(readFixture(t, "page-rotated.heic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if differing := differingPixels(rotated.Frames[0], imaging.Rotate90(plain.Frames[0])); differing < 0 || differing > 512 {
+		t.Errorf("irot was not applied: %d of 512x512 pixels differ", differing)
+	}
+}
+
+func TestDecodeEXIFOrientation(t *testing.T) {
+	png := scanImage(t, 60, 40)
+	img, err := decodeAll(png)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, img.Frames[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	images := map[string][]byte{
+		"jpeg": jpg.Bytes(),
+		"png":  png,
+		"webp": readFixture(t, "page.webp"),
+	}
+
+	// How a camera stores an upright picture for each orientation, so storing
+	// the decoded image again gives back the pixels in the file
+	store := map[int]func(image.Image) *image.NRGBA{
+		1: imaging.Clone,
+		2: imaging.FlipH,
+		3: imaging.Rotate180,
+		4: imaging.FlipV,
+		5: imaging.Transpose,
+		6: imaging.Rotate90,
+		7: imaging.Transverse,
+		8: imaging.Rotate270,
+	}
+
+	for format, data := range images {
+		plain, err := decodeAll(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for orientation := 1; orientation <= 8; orientation++ {
+			t.Run(fmt.Sprintf("%s/%d", format, orientation), func(t *testing.T) {
+				decoded, err := decodeAll(withOrientation(t, format, data, orientation))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if decoded.Format != format {
+					t.Errorf("decoded as %s", decoded.Format)
+				}
+				if differingPixels(store[orientation](decoded.Frames[0]), plain.Frames[0]) != 0 {
+					t.Error("orientation was not applied")
+				}
+			})
+		}
+	}
+}
+
+func TestEXIFOrientationTruncated(t *testing.T) {
+	// Truncated or corrupt metadata is ignored rather than read past its end
+	images := map[string][]byte{
+		"jpeg": withOrientation(t, "jpeg", []byte("\xff\xd8\xff\xd9"), 6),
+		"png":  withOrientation(t, "png", scanImage(t, 10, 10), 6),
+		"webp": withOrientation(t, "webp", readFixture(t, "page.webp"), 6),
+	}
+	for format, data := range images {
+		if got := exifOrientation(format, data); got != 6 {
+			t.Errorf("%s orientation is %d, want 6", format, got)
+		}
+		for i := range data {
+			exifOrientation(format, data[:i])
+		}
+	}
+}
+
+// withSize rewrites the size a PNG, TIFF or HEIC image declares, leaving its
+// pixel data as it is. For a TIFF, frame picks the IFD to rewrite.
+func withSize(t *testing.T, format string, data []byte, frame, width, height int) []byte {
+	t.Helper()
+	out := append([]byte(nil), data...)
+	switch format {
+	case "png":
+		// The IHDR chunk starts with the width and height, and ends in its CRC
+		binary.BigEndian.PutUint32(out[16:], uint32(width))
+		binary.BigEndian.PutUint32(out[20:], uint32(height))
+		binary.BigEndian.PutUint32(out[29:], crc32.ChecksumIEEE(out[12:29]))
+	case "tiff":
+		byteOrder := binary.ByteOrder(binary.LittleEndian)
+		if out[0] == 'M' {
+			byteOrder = binary.BigEndian
+		}
+		offset := byteOrder.Uint32(out[4:])
+		for ; frame > 0; frame-- {
+			offset = byteOrder.Uint32(out[offset+2+uint32(byteOrder.Uint16(out[offset:]))*12:])
+		}
+		for i := offset + 2; i < offset+2+uint32(byteOrder.Uint16(out[offset:]))*12; i += 12 {
+			// ImageWidth and ImageLength, each a SHORT or a LONG
+			value, ok := map[uint16]int{256: width, 257: height}[byteOrder.Uint16(out[i:])]
+			if ok && byteOrder.Uint16(out[i+2:]) == 3 {
+				byteOrder.PutUint16(out[i+8:], uint16(value))
+			} else if ok {
+				byteOrder.PutUint32(out[i+8:], uint32(value))
+			}
+		}
+	case "heic":
+		// The ispe property holds the size after its version and flags
+		i := bytes.Index(out, []byte("ispe"))
+		binary.BigEndian.PutUint32(out[i+8:], uint32(width))
+		binary.BigEndian.PutUint32(out[i+12:], uint32(height))
+	default:
+		t.Fatalf("no size for %s", format)
+	}
+	return out
+}
+
+func TestOpenTooLarge(t *testing.T) {
+	// Each declares 60000x60000 pixels, 3.6 gigapixels, in a few kilobytes
+	tests := map[string][]byte{
+		"png":          withSize(t, "png", scanImage(t, 10, 10), 0, 60000, 60000),
+		"tiff":         withSize(t, "tiff", readFixture(t, "pages.tiff"), 0, 60000, 60000),
+		"tiff frame 3": withSize(t, "tiff", readFixture(t, "pages.tiff"), 2, 60000, 60000),
+		"heic":         withSize(t, "heic", readFixture(t, "page.heic"), 0, 60000, 60000),
+		"pdf":          imagePDF(60000, 60000),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Open(data); !errors.Is(err, ErrImageTooLarge) {
+				t.Errorf("opened with %v, want ErrImageTooLarge", err)
+			}
+		})
+	}
+
+	// A page just within the limit is opened
+	if _, err := Open(withSize(t, "png", scanImage(t, 10, 10), 0, 10000, 10000)); err != nil {
+		t.Errorf("100 megapixels: %v", err)
+	}
+	if doc, err := Open(imagePDF(2, 2)); err != nil || doc.Pages != 1 {
+		t.Errorf("small pdf image: %v", err)
+	}
+}
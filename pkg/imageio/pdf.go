@@ -0,0 +1,127 @@
+package imageio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/disintegration/imaging"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// ErrUnscannedPDF is returned for a PDF page that holds no scanned image, such
+// as a PDF generated by accounting software. Only the images embedded in a PDF
+// are read; its text and vector graphics are not rendered.
+var ErrUnscannedPDF = errors.New("PDF page holds no scanned image; only scanned PDFs can be read")
+
+func init() {
+	// pdfcpu otherwise writes a configuration directory on first use, and
+	// exits the process if it cannot
+	model.ConfigPath = "disable"
+}
+
+// isPDF reports whether data is a PDF document. Readers accept the %PDF- header
+// anywhere in the first kilobyte, so it is looked for there too.
+func isPDF(data []byte) bool {
+	return bytes.Contains(data[:min(len(data), 1024)], []byte("%PDF-"))
+}
+
+// openPDF finds the scanned image of every page of a PDF. Scanners write each
+// page as one image; a page holding several, such as a scan with a thumbnail,
+// is read from the largest. Only the images' dictionaries are read here, so a
+// PDF without scanned pages is refused before any page is decoded.
+func openPDF(data []byte) (*Document, error) {
+	conf := model.NewDefaultConfiguration()
+	conf.Cmd = model.EXTRACTIMAGES
+	conf.ValidationMode = model.ValidationRelaxed
+	ctx, err := api.ReadValidateAndOptimize(bytes.NewReader(data), conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pdf: %v", err)
+	}
+	if ctx.PageCount == 0 {
+		return nil, errors.New("pdf: no pages")
+	}
+
+	scans := make([]model.Image, ctx.PageCount)
+	for pageNr := 1; pageNr <= ctx.PageCount; pageNr++ {
+		images, err := pdfcpu.ExtractPageImages(ctx, pageNr, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pdf page %d: %v", pageNr, err)
+		}
+
+		var scan *model.Image
+		for _, candidate := range images {
+			if candidate.Thumb || candidate.IsImgMask {
+				continue
+			}
+			if scan == nil || candidate.Width*candidate.Height > scan.Width*scan.Height {
+				scan = &candidate
+			}
+		}
+		if scan == nil {
+			return nil, fmt.Errorf("page %d: %w", pageNr, ErrUnscannedPDF)
+		}
+		if err := checkPixels(scan.Width, scan.Height); err != nil {
+			return nil, fmt.Errorf("pdf page %d: %w", pageNr, err)
+		}
+		scans[pageNr-1] = *scan
+	}
+
+	return &Document{Format: "pdf", Pages: ctx.PageCount, page: func(index int) (image.Image, error) {
+		return decodePDFPage(ctx, index+1, scans[index])
+	}}, nil
+}
+
+// decodePDFPage decodes the scanned image of a page and applies the page's
+// /Rotate like EXIF orientation is for other formats
+func decodePDFPage(ctx *model.Context, pageNr int, scan model.Image) (image.Image, error) {
+	dict := ctx.Optimize.ImageObjects[scan.ObjNr].ImageDict
+	// The decoded stream is kept on the dictionary; drop it once the page is
+	// read so the pages of a long PDF don't pile up in memory
+	defer func() { dict.Content = nil }()
+
+	extracted, err := pdfcpu.ExtractImage(ctx, dict, false, scan.Name, scan.ObjNr, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pdf page %d: %v", pageNr, err)
+	}
+	// An embedded JPEG may not be the size its dictionary claims
+	encoded, err := io.ReadAll(extracted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pdf page %d: %v", pageNr, err)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the image of pdf page %d: %v", pageNr, err)
+	}
+	if err := checkPixels(config.Width, config.Height); err != nil {
+		return nil, fmt.Errorf("pdf page %d: %w", pageNr, err)
+	}
+	page, _, err := image.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the image of pdf page %d: %v", pageNr, err)
+	}
+
+	_, _, inherited, err := ctx.PageDict(pageNr, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pdf page %d: %v", pageNr, err)
+	}
+	return applyPageRotation(page, inherited.Rotate), nil
+}
+
+// applyPageRotation turns a page image the way a viewer shows it. /Rotate is
+// in degrees clockwise, a multiple of 90 that may be negative.
+func applyPageRotation(img image.Image, rotate int) image.Image {
+	switch (rotate%360 + 360) % 360 {
+	case 90:
+		return imaging.Rotate270(img)
+	case 180:
+		return imaging.Rotate180(img)
+	case 270:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
@@ -0,0 +1,172 @@
+package imageio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+// scanImage returns a PNG of the given size, white with a black top left corner
+// so that rotations can be told apart
+func scanImage(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+	for y := 0; y < height/4; y++ {
+		for x := 0; x < width/4; x++ {
+			img.SetGray(x, y, color.Gray{})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// scannedPDF returns a PDF with one page per image, the way scanners write them
+func scannedPDF(t *testing.T, pages ...[]byte) []byte {
+	t.Helper()
+	readers := make([]io.Reader, 0, len(pages))
+	for _, page := range pages {
+		readers = append(readers, bytes.NewReader(page))
+	}
+	var buf bytes.Buffer
+	if err := api.ImportImages(nil, &buf, readers, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// textPDF returns a one-page PDF that draws text and holds no image, like the
+// PDFs accounting software generates
+func textPDF() []byte {
+	content := "BT /F1 24 Tf 72 720 Td (Invoice 100234) Tj ET"
+	return writePDF(
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	)
+}
+
+// imagePDF returns a one-page PDF whose image declares the given size, though
+// its stream holds only a few bytes
+func imagePDF(width, height int) []byte {
+	content := "q 612 0 0 792 0 0 cm /Im0 Do Q"
+	pixels := "\x00\x00\x00\x00"
+	return writePDF(
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R /Resources << /XObject << /Im0 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8 /Length %d >>\nstream\n%s\nendstream",
+			width, height, len(pixels), pixels),
+	)
+}
+
+// writePDF lays out numbered objects, the first being the catalog, with their
+// cross-reference table
+func writePDF(objects ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+// isDark reports whether the pixel at x, y is closer to black than white
+func isDark(img image.Image, x, y int) bool {
+	gray := color.GrayModel.Convert(img.At(img.Bounds().Min.X+x, img.Bounds().Min.Y+y)).(color.Gray)
+	return gray.Y < 128
+}
+
+func TestDecodePDF(t *testing.T) {
+	decoded, err := decodeAll(scannedPDF(t, scanImage(t, 400, 600), scanImage(t, 410, 600), scanImage(t, 420, 600)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Format != "pdf" || len(decoded.Frames) != 3 {
+		t.Fatalf("decoded %s with %d frames, want pdf with 3", decoded.Format, len(decoded.Frames))
+	}
+	for i, frame := range decoded.Frames {
+		if width := frame.Bounds().Dx(); width != 400+10*i {
+			t.Errorf("page %d is %d wide, want %d", i+1, width, 400+10*i)
+		}
+	}
+
+	// A header after a byte order mark or other junk is still recognised
+	decoded, err = decodeAll(append([]byte("\xef\xbb\xbf"), scannedPDF(t, scanImage(t, 400, 600))...))
+	if err != nil || decoded.Format != "pdf" {
+		t.Errorf("PDF after a byte order mark: %v", err)
+	}
+}
+
+func TestDecodePDFPageRotation(t *testing.T) {
+	tests := []struct {
+		rotate        int
+		width, height int
+		darkX, darkY  int // a pixel in the black corner once the page is upright
+	}{
+		{0, 400, 600, 10, 10},
+		{90, 600, 400, 590, 10},
+		{180, 400, 600, 390, 590},
+		{270, 600, 400, 10, 390},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.rotate), func(t *testing.T) {
+			pdf := scannedPDF(t, scanImage(t, 400, 600))
+			if tt.rotate != 0 {
+				var rotated bytes.Buffer
+				if err := api.Rotate(bytes.NewReader(pdf), &rotated, tt.rotate, nil, nil); err != nil {
+					t.Fatal(err)
+				}
+				pdf = rotated.Bytes()
+			}
+
+			decoded, err := decodeAll(pdf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page := decoded.Frames[0]
+			if page.Bounds().Dx() != tt.width || page.Bounds().Dy() != tt.height {
+				t.Errorf("page is %v, want %dx%d", page.Bounds().Size(), tt.width, tt.height)
+			}
+			if !isDark(page, tt.darkX, tt.darkY) {
+				t.Errorf("pixel %d,%d is not in the black corner", tt.darkX, tt.darkY)
+			}
+		})
+	}
+}
+
+func TestDecodePDFErrors(t *testing.T) {
+	_, err := Open(textPDF())
+	if !errors.Is(err, ErrUnscannedPDF) {
+		t.Errorf("PDF without scanned pages: %v, want ErrUnscannedPDF", err)
+	}
+
+	if _, err := decodeAll([]byte("%PDF-1.7\n1 0 obj << /Type /Catalog >> endobj\n%%EOF\n")); err == nil || errors.Is(err, ErrUnscannedPDF) {
+		t.Errorf("broken PDF: %v", err)
+	}
+}
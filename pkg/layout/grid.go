@@ -0,0 +1,211 @@
+package layout
+
+import (
+	"image"
+	"sort"
+)
+
+// minEdgeCoverage is how much of a cell edge a ruling must cover to separate two cells
+const minEdgeCoverage = 0.5
+
+// Cell is one cell of a ruled table. Row and Col index the grid's base rows and
+// columns; merged cells span several of them.
+type Cell struct {
+	Table   int // index of the table within the page
+	Row     int
+	Col     int
+	RowSpan int
+	ColSpan int
+	Bounds  image.Rectangle
+}
+
+// Grid is a ruled table: the positions of its ruling lines and the cells they form
+type Grid struct {
+	Index  int
+	Bounds image.Rectangle
+	Rows   []int // y positions of the horizontal rulings, top to bottom
+	Cols   []int // x positions of the vertical rulings, left to right
+	Cells  []Cell
+}
+
+// RowCount returns the number of base rows in the grid
+func (g *Grid) RowCount() int {
+	return len(g.Rows) - 1
+}
+
+// ColCount returns the number of base columns in the grid
+func (g *Grid) ColCount() int {
+	return len(g.Cols) - 1
+}
+
+// CellAt returns the cell containing the point
+func (g *Grid) CellAt(pt image.Point) (Cell, bool) {
+	for _, cell := range g.Cells {
+		if pt.In(cell.Bounds) {
+			return cell, true
+		}
+	}
+	return Cell{}, false
+}
+
+// DetectGrids finds the ruled tables on a page, ordered top to bottom. Grids much
+// narrower or shorter than a real table, such as the ragged edge of a photographed
+// page against a dark background, are discarded.
+func DetectGrids(gray *image.Gray) []*Grid {
+	width, height := gray.Bounds().Dx(), gray.Bounds().Dy()
+	horizontal, vertical := DetectRulings(gray)
+	tolerance := max(min(width, height)/100, 5)
+
+	var grids []*Grid
+	for _, grid := range BuildGrids(horizontal, vertical, tolerance) {
+		if grid.Bounds.Dx() < width/10 || grid.Bounds.Dy() < height/50 {
+			continue
+		}
+		grid.Index = len(grids)
+		for c := range grid.Cells {
+			grid.Cells[c].Table = grid.Index
+		}
+		grids = append(grids, grid)
+	}
+	return grids
+}
+
+// BuildGrids groups intersecting rulings into tables and derives each table's
+// cells. A table needs at least two horizontal and two vertical rulings.
+func BuildGrids(horizontal, vertical []Ruling, tolerance int) []*Grid {
+	// Union-find over all rulings: horizontal ones first, then vertical
+	parent := make([]int, len(horizontal)+len(vertical))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for i, h := range horizontal {
+		for j, v := range vertical {
+			if intersects(h, v, tolerance) {
+				parent[find(i)] = find(len(horizontal) + j)
+			}
+		}
+	}
+
+	components := make(map[int]*[2][]Ruling)
+	var roots []int
+	for i := range parent {
+		root := find(i)
+		component, ok := components[root]
+		if !ok {
+			component = &[2][]Ruling{}
+			components[root] = component
+			roots = append(roots, root)
+		}
+		if i < len(horizontal) {
+			component[0] = append(component[0], horizontal[i])
+		} else {
+			component[1] = append(component[1], vertical[i-len(horizontal)])
+		}
+	}
+
+	var grids []*Grid
+	for _, root := range roots {
+		component := components[root]
+		if len(component[0]) < 2 || len(component[1]) < 2 {
+			continue
+		}
+		grids = append(grids, buildGrid(component[0], component[1]))
+	}
+
+	sort.Slice(grids, func(i, j int) bool {
+		return grids[i].Bounds.Min.Y < grids[j].Bounds.Min.Y
+	})
+	for i, grid := range grids {
+		grid.Index = i
+		for c := range grid.Cells {
+			grid.Cells[c].Table = i
+		}
+	}
+	return grids
+}
+
+// intersects reports whether a horizontal and a vertical ruling cross or touch
+func intersects(h, v Ruling, tolerance int) bool {
+	return h.Coverage(v.Pos-tolerance, v.Pos+tolerance+1) > 0 &&
+		v.Coverage(h.Pos-tolerance, h.Pos+tolerance+1) > 0
+}
+
+// buildGrid derives the cells of one table. Neighbouring base cells are merged
+// into a spanning cell when no ruling separates them.
+func buildGrid(horizontal, vertical []Ruling) *Grid {
+	sort.Slice(horizontal, func(i, j int) bool { return horizontal[i].Pos < horizontal[j].Pos })
+	sort.Slice(vertical, func(i, j int) bool { return vertical[i].Pos < vertical[j].Pos })
+
+	grid := &Grid{}
+	for _, h := range horizontal {
+		grid.Rows = append(grid.Rows, h.Pos)
+	}
+	for _, v := range vertical {
+		grid.Cols = append(grid.Cols, v.Pos)
+	}
+	grid.Bounds = image.Rect(grid.Cols[0], grid.Rows[0], grid.Cols[len(grid.Cols)-1], grid.Rows[len(grid.Rows)-1])
+
+	rows, cols := grid.RowCount(), grid.ColCount()
+	parent := make([]int, rows*cols)
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			// Right neighbour: separated by the vertical ruling at column c+1
+			if c+1 < cols && vertical[c+1].Coverage(grid.Rows[r], grid.Rows[r+1]) < minEdgeCoverage {
+				parent[find(r*cols+c)] = find(r*cols + c + 1)
+			}
+			// Lower neighbour: separated by the horizontal ruling at row r+1
+			if r+1 < rows && horizontal[r+1].Coverage(grid.Cols[c], grid.Cols[c+1]) < minEdgeCoverage {
+				parent[find(r*cols+c)] = find((r+1)*cols + c)
+			}
+		}
+	}
+
+	// Collect each group of merged base cells into a spanning cell covering
+	// the group's bounding rows and columns
+	spans := make(map[int]*image.Rectangle)
+	var order []int
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			root := find(r*cols + c)
+			span, ok := spans[root]
+			if !ok {
+				spans[root] = &image.Rectangle{Min: image.Pt(c, r), Max: image.Pt(c+1, r+1)}
+				order = append(order, root)
+				continue
+			}
+			*span = span.Union(image.Rect(c, r, c+1, r+1))
+		}
+	}
+
+	for _, root := range order {
+		span := spans[root]
+		grid.Cells = append(grid.Cells, Cell{
+			Row:     span.Min.Y,
+			Col:     span.Min.X,
+			RowSpan: span.Dy(),
+			ColSpan: span.Dx(),
+			Bounds:  image.Rect(grid.Cols[span.Min.X], grid.Rows[span.Min.Y], grid.Cols[span.Max.X], grid.Rows[span.Max.Y]),
+		})
+	}
+
+	return grid
+}
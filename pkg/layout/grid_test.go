@@ -0,0 +1,237 @@
+package layout
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+// page is a synthetic scan: white paper on which lines and text are drawn
+type page struct {
+	*image.Gray
+}
+
+func newPage(width, height int) page {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	return page{img}
+}
+
+// hline draws a 3 pixel thick horizontal line centred on y from x0 to x1
+func (p page) hline(y, x0, x1 int) page {
+	p.fill(image.Rect(x0-1, y-1, x1+2, y+2))
+	return p
+}
+
+// vline draws a 3 pixel thick vertical line centred on x from y0 to y1
+func (p page) vline(x, y0, y1 int) page {
+	p.fill(image.Rect(x-1, y0-1, x+2, y1+2))
+	return p
+}
+
+// text draws short strokes the size of printed characters starting at x, y
+func (p page) text(x, y, chars int) page {
+	for i := 0; i < chars; i++ {
+		p.fill(image.Rect(x+i*10, y, x+i*10+6, y+12))
+	}
+	return p
+}
+
+func (p page) fill(r image.Rectangle) {
+	r = r.Intersect(p.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			p.SetGray(x, y, color.Gray{})
+		}
+	}
+}
+
+// table draws a fully ruled table with the given rulings
+func (p page) table(rows, cols []int) page {
+	for _, y := range rows {
+		p.hline(y, cols[0], cols[len(cols)-1])
+	}
+	for _, x := range cols {
+		p.vline(x, rows[0], rows[len(rows)-1])
+	}
+	return p
+}
+
+// span is a cell's position as row, column, row span and column span
+type span [4]int
+
+func spans(grid *Grid) []span {
+	var out []span
+	for _, cell := range grid.Cells {
+		out = append(out, span{cell.Row, cell.Col, cell.RowSpan, cell.ColSpan})
+	}
+	return out
+}
+
+func TestDetectGrids(t *testing.T) {
+	type want struct {
+		rows, cols []int
+		cells      []span
+	}
+
+	tests := []struct {
+		name  string
+		page  page
+		grids []want
+	}{
+		{
+			name: "plain grid",
+			page: newPage(800, 600).
+				table([]int{100, 200, 300, 400}, []int{100, 300, 500, 700}).
+				text(120, 140, 12).text(320, 240, 8).text(520, 340, 5),
+			grids: []want{{
+				rows: []int{100, 200, 300, 400},
+				cols: []int{100, 300, 500, 700},
+				cells: []span{
+					{0, 0, 1, 1}, {0, 1, 1, 1}, {0, 2, 1, 1},
+					{1, 0, 1, 1}, {1, 1, 1, 1}, {1, 2, 1, 1},
+					{2, 0, 1, 1}, {2, 1, 1, 1}, {2, 2, 1, 1},
+				},
+			}},
+		},
+		{
+			// The header spans the first two columns and the last column's
+			// lower two rows are one cell
+			name: "merged cells",
+			page: newPage(800, 600).
+				hline(100, 100, 700).hline(200, 100, 700).hline(300, 100, 500).hline(400, 100, 700).
+				vline(100, 100, 400).vline(300, 200, 400).vline(500, 100, 400).vline(700, 100, 400),
+			grids: []want{{
+				rows: []int{100, 200, 300, 400},
+				cols: []int{100, 300, 500, 700},
+				cells: []span{
+					{0, 0, 1, 2}, {0, 2, 1, 1},
+					{1, 0, 1, 1}, {1, 1, 1, 1}, {1, 2, 2, 1},
+					{2, 0, 1, 1}, {2, 1, 1, 1},
+				},
+			}},
+		},
+		{
+			// A ruling under only the first column splits that column alone; the
+			// signature line below the table does not touch it and is no table
+			name: "partial rulings",
+			page: newPage(800, 600).
+				table([]int{100, 200, 300, 400}, []int{100, 300, 500, 700}).
+				hline(250, 100, 300).
+				hline(500, 100, 400),
+			grids: []want{{
+				rows: []int{100, 200, 250, 300, 400},
+				cols: []int{100, 300, 500, 700},
+				cells: []span{
+					{0, 0, 1, 1}, {0, 1, 1, 1}, {0, 2, 1, 1},
+					{1, 0, 1, 1}, {1, 1, 2, 1}, {1, 2, 2, 1},
+					{2, 0, 1, 1},
+					{3, 0, 1, 1}, {3, 1, 1, 1}, {3, 2, 1, 1},
+				},
+			}},
+		},
+		{
+			// Drawn bottom first; their side rulings are offset because collinear
+			// rulings join into one line and would join the tables too
+			name: "two tables",
+			page: newPage(800, 600).
+				table([]int{320, 380, 440}, []int{150, 650}).
+				table([]int{60, 120, 180}, []int{100, 400, 700}),
+			grids: []want{
+				{
+					rows:  []int{60, 120, 180},
+					cols:  []int{100, 400, 700},
+					cells: []span{{0, 0, 1, 1}, {0, 1, 1, 1}, {1, 0, 1, 1}, {1, 1, 1, 1}},
+				},
+				{
+					rows:  []int{320, 380, 440},
+					cols:  []int{150, 650},
+					cells: []span{{0, 0, 1, 1}, {1, 0, 1, 1}},
+				},
+			},
+		},
+		{
+			name: "blank page",
+			page: newPage(800, 600),
+		},
+		{
+			name: "text without lines",
+			page: newPage(800, 600).text(100, 100, 30).text(100, 130, 25).text(100, 160, 40),
+		},
+		{
+			name: "lines that form no table",
+			page: newPage(800, 600).hline(100, 100, 700).hline(500, 100, 400).vline(750, 50, 550),
+		},
+		{
+			name: "checkbox",
+			page: newPage(800, 600).table([]int{100, 140}, []int{100, 140}).text(160, 114, 10),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grids := DetectGrids(tt.page.Gray)
+			if len(grids) != len(tt.grids) {
+				t.Fatalf("found %d grids, want %d", len(grids), len(tt.grids))
+			}
+			for i, grid := range grids {
+				want := tt.grids[i]
+				if grid.Index != i {
+					t.Errorf("grid %d has index %d", i, grid.Index)
+				}
+				if !reflect.DeepEqual(grid.Rows, want.rows) || !reflect.DeepEqual(grid.Cols, want.cols) {
+					t.Errorf("grid %d has rows %v and cols %v, want %v and %v", i, grid.Rows, grid.Cols, want.rows, want.cols)
+					continue
+				}
+				if got := spans(grid); !reflect.DeepEqual(got, want.cells) {
+					t.Errorf("grid %d has cells %v, want %v", i, got, want.cells)
+				}
+				for _, cell := range grid.Cells {
+					if cell.Table != i {
+						t.Errorf("cell %d,%d of grid %d is in table %d", cell.Row, cell.Col, i, cell.Table)
+					}
+					wantBounds := image.Rect(grid.Cols[cell.Col], grid.Rows[cell.Row],
+						grid.Cols[cell.Col+cell.ColSpan], grid.Rows[cell.Row+cell.RowSpan])
+					if cell.Bounds != wantBounds {
+						t.Errorf("cell %d,%d of grid %d has bounds %v, want %v", cell.Row, cell.Col, i, cell.Bounds, wantBounds)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCellAt(t *testing.T) {
+	grids := DetectGrids(newPage(800, 600).
+		hline(100, 100, 700).hline(200, 100, 700).hline(300, 100, 700).
+		vline(100, 100, 300).vline(300, 200, 300).vline(700, 100, 300).Gray)
+	if len(grids) != 1 {
+		t.Fatalf("found %d grids, want 1", len(grids))
+	}
+
+	tests := []struct {
+		pt   image.Point
+		ok   bool
+		cell span
+	}{
+		{image.Pt(150, 150), true, span{0, 0, 1, 2}},
+		{image.Pt(600, 150), true, span{0, 0, 1, 2}},
+		{image.Pt(150, 250), true, span{1, 0, 1, 1}},
+		{image.Pt(600, 250), true, span{1, 1, 1, 1}},
+		{image.Pt(50, 150), false, span{}},
+		{image.Pt(400, 350), false, span{}},
+	}
+	for _, tt := range tests {
+		cell, ok := grids[0].CellAt(tt.pt)
+		if ok != tt.ok {
+			t.Errorf("CellAt(%v) found %t, want %t", tt.pt, ok, tt.ok)
+			continue
+		}
+		if got := (span{cell.Row, cell.Col, cell.RowSpan, cell.ColSpan}); ok && got != tt.cell {
+			t.Errorf("CellAt(%v) = %v, want %v", tt.pt, got, tt.cell)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package layout
+
+import (
+	"image"
+	"sort"
+)
+
+// Orientation of a ruling line
+type Orientation int
+
+const (
+	Horizontal Orientation = iota
+	Vertical
+)
+
+// Segment is a covered stretch [Start, End) along a ruling line
+type Segment struct {
+	Start int
+	End   int
+}
+
+// Ruling is a printed table line. Pos is the y coordinate of a horizontal ruling or
+// the x coordinate of a vertical one; Segments are the stretches actually inked,
+// so a ruling broken by a merged cell still counts as one line.
+type Ruling struct {
+	Orientation Orientation
+	Pos         int
+	Thickness   int
+	Segments    []Segment
+}
+
+// Extent returns the first and last coordinate covered by the ruling
+func (r Ruling) Extent() (int, int) {
+	if len(r.Segments) == 0 {
+		return 0, 0
+	}
+	return r.Segments[0].Start, r.Segments[len(r.Segments)-1].End
+}
+
+// Coverage returns the fraction of [start, end) that the ruling covers
+func (r Ruling) Coverage(start, end int) float64 {
+	if end <= start {
+		return 0
+	}
+
+	covered := 0
+	for _, seg := range r.Segments {
+		lo, hi := max(seg.Start, start), min(seg.End, end)
+		if hi > lo {
+			covered += hi - lo
+		}
+	}
+	return float64(covered) / float64(end-start)
+}
+
+// DetectRulings finds horizontal and vertical ruling lines using a morphological
+// opening of the binarized image with line-shaped kernels. Opening with a 1xk
+// kernel keeps exactly the ink runs at least k pixels long, so text strokes are
+// removed and only long straight lines survive.
+func DetectRulings(gray *image.Gray) (horizontal, vertical []Ruling) {
+	bounds := gray.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return nil, nil
+	}
+
+	ink := binarize(gray)
+
+	// Table lines are much longer than any character stroke
+	hKernel := max(width/25, 20)
+	vKernel := max(height/40, 20)
+
+	// Horizontal runs are scanned row by row, vertical runs column by column
+	hRuns := openRuns(height, width, hKernel, func(y, x int) bool {
+		return ink[y*width+x]
+	})
+	vRuns := openRuns(width, height, vKernel, func(x, y int) bool {
+		return ink[y*width+x]
+	})
+
+	tolerance := max(min(width, height)/200, 3)
+	return mergeRuns(hRuns, Horizontal, tolerance), mergeRuns(vRuns, Vertical, tolerance)
+}
+
+// run is a stretch of ink along one row (or column) that survived the opening
+type run struct {
+	pos   int
+	start int
+	end   int
+}
+
+// openRuns scans every row (or column) and returns the ink runs of at least
+// kernel pixels, which is the result of a 1D morphological opening
+func openRuns(majorLen, minorLen, kernel int, isInk func(major, minor int) bool) []run {
+	var runs []run
+	for major := 0; major < majorLen; major++ {
+		start := -1
+		for minor := 0; minor <= minorLen; minor++ {
+			if minor < minorLen && isInk(major, minor) {
+				if start < 0 {
+					start = minor
+				}
+				continue
+			}
+			if start >= 0 && minor-start >= kernel {
+				runs = append(runs, run{pos: major, start: start, end: minor})
+			}
+			start = -1
+		}
+	}
+	return runs
+}
+
+// mergeRuns joins runs on neighbouring rows (a thick line) and collinear runs
+// separated by gaps into single rulings
+func mergeRuns(runs []run, orientation Orientation, tolerance int) []Ruling {
+	if len(runs) == 0 {
+		return nil
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].pos < runs[j].pos
+	})
+
+	// Group runs whose positions are within tolerance of the group's last row
+	var groups [][]run
+	for _, r := range runs {
+		if n := len(groups); n > 0 {
+			last := groups[n-1][len(groups[n-1])-1]
+			if r.pos-last.pos <= tolerance {
+				groups[n-1] = append(groups[n-1], r)
+				continue
+			}
+		}
+		groups = append(groups, []run{r})
+	}
+
+	var rulings []Ruling
+	for _, group := range groups {
+		first, last := group[0].pos, group[len(group)-1].pos
+		rulings = append(rulings, Ruling{
+			Orientation: orientation,
+			Pos:         (first + last) / 2,
+			Thickness:   last - first + 1,
+			Segments:    unionSegments(group, tolerance),
+		})
+	}
+	return rulings
+}
+
+// unionSegments merges the extents of runs into sorted, non-overlapping segments,
+// bridging gaps no larger than tolerance
+func unionSegments(runs []run, tolerance int) []Segment {
+	segments := make([]Segment, 0, len(runs))
+	for _, r := range runs {
+		segments = append(segments, Segment{Start: r.start, End: r.end})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Start < segments[j].Start
+	})
+
+	merged := []Segment{segments[0]}
+	for _, seg := range segments[1:] {
+		last := &merged[len(merged)-1]
+		if seg.Start <= last.End+tolerance {
+			last.End = max(last.End, seg.End)
+			continue
+		}
+		merged = append(merged, seg)
+	}
+	return merged
+}
+
+// binarize marks dark pixels as ink using Otsu's threshold
+func binarize(gray *image.Gray) []bool {
+	bounds := gray.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	var histogram [256]int
+	for y := 0; y < height; y++ {
+		row := gray.Pix[y*gray.Stride : y*gray.Stride+width]
+		for _, p := range row {
+			histogram[p]++
+		}
+	}
+
+	threshold := otsuThreshold(histogram, width*height)
+
+	ink := make([]bool, width*height)
+	for y := 0; y < height; y++ {
+		row := gray.Pix[y*gray.Stride : y*gray.Stride+width]
+		for x, p := range row {
+			ink[y*width+x] = int(p) <= threshold
+		}
+	}
+	return ink
+}
+
+// otsuThreshold picks the gray level that best separates ink from paper
+func otsuThreshold(histogram [256]int, total int) int {
+	var sum float64
+	for level, count := range histogram {
+		sum += float64(level * count)
+	}
+
+	var sumBackground float64
+	var weightBackground int
+	var bestVariance float64
+	threshold := 127
+
+	for level, count := range histogram {
+		weightBackground += count
+		if weightBackground == 0 {
+			continue
+		}
+		weightForeground := total - weightBackground
+		if weightForeground == 0 {
+			break
+		}
+
+		sumBackground += float64(level * count)
+		meanBackground := sumBackground / float64(weightBackground)
+		meanForeground := (sum - sumBackground) / float64(weightForeground)
+
+		diff := meanBackground - meanForeground
+		variance := float64(weightBackground) * float64(weightForeground) * diff * diff
+		if variance > bestVariance {
+			bestVariance = variance
+			threshold = level
+		}
+	}
+	return threshold
+}
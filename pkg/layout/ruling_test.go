@@ -0,0 +1,88 @@
+package layout
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDetectRulings(t *testing.T) {
+	tests := []struct {
+		name       string
+		page       page
+		horizontal []Ruling
+		vertical   []Ruling
+	}{
+		{
+			name: "one of each",
+			page: newPage(800, 600).hline(100, 100, 700).vline(400, 50, 550),
+			horizontal: []Ruling{
+				{Orientation: Horizontal, Pos: 100, Thickness: 3, Segments: []Segment{{99, 702}}},
+			},
+			vertical: []Ruling{
+				{Orientation: Vertical, Pos: 400, Thickness: 3, Segments: []Segment{{49, 552}}},
+			},
+		},
+		{
+			// A scan dropout of a pixel or two is bridged; a gap left for a
+			// merged cell splits the ruling into segments of one line
+			name: "broken line",
+			page: newPage(800, 600).hline(100, 100, 300).hline(100, 304, 700).hline(300, 100, 300).hline(300, 500, 700),
+			horizontal: []Ruling{
+				{Orientation: Horizontal, Pos: 100, Thickness: 3, Segments: []Segment{{99, 702}}},
+				{Orientation: Horizontal, Pos: 300, Thickness: 3, Segments: []Segment{{99, 302}, {499, 702}}},
+			},
+		},
+		{
+			name: "thick line",
+			page: newPage(800, 600).hline(100, 100, 700).hline(102, 100, 700),
+			horizontal: []Ruling{
+				{Orientation: Horizontal, Pos: 101, Thickness: 5, Segments: []Segment{{99, 702}}},
+			},
+		},
+		{
+			name: "text is not a ruling",
+			page: newPage(800, 600).text(100, 100, 40).text(100, 130, 40),
+		},
+		{
+			name: "blank page",
+			page: newPage(800, 600),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			horizontal, vertical := DetectRulings(tt.page.Gray)
+			if !reflect.DeepEqual(horizontal, tt.horizontal) {
+				t.Errorf("horizontal rulings %+v, want %+v", horizontal, tt.horizontal)
+			}
+			if !reflect.DeepEqual(vertical, tt.vertical) {
+				t.Errorf("vertical rulings %+v, want %+v", vertical, tt.vertical)
+			}
+		})
+	}
+}
+
+func TestRulingCoverage(t *testing.T) {
+	ruling := Ruling{Segments: []Segment{{100, 200}, {300, 400}}}
+
+	tests := []struct {
+		start, end int
+		want       float64
+	}{
+		{100, 200, 1},
+		{100, 400, 2.0 / 3},
+		{150, 350, 0.5},
+		{200, 300, 0},
+		{0, 50, 0},
+		{300, 300, 0},
+	}
+	for _, tt := range tests {
+		if got := ruling.Coverage(tt.start, tt.end); got != tt.want {
+			t.Errorf("Coverage(%d, %d) = %v, want %v", tt.start, tt.end, got, tt.want)
+		}
+	}
+
+	if start, end := ruling.Extent(); start != 100 || end != 400 {
+		t.Errorf("Extent() = %d, %d, want 100, 400", start, end)
+	}
+}
@@ -0,0 +1,226 @@
+package migrations
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// files holds the SQL migrations, one directory per database dialect. Each
+// migration is a pair NNNN_name.up.sql and NNNN_name.down.sql.
+//
+//go:embed postgres/*.sql sqlite/*.sql
+var files embed.FS
+
+// versionTable records which migrations have been applied
+const versionTable = "schema_migrations"
+
+// Migration is one versioned schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	Data    func(tx *gorm.DB) error // Go step run after Up, if any
+}
+
+// DataStep is the Go part of a data migration, for rows SQL cannot rewrite.
+// It runs after the migration's up SQL, in the same transaction.
+type DataStep struct {
+	Version int
+	Run     func(tx *gorm.DB) error
+}
+
+// Migrator applies the migrations for one database
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+// New loads the migrations for the database's dialect and attaches the Go
+// steps of its data migrations
+func New(db *gorm.DB, steps ...DataStep) (*Migrator, error) {
+	migrations, err := load(db.Dialector.Name())
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range steps {
+		if step.Version < 1 || step.Version > len(migrations) {
+			return nil, fmt.Errorf("data step for unknown migration %d", step.Version)
+		}
+		migrations[step.Version-1].Data = step.Run
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// load reads and checks the migrations of a dialect. Versions must run from 1
+// without gaps and every migration needs both directions.
+func load(dialect string) ([]Migration, error) {
+	entries, err := fs.ReadDir(files, dialect)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s databases", dialect)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		prefix, label, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version < 1 || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("malformed migration file name %s", name)
+		}
+		data, err := fs.ReadFile(files, path.Join(dialect, name))
+		if err != nil {
+			return nil, err
+		}
+
+		migration := byVersion[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: label}
+			byVersion[version] = migration
+		}
+		if migration.Name != label {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, migration.Name, label)
+		}
+		if direction == "up" {
+			migration.Up = string(data)
+		} else {
+			migration.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d needs both an up and a down file", migration.Version)
+		}
+	}
+	return migrations, nil
+}
+
+// Migrations returns all known migrations in order
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// Latest returns the version the migrations bring the schema to
+func (m *Migrator) Latest() int {
+	return len(m.migrations)
+}
+
+// Version returns the version of the database schema, 0 if no migration has been applied
+func (m *Migrator) Version() (int, error) {
+	if !m.db.Migrator().HasTable(versionTable) {
+		return 0, nil
+	}
+	var version int
+	err := m.db.Table(versionTable).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+// ensureVersionTable creates the version table if needed
+func (m *Migrator) ensureVersionTable() error {
+	return m.db.Exec("CREATE TABLE IF NOT EXISTS " + versionTable +
+		" (version integer PRIMARY KEY, name text NOT NULL, applied_at timestamp NOT NULL)").Error
+}
+
+// Up applies all pending migrations
+func (m *Migrator) Up() ([]Migration, error) {
+	return m.To(m.Latest())
+}
+
+// Down reverts the given number of applied migrations
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	version, err := m.Version()
+	if err != nil {
+		return nil, err
+	}
+	return m.To(max(version-steps, 0))
+}
+
+// To migrates up or down to the target version and returns the migrations it
+// ran, in the order it ran them. Each migration runs in its own transaction, so
+// a failure leaves the schema at the last version that succeeded.
+func (m *Migrator) To(target int) ([]Migration, error) {
+	if target < 0 || target > m.Latest() {
+		return nil, fmt.Errorf("unknown schema version %d; the latest is %d", target, m.Latest())
+	}
+	if err := m.ensureVersionTable(); err != nil {
+		return nil, err
+	}
+	version, err := m.Version()
+	if err != nil {
+		return nil, err
+	}
+	if version > m.Latest() {
+		return nil, fmt.Errorf("schema version %d is newer than this build knows (%d)", version, m.Latest())
+	}
+
+	var ran []Migration
+	for version < target {
+		migration := m.migrations[version]
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec(migration.Up).Error; err != nil {
+				return err
+			}
+			if migration.Data != nil {
+				if err := migration.Data(tx); err != nil {
+					return err
+				}
+			}
+			return tx.Exec("INSERT INTO "+versionTable+" (version, name, applied_at) VALUES (?, ?, ?)",
+				migration.Version, migration.Name, time.Now().UTC()).Error
+		})
+		if err != nil {
+			return ran, fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+		ran = append(ran, migration)
+		version++
+	}
+	for version > target {
+		migration := m.migrations[version-1]
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec(migration.Down).Error; err != nil {
+				return err
+			}
+			return tx.Exec("DELETE FROM "+versionTable+" WHERE version = ?", migration.Version).Error
+		})
+		if err != nil {
+			return ran, fmt.Errorf("reverting migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+		ran = append(ran, migration)
+		version--
+	}
+	return ran, nil
+}
+
+// ErrSchemaMismatch is returned by Check when the schema is not at the latest version
+var ErrSchemaMismatch = errors.New("unexpected database schema version")
+
+// Check verifies that the database schema is exactly at the latest version
+func (m *Migrator) Check() error {
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	if version != m.Latest() {
+		return fmt.Errorf("%w: database is at %d, this build expects %d", ErrSchemaMismatch, version, m.Latest())
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// baselineSchema is the invoices table AutoMigrate created in the first
+// release, before organizations, page ranges and approvals
+var baselineSchema = map[string]string{
+	"postgres": `CREATE TABLE invoices (
+		id bigserial, created_at timestamptz, updated_at timestamptz, deleted_at timestamptz,
+		invoice_number text, date text, total_amount decimal, currency text, vendor_name text,
+		PRIMARY KEY (id));
+		CREATE INDEX idx_invoices_deleted_at ON invoices (deleted_at)`,
+	"sqlite": `CREATE TABLE invoices (
+		id integer PRIMARY KEY AUTOINCREMENT, created_at datetime, updated_at datetime, deleted_at datetime,
+		invoice_number text, date text, total_amount real, currency text, vendor_name text);
+		CREATE INDEX idx_invoices_deleted_at ON invoices (deleted_at)`,
+}
+
+// openSQLite opens an empty in-memory SQLite database of the test's own
+func openSQLite(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared&_pragma=foreign_keys(1)", t.Name())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
+
+// openPostgres opens a schema of its own in the Postgres database named by
+// TEST_POSTGRES_URL, and skips the test when it is not set
+func openPostgres(t *testing.T) *gorm.DB {
+	t.Helper()
+	url := os.Getenv("TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("TEST_POSTGRES_URL is not set")
+	}
+	db, err := gorm.Open(postgres.Open(url), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One connection keeps the search path for every statement
+	sqlDB.SetMaxOpenConns(1)
+	schema := fmt.Sprintf("migrations_test_%d", time.Now().UnixNano())
+	if err := db.Exec("CREATE SCHEMA " + schema + "; SET search_path TO " + schema).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DROP SCHEMA " + schema + " CASCADE")
+		sqlDB.Close()
+	})
+	return db
+}
+
+func TestDialectsHaveTheSameMigrations(t *testing.T) {
+	postgres, err := load("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlite, err := load("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(postgres) != len(sqlite) {
+		t.Fatalf("postgres has %d migrations, sqlite %d", len(postgres), len(sqlite))
+	}
+	for i := range postgres {
+		if postgres[i].Version != i+1 || postgres[i].Name != sqlite[i].Name {
+			t.Errorf("migration %d is %d %s on postgres and %d %s on sqlite",
+				i+1, postgres[i].Version, postgres[i].Name, sqlite[i].Version, sqlite[i].Name)
+		}
+	}
+
+	if _, err := load("mysql"); err == nil {
+		t.Error("load(mysql) found migrations")
+	}
+}
+
+func TestUpDownUp(t *testing.T) {
+	for dialect, open := range map[string]func(*testing.T) *gorm.DB{"sqlite": openSQLite, "postgres": openPostgres} {
+		t.Run(dialect, func(t *testing.T) {
+			db := open(t)
+			migrator, err := New(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := migrator.Check(); !errors.Is(err, ErrSchemaMismatch) {
+				t.Fatalf("Check on an empty database = %v, want ErrSchemaMismatch", err)
+			}
+
+			ran, err := migrator.Up()
+			if err != nil {
+				t.Fatalf("up: %v", err)
+			}
+			if len(ran) != migrator.Latest() {
+				t.Errorf("up ran %d migrations, want %d", len(ran), migrator.Latest())
+			}
+			if err := migrator.Check(); err != nil {
+				t.Fatalf("Check after up: %v", err)
+			}
+			for _, table := range []string{"organizations", "invoices", "line_items", "invoice_duplicates", "vendors", "unmatched_vendors"} {
+				if !db.Migrator().HasTable(table) {
+					t.Errorf("table %s missing after up", table)
+				}
+			}
+			if ran, err := migrator.Up(); err != nil || len(ran) != 0 {
+				t.Errorf("second up ran %d migrations, err %v; want none", len(ran), err)
+			}
+
+			// Back to the third migration, before vendors and every later one
+			steps := migrator.Latest() - 3
+			ran, err = migrator.Down(steps)
+			if err != nil {
+				t.Fatalf("down %d: %v", steps, err)
+			}
+			if len(ran) != steps || ran[0].Version != migrator.Latest() {
+				t.Errorf("down %d ran %v, want the last %d migrations newest first", steps, ran, steps)
+			}
+			if version, _ := migrator.Version(); version != 3 {
+				t.Errorf("version after down %d = %d, want 3", steps, version)
+			}
+			if db.Migrator().HasTable("vendors") {
+				t.Error("vendors table still there after reverting its migration")
+			}
+			if db.Migrator().HasColumn("scan_jobs", "lease_owner") || db.Migrator().HasColumn("webhook_deliveries", "lease_owner") {
+				t.Error("leases still there after reverting their migrations")
+			}
+
+			if _, err := migrator.To(0); err != nil {
+				t.Fatalf("to 0: %v", err)
+			}
+			if db.Migrator().HasTable("invoices") {
+				t.Error("invoices table still there at version 0")
+			}
+
+			if _, err := migrator.Up(); err != nil {
+				t.Fatalf("up again: %v", err)
+			}
+			if err := migrator.Check(); err != nil {
+				t.Errorf("Check after up again: %v", err)
+			}
+		})
+	}
+}
+
+func TestPartiallyMigratedSQLiteIsRefused(t *testing.T) {
+	// A later release's AutoMigrate had added organizations to the first
+	// release's table
+	db := openSQLite(t)
+	if err := db.Exec(baselineSchema["sqlite"] + "; ALTER TABLE invoices ADD COLUMN organization_id integer").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	migrator, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(); err == nil {
+		t.Fatal("up adopted a partially migrated SQLite database")
+	}
+	if version, err := migrator.Version(); err != nil || version != 0 {
+		t.Errorf("version after the failed up = %d (%v), want 0", version, err)
+	}
+	if db.Migrator().HasTable("organizations") || db.Migrator().HasColumn("invoices", "issued_on") {
+		t.Error("the failed migration was not rolled back")
+	}
+}
+
+func TestDataSteps(t *testing.T) {
+	db := openSQLite(t)
+	runs := 0
+	fail := true
+	migrator, err := New(db, DataStep{Version: 2, Run: func(tx *gorm.DB) error {
+		runs++
+		if fail {
+			return errors.New("step failed")
+		}
+		return nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failing step rolls its migration back with it
+	if _, err := migrator.Up(); err == nil {
+		t.Fatal("up succeeded with a failing data step")
+	}
+	if version, _ := migrator.Version(); version != 1 {
+		t.Errorf("version after the failed step = %d, want 1", version)
+	}
+
+	fail = false
+	if _, err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 2 {
+		t.Errorf("data step ran %d times, want once per attempt", runs)
+	}
+
+	if _, err := New(db, DataStep{Version: migrator.Latest() + 1}); err == nil {
+		t.Error("New accepted a data step for an unknown migration")
+	}
+}
+
+func TestToUnknownVersion(t *testing.T) {
+	migrator, err := New(openSQLite(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []int{-1, migrator.Latest() + 1} {
+		if _, err := migrator.To(target); err == nil {
+			t.Errorf("To(%d) succeeded", target)
+		}
+	}
+}
+
+func TestUpFromBaselineSchema(t *testing.T) {
+	for dialect, open := range map[string]func(*testing.T) *gorm.DB{"sqlite": openSQLite, "postgres": openPostgres} {
+		t.Run(dialect, func(t *testing.T) {
+			db := open(t)
+			if err := db.Exec(baselineSchema[dialect]).Error; err != nil {
+				t.Fatal(err)
+			}
+			err := db.Exec("INSERT INTO invoices (created_at, updated_at, invoice_number, date, total_amount, currency, vendor_name) VALUES (?, ?, ?, ?, ?, ?, ?)",
+				time.Now(), time.Now(), "100234", "03/05/2024", 250.0, "USD", "Initech").Error
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			migrator, err := New(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := migrator.Up(); err != nil {
+				t.Fatalf("up from the baseline schema: %v", err)
+			}
+			if err := migrator.Check(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The invoice is kept, with the columns added since empty
+			var invoice struct {
+				InvoiceNumber  string
+				VendorName     string
+				OrganizationID *uint
+				IssuedOn       string
+				VendorID       *uint
+				GLCode         string
+			}
+			if err := db.Table("invoices").Take(&invoice).Error; err != nil {
+				t.Fatal(err)
+			}
+			if invoice.InvoiceNumber != "100234" || invoice.VendorName != "Initech" || invoice.OrganizationID != nil || invoice.IssuedOn != "" || invoice.VendorID != nil {
+				t.Errorf("invoice after up %+v", invoice)
+			}
+			for _, index := range []string{"idx_invoices_issued_on", "idx_invoices_organization_id"} {
+				if !db.Migrator().HasIndex("invoices", index) {
+					t.Errorf("index %s missing after up", index)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhook_endpoints;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS api_key_usages;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS invoice_documents;
+DROP TABLE IF EXISTS scan_job_files;
+DROP TABLE IF EXISTS scan_jobs;
+DROP TABLE IF EXISTS scan_batches;
+DROP TABLE IF EXISTS line_items;
+DROP TABLE IF EXISTS invoices;
+DROP TABLE IF EXISTS organizations;
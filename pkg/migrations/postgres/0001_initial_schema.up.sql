@@ -0,0 +1,218 @@
+-- Schema as created by gorm AutoMigrate before versioned migrations.
+-- IF NOT EXISTS lets databases created by AutoMigrate adopt it unchanged.
+
+CREATE TABLE IF NOT EXISTS organizations (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    name text,
+    slug text,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_organizations_deleted_at ON organizations (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_organizations_slug ON organizations (slug);
+
+CREATE TABLE IF NOT EXISTS invoices (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    invoice_number text,
+    date text,
+    total_amount decimal,
+    currency text,
+    vendor_name text,
+    PRIMARY KEY (id)
+);
+-- The table above is the one the first release created. Columns added since
+-- are added here so that its databases can adopt this schema as well.
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS organization_id bigint;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS issued_on text NOT NULL DEFAULT '';
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS page_count bigint;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS start_page bigint;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS end_page bigint;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS approved_at timestamptz;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS approved_by text;
+CREATE INDEX IF NOT EXISTS idx_invoices_deleted_at ON invoices (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_invoices_issued_on ON invoices (issued_on);
+CREATE INDEX IF NOT EXISTS idx_invoices_organization_id ON invoices (organization_id);
+
+CREATE TABLE IF NOT EXISTS line_items (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    invoice_id bigint,
+    page bigint,
+    description text,
+    amount decimal,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_invoices_line_items FOREIGN KEY (invoice_id) REFERENCES invoices(id)
+);
+CREATE INDEX IF NOT EXISTS idx_line_items_deleted_at ON line_items (deleted_at);
+
+CREATE TABLE IF NOT EXISTS scan_batches (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    organization_id bigint,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_scan_batches_deleted_at ON scan_batches (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_scan_batches_organization_id ON scan_batches (organization_id);
+
+CREATE TABLE IF NOT EXISTS scan_jobs (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    organization_id bigint,
+    batch_id bigint,
+    api_key_id bigint,
+    status text,
+    error text,
+    invoice_id bigint,
+    display_keys text,
+    formats text,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_scan_jobs_invoice FOREIGN KEY (invoice_id) REFERENCES invoices(id)
+);
+CREATE INDEX IF NOT EXISTS idx_scan_jobs_batch_id ON scan_jobs (batch_id);
+CREATE INDEX IF NOT EXISTS idx_scan_jobs_deleted_at ON scan_jobs (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_scan_jobs_organization_id ON scan_jobs (organization_id);
+
+CREATE TABLE IF NOT EXISTS scan_job_files (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    scan_job_id bigint,
+    position bigint,
+    filename text,
+    data bytea,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_scan_jobs_files FOREIGN KEY (scan_job_id) REFERENCES scan_jobs(id)
+);
+CREATE INDEX IF NOT EXISTS idx_scan_job_files_deleted_at ON scan_job_files (deleted_at);
+
+CREATE TABLE IF NOT EXISTS invoice_documents (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    organization_id bigint,
+    invoice_id bigint,
+    kind text,
+    page bigint,
+    filename text,
+    content_type text,
+    size bigint,
+    sha256 text,
+    blob_key text,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_invoices_documents FOREIGN KEY (invoice_id) REFERENCES invoices(id)
+);
+CREATE INDEX IF NOT EXISTS idx_invoice_documents_deleted_at ON invoice_documents (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_invoice_documents_invoice_id ON invoice_documents (invoice_id);
+CREATE INDEX IF NOT EXISTS idx_invoice_documents_organization_id ON invoice_documents (organization_id);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    organization_id bigint,
+    name text,
+    prefix text,
+    hash text,
+    scopes text,
+    rate_limit_per_minute bigint,
+    rate_limit_burst bigint,
+    monthly_ocr_quota bigint,
+    last_used_at timestamptz,
+    revoked_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_api_keys_deleted_at ON api_keys (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_keys_hash ON api_keys (hash);
+CREATE INDEX IF NOT EXISTS idx_api_keys_organization_id ON api_keys (organization_id);
+
+CREATE TABLE IF NOT EXISTS api_key_usages (
+    id bigserial,
+    api_key_id bigint,
+    month text,
+    ocr_pages bigint,
+    PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_key_usage_month ON api_key_usages (api_key_id,month);
+
+CREATE TABLE IF NOT EXISTS users (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    organization_id bigint,
+    email text,
+    name text,
+    password_hash text,
+    role text,
+    disabled_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users (email);
+CREATE INDEX IF NOT EXISTS idx_users_organization_id ON users (organization_id);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id bigserial,
+    token_hash text,
+    user_id bigint,
+    created_at timestamptz,
+    expires_at timestamptz,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_sessions_user FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sessions_token_hash ON sessions (token_hash);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+
+CREATE TABLE IF NOT EXISTS webhook_endpoints (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    organization_id bigint,
+    url text,
+    description text,
+    events text,
+    secret text,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_endpoints_deleted_at ON webhook_endpoints (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_endpoints_organization_id ON webhook_endpoints (organization_id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    organization_id bigint,
+    endpoint_id bigint,
+    event_id text,
+    event text,
+    payload bytea,
+    status text,
+    attempts bigint,
+    response_status bigint,
+    last_error text,
+    next_attempt_at timestamptz,
+    delivered_at timestamptz,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_webhook_deliveries_endpoint FOREIGN KEY (endpoint_id) REFERENCES webhook_endpoints(id)
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_deleted_at ON webhook_deliveries (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_endpoint_id ON webhook_deliveries (endpoint_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_event_id ON webhook_deliveries (event_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_next_attempt_at ON webhook_deliveries (next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_organization_id ON webhook_deliveries (organization_id);
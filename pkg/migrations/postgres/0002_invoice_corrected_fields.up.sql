@@ -0,0 +1,2 @@
+-- Fields set by hand, which re-extraction must keep (JSON array of field names)
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS corrected_fields text;
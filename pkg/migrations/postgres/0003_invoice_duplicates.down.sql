@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS invoice_duplicates;
+ALTER TABLE invoices DROP COLUMN IF EXISTS image_hash;
@@ -0,0 +1,26 @@
+-- Perceptual hash of an invoice's first page, empty for invoices scanned before it was kept
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS image_hash text NOT NULL DEFAULT '';
+
+-- Invoices flagged as possible duplicates of earlier ones, awaiting review
+CREATE TABLE IF NOT EXISTS invoice_duplicates (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    organization_id bigint,
+    invoice_id bigint,
+    original_id bigint,
+    reason text,
+    detail text,
+    status text,
+    reviewed_at timestamptz,
+    reviewed_by text,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_invoices_duplicates FOREIGN KEY (invoice_id) REFERENCES invoices(id),
+    CONSTRAINT fk_invoice_duplicates_original FOREIGN KEY (original_id) REFERENCES invoices(id)
+);
+CREATE INDEX IF NOT EXISTS idx_invoice_duplicates_deleted_at ON invoice_duplicates (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_invoice_duplicates_invoice_id ON invoice_duplicates (invoice_id);
+CREATE INDEX IF NOT EXISTS idx_invoice_duplicates_original_id ON invoice_duplicates (original_id);
+CREATE INDEX IF NOT EXISTS idx_invoice_duplicates_organization_id ON invoice_duplicates (organization_id);
+CREATE INDEX IF NOT EXISTS idx_invoice_duplicates_status ON invoice_duplicates (status);
@@ -0,0 +1,40 @@
+-- Vendor master data of each organization
+CREATE TABLE IF NOT EXISTS vendors (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    organization_id bigint,
+    name text,
+    aliases text,
+    domains text,
+    tax_id text,
+    address text,
+    default_currency text,
+    default_gl_code text,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_vendors_deleted_at ON vendors (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_vendors_organization_id ON vendors (organization_id);
+
+-- Scanned vendor names that resolved to no vendor, awaiting review
+CREATE TABLE IF NOT EXISTS unmatched_vendors (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    organization_id bigint,
+    name_key text,
+    names text,
+    domains text,
+    invoice_count bigint,
+    last_seen_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_unmatched_vendors_deleted_at ON unmatched_vendors (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_unmatched_vendors_organization_name_key ON unmatched_vendors (organization_id, name_key);
+
+-- The vendor an invoice resolved to, and the ledger account it is booked to
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS vendor_id bigint CONSTRAINT fk_invoices_vendor REFERENCES vendors(id);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS gl_code text NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS idx_invoices_vendor_id ON invoices (vendor_id);
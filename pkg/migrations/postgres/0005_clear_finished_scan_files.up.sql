@@ -0,0 +1,4 @@
+-- Uploads of scan jobs that are over are no longer needed; the originals are
+-- kept in the blob store with their invoices
+UPDATE scan_job_files SET data = NULL
+WHERE scan_job_id IN (SELECT id FROM scan_jobs WHERE status IN ('done', 'failed'));
@@ -0,0 +1,6 @@
+-- The instance sending a webhook delivery and until when its claim holds, so
+-- that replicas running the delivery loop do not send the same delivery twice.
+-- A claim left by an instance that stopped lapses and the delivery is sent by
+-- another.
+ALTER TABLE webhook_deliveries ADD COLUMN lease_owner text NOT NULL DEFAULT '';
+ALTER TABLE webhook_deliveries ADD COLUMN lease_expires_at timestamptz;
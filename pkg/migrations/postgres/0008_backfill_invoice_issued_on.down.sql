@@ -0,0 +1,2 @@
+-- The filled in dates are kept; saving an invoice sets them anyway
+SELECT 1;
@@ -0,0 +1,208 @@
+-- The Postgres 0001 schema in SQLite types.
+
+CREATE TABLE organizations (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    name text,
+    slug text
+);
+CREATE INDEX idx_organizations_deleted_at ON organizations (deleted_at);
+CREATE UNIQUE INDEX idx_organizations_slug ON organizations (slug);
+
+CREATE TABLE IF NOT EXISTS invoices (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    invoice_number text,
+    date text,
+    total_amount real,
+    currency text,
+    vendor_name text
+);
+-- SQLite has no ADD COLUMN IF NOT EXISTS, so unlike Postgres only the first
+-- release's table, or none, can be adopted. A SQLite database that a later
+-- release's AutoMigrate had already added any of these columns, or any of the
+-- tables below, to cannot be adopted: this migration fails and is rolled back,
+-- and the database has to be exported and loaded into a fresh one.
+ALTER TABLE invoices ADD COLUMN organization_id integer;
+ALTER TABLE invoices ADD COLUMN issued_on text NOT NULL DEFAULT '';
+ALTER TABLE invoices ADD COLUMN page_count integer;
+ALTER TABLE invoices ADD COLUMN start_page integer;
+ALTER TABLE invoices ADD COLUMN end_page integer;
+ALTER TABLE invoices ADD COLUMN approved_at datetime;
+ALTER TABLE invoices ADD COLUMN approved_by text;
+CREATE INDEX IF NOT EXISTS idx_invoices_deleted_at ON invoices (deleted_at);
+CREATE INDEX idx_invoices_issued_on ON invoices (issued_on);
+CREATE INDEX idx_invoices_organization_id ON invoices (organization_id);
+
+CREATE TABLE line_items (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    invoice_id integer,
+    page integer,
+    description text,
+    amount real,
+    CONSTRAINT fk_invoices_line_items FOREIGN KEY (invoice_id) REFERENCES invoices(id)
+);
+CREATE INDEX idx_line_items_deleted_at ON line_items (deleted_at);
+
+CREATE TABLE scan_batches (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    organization_id integer
+);
+CREATE INDEX idx_scan_batches_deleted_at ON scan_batches (deleted_at);
+CREATE INDEX idx_scan_batches_organization_id ON scan_batches (organization_id);
+
+CREATE TABLE scan_jobs (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    organization_id integer,
+    batch_id integer,
+    api_key_id integer,
+    status text,
+    error text,
+    invoice_id integer,
+    display_keys text,
+    formats text,
+    CONSTRAINT fk_scan_jobs_invoice FOREIGN KEY (invoice_id) REFERENCES invoices(id),
+    CONSTRAINT fk_scan_batches_jobs FOREIGN KEY (batch_id) REFERENCES scan_batches(id)
+);
+CREATE INDEX idx_scan_jobs_batch_id ON scan_jobs (batch_id);
+CREATE INDEX idx_scan_jobs_deleted_at ON scan_jobs (deleted_at);
+CREATE INDEX idx_scan_jobs_organization_id ON scan_jobs (organization_id);
+
+CREATE TABLE scan_job_files (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    scan_job_id integer,
+    position integer,
+    filename text,
+    data blob,
+    CONSTRAINT fk_scan_jobs_files FOREIGN KEY (scan_job_id) REFERENCES scan_jobs(id)
+);
+CREATE INDEX idx_scan_job_files_deleted_at ON scan_job_files (deleted_at);
+
+CREATE TABLE invoice_documents (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    organization_id integer,
+    invoice_id integer,
+    kind text,
+    page integer,
+    filename text,
+    content_type text,
+    size integer,
+    sha256 text,
+    blob_key text,
+    CONSTRAINT fk_invoices_documents FOREIGN KEY (invoice_id) REFERENCES invoices(id)
+);
+CREATE INDEX idx_invoice_documents_deleted_at ON invoice_documents (deleted_at);
+CREATE INDEX idx_invoice_documents_invoice_id ON invoice_documents (invoice_id);
+CREATE INDEX idx_invoice_documents_organization_id ON invoice_documents (organization_id);
+
+CREATE TABLE api_keys (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    organization_id integer,
+    name text,
+    prefix text,
+    hash text,
+    scopes text,
+    rate_limit_per_minute integer,
+    rate_limit_burst integer,
+    monthly_ocr_quota integer,
+    last_used_at datetime,
+    revoked_at datetime
+);
+CREATE INDEX idx_api_keys_deleted_at ON api_keys (deleted_at);
+CREATE UNIQUE INDEX idx_api_keys_hash ON api_keys (hash);
+CREATE INDEX idx_api_keys_organization_id ON api_keys (organization_id);
+
+CREATE TABLE api_key_usages (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    api_key_id integer,
+    month text,
+    ocr_pages integer
+);
+CREATE UNIQUE INDEX idx_api_key_usage_month ON api_key_usages (api_key_id,month);
+
+CREATE TABLE users (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    organization_id integer,
+    email text,
+    name text,
+    password_hash text,
+    role text,
+    disabled_at datetime
+);
+CREATE INDEX idx_users_deleted_at ON users (deleted_at);
+CREATE UNIQUE INDEX idx_users_email ON users (email);
+CREATE INDEX idx_users_organization_id ON users (organization_id);
+
+CREATE TABLE sessions (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    token_hash text,
+    user_id integer,
+    created_at datetime,
+    expires_at datetime,
+    CONSTRAINT fk_sessions_user FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE UNIQUE INDEX idx_sessions_token_hash ON sessions (token_hash);
+CREATE INDEX idx_sessions_user_id ON sessions (user_id);
+
+CREATE TABLE webhook_endpoints (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    organization_id integer,
+    url text,
+    description text,
+    events text,
+    secret text
+);
+CREATE INDEX idx_webhook_endpoints_deleted_at ON webhook_endpoints (deleted_at);
+CREATE INDEX idx_webhook_endpoints_organization_id ON webhook_endpoints (organization_id);
+
+CREATE TABLE webhook_deliveries (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    organization_id integer,
+    endpoint_id integer,
+    event_id text,
+    event text,
+    payload blob,
+    status text,
+    attempts integer,
+    response_status integer,
+    last_error text,
+    next_attempt_at datetime,
+    delivered_at datetime,
+    CONSTRAINT fk_webhook_deliveries_endpoint FOREIGN KEY (endpoint_id) REFERENCES webhook_endpoints(id)
+);
+CREATE INDEX idx_webhook_deliveries_deleted_at ON webhook_deliveries (deleted_at);
+CREATE INDEX idx_webhook_deliveries_endpoint_id ON webhook_deliveries (endpoint_id);
+CREATE INDEX idx_webhook_deliveries_event_id ON webhook_deliveries (event_id);
+CREATE INDEX idx_webhook_deliveries_next_attempt_at ON webhook_deliveries (next_attempt_at);
+CREATE INDEX idx_webhook_deliveries_organization_id ON webhook_deliveries (organization_id);
@@ -0,0 +1,25 @@
+-- Perceptual hash of an invoice's first page, empty for invoices scanned before it was kept
+ALTER TABLE invoices ADD COLUMN image_hash text NOT NULL DEFAULT '';
+
+-- Invoices flagged as possible duplicates of earlier ones, awaiting review
+CREATE TABLE invoice_duplicates (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    organization_id integer,
+    invoice_id integer,
+    original_id integer,
+    reason text,
+    detail text,
+    status text,
+    reviewed_at datetime,
+    reviewed_by text,
+    CONSTRAINT fk_invoices_duplicates FOREIGN KEY (invoice_id) REFERENCES invoices(id),
+    CONSTRAINT fk_invoice_duplicates_original FOREIGN KEY (original_id) REFERENCES invoices(id)
+);
+CREATE INDEX idx_invoice_duplicates_deleted_at ON invoice_duplicates (deleted_at);
+CREATE INDEX idx_invoice_duplicates_invoice_id ON invoice_duplicates (invoice_id);
+CREATE INDEX idx_invoice_duplicates_original_id ON invoice_duplicates (original_id);
+CREATE INDEX idx_invoice_duplicates_organization_id ON invoice_duplicates (organization_id);
+CREATE INDEX idx_invoice_duplicates_status ON invoice_duplicates (status);
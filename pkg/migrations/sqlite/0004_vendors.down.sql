@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_invoices_vendor_id;
+ALTER TABLE invoices DROP COLUMN gl_code;
+ALTER TABLE invoices DROP COLUMN vendor_id;
+DROP TABLE IF EXISTS unmatched_vendors;
+DROP TABLE IF EXISTS vendors;
@@ -0,0 +1,38 @@
+-- Vendor master data of each organization
+CREATE TABLE vendors (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    organization_id integer,
+    name text,
+    aliases text,
+    domains text,
+    tax_id text,
+    address text,
+    default_currency text,
+    default_gl_code text
+);
+CREATE INDEX idx_vendors_deleted_at ON vendors (deleted_at);
+CREATE INDEX idx_vendors_organization_id ON vendors (organization_id);
+
+-- Scanned vendor names that resolved to no vendor, awaiting review
+CREATE TABLE unmatched_vendors (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    organization_id integer,
+    name_key text,
+    names text,
+    domains text,
+    invoice_count integer,
+    last_seen_at datetime
+);
+CREATE INDEX idx_unmatched_vendors_deleted_at ON unmatched_vendors (deleted_at);
+CREATE UNIQUE INDEX idx_unmatched_vendors_organization_name_key ON unmatched_vendors (organization_id, name_key);
+
+-- The vendor an invoice resolved to, and the ledger account it is booked to
+ALTER TABLE invoices ADD COLUMN vendor_id integer CONSTRAINT fk_invoices_vendor REFERENCES vendors(id);
+ALTER TABLE invoices ADD COLUMN gl_code text NOT NULL DEFAULT '';
+CREATE INDEX idx_invoices_vendor_id ON invoices (vendor_id);
@@ -0,0 +1,2 @@
+-- The cleared uploads cannot be restored
+SELECT 1;
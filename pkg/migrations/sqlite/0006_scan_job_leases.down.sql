@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_scan_jobs_lease_owner;
+ALTER TABLE scan_jobs DROP COLUMN lease_expires_at;
+ALTER TABLE scan_jobs DROP COLUMN lease_owner;
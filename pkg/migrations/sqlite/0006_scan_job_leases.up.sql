@@ -0,0 +1,6 @@
+-- The instance queuing or running a scan job and until when its claim holds.
+-- Other instances take a job over only once the claim lapses; jobs from before
+-- have no claim and are taken over by the first instance to start.
+ALTER TABLE scan_jobs ADD COLUMN lease_owner text NOT NULL DEFAULT '';
+ALTER TABLE scan_jobs ADD COLUMN lease_expires_at datetime;
+CREATE INDEX idx_scan_jobs_lease_owner ON scan_jobs (lease_owner);
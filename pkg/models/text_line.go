@@ -0,0 +1,11 @@
+package models
+
+// TextLine represents a line of text with its position from OCR
+type TextLine struct {
+	Text   string
+	Page   int // 1-based page number within the document
+	X      int
+	Y      int
+	Width  int
+	Height int
+}
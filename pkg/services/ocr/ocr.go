@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"image"
 	"io"
-	"os"
 	"strconv"
 	"strings"
 
@@ -37,14 +36,9 @@ func NewService(endpoint, apiKey string) *Service {
 	}
 }
 
-// EnhanceImageForOCR enhances the image for better OCR results
-func (s *Service) EnhanceImageForOCR(imagePath string) (string, error) {
-	// Open the image
-	src, err := imaging.Open(imagePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to open image: %v", err)
-	}
-
+// EnhanceImageForOCR enhances the image for better OCR results. The image is
+// processed in memory so concurrent scans never share any files.
+func (s *Service) EnhanceImageForOCR(src image.Image) *image.NRGBA {
 	// Apply a series of image processing operations to enhance the document
 	// 1. Convert to grayscale for better contrast
 	img := imaging.Grayscale(src)
@@ -61,24 +55,11 @@ func (s *Service) EnhanceImageForOCR(imagePath string) (string, error) {
 	// 5. Apply gamma correction to enhance details
 	img = imaging.AdjustGamma(img, 1.2)
 
-	// Save the processed image
-	processedPath := "processed-invoice.jpg"
-	err = imaging.Save(img, processedPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to save processed image: %v", err)
-	}
-
-	return processedPath, nil
+	return img
 }
 
 // CreateDisplayImage creates a cropped and enhanced version of the invoice for display
-func (s *Service) CreateDisplayImage(sourcePath, destPath string) error {
-	// Open the source image
-	src, err := imaging.Open(sourcePath)
-	if err != nil {
-		return err
-	}
-
+func (s *Service) CreateDisplayImage(src image.Image, destPath string) error {
 	// Get image dimensions
 	width := src.Bounds().Dx()
 	height := src.Bounds().Dy()
@@ -120,42 +101,43 @@ func (s *Service) CreateDisplayImage(sourcePath, destPath string) error {
 	}
 
 	// Save the processed image
-	err = imaging.Save(img, destPath)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return imaging.Save(img, destPath)
 }
 
 // ExtractText performs OCR on an image and returns the extracted text lines
-func (s *Service) ExtractText(imagePath string) ([]models.TextLine, error) {
-	// Read the processed image file
-	imageData, err := os.ReadFile(imagePath)
+// tagged with the given page number
+func (s *Service) ExtractText(img image.Image, page int) ([]models.TextLine, error) {
+	// Encode the processed image in memory
+	var imageData bytes.Buffer
+	if err := imaging.Encode(&imageData, img, imaging.JPEG); err != nil {
+		return nil, fmt.Errorf("failed to encode processed image: %v", err)
+	}
+
+	result, err := s.Recognize(context.Background(), imageData.Bytes())
 	if err != nil {
-		return nil, fmt.Errorf("failed to read processed file: %v", err)
+		return nil, err
 	}
 
-	// Create a ReadCloser from the image data
-	imageReader := io.NopCloser(bytes.NewReader(imageData))
+	// Extract text from the OCR result
+	return extractTextFromOCRResult(result, page), nil
+}
 
-	// Extract text
+// Recognize sends an encoded image to OCR and returns the raw result
+func (s *Service) Recognize(ctx context.Context, imageData []byte) (computervision.OcrResult, error) {
 	result, err := s.client.RecognizePrintedTextInStream(
-		context.Background(),
+		ctx,
 		true,
-		imageReader,
+		io.NopCloser(bytes.NewReader(imageData)),
 		computervision.OcrLanguages(computervision.En),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to extract text: %v", err)
+		return result, fmt.Errorf("failed to extract text: %v", err)
 	}
-
-	// Extract text from the OCR result
-	return extractTextFromOCRResult(result), nil
+	return result, nil
 }
 
 // extractTextFromOCRResult extracts text lines with position information from OCR result
-func extractTextFromOCRResult(result computervision.OcrResult) []models.TextLine {
+func extractTextFromOCRResult(result computervision.OcrResult, page int) []models.TextLine {
 	var textLines []models.TextLine
 	for _, region := range *result.Regions {
 		for _, line := range *region.Lines {
@@ -180,6 +162,7 @@ func extractTextFromOCRResult(result computervision.OcrResult) []models.TextLine
 			if len(boundingBox) >= 4 {
 				textLines = append(textLines, models.TextLine{
 					Text:   strings.TrimSpace(lineText.String()),
+					Page:   page,
 					X:      boundingBox[0],
 					Y:      boundingBox[1],
 					Width:  boundingBox[2],
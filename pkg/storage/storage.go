@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a key holds no blob
+var ErrNotFound = errors.New("blob not found")
+
+// ErrInvalidKey is returned for keys that are empty, absolute or climb out of
+// the store with ".."
+var ErrInvalidKey = errors.New("invalid blob key")
+
+// Info describes a stored blob
+type Info struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// BlobStore keeps immutable blobs under slash-separated keys
+type BlobStore interface {
+	// Put stores data under key, replacing any blob already there
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get opens the blob under key. The caller must close the reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, *Info, error)
+	// Delete removes the blob under key. Deleting a missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every blob whose key starts with prefix
+	List(ctx context.Context, prefix string, fn func(Info) error) error
+}
+
+// ContentKey returns the content-addressed key for data: the prefix, the hex
+// SHA-256 of the data and the extension. Storing the same bytes twice yields
+// the same key, so duplicates cost nothing.
+func ContentKey(prefix string, data []byte, ext string) string {
+	sum := sha256.Sum256(data)
+	return strings.TrimSuffix(prefix, "/") + "/" + hex.EncodeToString(sum[:]) + ext
+}
+
+// ValidKey reports whether key is safe to use with any store
+func ValidKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// RetentionRule expires the blobs under a prefix once they are older than MaxAge
+type RetentionRule struct {
+	Prefix string
+	MaxAge time.Duration
+}
+
+// ApplyRetention deletes the blobs that have outlived their rule and returns
+// how many were removed
+func ApplyRetention(ctx context.Context, store BlobStore, rules []RetentionRule) (int, error) {
+	removed := 0
+	for _, rule := range rules {
+		cutoff := time.Now().Add(-rule.MaxAge)
+		var expired []string
+		err := store.List(ctx, rule.Prefix, func(info Info) error {
+			if info.ModTime.Before(cutoff) {
+				expired = append(expired, info.Key)
+			}
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+		for _, key := range expired {
+			if err := store.Delete(ctx, key); err != nil {
+				log.Printf("Warning: Failed to delete expired blob %s: %v", key, err)
+				continue
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
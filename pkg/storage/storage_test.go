@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// s3Object is an object held by fakeS3
+type s3Object struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+// fakeS3 serves the part of the S3 API the store uses, for one bucket, in
+// the path style clients use for IP endpoints. Requests are not authenticated.
+type fakeS3 struct {
+	bucket  string
+	mu      sync.Mutex
+	objects map[string]s3Object
+}
+
+// s3Error is the XML body of an S3 error response
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+	Key     string `xml:",omitempty"`
+}
+
+// s3ListResult is the XML body of a ListObjectsV2 response
+type s3ListResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	MaxKeys     int
+	IsTruncated bool
+	Contents    []s3ListEntry
+}
+
+type s3ListEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		f.fail(w, 404, "NoSuchBucket", key)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case key == "" && r.Method == "GET" && r.URL.Query().Has("location"):
+		fmt.Fprint(w, `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+	case key == "" && r.Method == "GET":
+		f.list(w, r.URL.Query())
+	case r.Method == "PUT":
+		data, err := readS3Body(r)
+		if err != nil {
+			f.fail(w, 400, "IncompleteBody", key)
+			return
+		}
+		f.objects[key] = s3Object{data: data, contentType: r.Header.Get("Content-Type"), modTime: time.Now()}
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == "HEAD" || r.Method == "GET":
+		object, ok := f.objects[key]
+		if !ok {
+			f.fail(w, 404, "NoSuchKey", key)
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Header().Set("Last-Modified", object.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+		if r.Method == "GET" {
+			w.Write(object.data)
+		}
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(204)
+	default:
+		f.fail(w, 405, "MethodNotAllowed", key)
+	}
+}
+
+// list answers a ListObjectsV2 request in one page
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	result := s3ListResult{Name: f.bucket, Prefix: query.Get("prefix"), MaxKeys: 1000}
+	for key, object := range f.objects {
+		if strings.HasPrefix(key, result.Prefix) {
+			result.Contents = append(result.Contents, s3ListEntry{
+				Key:          key,
+				LastModified: object.modTime.UTC().Format(time.RFC3339),
+				ETag:         `"etag"`,
+				Size:         len(object.data),
+				StorageClass: "STANDARD",
+			})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// fail writes an S3 error response; HEAD responses carry no body
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code, key string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(s3Error{Code: code, Message: code, Key: key})
+}
+
+// readS3Body reads an upload, decoding the aws-chunked encoding clients use
+// to sign the payload over plain HTTP
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var data []byte
+	body := bufio.NewReader(r.Body)
+	for {
+		header, err := body.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, size+2) // the chunk and its CRLF
+		if _, err := io.ReadFull(body, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+// newFakeS3Store returns a store on a fake S3 server, and the server's objects
+func newFakeS3Store(t *testing.T) (*S3Store, *fakeS3) {
+	t.Helper()
+	fake := &fakeS3{bucket: "scans", objects: make(map[string]s3Object)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	store, err := NewS3Store(S3Config{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Region:    "us-east-1",
+		Bucket:    "scans",
+		AccessKey: "minio",
+		SecretKey: "minio-secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, fake
+}
+
+// testBlobStore checks the behaviour every BlobStore must have
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+	data := []byte("%PDF-1.4 invoice")
+	key := ContentKey("originals", data, ".pdf")
+
+	if err := store.Put(ctx, key, data, "application/pdf"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	reader, info, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(got) != string(data) {
+		t.Errorf("Get read %q, %v; want %q", got, err, data)
+	}
+	if info.Key != key || info.Size != int64(len(data)) || info.ContentType != "application/pdf" || info.ModTime.IsZero() {
+		t.Errorf("Get info %+v", info)
+	}
+
+	// Put replaces
+	if err := store.Put(ctx, key, []byte("replaced"), "application/pdf"); err != nil {
+		t.Fatalf("second Put: %v", err)
+	}
+	if reader, info, err := store.Get(ctx, key); err != nil || info.Size != int64(len("replaced")) {
+		t.Errorf("Get after replacing: %+v, %v", info, err)
+	} else {
+		reader.Close()
+	}
+
+	if err := store.Put(ctx, "display/a.jpg", []byte("a"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, "display/b.jpg", []byte("bb"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	err = store.List(ctx, "display/", func(info Info) error {
+		listed = append(listed, fmt.Sprintf("%s:%d", info.Key, info.Size))
+		return nil
+	})
+	slices.Sort(listed)
+	if err != nil || !slices.Equal(listed, []string{"display/a.jpg:1", "display/b.jpg:2"}) {
+		t.Errorf("List(display/) = %v, %v", listed, err)
+	}
+	stop := errors.New("stop")
+	if err := store.List(ctx, "", func(Info) error { return stop }); err != stop {
+		t.Errorf("List passed on %v, want the callback's error", err)
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, err := store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete: %v, want ErrNotFound", err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of a missing blob: %v", err)
+	}
+	if _, _, err := store.Get(ctx, "display/missing.jpg"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a missing blob: %v, want ErrNotFound", err)
+	}
+
+	for _, bad := range []string{"", "/etc/passwd", "../outside", "display/../../outside", "display//a.jpg", `display\a.jpg`} {
+		if err := store.Put(ctx, bad, data, "text/plain"); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q): %v, want ErrInvalidKey", bad, err)
+		}
+		if _, _, err := store.Get(ctx, bad); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Get(%q): %v, want ErrInvalidKey", bad, err)
+		}
+		if err := store.Delete(ctx, bad); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Delete(%q): %v, want ErrInvalidKey", bad, err)
+		}
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLocalStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+
+	// Keys never reach outside the root
+	if _, err := os.Stat(filepath.Join(dir, "outside")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a blob was written outside the store: %v", err)
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	store, fake := newFakeS3Store(t)
+	testBlobStore(t, store)
+
+	if _, ok := fake.objects["display/a.jpg"]; !ok {
+		t.Errorf("objects on the server: %v", fake.objects)
+	}
+}
+
+func TestS3StoreMissingBucket(t *testing.T) {
+	store, _ := newFakeS3Store(t)
+	store.bucket = "other"
+	if err := store.Put(context.Background(), "display/a.jpg", []byte("a"), "image/jpeg"); err == nil {
+		t.Error("Put to a missing bucket succeeded")
+	}
+}
+
+func TestContentKey(t *testing.T) {
+	a := ContentKey("originals/", []byte("invoice"), ".png")
+	if a != ContentKey("originals", []byte("invoice"), ".png") {
+		t.Error("the same bytes got different keys")
+	}
+	if a == ContentKey("originals", []byte("invoice 2"), ".png") {
+		t.Error("different bytes got the same key")
+	}
+	if !strings.HasPrefix(a, "originals/") || !strings.HasSuffix(a, ".png") || len(a) != len("originals/")+64+len(".png") || !ValidKey(a) {
+		t.Errorf("ContentKey = %s", a)
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLocalStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	old := time.Now().Add(-48 * time.Hour)
+	for _, key := range []string{"display/old.jpg", "display/new.jpg", "originals/old.png"} {
+		if err := store.Put(ctx, key, []byte(key), ""); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(key, "old") {
+			if err := os.Chtimes(filepath.Join(dir, filepath.FromSlash(key)), old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	removed, err := ApplyRetention(ctx, store, []RetentionRule{{Prefix: "display/", MaxAge: 24 * time.Hour}})
+	if err != nil || removed != 1 {
+		t.Fatalf("ApplyRetention removed %d, %v; want 1", removed, err)
+	}
+	for key, kept := range map[string]bool{"display/old.jpg": false, "display/new.jpg": true, "originals/old.png": true} {
+		reader, _, err := store.Get(ctx, key)
+		if err == nil {
+			reader.Close()
+		}
+		if (err == nil) != kept {
+			t.Errorf("%s after retention: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"scan-in/pkg/layout"
+	"scan-in/pkg/storage"
+
+	"github.com/Azure/azure-sdk-for-go/services/cognitiveservices/v3.0/computervision"
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+// errNoStoredOCR means an invoice was scanned before OCR output was kept
+var errNoStoredOCR = errors.New("no stored OCR output")
+
+// invoiceReextraction is what re-running extraction would change on one invoice
+type invoiceReextraction struct {
+	invoice   Invoice
+	extracted Invoice
+	Changes   []FieldChangeDTO
+	Kept      []string // corrected fields whose extracted value differs
+	domains   []string // domains on the document, for the vendor review list
+}
+
+// reextractionPlan is the outcome of re-running extraction over a set of invoices
+type reextractionPlan struct {
+	Checked  int
+	Invoices []invoiceReextraction
+	Skipped  []ReextractionSkipDTO
+}
+
+// readBlob returns the whole contents of a blob
+func readBlob(ctx context.Context, store storage.BlobStore, key string) ([]byte, error) {
+	reader, _, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// storedTextLines rebuilds an invoice's text lines from its stored OCR output.
+// Table cells are detected again on the stored processed images.
+func storedTextLines(ctx context.Context, store storage.BlobStore, invoice Invoice) ([]TextLine, error) {
+	processed := make(map[int]InvoiceDocument)
+	for _, document := range invoice.Documents {
+		if document.Kind == DocumentProcessed {
+			processed[document.Page] = document
+		}
+	}
+
+	var textLines []TextLine
+	found := false
+	for _, document := range invoice.Documents {
+		if document.Kind != DocumentOCR {
+			continue
+		}
+		found = true
+
+		data, err := readBlob(ctx, store, document.BlobKey)
+		if err != nil {
+			return nil, fmt.Errorf("page %d OCR output: %v", document.Page, err)
+		}
+		var result computervision.OcrResult
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("page %d OCR output: %v", document.Page, err)
+		}
+		pageLines := extractTextFromOCRResult(result, document.Page)
+
+		if image, ok := processed[document.Page]; ok {
+			data, err := readBlob(ctx, store, image.BlobKey)
+			if err != nil {
+				return nil, fmt.Errorf("page %d processed image: %v", document.Page, err)
+			}
+			img, err := imaging.Decode(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("page %d processed image: %v", document.Page, err)
+			}
+			assignTableCells(pageLines, layout.DetectGrids(toGray(img)))
+		}
+		textLines = append(textLines, pageLines...)
+	}
+	if !found {
+		return nil, errNoStoredOCR
+	}
+	return textLines, nil
+}
+
+// diffExtraction compares an invoice with freshly extracted values. Fields a
+// person corrected are never changed; they are listed in Kept if they differ.
+func diffExtraction(invoice, extracted Invoice) invoiceReextraction {
+	result := invoiceReextraction{invoice: invoice, extracted: extracted}
+	compare := func(field string, old, new interface{}, equal bool) {
+		if equal {
+			return
+		}
+		if slices.Contains(invoice.CorrectedFields, field) {
+			result.Kept = append(result.Kept, field)
+			return
+		}
+		result.Changes = append(result.Changes, FieldChangeDTO{Field: field, Old: old, New: new})
+	}
+
+	compare("invoice_number", invoice.InvoiceNumber, extracted.InvoiceNumber, invoice.InvoiceNumber == extracted.InvoiceNumber)
+	compare("date", invoice.Date, extracted.Date, invoice.Date == extracted.Date)
+	compare("total_amount", invoice.TotalAmount, extracted.TotalAmount, invoice.TotalAmount == extracted.TotalAmount)
+	compare("currency", invoice.Currency, extracted.Currency, invoice.Currency == extracted.Currency)
+	compare("vendor_name", invoice.VendorName, extracted.VendorName, invoice.VendorName == extracted.VendorName)
+	compare("vendor_id", invoice.VendorID, extracted.VendorID, sameVendorID(invoice.VendorID, extracted.VendorID))
+	compare("gl_code", invoice.GLCode, extracted.GLCode, invoice.GLCode == extracted.GLCode)
+	oldItems, newItems := lineItemValues(invoice.LineItems), lineItemValues(extracted.LineItems)
+	compare("line_items", oldItems, newItems, slices.Equal(oldItems, newItems))
+	return result
+}
+
+// sameVendorID reports whether two vendor links point at the same vendor
+func sameVendorID(a, b *uint) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
+
+// lineItemValues returns the comparable values of line items
+func lineItemValues(items []LineItem) []lineItemUpdate {
+	values := make([]lineItemUpdate, 0, len(items))
+	for _, item := range items {
+		values = append(values, lineItemUpdate{Page: item.Page, Description: item.Description, Amount: item.Amount})
+	}
+	return values
+}
+
+// planReextraction re-runs extraction over the invoices matching the filter
+// without changing anything. Approved invoices are skipped. An invoice whose
+// vendor name would change is linked again to the vendor the new name matches.
+func (h *invoiceHandlers) planReextraction(ctx context.Context, filter InvoiceFilter) (*reextractionPlan, error) {
+	plan := &reextractionPlan{}
+	vendors := make(map[uint][]Vendor) // known vendors of each organization
+	err := h.invoices.Each(ctx, filter, func(invoice Invoice) error {
+		plan.Checked++
+		if invoice.ApprovedAt != nil {
+			plan.Skipped = append(plan.Skipped, ReextractionSkipDTO{InvoiceID: invoice.ID, Reason: "approved"})
+			return nil
+		}
+		textLines, err := storedTextLines(ctx, h.blobs, invoice)
+		if err != nil {
+			plan.Skipped = append(plan.Skipped, ReextractionSkipDTO{InvoiceID: invoice.ID, Reason: err.Error()})
+			return nil
+		}
+		extracted := extractInvoiceDetails(textLines)
+		var domains []string
+		if extracted.VendorName != invoice.VendorName && !slices.Contains(invoice.CorrectedFields, "vendor_name") {
+			known, ok := vendors[invoice.OrganizationID]
+			if !ok {
+				if known, err = h.vendors.List(withTenant(ctx, invoice.OrganizationID)); err != nil {
+					return fmt.Errorf("loading vendors: %v", err)
+				}
+				vendors[invoice.OrganizationID] = known
+			}
+			domains = extractDomains(textLines)
+			linkVendor(known, &extracted, textLines, domains)
+		} else {
+			extracted.VendorID, extracted.Vendor, extracted.GLCode = invoice.VendorID, invoice.Vendor, invoice.GLCode
+			// As at scan time, the vendor's currency stands in for one the document doesn't state
+			if invoice.Vendor != nil && invoice.Vendor.DefaultCurrency != "" && statedCurrency(textLines) == "" {
+				extracted.Currency = invoice.Vendor.DefaultCurrency
+			}
+		}
+		result := diffExtraction(invoice, extracted)
+		result.domains = domains
+		if len(result.Changes) > 0 || len(result.Kept) > 0 {
+			plan.Invoices = append(plan.Invoices, result)
+		}
+		return nil
+	})
+	return plan, err
+}
+
+// Changed returns how many invoices the plan would change
+func (p *reextractionPlan) Changed() int {
+	changed := 0
+	for _, result := range p.Invoices {
+		if len(result.Changes) > 0 {
+			changed++
+		}
+	}
+	return changed
+}
+
+// Confirmation returns a token identifying exactly the changes in the plan.
+// Applying requires it, so what is applied is what was reviewed.
+func (p *reextractionPlan) Confirmation() string {
+	type entry struct {
+		InvoiceID uint             `json:"invoice_id"`
+		Changes   []FieldChangeDTO `json:"changes"`
+	}
+	var entries []entry
+	for _, result := range p.Invoices {
+		if len(result.Changes) > 0 {
+			entries = append(entries, entry{InvoiceID: result.invoice.ID, Changes: result.Changes})
+		}
+	}
+	data, _ := json.Marshal(entries)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// applyReextraction writes the plan's changes, one invoice at a time
+func (h *invoiceHandlers) applyReextraction(ctx context.Context, plan *reextractionPlan) error {
+	for _, result := range plan.Invoices {
+		if len(result.Changes) == 0 {
+			continue
+		}
+		invoice := result.invoice
+		replaceItems := false
+		for _, change := range result.Changes {
+			switch change.Field {
+			case "invoice_number":
+				invoice.InvoiceNumber = result.extracted.InvoiceNumber
+			case "date":
+				invoice.Date = result.extracted.Date
+			case "total_amount":
+				invoice.TotalAmount = result.extracted.TotalAmount
+			case "currency":
+				invoice.Currency = result.extracted.Currency
+			case "vendor_name":
+				invoice.VendorName = result.extracted.VendorName
+				if result.extracted.VendorID == nil {
+					recordUnmatchedVendor(withTenant(ctx, invoice.OrganizationID), h.vendors, invoice.VendorName, result.domains)
+				}
+			case "vendor_id":
+				invoice.VendorID, invoice.Vendor = result.extracted.VendorID, result.extracted.Vendor
+			case "gl_code":
+				invoice.GLCode = result.extracted.GLCode
+			case "line_items":
+				replaceItems = true
+			}
+		}
+
+		if replaceItems {
+			invoice.LineItems = make([]LineItem, 0, len(result.extracted.LineItems))
+			for _, item := range result.extracted.LineItems {
+				invoice.LineItems = append(invoice.LineItems, LineItem{Page: item.Page, Description: item.Description, Amount: item.Amount})
+			}
+		}
+		if err := h.invoices.Update(ctx, &invoice, replaceItems); err != nil {
+			return fmt.Errorf("invoice %d: %v", invoice.ID, err)
+		}
+
+		log.Printf("Re-extracted invoice %d: %d fields changed", invoice.ID, len(result.Changes))
+		h.webhooks.Emit(invoice.OrganizationID, EventInvoiceCorrected, toInvoiceDTO(invoice))
+	}
+	return nil
+}
+
+// reextractRequest is the body of a re-extraction request. Without a
+// confirmation the request only previews the changes.
+type reextractRequest struct {
+	Confirmation string `json:"confirmation" binding:"omitempty,len=64,hexadecimal"`
+}
+
+// reextract re-runs extraction over the invoices matching the list
+// filters. It previews the changes, and applies them when given the
+// confirmation token of an identical preview.
+func (h *invoiceHandlers) reextract(c *gin.Context) {
+	var request reextractRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondBindError(c, err)
+			return
+		}
+	}
+
+	filter, ok := invoiceFilter(c)
+	if !ok {
+		return
+	}
+	plan, err := h.planReextraction(tenantContext(c), filter)
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to re-extract invoices")
+		return
+	}
+
+	if request.Confirmation == "" {
+		c.JSON(200, toReextractionDTO(plan, false))
+		return
+	}
+	if request.Confirmation != plan.Confirmation() {
+		respondError(c, 409, ErrCodeConflict, "The re-extraction results have changed since the preview; review them again")
+		return
+	}
+	if err := h.applyReextraction(tenantContext(c), plan); err != nil {
+		log.Printf("Error applying re-extraction: %v", err)
+		respondError(c, 500, ErrCodeInternal, "Failed to apply re-extraction")
+		return
+	}
+	c.JSON(200, toReextractionDTO(plan, true))
+}
+
+// reextractCommand is the CLI form of the re-extraction endpoint:
+//
+//	scan-in reextract [-vendor name] [-from date] [-to date] ... [-organization id] [-yes]
+func (h *invoiceHandlers) reextractCommand(args []string) {
+	flags := flag.NewFlagSet("reextract", flag.ExitOnError)
+	params := url.Values{}
+	for _, name := range []string{"q", "vendor", "currency", "min_amount", "max_amount", "from", "to"} {
+		flags.Func(name, "filter as in GET /api/invoices", func(value string) error {
+			params.Set(name, value)
+			return nil
+		})
+	}
+	orgID := flags.Uint("organization", 0, "only re-extract this organization's invoices")
+	yes := flags.Bool("yes", false, "apply without asking")
+	flags.Parse(args)
+
+	ctx := context.Background()
+	if *orgID != 0 {
+		ctx = withTenant(ctx, *orgID)
+	}
+	filter, fieldErr := parseInvoiceFilter(params)
+	if fieldErr != nil {
+		log.Fatalf("-%s %s", fieldErr.Field, fieldErr.Message)
+	}
+
+	plan, err := h.planReextraction(ctx, filter)
+	if err != nil {
+		log.Fatalf("Failed to re-extract invoices: %v", err)
+	}
+	printReextraction(os.Stdout, plan)
+
+	changed := plan.Changed()
+	if changed == 0 {
+		return
+	}
+	if !*yes {
+		fmt.Printf("Apply these changes to %d invoices? [y/N] ", changed)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if !strings.EqualFold(strings.TrimSpace(answer), "y") {
+			fmt.Println("Nothing changed.")
+			return
+		}
+	}
+	if err := h.applyReextraction(ctx, plan); err != nil {
+		log.Fatalf("Failed to apply re-extraction: %v", err)
+	}
+	fmt.Printf("Updated %d invoices.\n", changed)
+}
+
+// printReextraction writes a plan as a readable diff
+func printReextraction(w io.Writer, plan *reextractionPlan) {
+	for _, result := range plan.Invoices {
+		fmt.Fprintf(w, "Invoice %d (%s %s)\n", result.invoice.ID, result.invoice.VendorName, result.invoice.InvoiceNumber)
+		for _, change := range result.Changes {
+			old, _ := json.Marshal(change.Old)
+			new, _ := json.Marshal(change.New)
+			fmt.Fprintf(w, "  - %s: %s\n  + %s: %s\n", change.Field, old, change.Field, new)
+		}
+		for _, field := range result.Kept {
+			fmt.Fprintf(w, "  = %s: kept, corrected by hand\n", field)
+		}
+	}
+	reasons := make(map[string]int)
+	for _, skip := range plan.Skipped {
+		reasons[skip.Reason]++
+	}
+	for reason, count := range reasons {
+		fmt.Fprintf(w, "Skipped %d invoices: %s\n", count, reason)
+	}
+	fmt.Fprintf(w, "Checked %d invoices, %d would change.\n", plan.Checked, plan.Changed())
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reextractRouter routes the re-extraction endpoint for a user of organization 1
+func reextractRouter(h *testHandlers) *gin.Engine {
+	r := h.testRouter(1)
+	r.POST("/api/admin/invoices/reextract", h.reextract)
+	return r
+}
+
+// reextractInvoices previews re-extraction, or applies it given a confirmation
+func reextractInvoices(t *testing.T, r *gin.Engine, confirmation string, status int) ReextractionDTO {
+	t.Helper()
+	body := ""
+	if confirmation != "" {
+		body = `{"confirmation": "` + confirmation + `"}`
+	}
+	req := httptest.NewRequest("POST", "/api/admin/invoices/reextract", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	var result ReextractionDTO
+	if status != 200 {
+		decode(t, serve(r, req), status, nil)
+		return result
+	}
+	decode(t, serve(r, req), status, &result)
+	return result
+}
+
+func TestReextract(t *testing.T) {
+	h := newTestHandlers(t)
+	h.ocrService.page(800, invoiceText("Acme Corp", "100234", "03/05/2024", 250)...)
+	h.ocrService.page(810, invoiceText("Globex Corporation", "200345", "03/06/2024", 80)...)
+	h.ocrService.page(820, invoiceText("Initech", "300456", "03/07/2024", 12)...)
+	stale := scanInvoice(t, h, 1, testPage(t, 800, 1))
+	corrected := scanInvoice(t, h, 1, testPage(t, 810, 2))
+	approved := scanInvoice(t, h, 1, testPage(t, 820, 3))
+	scanInvoice(t, h, 2, testPage(t, 800, 1))
+	ctx := withTenant(t.Context(), 1)
+
+	// Stand in for invoices read by an older extractor, one of them corrected by hand
+	change := func(id uint, fn func(*Invoice)) {
+		t.Helper()
+		invoice, err := h.invoiceRepo.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn(invoice)
+		if err := h.invoiceRepo.Update(ctx, invoice, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	change(stale.ID, func(invoice *Invoice) {
+		invoice.InvoiceNumber, invoice.TotalAmount, invoice.LineItems = "UNKNOWN", 0, nil
+	})
+	change(corrected.ID, func(invoice *Invoice) {
+		invoice.TotalAmount = 85
+		invoice.markCorrected("total_amount")
+	})
+	change(approved.ID, func(invoice *Invoice) {
+		now := time.Now()
+		invoice.TotalAmount, invoice.ApprovedAt = 0, &now
+	})
+	unscanned := Invoice{InvoiceNumber: "400567", VendorName: "Hooli", TotalAmount: 5}
+	if err := h.invoiceRepo.Create(ctx, &unscanned); err != nil {
+		t.Fatal(err)
+	}
+	r := reextractRouter(h)
+
+	// The other organization's invoice is not checked
+	preview := reextractInvoices(t, r, "", 200)
+	if preview.Checked != 4 || preview.Changed != 1 || preview.Applied || len(preview.Confirmation) != 64 {
+		t.Fatalf("preview checked %d, changed %d, applied %v, confirmation %q", preview.Checked, preview.Changed, preview.Applied, preview.Confirmation)
+	}
+	results := make(map[uint]InvoiceReextractionDTO)
+	for _, result := range preview.Invoices {
+		results[result.InvoiceID] = result
+	}
+	var fields []string
+	for _, change := range results[stale.ID].Changes {
+		fields = append(fields, change.Field)
+	}
+	if !slices.Equal(fields, []string{"invoice_number", "total_amount", "line_items"}) {
+		t.Errorf("stale invoice changes %v", results[stale.ID].Changes)
+	}
+	if result := results[corrected.ID]; len(result.Changes) != 0 || !slices.Equal(result.KeptCorrections, []string{"total_amount"}) {
+		t.Errorf("corrected invoice: changes %v, kept %v", result.Changes, result.KeptCorrections)
+	}
+	skipped := make(map[uint]string)
+	for _, skip := range preview.Skipped {
+		skipped[skip.InvoiceID] = skip.Reason
+	}
+	if skipped[approved.ID] != "approved" || skipped[unscanned.ID] != errNoStoredOCR.Error() || len(skipped) != 2 {
+		t.Errorf("skipped %v", skipped)
+	}
+
+	// The same results give the same token
+	if again := reextractInvoices(t, r, "", 200); again.Confirmation != preview.Confirmation {
+		t.Errorf("confirmation changed between identical previews: %s, then %s", preview.Confirmation, again.Confirmation)
+	}
+
+	// A token of other results is refused and nothing is changed
+	reextractInvoices(t, r, strings.Repeat("0", 64), 409)
+	change(corrected.ID, func(invoice *Invoice) { invoice.VendorName = "Globex" })
+	reextractInvoices(t, r, preview.Confirmation, 409)
+	if invoice, _ := h.invoiceRepo.Get(ctx, stale.ID); invoice.InvoiceNumber != "UNKNOWN" {
+		t.Errorf("invoice changed by a refused re-extraction: %s", invoice.InvoiceNumber)
+	}
+	reextractInvoices(t, r, "not-a-token", 422)
+
+	preview = reextractInvoices(t, r, "", 200)
+	if preview.Changed != 2 {
+		t.Fatalf("preview after the vendor name changed: %d invoices change", preview.Changed)
+	}
+	applied := reextractInvoices(t, r, preview.Confirmation, 200)
+	if !applied.Applied || applied.Changed != 2 || applied.Confirmation != "" {
+		t.Errorf("apply: applied %v, changed %d, confirmation %q", applied.Applied, applied.Changed, applied.Confirmation)
+	}
+
+	invoice, _ := h.invoiceRepo.Get(ctx, stale.ID)
+	if invoice.InvoiceNumber != "100234" || invoice.TotalAmount != 250 || len(invoice.LineItems) == 0 {
+		t.Errorf("re-extracted invoice %s for %.2f with %d line items", invoice.InvoiceNumber, invoice.TotalAmount, len(invoice.LineItems))
+	}
+	invoice, _ = h.invoiceRepo.Get(ctx, corrected.ID)
+	if invoice.VendorName != "Globex Corporation" || invoice.TotalAmount != 85 {
+		t.Errorf("corrected invoice re-extracted to %s for %.2f, want the vendor name back and the correction kept", invoice.VendorName, invoice.TotalAmount)
+	}
+	invoice, _ = h.invoiceRepo.Get(ctx, approved.ID)
+	if invoice.TotalAmount != 0 {
+		t.Errorf("approved invoice re-extracted to %.2f", invoice.TotalAmount)
+	}
+
+	if done := reextractInvoices(t, r, "", 200); done.Changed != 0 || done.Confirmation != "" {
+		t.Errorf("preview after applying: %d invoices change, confirmation %q", done.Changed, done.Confirmation)
+	}
+}
+
+func TestReextractRelinksVendor(t *testing.T) {
+	h := newTestHandlers(t)
+	h.vendorRepo.vendors = []Vendor{
+		{OrganizationID: 1, Name: "Acme Corp", DefaultGLCode: "6100"},
+		{OrganizationID: 1, Name: "Globex Corporation", DefaultGLCode: "6200"},
+	}
+	h.vendorRepo.vendors[0].ID, h.vendorRepo.vendors[1].ID = 7, 8
+	h.ocrService.page(800, invoiceText("Globex Corporation", "200345", "03/06/2024", 80)...)
+	h.ocrService.page(810, invoiceText("Initech", "300456", "03/07/2024", 12)...)
+	globex := scanInvoice(t, h, 1, testPage(t, 800, 1))
+	initech := scanInvoice(t, h, 1, testPage(t, 810, 2))
+	ctx := withTenant(t.Context(), 1)
+
+	// Stand in for vendor names an older extractor misread as Acme's
+	acme := uint(7)
+	for _, id := range []uint{globex.ID, initech.ID} {
+		invoice, err := h.invoiceRepo.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		invoice.VendorName, invoice.VendorID, invoice.Vendor, invoice.GLCode = "Acme Corp", &acme, nil, "6100"
+		if err := h.invoiceRepo.Update(ctx, invoice, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.vendorRepo.unmatched = nil
+	r := reextractRouter(h)
+
+	preview := reextractInvoices(t, r, "", 200)
+	if preview.Changed != 2 {
+		t.Fatalf("preview: %d invoices change", preview.Changed)
+	}
+	changes := make(map[uint]map[string]FieldChangeDTO)
+	for _, result := range preview.Invoices {
+		changes[result.InvoiceID] = make(map[string]FieldChangeDTO)
+		for _, change := range result.Changes {
+			changes[result.InvoiceID][change.Field] = change
+		}
+	}
+	if change := changes[globex.ID]["vendor_id"]; change.Old != float64(7) || change.New != float64(8) {
+		t.Errorf("Globex invoice vendor link change %+v, want 7 to 8", change)
+	}
+	if change := changes[globex.ID]["gl_code"]; change.Old != "6100" || change.New != "6200" {
+		t.Errorf("Globex invoice GL code change %+v, want 6100 to 6200", change)
+	}
+	if change := changes[initech.ID]["vendor_id"]; change.Old != float64(7) || change.New != nil {
+		t.Errorf("Initech invoice vendor link change %+v, want 7 to none", change)
+	}
+	if entries, _ := h.vendorRepo.ListUnmatched(ctx); len(entries) != 0 {
+		t.Errorf("preview put vendors on the review list: %+v", entries)
+	}
+
+	reextractInvoices(t, r, preview.Confirmation, 200)
+	invoice, _ := h.invoiceRepo.Get(ctx, globex.ID)
+	if invoice.VendorName != "Globex Corporation" || invoice.VendorID == nil || *invoice.VendorID != 8 || invoice.GLCode != "6200" {
+		t.Errorf("Globex invoice re-extracted to %q, vendor %v, GL code %q", invoice.VendorName, invoice.VendorID, invoice.GLCode)
+	}
+	invoice, _ = h.invoiceRepo.Get(ctx, initech.ID)
+	if invoice.VendorName != "Initech" || invoice.VendorID != nil || invoice.GLCode != "" {
+		t.Errorf("Initech invoice re-extracted to %q, vendor %v, GL code %q", invoice.VendorName, invoice.VendorID, invoice.GLCode)
+	}
+	if entries, _ := h.vendorRepo.ListUnmatched(ctx); len(entries) != 1 || !slices.Equal(entries[0].Names, []string{"Initech"}) {
+		t.Errorf("review list after applying: %+v", entries)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// scanEventBuffer is how many events a slow subscriber may fall behind before
+// further progress events are dropped for it. The final event of a job is never
+// dropped.
+const scanEventBuffer = 64
+
+// scanEventHeartbeat keeps idle event streams from being closed by proxies, and
+// is how often a stream checks whether its job finished on another instance. It
+// is a variable so tests can shorten it.
+var scanEventHeartbeat = 15 * time.Second
+
+// ScanEvent reports one step of the scan pipeline. Stage is the job status the
+// step belongs to; Event names the step itself.
+type ScanEvent struct {
+	Stage  string                 `json:"stage"`
+	Event  string                 `json:"event"`
+	Page   int                    `json:"page,omitempty"`
+	Detail map[string]interface{} `json:"detail,omitempty"`
+}
+
+// ProgressFunc is told about each step of the pipeline as a scan moves through it
+type ProgressFunc func(event ScanEvent)
+
+// scanEventHub fans events of running scan jobs out to their subscribers. Events
+// are not stored: a subscriber only sees what is published after it subscribed.
+// A hub only sees the jobs its own instance runs.
+type scanEventHub struct {
+	mu          sync.Mutex
+	subscribers map[uint]map[chan ScanEvent]struct{}
+}
+
+// newScanEventHub returns a hub without subscribers
+func newScanEventHub() *scanEventHub {
+	return &scanEventHub{subscribers: make(map[uint]map[chan ScanEvent]struct{})}
+}
+
+// subscribe returns a channel receiving the events of a job
+func (h *scanEventHub) subscribe(jobID uint) chan ScanEvent {
+	ch := make(chan ScanEvent, scanEventBuffer)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[jobID] == nil {
+		h.subscribers[jobID] = make(map[chan ScanEvent]struct{})
+	}
+	h.subscribers[jobID][ch] = struct{}{}
+	return ch
+}
+
+// unsubscribe stops delivering events to ch, if the job has not finished already
+func (h *scanEventHub) unsubscribe(jobID uint, ch chan ScanEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers[jobID], ch)
+	if len(h.subscribers[jobID]) == 0 {
+		delete(h.subscribers, jobID)
+	}
+}
+
+// publish sends an event to every subscriber of a job without blocking the scan
+func (h *scanEventHub) publish(jobID uint, event ScanEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers[jobID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// finish sends the final event of a job to every subscriber and closes their
+// channels. A subscriber that has fallen behind loses its oldest progress
+// events to make room, so the final event always arrives.
+func (h *scanEventHub) finish(jobID uint, event ScanEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers[jobID] {
+		for sent := false; !sent; {
+			select {
+			case ch <- event:
+				sent = true
+			default:
+				select {
+				case <-ch:
+				default:
+				}
+			}
+		}
+		close(ch)
+	}
+	delete(h.subscribers, jobID)
+}
+
+// finalScanEvent describes a finished job, or returns false if it is still running
+func finalScanEvent(job *ScanJob) (ScanEvent, bool) {
+	switch job.Status {
+	case ScanStatusDone:
+		detail := map[string]interface{}{"result_url": fmt.Sprintf("/api/scans/%d", job.ID)}
+		if job.InvoiceID != nil {
+			detail["invoice_id"] = *job.InvoiceID
+		}
+		return ScanEvent{Stage: ScanStatusDone, Event: ScanStatusDone, Detail: detail}, true
+	case ScanStatusFailed:
+		return ScanEvent{
+			Stage:  ScanStatusFailed,
+			Event:  ScanStatusFailed,
+			Detail: map[string]interface{}{"error_message": job.Error},
+		}, true
+	}
+	return ScanEvent{}, false
+}
+
+// streamScanEvents streams the progress of a scan job as Server-Sent Events until
+// the job finishes or the client goes away. Progress is only seen for jobs that
+// this instance runs; a job running on another instance is checked on at each
+// heartbeat, and its stream ends with the final event once it is over.
+func (h *invoiceHandlers) streamScanEvents(c *gin.Context) {
+	job := h.loadScanJob(c)
+	if job == nil {
+		return
+	}
+
+	// Subscribe before reading the status again so a job finishing in between is not missed
+	events := h.events.subscribe(job.ID)
+	defer h.events.unsubscribe(job.ID, events)
+
+	job, err := h.jobs.Get(tenantContext(c), job.ID)
+	if err != nil {
+		respondError(c, 404, ErrCodeNotFound, "Scan job not found")
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	c.SSEvent("status", gin.H{"id": job.ID, "status": job.Status})
+	if final, ok := finalScanEvent(job); ok {
+		c.SSEvent(final.Event, final)
+		return
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(scanEventHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			c.SSEvent(event.Event, event)
+			return event.Event != ScanStatusDone && event.Event != ScanStatusFailed
+		case <-heartbeat.C:
+			current, err := h.jobs.Get(tenantContext(c), job.ID)
+			if err != nil {
+				log.Printf("Warning: Failed to check on scan job %d: %v", job.ID, err)
+			} else if final, ok := finalScanEvent(current); ok {
+				c.SSEvent(final.Event, final)
+				return false
+			}
+			fmt.Fprint(w, ": heartbeat\n\n")
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
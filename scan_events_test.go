@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is one event read from a Server-Sent Events stream
+type sseEvent struct {
+	name, data string
+}
+
+// openScanEvents starts streaming a job's events from a live server, and
+// returns the stream once its opening status event has arrived
+func openScanEvents(t *testing.T, h *testHandlers, id uint) *bufio.Scanner {
+	t.Helper()
+	server := httptest.NewServer(scanJobRouter(h))
+	t.Cleanup(server.Close)
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Get(fmt.Sprintf("%s/api/scans/%d/events", server.URL, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	if response.StatusCode != 200 || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("stream answered %d %s", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+
+	stream := bufio.NewScanner(response.Body)
+	if events := readSSE(t, stream, 1); events[0].name != "status" {
+		t.Fatalf("stream opened with %+v", events[0])
+	}
+	return stream
+}
+
+// readSSE reads up to limit events, or to the end of the stream if limit is 0.
+// The client's timeout fails the test if the stream never ends.
+func readSSE(t *testing.T, stream *bufio.Scanner, limit int) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var event sseEvent
+	for stream.Scan() {
+		line := stream.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event.name = strings.TrimPrefix(line, "event:")
+		case strings.HasPrefix(line, "data:"):
+			event.data = strings.TrimPrefix(line, "data:")
+		case line == "" && event.name != "":
+			events = append(events, event)
+			event = sseEvent{}
+			if len(events) == limit {
+				return events
+			}
+		}
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatalf("stream did not end: %v", err)
+	}
+	return events
+}
+
+// queueScanJob creates a job through the API and takes it off the queue
+func queueScanJob(t *testing.T, h *testHandlers) uint {
+	t.Helper()
+	var queued ScanJobDTO
+	decode(t, serve(scanJobRouter(h), multipartRequest(t, "/api/scans", upload{"invoice", "1.png", testPage(t, 800, 1)})), 202, &queued)
+	<-h.queue
+	return queued.ID
+}
+
+func TestScanEventStream(t *testing.T) {
+	h := newTestHandlers(t)
+	h.jobs = newGormScanJobRepository(openTestDB(t))
+	id := queueScanJob(t, h)
+	stream := openScanEvents(t, h, id)
+
+	go h.processScanJob(id)
+
+	// Every step is streamed, and the stream ends with the result
+	events := readSSE(t, stream, 0)
+	if len(events) < 2 {
+		t.Fatalf("stream ended after %d events", len(events))
+	}
+	if events[0].name != "decoded" {
+		t.Errorf("first event %s, want decoded", events[0].name)
+	}
+	last := events[len(events)-1]
+	if last.name != ScanStatusDone || !strings.Contains(last.data, fmt.Sprintf(`"result_url":"/api/scans/%d"`, id)) {
+		t.Errorf("stream ended with %+v", last)
+	}
+}
+
+func TestScanEventStreamOfJobFinishedElsewhere(t *testing.T) {
+	saved := scanEventHeartbeat
+	scanEventHeartbeat = 20 * time.Millisecond
+	t.Cleanup(func() { scanEventHeartbeat = saved })
+
+	h := newTestHandlers(t)
+	h.jobs = newGormScanJobRepository(openTestDB(t))
+	id := queueScanJob(t, h)
+	stream := openScanEvents(t, h, id)
+
+	// Another instance runs the job, so this one's hub never hears of it; the
+	// stream finds out at a heartbeat
+	if err := h.jobs.Fail(withTenant(t.Context(), 1), id, "unreadable image"); err != nil {
+		t.Fatal(err)
+	}
+	events := readSSE(t, stream, 0)
+	if len(events) != 1 || events[0].name != ScanStatusFailed || !strings.Contains(events[0].data, "unreadable image") {
+		t.Errorf("stream ended with %+v", events)
+	}
+}
+
+func TestScanEventHubKeepsFinalEvent(t *testing.T) {
+	hub := newScanEventHub()
+	slow := hub.subscribe(1)
+	for i := 0; i < 2*scanEventBuffer; i++ {
+		hub.publish(1, ScanEvent{Stage: ScanStatusOCR, Event: "ocr_done", Page: i + 1})
+	}
+	hub.finish(1, ScanEvent{Stage: ScanStatusDone, Event: ScanStatusDone})
+
+	// The subscriber that fell behind loses progress, never the outcome, and
+	// its channel is closed after it
+	var received []ScanEvent
+	for event := range slow {
+		received = append(received, event)
+	}
+	if len(received) != scanEventBuffer || received[len(received)-1].Event != ScanStatusDone {
+		t.Errorf("received %d events ending with %+v", len(received), received[len(received)-1])
+	}
+
+	// Events after the end reach no one, and unsubscribing late is harmless
+	hub.publish(1, ScanEvent{Stage: ScanStatusDone, Event: "late"})
+	hub.unsubscribe(1, slow)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrScanJobNotFound is returned when no scan job of the context's organization has the ID
+var ErrScanJobNotFound = errors.New("scan job not found")
+
+// ErrBatchNotFound is returned when no batch of the context's organization has the ID
+var ErrBatchNotFound = errors.New("batch not found")
+
+// ScanJobRepository stores scan jobs, their uploaded files and the batches
+// grouping them. Calls are scoped to the context's organization like those of
+// InvoiceRepository; the scan workers use an unscoped context.
+type ScanJobRepository interface {
+	// Create stores a new job with its files
+	Create(ctx context.Context, job *ScanJob) error
+	// Get returns a job with its invoice, but not its files
+	Get(ctx context.Context, id uint) (*ScanJob, error)
+	// GetWithFiles returns a job with its files in upload order
+	GetWithFiles(ctx context.Context, id uint) (*ScanJob, error)
+	// SetStatus records the stage a job has reached
+	SetStatus(ctx context.Context, id uint, status string) error
+	// Fail records that a job failed and why, and discards its files' contents
+	Fail(ctx context.Context, id uint, message string) error
+	// Finish records the result of a job that is done, and discards its files'
+	// contents
+	Finish(ctx context.Context, job *ScanJob) error
+	// Claim leases to owner until the given time the jobs that are neither done
+	// nor failed and whose lease has lapsed, marks them as queued and returns
+	// their IDs in submission order. A job is claimed by one caller only, however
+	// many instances claim at once.
+	Claim(ctx context.Context, owner string, until time.Time) ([]uint, error)
+	// Renew extends the leases owner holds on jobs that are neither done nor
+	// failed until the given time
+	Renew(ctx context.Context, owner string, until time.Time) error
+	// Release lets the leases owner holds lapse at once, so the jobs it held can
+	// be claimed again
+	Release(ctx context.Context, owner string) error
+	// CreateBatch stores a new batch with its jobs and their files
+	CreateBatch(ctx context.Context, batch *ScanBatch) error
+	// GetBatch returns a batch with its jobs and their filenames
+	GetBatch(ctx context.Context, id uint) (*ScanBatch, error)
+}
+
+// gormScanJobRepository keeps scan jobs in the SQL database
+type gormScanJobRepository struct {
+	db *gorm.DB
+}
+
+// newGormScanJobRepository returns a repository on the database. Tenant scoping
+// relies on the callbacks of registerTenantCallbacks.
+func newGormScanJobRepository(db *gorm.DB) *gormScanJobRepository {
+	return &gormScanJobRepository{db: db}
+}
+
+// Create inserts the job and its files in one transaction
+func (r *gormScanJobRepository) Create(ctx context.Context, job *ScanJob) error {
+	return r.db.WithContext(ctx).Create(job).Error
+}
+
+// Get loads a job with its invoice and the invoice's associations
+func (r *gormScanJobRepository) Get(ctx context.Context, id uint) (*ScanJob, error) {
+	var job ScanJob
+	err := r.db.WithContext(ctx).
+		Preload("Invoice.LineItems").
+		Preload("Invoice.Documents").
+		Preload("Invoice.Duplicates").
+		Preload("Invoice.Vendor").
+		First(&job, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrScanJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// GetWithFiles loads a job with its files
+func (r *gormScanJobRepository) GetWithFiles(ctx context.Context, id uint) (*ScanJob, error) {
+	var job ScanJob
+	err := r.db.WithContext(ctx).Preload("Files", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("position")
+	}).First(&job, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrScanJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// SetStatus updates only the status column
+func (r *gormScanJobRepository) SetStatus(ctx context.Context, id uint, status string) error {
+	return r.db.WithContext(ctx).Model(&ScanJob{}).Where("id = ?", id).Update("status", status).Error
+}
+
+// Fail updates the status and error columns and drops the uploaded files' contents
+func (r *gormScanJobRepository) Fail(ctx context.Context, id uint, message string) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&ScanJob{}).Where("id = ?", id).
+			Updates(map[string]interface{}{"status": ScanStatusFailed, "error": message}).Error
+		if err != nil {
+			return err
+		}
+		return clearScanJobFiles(tx, id)
+	})
+}
+
+// Finish saves the job's status, invoice, display images and formats and drops
+// the uploaded files' contents
+func (r *gormScanJobRepository) Finish(ctx context.Context, job *ScanJob) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(job).Select("status", "invoice_id", "display_keys", "formats").Updates(job).Error; err != nil {
+			return err
+		}
+		return clearScanJobFiles(tx, job.ID)
+	})
+}
+
+// clearScanJobFiles empties the data of a job's files once the job is over. The
+// originals live on in the blob store with the invoice; the rows are kept for
+// their filenames, which batch summaries list.
+func clearScanJobFiles(tx *gorm.DB, jobID uint) error {
+	return tx.Model(&ScanJobFile{}).Where("scan_job_id = ?", jobID).Update("data", nil).Error
+}
+
+// unfinishedScanJobs scopes a query to the jobs that are neither done nor failed
+func unfinishedScanJobs(tx *gorm.DB) *gorm.DB {
+	return tx.Where("status NOT IN ?", []string{ScanStatusDone, ScanStatusFailed})
+}
+
+// lapsedScanJobs scopes a query to the jobs whose lease has lapsed by now
+func lapsedScanJobs(now time.Time) func(tx *gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("lease_expires_at IS NULL OR lease_expires_at < ?", now)
+	}
+}
+
+// Claim finds the lapsed jobs, then takes each one over with an update that
+// checks again that its lease has lapsed. When instances race for a job, the
+// database applies one update first and the others no longer match it.
+func (r *gormScanJobRepository) Claim(ctx context.Context, owner string, until time.Time) ([]uint, error) {
+	now := time.Now()
+	var ids []uint
+	err := r.db.WithContext(ctx).Model(&ScanJob{}).
+		Scopes(unfinishedScanJobs, lapsedScanJobs(now)).
+		Order("id").
+		Pluck("id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var claimed []uint
+	for _, id := range ids {
+		result := r.db.WithContext(ctx).Model(&ScanJob{}).
+			Scopes(unfinishedScanJobs, lapsedScanJobs(now)).
+			Where("id = ?", id).
+			Updates(map[string]interface{}{"status": ScanStatusQueued, "lease_owner": owner, "lease_expires_at": until})
+		if result.Error != nil {
+			return claimed, result.Error
+		}
+		if result.RowsAffected == 1 {
+			claimed = append(claimed, id)
+		}
+	}
+	return claimed, nil
+}
+
+// Renew updates the lease expiry of the owner's unfinished jobs
+func (r *gormScanJobRepository) Renew(ctx context.Context, owner string, until time.Time) error {
+	return r.db.WithContext(ctx).Model(&ScanJob{}).
+		Scopes(unfinishedScanJobs).
+		Where("lease_owner = ?", owner).
+		Update("lease_expires_at", until).Error
+}
+
+// Release clears the lease expiry of the owner's unfinished jobs
+func (r *gormScanJobRepository) Release(ctx context.Context, owner string) error {
+	return r.db.WithContext(ctx).Model(&ScanJob{}).
+		Scopes(unfinishedScanJobs).
+		Where("lease_owner = ?", owner).
+		Update("lease_expires_at", nil).Error
+}
+
+// CreateBatch inserts the batch, its jobs and their files in one transaction
+func (r *gormScanJobRepository) CreateBatch(ctx context.Context, batch *ScanBatch) error {
+	return r.db.WithContext(ctx).Create(batch).Error
+}
+
+// GetBatch loads a batch with its jobs, leaving out the file contents
+func (r *gormScanJobRepository) GetBatch(ctx context.Context, id uint) (*ScanBatch, error) {
+	var batch ScanBatch
+	err := r.db.WithContext(ctx).Preload("Jobs", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("id")
+	}).Preload("Jobs.Files", func(tx *gorm.DB) *gorm.DB {
+		return tx.Select("id", "scan_job_id", "position", "filename").Order("position")
+	}).First(&batch, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrBatchNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
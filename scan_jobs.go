@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Scan job statuses, in pipeline order
+const (
+	ScanStatusQueued        = "queued"
+	ScanStatusPreprocessing = "preprocessing"
+	ScanStatusOCR           = "ocr"
+	ScanStatusExtracting    = "extracting"
+	ScanStatusDone          = "done"
+	ScanStatusFailed        = "failed"
+)
+
+// scanQueueSize bounds how many jobs can wait for a worker before new scans are refused
+const scanQueueSize = 1000
+
+// scanLeaseDuration is how long an instance's claim on a scan job holds unless
+// renewed. Leases are renewed, and lapsed ones looked for, every
+// scanLeaseInterval.
+const (
+	scanLeaseDuration = time.Minute
+	scanLeaseInterval = scanLeaseDuration / 4
+)
+
+// ScanJob is an asynchronous scan of one invoice. The uploaded files are stored
+// with the job so queued and running jobs survive a restart; their contents are
+// dropped once the job is done or has failed.
+//
+// The instance that queues a job holds a lease on it and renews it while the
+// job is unfinished. Other instances take a job over only once its lease lapses,
+// so several instances can share one database.
+type ScanJob struct {
+	gorm.Model
+	OrganizationID uint  `gorm:"index"`
+	BatchID        *uint `gorm:"index"`
+	APIKeyID       *uint // key the scan's OCR usage is charged to
+	Status         string
+	Error          string
+	Files          []ScanJobFile
+	InvoiceID      *uint
+	Invoice        *Invoice
+	DisplayKeys    []string `gorm:"serializer:json"` // blob keys of the display images
+	Formats        []string `gorm:"serializer:json"`
+	LeaseOwner     string   `gorm:"index"` // instance queuing or running the job
+	LeaseExpiresAt *time.Time
+}
+
+// ScanJobFile is one uploaded file of a scan job
+type ScanJobFile struct {
+	gorm.Model
+	ScanJobID uint
+	Position  int
+	Filename  string
+	Data      []byte
+}
+
+// errScanQueueFull is the error recorded on a job the full queue had no room for
+const errScanQueueFull = "scan queue is full"
+
+// scanInstanceID names this process in the leases it holds on scan jobs and
+// webhook deliveries. It is unique to the process unless SCAN_INSTANCE_ID sets a name that survives
+// restarts, such as a StatefulSet pod name, in which case a restarted instance
+// resumes its own jobs at once rather than when their leases lapse.
+func scanInstanceID() string {
+	if id := os.Getenv("SCAN_INSTANCE_ID"); id != "" {
+		return id
+	}
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%x", host, os.Getpid(), suffix)
+}
+
+// leaseScanJob gives this instance the lease on a job it is about to queue
+func (h *invoiceHandlers) leaseScanJob(job *ScanJob) {
+	until := time.Now().Add(scanLeaseDuration)
+	job.LeaseOwner = h.instance
+	job.LeaseExpiresAt = &until
+}
+
+// enqueueScanJob hands a stored job to the workers without waiting for room in
+// the queue, reporting whether there was any. Only claimed jobs may block on the
+// queue, as they are fed to it in the background.
+func (h *invoiceHandlers) enqueueScanJob(id uint) bool {
+	select {
+	case h.queue <- id:
+		return true
+	default:
+		return false
+	}
+}
+
+// startScanWorkers starts the bounded pool of scan workers and the lease keeper,
+// which first takes over the jobs left unfinished by instances that stopped
+func (h *invoiceHandlers) startScanWorkers() {
+	workers := 2
+	if n, err := strconv.Atoi(os.Getenv("SCAN_WORKERS")); err == nil && n > 0 {
+		workers = n
+	}
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for id := range h.queue {
+				h.processScanJob(id)
+			}
+		}()
+	}
+
+	// Jobs this instance held before a restart have no one working on them
+	if err := h.jobs.Release(context.Background(), h.instance); err != nil {
+		log.Printf("Error releasing scan jobs of a previous run: %v", err)
+	}
+	h.claimScanJobs()
+
+	go func() {
+		for range time.Tick(scanLeaseInterval) {
+			h.renewScanLeases()
+			h.claimScanJobs()
+		}
+	}()
+}
+
+// renewScanLeases keeps the jobs this instance has queued or is running from
+// being taken over by another instance
+func (h *invoiceHandlers) renewScanLeases() {
+	if err := h.jobs.Renew(context.Background(), h.instance, time.Now().Add(scanLeaseDuration)); err != nil {
+		log.Printf("Error renewing scan job leases: %v", err)
+	}
+}
+
+// claimScanJobs takes over the unfinished jobs whose lease has lapsed, because
+// the instance holding it stopped, and puts them on the queue in submission order
+func (h *invoiceHandlers) claimScanJobs() {
+	ids, err := h.jobs.Claim(context.Background(), h.instance, time.Now().Add(scanLeaseDuration))
+	if err != nil {
+		log.Printf("Error claiming pending scan jobs: %v", err)
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	log.Printf("Requeuing %d pending scan jobs", len(ids))
+
+	// Feed the queue in the background in case the backlog exceeds its capacity
+	go func() {
+		for _, id := range ids {
+			h.queue <- id
+		}
+	}()
+}
+
+// createScanJob stores the uploads as a new queued job and returns immediately
+func (h *invoiceHandlers) createScanJob(c *gin.Context) {
+	uploads, ok := formUploads(c, "invoice", "No file uploaded")
+	if !ok {
+		return
+	}
+
+	pages := countPages(uploads)
+	if !reserveOCRQuota(c, h.usage, pages) {
+		return
+	}
+
+	job := ScanJob{Status: ScanStatusQueued, APIKeyID: currentAPIKeyID(c)}
+	h.leaseScanJob(&job)
+	for i, upload := range uploads {
+		job.Files = append(job.Files, ScanJobFile{
+			Position: i,
+			Filename: upload.Filename,
+			Data:     upload.Data,
+		})
+	}
+
+	if err := h.jobs.Create(tenantContext(c), &job); err != nil {
+		h.usage.Record(job.APIKeyID, -pages)
+		respondError(c, 500, ErrCodeInternal, "Failed to create scan job")
+		return
+	}
+
+	if !h.enqueueScanJob(job.ID) {
+		h.usage.Record(job.APIKeyID, -pages)
+		if err := h.jobs.Fail(tenantContext(c), job.ID, errScanQueueFull); err != nil {
+			log.Printf("Warning: Failed to record scan job %d failure: %v", job.ID, err)
+		}
+		respondError(c, 503, ErrCodeQueueFull, "Scan queue is full, try again later")
+		return
+	}
+
+	c.JSON(202, toScanJobDTO(job, h.urls))
+}
+
+// loadScanJob fetches the scan job named by the path, responding with an error
+// and returning nil if there is none
+func (h *invoiceHandlers) loadScanJob(c *gin.Context) *ScanJob {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		respondError(c, 404, ErrCodeNotFound, "Scan job not found")
+		return nil
+	}
+	job, err := h.jobs.Get(tenantContext(c), uint(id))
+	if errors.Is(err, ErrScanJobNotFound) {
+		respondError(c, 404, ErrCodeNotFound, "Scan job not found")
+		return nil
+	}
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to load scan job")
+		return nil
+	}
+	return job
+}
+
+// getScanJob reports the status of a scan job and its result once done
+func (h *invoiceHandlers) getScanJob(c *gin.Context) {
+	job := h.loadScanJob(c)
+	if job == nil {
+		return
+	}
+	c.JSON(200, toScanJobDTO(*job, h.urls))
+}
+
+// processScanJob runs the scan pipeline for a queued job, recording each stage and
+// publishing every step to the job's event subscribers
+func (h *invoiceHandlers) processScanJob(id uint) {
+	job, err := h.jobs.GetWithFiles(context.Background(), id)
+	if err != nil {
+		log.Printf("Error loading scan job %d: %v", id, err)
+		return
+	}
+	if job.LeaseOwner != h.instance || job.Status == ScanStatusDone || job.Status == ScanStatusFailed {
+		// The lease lapsed while the job waited, and another instance took the
+		// job over and may already have finished it
+		log.Printf("Skipping scan job %d: %s by %s", id, job.Status, job.LeaseOwner)
+		return
+	}
+
+	report := func(event ScanEvent) {
+		if event.Stage != job.Status {
+			job.Status = event.Stage
+			if err := h.jobs.SetStatus(context.Background(), id, event.Stage); err != nil {
+				log.Printf("Warning: Failed to update scan job %d status: %v", id, err)
+			}
+		}
+		h.events.publish(id, event)
+	}
+	fail := func(message string) {
+		job.Status = ScanStatusFailed
+		job.Error = message
+		if err := h.jobs.Fail(context.Background(), id, message); err != nil {
+			log.Printf("Warning: Failed to record scan job %d failure: %v", id, err)
+		}
+		final, _ := finalScanEvent(job)
+		h.events.finish(id, final)
+		h.webhooks.Emit(job.OrganizationID, EventScanFailed, toScanJobDTO(*job, h.urls))
+	}
+
+	uploads := scanJobUploads(job)
+	scan, err := scanPages(context.Background(), h.ocr, h.blobs, uploads, report)
+	// The job's pages were reserved when it was created
+	h.usage.Record(job.APIKeyID, len(scan.DisplayKeys)-countPages(uploads))
+	if err != nil {
+		log.Printf("Scan job %d failed: %v", id, err)
+		fail(err.Error())
+		return
+	}
+
+	invoice := extractInvoiceDetailsReporting(scan.TextLines, func(field string, value interface{}) {
+		report(ScanEvent{
+			Stage:  ScanStatusExtracting,
+			Event:  "field_extracted",
+			Detail: map[string]interface{}{"field": field, "value": value},
+		})
+	})
+	invoice.PageCount = len(scan.DisplayKeys)
+	invoice.StartPage = 1
+	invoice.EndPage = len(scan.DisplayKeys)
+
+	ctx := withTenant(context.Background(), job.OrganizationID)
+	assignVendor(ctx, h.vendors, &invoice, scan.TextLines)
+	attachInvoiceDocuments(h.blobs, &invoice, uploads, scan.Pages)
+	checkDuplicates(ctx, h.invoices, &invoice, scan.Pages)
+	if err := h.invoices.Create(ctx, &invoice); err != nil {
+		log.Printf("Scan job %d failed to save invoice: %v", id, err)
+		fail("Failed to save invoice")
+		return
+	}
+
+	job.Status = ScanStatusDone
+	job.InvoiceID = &invoice.ID
+	job.DisplayKeys = scan.DisplayKeys
+	job.Formats = scan.Formats
+	if err := h.jobs.Finish(context.Background(), job); err != nil {
+		log.Printf("Warning: Failed to save scan job %d result: %v", id, err)
+	}
+	final, _ := finalScanEvent(job)
+	h.events.finish(id, final)
+	h.emitInvoiceScanned(invoice)
+
+	log.Printf("Scan job %d done: invoice %d (%s %s)", id, invoice.ID, invoice.VendorName, invoice.InvoiceNumber)
+}
+
+// scanJobUploads returns the files of a job as the uploads they were made from
+func scanJobUploads(job *ScanJob) []Upload {
+	uploads := make([]Upload, 0, len(job.Files))
+	for _, file := range job.Files {
+		uploads = append(uploads, Upload{Filename: file.Filename, Data: file.Data})
+	}
+	return uploads
+}
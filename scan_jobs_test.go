@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// withScanQueue replaces the handlers' queue with one that has room for size jobs
+func withScanQueue(h *invoiceHandlers, size int) {
+	h.queue = make(chan uint, size)
+}
+
+// scanJobRouter routes the asynchronous scan endpoints for a user of organization 1
+func scanJobRouter(h *testHandlers) *gin.Engine {
+	r := h.testRouter(1)
+	r.POST("/api/scans", h.createScanJob)
+	r.POST("/api/batches", h.createBatch)
+	r.GET("/api/scans/:id/events", h.streamScanEvents)
+	return r
+}
+
+func TestCreateScanJobWithFullQueue(t *testing.T) {
+	h := newTestHandlers(t)
+	h.jobs = newGormScanJobRepository(openTestDB(t))
+	withScanQueue(h.invoiceHandlers, 1)
+	r := scanJobRouter(h)
+	ctx := withTenant(t.Context(), 1)
+
+	var queued ScanJobDTO
+	decode(t, serve(r, multipartRequest(t, "/api/scans", upload{"invoice", "1.png", testPage(t, 800, 1)})), 202, &queued)
+	if queued.Status != ScanStatusQueued || len(h.queue) != 1 {
+		t.Fatalf("first job %s with %d jobs queued", queued.Status, len(h.queue))
+	}
+
+	// The second job finds no room: the request fails rather than waiting and
+	// the stored job is failed rather than left for a worker that never comes
+	decode(t, serve(r, multipartRequest(t, "/api/scans", upload{"invoice", "2.png", testPage(t, 810, 2)})), 503, nil)
+	refused, err := h.jobs.GetWithFiles(ctx, queued.ID+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refused.Status != ScanStatusFailed || refused.Error != errScanQueueFull || refused.Files[0].Data != nil {
+		t.Errorf("refused job %s (%q) keeps %d bytes", refused.Status, refused.Error, len(refused.Files[0].Data))
+	}
+	<-h.queue
+
+	// A batch that passes the size check but outgrows the queue while it is
+	// sent fails only the jobs that did not fit
+	var batch BatchDTO
+	decode(t, serve(r, multipartRequest(t, "/api/batches",
+		upload{"invoices", "a.png", testPage(t, 800, 3)},
+		upload{"invoices", "b.png", testPage(t, 810, 4)})), 202, &batch)
+	if len(batch.Files) != 2 || batch.Files[0].Status != ScanStatusQueued || batch.Files[1].Status != ScanStatusFailed {
+		t.Fatalf("batch files %+v", batch.Files)
+	}
+	if id := <-h.queue; id != batch.Files[0].JobID {
+		t.Errorf("queued job %d, want %d", id, batch.Files[0].JobID)
+	}
+	stored, err := h.jobs.GetBatch(ctx, batch.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job := stored.Jobs[1]; job.Status != ScanStatusFailed || job.Error != errScanQueueFull {
+		t.Errorf("stored job %s (%q), want it failed", job.Status, job.Error)
+	}
+}
+
+func TestScanJobFilesClearedWhenOver(t *testing.T) {
+	jobs := newGormScanJobRepository(openTestDB(t))
+	ctx := withTenant(t.Context(), 1)
+
+	create := func() *ScanJob {
+		t.Helper()
+		job := &ScanJob{Status: ScanStatusQueued, Files: []ScanJobFile{
+			{Position: 0, Filename: "1.png", Data: []byte("page 1")},
+			{Position: 1, Filename: "2.png", Data: []byte("page 2")},
+		}}
+		if err := jobs.Create(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+	filesOf := func(id uint) []ScanJobFile {
+		t.Helper()
+		job, err := jobs.GetWithFiles(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return job.Files
+	}
+
+	running, done, failed := create(), create(), create()
+	done.Status, done.DisplayKeys = ScanStatusDone, []string{"display/1.jpg", "display/2.jpg"}
+	if err := jobs.Finish(ctx, done); err != nil {
+		t.Fatal(err)
+	}
+	if err := jobs.Fail(ctx, failed.ID, "unreadable image"); err != nil {
+		t.Fatal(err)
+	}
+
+	if files := filesOf(running.ID); string(files[0].Data) != "page 1" || string(files[1].Data) != "page 2" {
+		t.Errorf("pending job lost its uploads: %q, %q", files[0].Data, files[1].Data)
+	}
+	for _, id := range []uint{done.ID, failed.ID} {
+		files := filesOf(id)
+		if len(files) != 2 || files[0].Filename != "1.png" || files[1].Filename != "2.png" {
+			t.Errorf("job %d files %+v, want both filenames kept", id, files)
+		}
+		for _, file := range files {
+			if file.Data != nil {
+				t.Errorf("job %d still holds %d bytes of %s", id, len(file.Data), file.Filename)
+			}
+		}
+	}
+}
+
+func TestScanJobLeases(t *testing.T) {
+	jobs := newGormScanJobRepository(openTestDB(t))
+	ctx := withTenant(t.Context(), 1)
+	now := time.Now()
+	later, earlier := now.Add(time.Minute), now.Add(-time.Second)
+
+	create := func(status, owner string, expires *time.Time) uint {
+		t.Helper()
+		job := &ScanJob{Status: status, LeaseOwner: owner, LeaseExpiresAt: expires}
+		if err := jobs.Create(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+		return job.ID
+	}
+	running := create(ScanStatusOCR, "a", &later)
+	lapsed := create(ScanStatusQueued, "a", &earlier)
+	legacy := create(ScanStatusPreprocessing, "", nil)
+	create(ScanStatusDone, "a", &earlier)
+	create(ScanStatusFailed, "", nil)
+
+	// Only unfinished jobs whose lease lapsed are taken over, and only once
+	claimed, err := jobs.Claim(t.Context(), "b", later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(claimed, []uint{lapsed, legacy}) {
+		t.Fatalf("claimed %v, want %v", claimed, []uint{lapsed, legacy})
+	}
+	for _, id := range claimed {
+		job, err := jobs.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != ScanStatusQueued || job.LeaseOwner != "b" {
+			t.Errorf("claimed job %d is %s by %q", id, job.Status, job.LeaseOwner)
+		}
+	}
+	if claimed, err := jobs.Claim(t.Context(), "c", later); err != nil || len(claimed) != 0 {
+		t.Errorf("claimed %v again (%v)", claimed, err)
+	}
+
+	// A renewed lease holds; a released one lapses at once
+	if err := jobs.Renew(t.Context(), "a", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := jobs.Get(ctx, running); job.LeaseExpiresAt == nil || job.LeaseExpiresAt.Before(later) {
+		t.Errorf("renewed lease expires %v", job.LeaseExpiresAt)
+	}
+	if err := jobs.Release(t.Context(), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Instances claiming at once share the released job out between them
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var all []uint
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			claimed, err := jobs.Claim(t.Context(), fmt.Sprintf("instance %d", i), later)
+			if err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			all = append(all, claimed...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if !slices.Equal(all, []uint{running}) {
+		t.Errorf("instances claimed %v, want %d once", all, running)
+	}
+}
+
+func TestScanJobTakenOverIsSkipped(t *testing.T) {
+	h := newTestHandlers(t)
+	h.jobs = newGormScanJobRepository(openTestDB(t))
+	r := scanJobRouter(h)
+
+	var queued ScanJobDTO
+	decode(t, serve(r, multipartRequest(t, "/api/scans", upload{"invoice", "1.png", testPage(t, 800, 1)})), 202, &queued)
+	<-h.queue
+
+	// Another instance took the job over while it waited in this one's queue
+	h.instance = "restarted"
+	h.processScanJob(queued.ID)
+	if h.ocrService.calls != 0 {
+		t.Errorf("OCR called %d times for a job another instance holds", h.ocrService.calls)
+	}
+	job, err := h.jobs.Get(withTenant(t.Context(), 1), queued.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != ScanStatusQueued {
+		t.Errorf("job %s, want it left queued", job.Status)
+	}
+}
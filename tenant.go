@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// orgContextKey is where the middleware stores the caller's organization ID
+const orgContextKey = "organizationID"
+
+// Organization is a tenant. Invoices, scan jobs, batches, users and API keys all
+// belong to exactly one organization and are invisible to the others.
+type Organization struct {
+	gorm.Model
+	Name string
+	Slug string `gorm:"uniqueIndex"`
+}
+
+// tenantKey carries the organization ID in a context passed to gorm
+type tenantKey struct{}
+
+// withTenant returns a context that scopes gorm statements to an organization
+func withTenant(ctx context.Context, orgID uint) context.Context {
+	return context.WithValue(ctx, tenantKey{}, orgID)
+}
+
+// tenantFromContext returns the organization a context is scoped to
+func tenantFromContext(ctx context.Context) (uint, bool) {
+	orgID, ok := ctx.Value(tenantKey{}).(uint)
+	return orgID, ok
+}
+
+// tenantContext returns the request context scoped to the caller's organization,
+// for passing to repositories
+func tenantContext(c *gin.Context) context.Context {
+	return withTenant(c.Request.Context(), c.GetUint(orgContextKey))
+}
+
+// registerTenantCallbacks makes every statement on a tenant-scoped handle
+// filter by, and every insert stamp, the organization. Models are tenant-owned
+// if they have an OrganizationID field.
+func registerTenantCallbacks(db *gorm.DB) {
+	db.Callback().Query().Before("gorm:query").Register("tenant:query", scopeToTenant)
+	db.Callback().Row().Before("gorm:row").Register("tenant:row", scopeToTenant)
+	db.Callback().Update().Before("gorm:update").Register("tenant:update", scopeToTenant)
+	db.Callback().Delete().Before("gorm:delete").Register("tenant:delete", scopeToTenant)
+	db.Callback().Create().Before("gorm:create").Register("tenant:create", assignTenant)
+}
+
+// scopeToTenant restricts a query, update or delete to the context's organization
+func scopeToTenant(tx *gorm.DB) {
+	orgID, ok := tenantFromContext(tx.Statement.Context)
+	if !ok || tx.Statement.Schema == nil {
+		return
+	}
+	field := tx.Statement.Schema.LookUpField("OrganizationID")
+	if field == nil {
+		return
+	}
+	tx.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: orgID},
+	}})
+}
+
+// assignTenant sets the organization of records being created, overriding
+// whatever the caller put there
+func assignTenant(tx *gorm.DB) {
+	orgID, ok := tenantFromContext(tx.Statement.Context)
+	if !ok || tx.Statement.Schema == nil {
+		return
+	}
+	field := tx.Statement.Schema.LookUpField("OrganizationID")
+	if field == nil {
+		return
+	}
+
+	ctx := tx.Statement.Context
+	switch value := tx.Statement.ReflectValue; value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if err := field.Set(ctx, reflect.Indirect(value.Index(i)), orgID); err != nil {
+				tx.AddError(err)
+			}
+		}
+	case reflect.Struct:
+		if err := field.Set(ctx, value, orgID); err != nil {
+			tx.AddError(err)
+		}
+	}
+}
+
+var slugInvalidChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// slugify derives a URL-safe identifier from an organization name
+func slugify(name string) string {
+	return strings.Trim(slugInvalidChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// tenantTables lists the tables of tenant-owned models, for the default
+// organization backfill
+var tenantTables = []interface{}{&Invoice{}, &ScanJob{}, &ScanBatch{}, &APIKey{}, &User{}}
+
+// ensureDefaultOrganization creates the first organization and assigns it every
+// row saved before organizations existed. It returns the organization's ID.
+func ensureDefaultOrganization(orgs OrganizationRepository) uint {
+	ctx := context.Background()
+	org, err := orgs.First(ctx)
+	if errors.Is(err, ErrOrganizationNotFound) {
+		name := os.Getenv("DEFAULT_ORGANIZATION")
+		if name == "" {
+			name = "Default"
+		}
+		org = &Organization{Name: name, Slug: slugify(name)}
+		if err := orgs.Create(ctx, org); err != nil {
+			log.Fatalf("Failed to create default organization: %v", err)
+		}
+		log.Printf("Created default organization %d (%s)", org.ID, org.Name)
+	} else if err != nil {
+		log.Fatalf("Failed to load default organization: %v", err)
+	}
+
+	adopted, err := orgs.AdoptOrphans(ctx, org.ID)
+	if err != nil {
+		log.Printf("Warning: Failed to assign existing rows to organization %d: %v", org.ID, err)
+	}
+	if adopted > 0 {
+		log.Printf("Assigned %d existing rows to organization %d", adopted, org.ID)
+	}
+	return org.ID
+}
+
+// organizationCreate is the body of a request to create an organization
+type organizationCreate struct {
+	Name string `json:"name" binding:"required,max=100"`
+	Slug string `json:"slug" binding:"omitempty,max=100"`
+}
+
+// createOrganization adds a tenant
+func (h *authHandlers) createOrganization(c *gin.Context) {
+	var request organizationCreate
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	org := Organization{Name: request.Name, Slug: slugify(request.Slug)}
+	if org.Slug == "" {
+		org.Slug = slugify(request.Name)
+	}
+	if org.Slug == "" {
+		respondError(c, 422, ErrCodeValidationFailed, "Request body failed validation",
+			FieldError{Field: "slug", Message: "could not derive a slug from the name"})
+		return
+	}
+
+	taken, err := h.orgs.SlugTaken(c.Request.Context(), org.Slug)
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to create organization")
+		return
+	}
+	if taken {
+		respondError(c, 409, ErrCodeConflict, "An organization with this slug already exists")
+		return
+	}
+
+	if err := h.orgs.Create(c.Request.Context(), &org); err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to create organization")
+		return
+	}
+
+	log.Printf("Created organization %d (%s)", org.ID, org.Name)
+	c.JSON(201, toOrganizationDTO(org))
+}
+
+// listOrganizations returns every tenant
+func (h *authHandlers) listOrganizations(c *gin.Context) {
+	orgs, err := h.orgs.List(c.Request.Context())
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to list organizations")
+		return
+	}
+
+	dtos := make([]OrganizationDTO, 0, len(orgs))
+	for _, org := range orgs {
+		dtos = append(dtos, toOrganizationDTO(org))
+	}
+	c.JSON(200, OrganizationListDTO{Organizations: dtos})
+}
+
+// targetOrganization returns the organization an admin request acts on: the
+// caller's own, or for platform keys the organization_id query parameter
+func (h *authHandlers) targetOrganization(c *gin.Context) (uint, bool) {
+	orgID := c.GetUint(orgContextKey)
+	value := c.Query("organization_id")
+	if value == "" {
+		return orgID, true
+	}
+
+	if key := currentAPIKey(c); key == nil || !key.HasScope(ScopePlatform) {
+		respondError(c, 403, ErrCodeForbidden, "Only platform keys may act on other organizations")
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(value, 10, 0)
+	if err != nil {
+		respondInvalidParameter(c, "organization_id", "no such organization")
+		return 0, false
+	}
+	org, err := h.orgs.Get(c.Request.Context(), uint(id))
+	if errors.Is(err, ErrOrganizationNotFound) {
+		respondInvalidParameter(c, "organization_id", "no such organization")
+		return 0, false
+	}
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to load organization")
+		return 0, false
+	}
+	return org.ID, true
+}
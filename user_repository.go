@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrUserNotFound is returned when no user of the context's organization has the ID or email
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrSessionNotFound is returned when no unexpired session has the token hash
+var ErrSessionNotFound = errors.New("session not found")
+
+// UserRepository stores the web UI's user accounts and their sessions. Calls
+// are scoped to the context's organization like those of InvoiceRepository;
+// logging in and checking sessions use an unscoped context, since emails are
+// unique across organizations.
+type UserRepository interface {
+	// Create stores a new user
+	Create(ctx context.Context, user *User) error
+	// Get returns a user
+	Get(ctx context.Context, id uint) (*User, error)
+	// GetByEmail returns the user with the email, disabled or not
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	// EmailTaken reports whether a user has the email
+	EmailTaken(ctx context.Context, email string) (bool, error)
+	// List returns every user in the order they were created
+	List(ctx context.Context) ([]User, error)
+	// Update saves a user, and with endSessions also signs the user out everywhere
+	Update(ctx context.Context, user *User, endSessions bool) error
+	// CreateSession stores a new session
+	CreateSession(ctx context.Context, session *Session) error
+	// SessionUser returns the user of the session with the token hash, unless
+	// the session has expired
+	SessionUser(ctx context.Context, tokenHash string) (*User, error)
+	// DeleteSession ends the session with the token hash
+	DeleteSession(ctx context.Context, tokenHash string) error
+	// DeleteExpiredSessions removes the sessions that have expired
+	DeleteExpiredSessions(ctx context.Context) error
+}
+
+// gormUserRepository keeps users and sessions in the SQL database
+type gormUserRepository struct {
+	db *gorm.DB
+}
+
+// newGormUserRepository returns a repository on the database. Tenant scoping
+// relies on the callbacks of registerTenantCallbacks.
+func newGormUserRepository(db *gorm.DB) *gormUserRepository {
+	return &gormUserRepository{db: db}
+}
+
+// Create inserts the user
+func (r *gormUserRepository) Create(ctx context.Context, user *User) error {
+	return r.db.WithContext(ctx).Create(user).Error
+}
+
+// Get loads one user
+func (r *gormUserRepository) Get(ctx context.Context, id uint) (*User, error) {
+	return r.first(r.db.WithContext(ctx).Where("id = ?", id))
+}
+
+// GetByEmail loads the user with the email
+func (r *gormUserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	return r.first(r.db.WithContext(ctx).Where("email = ?", email))
+}
+
+// first loads the user the query selects
+func (r *gormUserRepository) first(query *gorm.DB) (*User, error) {
+	var user User
+	err := query.First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// EmailTaken counts the users with the email
+func (r *gormUserRepository) EmailTaken(ctx context.Context, email string) (bool, error) {
+	var count int64
+	err := r.db.WithContext(ctx).Model(&User{}).Where("email = ?", email).Count(&count).Error
+	return count > 0, err
+}
+
+// List loads the users in ID order
+func (r *gormUserRepository) List(ctx context.Context) ([]User, error) {
+	var users []User
+	err := r.db.WithContext(ctx).Order("id").Find(&users).Error
+	return users, err
+}
+
+// Update saves the user and deletes its sessions in one transaction
+func (r *gormUserRepository) Update(ctx context.Context, user *User, endSessions bool) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(user).Error; err != nil {
+			return err
+		}
+		if endSessions {
+			return tx.Where("user_id = ?", user.ID).Delete(&Session{}).Error
+		}
+		return nil
+	})
+}
+
+// CreateSession inserts the session
+func (r *gormUserRepository) CreateSession(ctx context.Context, session *Session) error {
+	return r.db.WithContext(ctx).Create(session).Error
+}
+
+// SessionUser loads the session with its user
+func (r *gormUserRepository) SessionUser(ctx context.Context, tokenHash string) (*User, error) {
+	var session Session
+	err := r.db.WithContext(ctx).Preload("User").
+		Where("token_hash = ? AND expires_at > ?", tokenHash, time.Now()).
+		First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && session.User.ID == 0) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session.User, nil
+}
+
+// DeleteSession deletes the session's row
+func (r *gormUserRepository) DeleteSession(ctx context.Context, tokenHash string) error {
+	return r.db.WithContext(ctx).Where("token_hash = ?", tokenHash).Delete(&Session{}).Error
+}
+
+// DeleteExpiredSessions deletes the rows of sessions past their expiry
+func (r *gormUserRepository) DeleteExpiredSessions(ctx context.Context) error {
+	return r.db.WithContext(ctx).Where("expires_at <= ?", time.Now()).Delete(&Session{}).Error
+}
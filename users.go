@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// User roles, from least to most privileged
+const (
+	RoleUploader = "uploader"
+	RoleReviewer = "reviewer"
+	RoleApprover = "approver"
+	RoleAdmin    = "admin"
+)
+
+// roleScopes lists what each role may do, in terms of the API key scopes
+var roleScopes = map[string][]string{
+	RoleUploader: {ScopeScan, ScopeRead},
+	RoleReviewer: {ScopeScan, ScopeRead, ScopeWrite},
+	RoleApprover: {ScopeScan, ScopeRead, ScopeWrite, ScopeApprove, ScopeExport},
+	RoleAdmin:    {ScopeAdmin},
+}
+
+// sessionCookie names the cookie holding the session token
+const sessionCookie = "scan_in_session"
+
+// defaultSessionTTL is how long a login lasts unless SESSION_TTL says otherwise
+const defaultSessionTTL = 12 * time.Hour
+
+// userContextKey is where the middleware stores the logged-in user
+const userContextKey = "user"
+
+// User is a person who signs in to the web UI
+type User struct {
+	gorm.Model
+	OrganizationID uint   `gorm:"index"`
+	Email          string `gorm:"uniqueIndex"`
+	Name           string
+	PasswordHash   string
+	Role           string
+	DisabledAt     *time.Time
+}
+
+// Session is a login. The cookie holds a random token; only its hash is stored.
+type Session struct {
+	ID        uint   `gorm:"primarykey"`
+	TokenHash string `gorm:"uniqueIndex"`
+	UserID    uint   `gorm:"index"`
+	User      User
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// HasScope reports whether the user's role grants scope
+func (u *User) HasScope(scope string) bool {
+	scopes := roleScopes[u.Role]
+	if slices.Contains(scopes, scope) {
+		return true
+	}
+	return scope != ScopePlatform && slices.Contains(scopes, ScopeAdmin)
+}
+
+// sessionTTL returns the configured session lifetime
+func sessionTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("SESSION_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return defaultSessionTTL
+}
+
+// hashPassword returns the bcrypt hash of a password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// ensureBootstrapAdmin creates ADMIN_EMAIL with ADMIN_PASSWORD as an admin user
+// of the default organization if no user with that email exists, so the first
+// login is possible
+func (h *authHandlers) ensureBootstrapAdmin(orgID uint) {
+	email := strings.ToLower(strings.TrimSpace(os.Getenv("ADMIN_EMAIL")))
+	password := os.Getenv("ADMIN_PASSWORD")
+	if email == "" || password == "" {
+		return
+	}
+
+	ctx := context.Background()
+	if taken, err := h.users.EmailTaken(ctx, email); err != nil || taken {
+		if err != nil {
+			log.Printf("Warning: Failed to look up admin user: %v", err)
+		}
+		return
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Warning: Failed to hash ADMIN_PASSWORD: %v", err)
+		return
+	}
+	admin := User{Email: email, Name: "Administrator", PasswordHash: hash, Role: RoleAdmin}
+	if err := h.users.Create(withTenant(ctx, orgID), &admin); err != nil {
+		log.Printf("Warning: Failed to create admin user: %v", err)
+	}
+}
+
+// sessionUser returns the user of a valid session cookie, or nil
+func (h *authHandlers) sessionUser(c *gin.Context) *User {
+	token, err := c.Cookie(sessionCookie)
+	if err != nil || token == "" {
+		return nil
+	}
+
+	user, err := h.users.SessionUser(c.Request.Context(), hashToken(token))
+	if err != nil || user.DisabledAt != nil {
+		return nil
+	}
+	return user
+}
+
+// currentUser returns the user the request was authenticated as
+func currentUser(c *gin.Context) *User {
+	if user, ok := c.Get(userContextKey); ok {
+		return user.(*User)
+	}
+	return nil
+}
+
+// sameOrigin guards cookie-authenticated requests that change state against
+// cross-site request forgery. SameSite cookies already stop most of it; this
+// also rejects requests whose Origin header names another site.
+func sameOrigin(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	origin := c.GetHeader("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	return err == nil && parsed.Host == c.Request.Host
+}
+
+// requireLogin sends visitors without a session to the login page
+func (h *authHandlers) requireLogin(c *gin.Context) {
+	user := h.sessionUser(c)
+	if user == nil {
+		c.Redirect(http.StatusSeeOther, "/login")
+		c.Abort()
+		return
+	}
+	c.Set(userContextKey, user)
+	c.Next()
+}
+
+// showLogin renders the login form
+func (h *authHandlers) showLogin(c *gin.Context) {
+	if h.sessionUser(c) != nil {
+		c.Redirect(http.StatusSeeOther, "/")
+		return
+	}
+	c.HTML(200, "login.html", gin.H{"title": "Log in"})
+}
+
+// Limits on login attempts. They apply per client address and per account, so
+// that neither many accounts from one address nor one account from many
+// addresses can be tried quickly.
+const (
+	loginRateLimitPerMinute  = 10
+	loginRateLimitBurst      = 20
+	loginEmailLimitPerMinute = 5
+	loginEmailLimitBurst     = 10
+)
+
+// sessionCookieSecure reports whether the session cookie may only be sent over
+// HTTPS. Behind a proxy that terminates TLS, set COOKIE_SECURE=true; otherwise
+// the flag follows whether the request itself came over TLS.
+func sessionCookieSecure(c *gin.Context) bool {
+	if secure, err := strconv.ParseBool(os.Getenv("COOKIE_SECURE")); err == nil {
+		return secure
+	}
+	return c.Request.TLS != nil
+}
+
+// login checks the submitted credentials and starts a session
+func (h *authHandlers) login(c *gin.Context) {
+	email := strings.ToLower(strings.TrimSpace(c.PostForm("email")))
+	password := c.PostForm("password")
+
+	limits := []struct {
+		id               string
+		perMinute, burst int
+	}{
+		{"login-ip:" + c.ClientIP(), loginRateLimitPerMinute, loginRateLimitBurst},
+		{"login-email:" + email, loginEmailLimitPerMinute, loginEmailLimitBurst},
+	}
+	for _, limit := range limits {
+		if wait, ok := h.limiter.allow(limit.id, limit.perMinute, limit.burst); !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.HTML(429, "login.html", gin.H{"title": "Log in", "error": "Too many login attempts, try again later", "email": email})
+			return
+		}
+	}
+
+	user, err := h.users.GetByEmail(c.Request.Context(), email)
+	if err != nil || user.DisabledAt != nil ||
+		bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		c.HTML(401, "login.html", gin.H{"title": "Log in", "error": "Invalid email or password", "email": email})
+		return
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		c.HTML(500, "login.html", gin.H{"title": "Log in", "error": "Could not start a session"})
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	ttl := sessionTTL()
+	session := Session{TokenHash: hashToken(token), UserID: user.ID, ExpiresAt: time.Now().Add(ttl)}
+	if err := h.users.CreateSession(c.Request.Context(), &session); err != nil {
+		c.HTML(500, "login.html", gin.H{"title": "Log in", "error": "Could not start a session"})
+		return
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, token, int(ttl.Seconds()), "/", "", sessionCookieSecure(c), true)
+
+	log.Printf("User %d (%s) logged in", user.ID, user.Email)
+	c.Redirect(http.StatusSeeOther, "/")
+}
+
+// logout ends the current session
+func (h *authHandlers) logout(c *gin.Context) {
+	if token, err := c.Cookie(sessionCookie); err == nil && token != "" {
+		if err := h.users.DeleteSession(c.Request.Context(), hashToken(token)); err != nil {
+			log.Printf("Warning: Failed to end session: %v", err)
+		}
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, "", -1, "/", "", sessionCookieSecure(c), true)
+	c.Redirect(http.StatusSeeOther, "/login")
+}
+
+// cleanupExpiredSessions periodically removes sessions that have expired
+func (h *authHandlers) cleanupExpiredSessions() {
+	for {
+		if err := h.users.DeleteExpiredSessions(context.Background()); err != nil {
+			log.Printf("Warning: Failed to remove expired sessions: %v", err)
+		}
+		time.Sleep(1 * time.Hour)
+	}
+}
+
+// userCreate is the body of a request to create a user
+type userCreate struct {
+	Email    string `json:"email" binding:"required,email,max=200"`
+	Name     string `json:"name" binding:"required,max=100"`
+	Password string `json:"password" binding:"required,min=12,max=72"`
+	Role     string `json:"role" binding:"required,oneof=uploader reviewer approver admin"`
+}
+
+// userUpdate is the body of a request to change a user. Omitted fields are left unchanged.
+type userUpdate struct {
+	Name     *string `json:"name" binding:"omitempty,max=100"`
+	Password *string `json:"password" binding:"omitempty,min=12,max=72"`
+	Role     *string `json:"role" binding:"omitempty,oneof=uploader reviewer approver admin"`
+	Disabled *bool   `json:"disabled"`
+}
+
+// createUser adds a user account to the organization
+func (h *authHandlers) createUser(c *gin.Context) {
+	orgID, ok := h.targetOrganization(c)
+	if !ok {
+		return
+	}
+
+	var request userCreate
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	hash, err := hashPassword(request.Password)
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to hash password")
+		return
+	}
+
+	user := User{
+		Email:        strings.ToLower(request.Email),
+		Name:         request.Name,
+		PasswordHash: hash,
+		Role:         request.Role,
+	}
+
+	taken, err := h.users.EmailTaken(c.Request.Context(), user.Email)
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to create user")
+		return
+	}
+	if taken {
+		respondError(c, 409, ErrCodeConflict, "A user with this email already exists")
+		return
+	}
+
+	if err := h.users.Create(withTenant(c.Request.Context(), orgID), &user); err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to create user")
+		return
+	}
+
+	log.Printf("Created user %d (%s) in organization %d with role %s", user.ID, user.Email, orgID, user.Role)
+	c.JSON(201, toUserDTO(user))
+}
+
+// listUsers returns every user account of the organization
+func (h *authHandlers) listUsers(c *gin.Context) {
+	orgID, ok := h.targetOrganization(c)
+	if !ok {
+		return
+	}
+
+	users, err := h.users.List(withTenant(c.Request.Context(), orgID))
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to list users")
+		return
+	}
+
+	dtos := make([]UserDTO, 0, len(users))
+	for _, user := range users {
+		dtos = append(dtos, toUserDTO(user))
+	}
+	c.JSON(200, UserListDTO{Users: dtos})
+}
+
+// updateUser changes a user's name, password, role or disabled state. Changing
+// the password, role or disabled state signs the user out everywhere.
+func (h *authHandlers) updateUser(c *gin.Context) {
+	orgID, ok := h.targetOrganization(c)
+	if !ok {
+		return
+	}
+
+	ctx := withTenant(c.Request.Context(), orgID)
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		respondError(c, 404, ErrCodeNotFound, "User not found")
+		return
+	}
+	user, err := h.users.Get(ctx, uint(id))
+	if errors.Is(err, ErrUserNotFound) {
+		respondError(c, 404, ErrCodeNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to load user")
+		return
+	}
+
+	var request userUpdate
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	revokeSessions := false
+	if request.Name != nil {
+		user.Name = *request.Name
+	}
+	if request.Password != nil {
+		hash, err := hashPassword(*request.Password)
+		if err != nil {
+			respondError(c, 500, ErrCodeInternal, "Failed to hash password")
+			return
+		}
+		user.PasswordHash = hash
+		revokeSessions = true
+	}
+	if request.Role != nil && *request.Role != user.Role {
+		user.Role = *request.Role
+		revokeSessions = true
+	}
+	if request.Disabled != nil && *request.Disabled != (user.DisabledAt != nil) {
+		user.DisabledAt = nil
+		if *request.Disabled {
+			now := time.Now()
+			user.DisabledAt = &now
+		}
+		revokeSessions = true
+	}
+
+	if err := h.users.Update(ctx, user, revokeSessions); err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to update user")
+		return
+	}
+
+	c.JSON(200, toUserDTO(*user))
+}
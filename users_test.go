@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPassword is the password of every user createUser makes
+const testPassword = "correct horse battery"
+
+// createUser stores a user of the organization with the role and testPassword
+// and returns its ID
+func (s *testServer) createUser(t *testing.T, orgID uint, email, role string) uint {
+	t.Helper()
+	hash, err := hashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := User{OrganizationID: orgID, Email: email, Name: email, PasswordHash: hash, Role: role}
+	if err := s.db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user.ID
+}
+
+// loginRequest returns a request posting the login form
+func loginRequest(email, password string) *http.Request {
+	form := url.Values{"email": {email}, "password": {password}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+// submitLogin posts the login form
+func (s *testServer) submitLogin(email, password string) *httptest.ResponseRecorder {
+	return serve(s.router, loginRequest(email, password))
+}
+
+// login signs the user in and returns the session cookie
+func (s *testServer) login(t *testing.T, email string) *http.Cookie {
+	t.Helper()
+	w := s.submitLogin(email, testPassword)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("login as %s: %d %s", email, w.Code, w.Body)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == sessionCookie {
+			return cookie
+		}
+	}
+	t.Fatalf("login as %s set no session cookie", email)
+	return nil
+}
+
+// browse serves a request made with the session cookie
+func (s *testServer) browse(cookie *http.Cookie, req *http.Request) *httptest.ResponseRecorder {
+	req.AddCookie(cookie)
+	return serve(s.router, req)
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, 1, "ada@acme.test", RoleReviewer)
+
+	for _, credentials := range [][2]string{
+		{"ada@acme.test", "wrong password"},
+		{"nobody@acme.test", testPassword},
+		{"", ""},
+	} {
+		if w := s.submitLogin(credentials[0], credentials[1]); w.Code != 401 || len(w.Result().Cookies()) != 0 {
+			t.Errorf("login as %q with %q: %d, cookies %v", credentials[0], credentials[1], w.Code, w.Result().Cookies())
+		}
+	}
+
+	// Emails are matched case-insensitively
+	w := s.submitLogin(" Ada@Acme.test ", testPassword)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Fatalf("login: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.MaxAge != int(defaultSessionTTL.Seconds()) {
+		t.Fatalf("session cookie %+v", cookie)
+	}
+
+	if w := s.browse(cookie, request("GET", "/", "")); w.Code != 200 {
+		t.Errorf("UI with a session: %d", w.Code)
+	}
+	if w := s.browse(cookie, request("GET", "/login", "")); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Errorf("login page with a session: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if w := s.browse(cookie, request("GET", "/api/invoices", "")); w.Code != 200 {
+		t.Errorf("API with a session: %d %s", w.Code, w.Body)
+	}
+	if w := serve(s.router, request("GET", "/", "")); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Errorf("UI without a session: %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	// Logging out ends the session on the server, not just in the browser
+	if w := s.browse(cookie, request("POST", "/logout", "")); w.Code != http.StatusSeeOther {
+		t.Errorf("logout: %d", w.Code)
+	}
+	if w := s.browse(cookie, request("GET", "/api/invoices", "")); w.Code != 401 {
+		t.Errorf("API after logout: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, 1, "ada@acme.test", RoleReviewer)
+	from := func(addr, email, password string) *httptest.ResponseRecorder {
+		req := loginRequest(email, password)
+		req.RemoteAddr = addr + ":40000"
+		return serve(s.router, req)
+	}
+
+	// One address trying many accounts is stopped, whatever it claims to forward for
+	for i := 0; i < loginRateLimitBurst; i++ {
+		if w := from("203.0.113.1", fmt.Sprintf("user%d@acme.test", i), "guess"); w.Code != 401 {
+			t.Fatalf("attempt %d: %d", i+1, w.Code)
+		}
+	}
+	w := from("203.0.113.1", "ada@acme.test", testPassword)
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" || len(w.Result().Cookies()) != 0 {
+		t.Errorf("attempt over the address limit: %d %v", w.Code, w.Result().Cookies())
+	}
+	req := loginRequest("ada@acme.test", testPassword)
+	req.RemoteAddr = "203.0.113.1:40000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if w := serve(s.router, req); w.Code != 429 {
+		t.Errorf("attempt with a forged X-Forwarded-For: %d", w.Code)
+	}
+
+	// One account tried from many addresses is stopped too
+	for i := 0; i < loginEmailLimitBurst; i++ {
+		if w := from(fmt.Sprintf("198.51.100.%d", i+1), "ada@acme.test", "guess"); w.Code != 401 {
+			t.Fatalf("attempt %d on the account: %d", i+1, w.Code)
+		}
+	}
+	if w := from("198.51.100.200", "ada@acme.test", testPassword); w.Code != 429 {
+		t.Errorf("attempt over the account limit: %d", w.Code)
+	}
+	if w := from("198.51.100.200", "bob@acme.test", "guess"); w.Code != 401 {
+		t.Errorf("other account from a fresh address: %d", w.Code)
+	}
+}
+
+func TestSessionCookieSecure(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, 1, "ada@acme.test", RoleReviewer)
+
+	// The client cannot mark its plain HTTP connection as HTTPS
+	req := loginRequest("ada@acme.test", testPassword)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	if cookies := serve(s.router, req).Result().Cookies(); len(cookies) != 1 || cookies[0].Secure {
+		t.Errorf("cookie over plain HTTP: %+v", cookies)
+	}
+
+	t.Setenv("COOKIE_SECURE", "true")
+	if cookie := s.login(t, "ada@acme.test"); !cookie.Secure {
+		t.Errorf("cookie with COOKIE_SECURE set: %+v", cookie)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	t.Setenv("SESSION_TTL", "1h")
+	s := newTestServer(t)
+	s.createUser(t, 1, "ada@acme.test", RoleReviewer)
+
+	cookie := s.login(t, "ada@acme.test")
+	if cookie.MaxAge != 3600 {
+		t.Errorf("cookie lifetime %d with SESSION_TTL=1h", cookie.MaxAge)
+	}
+	var session Session
+	if err := s.db.Where("token_hash = ?", hashToken(cookie.Value)).First(&session).Error; err != nil {
+		t.Fatal(err)
+	}
+	if ttl := time.Until(session.ExpiresAt); ttl < 59*time.Minute || ttl > time.Hour {
+		t.Errorf("session expires in %v", ttl)
+	}
+
+	// The server decides when a session ends, whatever the browser keeps
+	if err := s.db.Model(&session).Update("expires_at", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if w := s.browse(cookie, request("GET", "/api/invoices", "")); w.Code != 401 {
+		t.Errorf("API with an expired session: %d %s", w.Code, w.Body)
+	}
+	if w := s.browse(cookie, request("GET", "/", "")); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Errorf("UI with an expired session: %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	if err := s.auth.users.DeleteExpiredSessions(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	var left int64
+	s.db.Model(&Session{}).Count(&left)
+	if left != 0 {
+		t.Errorf("%d sessions left after removing expired ones", left)
+	}
+}
+
+func TestDisabledUsers(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.issueKey(t, 1, ScopeAdmin)
+	adaID := s.createUser(t, 1, "ada@acme.test", RoleReviewer)
+	s.createUser(t, 1, "bob@acme.test", RoleReviewer)
+
+	// Disabling through the API signs the user out and stops new logins
+	cookie := s.login(t, "ada@acme.test")
+	userPath := fmt.Sprintf("/api/admin/users/%d", adaID)
+	var disabled UserDTO
+	decode(t, s.call(admin, request("PATCH", userPath, `{"disabled": true}`)), 200, &disabled)
+	if disabled.DisabledAt == nil {
+		t.Errorf("disabled user %+v", disabled)
+	}
+	if w := s.browse(cookie, request("GET", "/api/invoices", "")); w.Code != 401 {
+		t.Errorf("session of a disabled user: %d %s", w.Code, w.Body)
+	}
+	if w := s.submitLogin("ada@acme.test", testPassword); w.Code != 401 {
+		t.Errorf("login of a disabled user: %d", w.Code)
+	}
+
+	// A session that outlived its user's disabling is refused all the same
+	cookie = s.login(t, "bob@acme.test")
+	if err := s.db.Model(&User{}).Where("email = ?", "bob@acme.test").Update("disabled_at", time.Now()).Error; err != nil {
+		t.Fatal(err)
+	}
+	if w := s.browse(cookie, request("GET", "/api/invoices", "")); w.Code != 401 {
+		t.Errorf("leftover session of a disabled user: %d %s", w.Code, w.Body)
+	}
+
+	// Enabling the user again allows logging in
+	decode(t, s.call(admin, request("PATCH", userPath, `{"disabled": false}`)), 200, nil)
+	s.login(t, "ada@acme.test")
+}
+
+func TestRolesGateRequests(t *testing.T) {
+	s := newTestServer(t)
+	sessions := map[string]*http.Cookie{}
+	for _, role := range []string{RoleUploader, RoleReviewer, RoleApprover, RoleAdmin} {
+		email := role + "@acme.test"
+		s.createUser(t, 1, email, role)
+		sessions[role] = s.login(t, email)
+	}
+
+	// Allowed requests reach the handler, which finds no invoice 999
+	tests := []struct {
+		role, method, path, body string
+		status                   int
+	}{
+		{RoleUploader, "GET", "/api/invoices", "", 200},
+		{RoleUploader, "PATCH", "/api/invoices/999", `{"vendor_name": "Initech"}`, 403},
+		{RoleUploader, "GET", "/api/invoices/export", "", 403},
+		{RoleReviewer, "PATCH", "/api/invoices/999", `{"vendor_name": "Initech"}`, 404},
+		{RoleReviewer, "POST", "/api/invoices/999/approve", "", 403},
+		{RoleApprover, "POST", "/api/invoices/999/approve", "", 404},
+		{RoleApprover, "GET", "/api/invoices/export", "", 200},
+		{RoleApprover, "GET", "/api/admin/users", "", 403},
+		{RoleAdmin, "GET", "/api/admin/users", "", 200},
+		{RoleAdmin, "POST", "/api/invoices/999/approve", "", 404},
+		{RoleAdmin, "GET", "/api/platform/organizations", "", 403},
+	}
+	for _, tt := range tests {
+		w := s.browse(sessions[tt.role], request(tt.method, tt.path, tt.body))
+		if w.Code != tt.status {
+			t.Errorf("%s: %s %s: %d %s, want %d", tt.role, tt.method, tt.path, w.Code, w.Body, tt.status)
+		}
+		if w.Code == 403 && !strings.Contains(w.Body.String(), "The "+tt.role+" role may not") {
+			t.Errorf("%s: %s %s refused with %s", tt.role, tt.method, tt.path, w.Body)
+		}
+	}
+
+	// A change of role takes effect at the next login
+	var users UserListDTO
+	decode(t, s.browse(sessions[RoleAdmin], request("GET", "/api/admin/users", "")), 200, &users)
+	uploaderPath := fmt.Sprintf("/api/admin/users/%d", users.Users[0].ID)
+	decode(t, s.browse(sessions[RoleAdmin], request("PATCH", uploaderPath, `{"role": "reviewer"}`)), 200, nil)
+	if w := s.browse(sessions[RoleUploader], request("GET", "/api/invoices", "")); w.Code != 401 {
+		t.Errorf("session after a change of role: %d %s", w.Code, w.Body)
+	}
+	promoted := s.login(t, "uploader@acme.test")
+	if w := s.browse(promoted, request("PATCH", "/api/invoices/999", `{"vendor_name": "Initech"}`)); w.Code != 404 {
+		t.Errorf("promoted user writing: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestCrossOriginRequestsWithSessionsAreRejected(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, 1, "ada@acme.test", RoleReviewer)
+	cookie := s.login(t, "ada@acme.test")
+	key, _ := s.issueKey(t, 1, ScopeWrite)
+
+	// httptest requests are made to example.com
+	tests := []struct {
+		name, method, origin string
+		status               int
+	}{
+		{"write from another site", "PATCH", "https://evil.test", 403},
+		{"write from a lookalike host", "PATCH", "http://example.com.evil.test", 403},
+		{"write from an unparseable origin", "PATCH", "://", 403},
+		{"write from the same site", "PATCH", "http://example.com", 404},
+		{"write without an origin", "PATCH", "", 404},
+		{"read from another site", "GET", "https://evil.test", 404},
+	}
+	for _, tt := range tests {
+		req := request(tt.method, "/api/invoices/999", `{"vendor_name": "Initech"}`)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		w := s.browse(cookie, req)
+		if w.Code != tt.status {
+			t.Errorf("%s: %d %s, want %d", tt.name, w.Code, w.Body, tt.status)
+		}
+		if tt.status == 403 && !strings.Contains(w.Body.String(), "Cross-site request rejected") {
+			t.Errorf("%s refused with %s", tt.name, w.Body)
+		}
+	}
+
+	// Browsers don't attach API keys on their own, so keys are not checked
+	req := request("PATCH", "/api/invoices/999", `{"vendor_name": "Initech"}`)
+	req.Header.Set("Origin", "https://evil.test")
+	if w := s.call(key, req); w.Code != 404 {
+		t.Errorf("API key from another site: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"cmp"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Thresholds of vendor name scoring, out of 1
+const (
+	vendorAutoMatchScore = 0.9  // a scan is linked to the best candidate only from this score
+	vendorMatchMargin    = 0.05 // by which the best candidate must beat the next vendor
+	vendorCandidateScore = 0.6  // candidates below this are not worth showing
+	vendorTokenScore     = 0.85 // from which two words of a name count as the same word
+)
+
+// maxVendorCandidates bounds the candidates returned for one name
+const maxVendorCandidates = 5
+
+// ocrDigits folds characters OCR reads in place of letters, such as the 0 in
+// "ACME C0RP", to the letter they stand for
+var ocrDigits = strings.NewReplacer("0", "o", "1", "l", "|", "l", "!", "l", "5", "s", "8", "b")
+
+// legalForms are the words of a vendor name that only state its legal form
+var legalForms = []string{"inc", "llc", "ltd", "limited", "corp", "corporation", "co", "company", "gmbh", "ag", "plc", "sa", "bv"}
+
+// vendorWordRegex splits a vendor name into words
+var vendorWordRegex = regexp.MustCompile(`[a-z0-9|!]+`)
+
+// vendorCandidate is a vendor a scanned name may belong to
+type vendorCandidate struct {
+	Vendor      *Vendor
+	Score       float64 // 1 for a domain match or equal names
+	Method      string  // VendorMatchDomain or VendorMatchName
+	MatchedName string  // the vendor's name or alias that scored best, empty for a domain match
+}
+
+// vendorMatch is the outcome of resolving a scanned vendor to the vendor master data
+type vendorMatch struct {
+	Vendor     *Vendor // nil unless one candidate is clearly the vendor
+	Method     string
+	Candidates []vendorCandidate // best first
+}
+
+// ocrKey folds a vendor name to the form names are compared in: the cleaned
+// name with OCR confusions folded and a legal form written without a space,
+// as in "Acmecorp", removed
+func ocrKey(name string) string {
+	key := cleanTextForComparison(ocrDigits.Replace(strings.ToLower(name)))
+	for _, form := range legalForms {
+		// Short forms are too likely to be the end of a word
+		if len(form) >= 3 && len(key)-len(form) >= 4 && strings.HasSuffix(key, form) {
+			key = strings.TrimSuffix(key, form)
+			break
+		}
+	}
+	// Folded after the legal forms, which contain an i
+	return strings.ReplaceAll(key, "i", "l")
+}
+
+// ocrTokens returns the words of a vendor name other than its legal form,
+// folded like ocrKey
+func ocrTokens(name string) []string {
+	var tokens []string
+	for _, word := range vendorWordRegex.FindAllString(strings.ToLower(name), -1) {
+		word = ocrDigits.Replace(word)
+		if slices.Contains(legalForms, word) {
+			continue
+		}
+		tokens = append(tokens, strings.ReplaceAll(word, "i", "l"))
+	}
+	return tokens
+}
+
+// levenshteinSimilarity is 1 minus the edit distance of two strings divided by
+// the length of the longer
+func levenshteinSimilarity(a, b string) float64 {
+	x, y := []rune(a), []rune(b)
+	if len(x) == 0 && len(y) == 0 {
+		return 1
+	}
+
+	row := make([]int, len(y)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(x); i++ {
+		diagonal := row[0]
+		row[0] = i
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+			diagonal, row[j] = row[j], min(min(row[j]+1, row[j-1]+1), diagonal+cost)
+		}
+	}
+	return 1 - float64(row[len(y)])/float64(max(len(x), len(y)))
+}
+
+// jaroWinkler is the Jaro similarity of two strings, raised for a common
+// prefix of up to four characters since names are mostly misread at the end
+func jaroWinkler(a, b string) float64 {
+	x, y := []rune(a), []rune(b)
+	if len(x) == 0 || len(y) == 0 {
+		if len(x) == len(y) {
+			return 1
+		}
+		return 0
+	}
+
+	window := max(len(x), len(y))/2 - 1
+	if window < 0 {
+		window = 0
+	}
+	matchedX, matchedY := make([]bool, len(x)), make([]bool, len(y))
+	matches := 0
+	for i := range x {
+		for j := max(0, i-window); j < min(len(y), i+window+1); j++ {
+			if !matchedY[j] && x[i] == y[j] {
+				matchedX[i], matchedY[j] = true, true
+				matches++
+				break
+			}
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+
+	transpositions, j := 0, 0
+	for i := range x {
+		if !matchedX[i] {
+			continue
+		}
+		for !matchedY[j] {
+			j++
+		}
+		if x[i] != y[j] {
+			transpositions++
+		}
+		j++
+	}
+	m := float64(matches)
+	jaro := (m/float64(len(x)) + m/float64(len(y)) + (m-float64(transpositions)/2)/m) / 3
+
+	prefix := 0
+	for prefix < min(4, min(len(x), len(y))) && x[prefix] == y[prefix] {
+		prefix++
+	}
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
+
+// keySimilarity compares two folded names character by character, averaging
+// the edit distance, which punishes every misread letter, with Jaro-Winkler,
+// which forgives a misread ending
+func keySimilarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	return (levenshteinSimilarity(a, b) + jaroWinkler(a, b)) / 2
+}
+
+// tokenSetSimilarity compares two names word by word regardless of order, so
+// "Acme Office Supplies" matches "Office Supplies Acme". Words count as the
+// same when keySimilarity rates them at least vendorTokenScore; the score is
+// the share of words on both sides that found a partner.
+func tokenSetSimilarity(a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	used := make([]bool, len(b))
+	matched := 0.0
+	for _, token := range a {
+		best, bestScore := -1, vendorTokenScore
+		for j, other := range b {
+			if score := keySimilarity(token, other); !used[j] && score >= bestScore {
+				best, bestScore = j, score
+			}
+		}
+		if best >= 0 {
+			used[best] = true
+			matched += bestScore
+		}
+	}
+	return 2 * matched / float64(len(a)+len(b))
+}
+
+// vendorNameScore rates how likely two vendor names name the same vendor,
+// from 0 to 1, as the better of comparing them whole and word by word
+func vendorNameScore(a, b string) float64 {
+	keyA, keyB := ocrKey(a), ocrKey(b)
+	if keyA == "" || keyB == "" {
+		return 0
+	}
+	return math.Max(keySimilarity(keyA, keyB), tokenSetSimilarity(ocrTokens(a), ocrTokens(b)))
+}
+
+// rankVendors scores every vendor against a scanned vendor name and the
+// domains on the invoice, and returns the likely ones best first. A vendor
+// owning one of the domains scores 1; otherwise its best scoring name or alias
+// counts.
+func rankVendors(vendors []Vendor, vendorName string, domains []string) []vendorCandidate {
+	nameKnown := knownValue(vendorName) && len(ocrKey(vendorName)) >= 3
+
+	var candidates []vendorCandidate
+	for i := range vendors {
+		vendor := &vendors[i]
+		candidate := vendorCandidate{Vendor: vendor}
+		for _, vendorDomain := range vendor.Domains {
+			for _, domain := range domains {
+				if domainMatches(normalizeDomain(domain), normalizeDomain(vendorDomain)) {
+					candidate.Score, candidate.Method = 1, VendorMatchDomain
+				}
+			}
+		}
+		if candidate.Method == "" && nameKnown {
+			for _, name := range append([]string{vendor.Name}, vendor.Aliases...) {
+				if score := vendorNameScore(vendorName, name); score > candidate.Score {
+					candidate.Score, candidate.Method, candidate.MatchedName = score, VendorMatchName, name
+				}
+			}
+		}
+		if candidate.Score >= vendorCandidateScore {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	// Domain matches first, since OCR reads domains exactly
+	byDomain := func(candidate vendorCandidate) int {
+		if candidate.Method == VendorMatchDomain {
+			return 1
+		}
+		return 0
+	}
+	slices.SortStableFunc(candidates, func(a, b vendorCandidate) int {
+		return cmp.Or(
+			cmp.Compare(byDomain(b), byDomain(a)),
+			cmp.Compare(b.Score, a.Score),
+			cmp.Compare(a.Vendor.Name, b.Vendor.Name),
+		)
+	})
+	if len(candidates) > maxVendorCandidates {
+		candidates = candidates[:maxVendorCandidates]
+	}
+	return candidates
+}
+
+// matchVendor resolves a scanned vendor to a vendor. A domain belonging to one
+// vendor decides; otherwise the best scoring name is taken if it reaches
+// vendorAutoMatchScore and beats every other vendor by vendorMatchMargin. The
+// candidates are returned either way, for review.
+func matchVendor(vendors []Vendor, vendorName string, domains []string) vendorMatch {
+	match := vendorMatch{Candidates: rankVendors(vendors, vendorName, domains)}
+
+	// Several vendors sharing a domain can only be told apart by name
+	var byName []vendorCandidate
+	for _, candidate := range match.Candidates {
+		if candidate.Method == VendorMatchDomain {
+			byName = append(byName, candidate)
+		}
+	}
+	switch len(byName) {
+	case 0:
+		byName = match.Candidates
+	case 1:
+		match.Vendor, match.Method = byName[0].Vendor, VendorMatchDomain
+		return match
+	default:
+		byName = rescoreByName(byName, vendorName)
+	}
+
+	if len(byName) == 0 || byName[0].Score < vendorAutoMatchScore {
+		return match
+	}
+	if len(byName) > 1 && byName[1].Score > byName[0].Score-vendorMatchMargin {
+		return match
+	}
+	match.Vendor, match.Method = byName[0].Vendor, VendorMatchName
+	return match
+}
+
+// rescoreByName scores candidates on their names alone, best first
+func rescoreByName(candidates []vendorCandidate, vendorName string) []vendorCandidate {
+	rescored := make([]vendorCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		candidate.Score, candidate.Method = 0, VendorMatchName
+		if knownValue(vendorName) {
+			for _, name := range append([]string{candidate.Vendor.Name}, candidate.Vendor.Aliases...) {
+				if score := vendorNameScore(vendorName, name); score > candidate.Score {
+					candidate.Score, candidate.MatchedName = score, name
+				}
+			}
+		}
+		rescored = append(rescored, candidate)
+	}
+	slices.SortStableFunc(rescored, func(a, b vendorCandidate) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+	return rescored
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+// testVendors are the vendor master data the matching tests resolve names against
+func testVendors() []Vendor {
+	vendors := []Vendor{
+		{Name: "ACME Corp", Domains: []string{"acme.example"}},
+		{Name: "Globex Corporation"},
+		{Name: "Initech", Aliases: []string{"Initech Software"}},
+		{Name: "Office Supplies Direct"},
+		{Name: "Stark Industries", Domains: []string{"stark.example"}},
+		{Name: "Stark Logistics", Domains: []string{"stark.example"}},
+	}
+	for i := range vendors {
+		vendors[i].ID = uint(i + 1)
+	}
+	return vendors
+}
+
+func TestVendorNameScore(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"ACME C0RP", "Acme Corp", 1},
+		{"Acmecorp", "ACME Corp", 1},
+		{"GL0BEX C0RP.", "Globex Corporation", 1},
+		{"Direct Office Supplies", "Office Supplies Direct", 1},
+		{"Globx Corporation", "Globex Corporation", 0.9},
+		{"Acne Corp", "ACME Corp", 0.81},
+		{"Stark", "Stark Industries", 0.67},
+		{"Umbrella Corp", "ACME Corp", 0},
+		{"", "ACME Corp", 0},
+		{"Inc.", "ACME Corp", 0},
+	}
+	for _, test := range tests {
+		got := vendorNameScore(test.a, test.b)
+		if math.Abs(got-test.want) > 0.05 && !(test.want == 0 && got < vendorCandidateScore) {
+			t.Errorf("vendorNameScore(%q, %q) = %.2f, want %.2f", test.a, test.b, got, test.want)
+		}
+		if reverse := vendorNameScore(test.b, test.a); math.Abs(reverse-got) > 1e-9 {
+			t.Errorf("vendorNameScore(%q, %q) = %.2f, but %.2f the other way", test.b, test.a, reverse, got)
+		}
+	}
+}
+
+func TestMatchVendor(t *testing.T) {
+	tests := []struct {
+		name       string
+		domains    []string
+		want       uint // vendor resolved to, 0 for none
+		method     string
+		candidates []uint
+	}{
+		{"ACME C0RP", nil, 1, VendorMatchName, []uint{1}},
+		{"Acmecorp", nil, 1, VendorMatchName, []uint{1}},
+		{"GL0BEX C0RP.", nil, 2, VendorMatchName, []uint{2}},
+		{"Globx Corporation", nil, 2, VendorMatchName, []uint{2}},
+		{"lnitech", nil, 3, VendorMatchName, []uint{3}},
+		{"1NITECH SOFTWARE", nil, 3, VendorMatchName, []uint{3}},
+		{"Direct Office Supplies", nil, 4, VendorMatchName, []uint{4}},
+		{"Stark Industrles", nil, 5, VendorMatchName, []uint{5, 6}},
+
+		// Close but not close enough, or too close to another vendor, goes to review
+		{"Acne Corp", nil, 0, "", []uint{1}},
+		{"Stark", nil, 0, "", []uint{5, 6}},
+		{"Umbrella Corp", nil, 0, "", nil},
+		{"UNKNOWN", nil, 0, "", nil},
+
+		// A domain of one vendor decides, whatever the name
+		{"Umbrella Corp", []string{"www.ACME.example"}, 1, VendorMatchDomain, []uint{1}},
+		{"UNKNOWN", []string{"billing.acme.example"}, 1, VendorMatchDomain, []uint{1}},
+
+		// A domain several vendors share leaves the name to decide
+		{"Stark Logistics", []string{"stark.example"}, 6, VendorMatchName, []uint{5, 6}},
+		{"Stark", []string{"stark.example"}, 0, "", []uint{5, 6}},
+	}
+	for _, test := range tests {
+		match := matchVendor(testVendors(), test.name, test.domains)
+
+		var got uint
+		if match.Vendor != nil {
+			got = match.Vendor.ID
+		}
+		if got != test.want || match.Method != test.method {
+			t.Errorf("matchVendor(%q, %v) = vendor %d by %q, want %d by %q", test.name, test.domains, got, match.Method, test.want, test.method)
+		}
+
+		var candidates []uint
+		for _, candidate := range match.Candidates {
+			candidates = append(candidates, candidate.Vendor.ID)
+		}
+		if !slices.Equal(candidates, test.candidates) {
+			t.Errorf("matchVendor(%q, %v) candidates %v, want %v", test.name, test.domains, candidates, test.candidates)
+		}
+	}
+}
+
+func TestMatchVendorCapsCandidates(t *testing.T) {
+	var vendors []Vendor
+	for _, name := range []string{"Acme A", "Acme B", "Acme C", "Acme D", "Acme E", "Acme F", "Acme G"} {
+		vendors = append(vendors, Vendor{Name: name})
+	}
+	match := matchVendor(vendors, "Acme", nil)
+	if match.Vendor != nil || len(match.Candidates) != maxVendorCandidates {
+		t.Errorf("matched %v with %d candidates, want no match and %d candidates", match.Vendor, len(match.Candidates), maxVendorCandidates)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrVendorNotFound is returned when no vendor of the context's organization has the ID
+var ErrVendorNotFound = errors.New("vendor not found")
+
+// ErrUnmatchedVendorNotFound is returned when no review list entry of the context's organization has the ID
+var ErrUnmatchedVendorNotFound = errors.New("unmatched vendor not found")
+
+// VendorRepository stores the vendors scans are resolved to and the review
+// list of vendor names that resolved to none. Calls are scoped to the
+// context's organization like those of InvoiceRepository.
+type VendorRepository interface {
+	// Create stores a new vendor
+	Create(ctx context.Context, vendor *Vendor) error
+	// List returns every vendor
+	List(ctx context.Context) ([]Vendor, error)
+	// Get returns a vendor
+	Get(ctx context.Context, id uint) (*Vendor, error)
+	// Update saves all of the vendor's master data
+	Update(ctx context.Context, vendor *Vendor) error
+	// UpdateAliases saves the vendor's aliases
+	UpdateAliases(ctx context.Context, vendor *Vendor) error
+	// RecordUnmatched adds a scanned vendor name and the domains seen with it
+	// to the review list entry of its name key, creating the entry if needed
+	RecordUnmatched(ctx context.Context, nameKey, name string, domains []string) error
+	// ListUnmatched returns the review list, most frequent names first
+	ListUnmatched(ctx context.Context) ([]UnmatchedVendor, error)
+	// GetUnmatched returns a review list entry
+	GetUnmatched(ctx context.Context, id uint) (*UnmatchedVendor, error)
+	// DeleteUnmatched removes a review list entry for good, so the name is
+	// listed afresh if it recurs
+	DeleteUnmatched(ctx context.Context, id uint) error
+}
+
+// gormVendorRepository keeps vendors in the SQL database
+type gormVendorRepository struct {
+	db *gorm.DB
+}
+
+// newGormVendorRepository returns a repository on the database. Tenant scoping
+// relies on the callbacks of registerTenantCallbacks.
+func newGormVendorRepository(db *gorm.DB) *gormVendorRepository {
+	return &gormVendorRepository{db: db}
+}
+
+// Create inserts the vendor
+func (r *gormVendorRepository) Create(ctx context.Context, vendor *Vendor) error {
+	return r.db.WithContext(ctx).Create(vendor).Error
+}
+
+// List loads the vendors in ID order
+func (r *gormVendorRepository) List(ctx context.Context) ([]Vendor, error) {
+	var vendors []Vendor
+	err := r.db.WithContext(ctx).Order("id").Find(&vendors).Error
+	return vendors, err
+}
+
+// Get loads one vendor
+func (r *gormVendorRepository) Get(ctx context.Context, id uint) (*Vendor, error) {
+	var vendor Vendor
+	err := r.db.WithContext(ctx).First(&vendor, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrVendorNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &vendor, nil
+}
+
+// Update writes every column, so cleared fields are saved too
+func (r *gormVendorRepository) Update(ctx context.Context, vendor *Vendor) error {
+	result := r.db.WithContext(ctx).Select("*").Updates(vendor)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrVendorNotFound
+	}
+	return nil
+}
+
+// UpdateAliases writes only the aliases column
+func (r *gormVendorRepository) UpdateAliases(ctx context.Context, vendor *Vendor) error {
+	result := r.db.WithContext(ctx).Model(vendor).Select("aliases").Updates(vendor)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrVendorNotFound
+	}
+	return nil
+}
+
+// RecordUnmatched creates the entry unless it exists, then counts the invoice
+// and merges the names and domains into it. Scan workers record names
+// concurrently: the insert gives way to an existing row instead of failing
+// on the unique name key, and the count is incremented by the database. The
+// update holds the row until the transaction ends, so the variants merged
+// after it are not overwritten by a concurrent merge.
+func (r *gormVendorRepository) RecordUnmatched(ctx context.Context, nameKey, name string, domains []string) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "organization_id"}, {Name: "name_key"}},
+			DoNothing: true,
+		}).Create(&UnmatchedVendor{NameKey: nameKey, LastSeenAt: now}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&UnmatchedVendor{}).Where("name_key = ?", nameKey).Updates(map[string]interface{}{
+			"invoice_count": gorm.Expr("invoice_count + 1"),
+			"last_seen_at":  now,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		var entry UnmatchedVendor
+		if err := tx.Where("name_key = ?", nameKey).First(&entry).Error; err != nil {
+			return err
+		}
+		names, known := appendVariants(entry.Names, name), appendVariants(entry.Domains, domains...)
+		if len(names) == len(entry.Names) && len(known) == len(entry.Domains) {
+			return nil
+		}
+		entry.Names, entry.Domains = names, known
+		return tx.Model(&entry).Select("names", "domains").Updates(&entry).Error
+	})
+}
+
+// appendVariants adds the values a review list entry does not hold yet, up to
+// maxUnmatchedVariants
+func appendVariants(variants []string, values ...string) []string {
+	for _, value := range values {
+		if !slices.Contains(variants, value) && len(variants) < maxUnmatchedVariants {
+			variants = append(variants, value)
+		}
+	}
+	return variants
+}
+
+// ListUnmatched orders the entries by how many invoices showed them
+func (r *gormVendorRepository) ListUnmatched(ctx context.Context) ([]UnmatchedVendor, error) {
+	var entries []UnmatchedVendor
+	err := r.db.WithContext(ctx).Order("invoice_count DESC, id").Find(&entries).Error
+	return entries, err
+}
+
+// GetUnmatched loads one review list entry
+func (r *gormVendorRepository) GetUnmatched(ctx context.Context, id uint) (*UnmatchedVendor, error) {
+	var entry UnmatchedVendor
+	err := r.db.WithContext(ctx).First(&entry, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUnmatchedVendorNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// DeleteUnmatched deletes the entry's row rather than soft-deleting it, which
+// would leave its name key taken
+func (r *gormVendorRepository) DeleteUnmatched(ctx context.Context, id uint) error {
+	result := r.db.WithContext(ctx).Unscoped().Delete(&UnmatchedVendor{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrUnmatchedVendorNotFound
+	}
+	return nil
+}
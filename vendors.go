@@ -0,0 +1,449 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// How a scanned vendor name was resolved to a vendor
+const (
+	VendorMatchDomain = "domain" // a website or email domain on the invoice belongs to the vendor
+	VendorMatchName   = "name"   // the name scores close enough to the vendor's name or an alias
+)
+
+// maxUnmatchedVariants bounds the names and domains kept on a review list entry
+const maxUnmatchedVariants = 20
+
+// Vendor is a supplier of the organization. Scanned invoices are linked to the
+// vendor their vendor name or domains resolve to, and take its defaults.
+type Vendor struct {
+	gorm.Model
+	OrganizationID  uint     `gorm:"index"`
+	Name            string   // canonical name
+	Aliases         []string `gorm:"serializer:json"` // other names the vendor's invoices show
+	Domains         []string `gorm:"serializer:json"` // website and email domains, such as acme.com
+	TaxID           string
+	Address         string
+	DefaultCurrency string // used when an invoice states no currency
+	DefaultGLCode   string // general ledger account the vendor's invoices are booked to
+}
+
+// UnmatchedVendor is an entry of the vendor review list: a scanned vendor name
+// that resolved to no vendor. Names are grouped by their cleaned form, so
+// "ACME Corp" and "Acme, Corp" share an entry.
+type UnmatchedVendor struct {
+	gorm.Model
+	OrganizationID uint     `gorm:"uniqueIndex:idx_unmatched_vendors_organization_name_key"`
+	NameKey        string   `gorm:"uniqueIndex:idx_unmatched_vendors_organization_name_key"` // cleanTextForComparison of the names
+	Names          []string `gorm:"serializer:json"`                                         // names as scanned
+	Domains        []string `gorm:"serializer:json"`                                         // domains seen on the invoices
+	InvoiceCount   int
+	LastSeenAt     time.Time
+}
+
+// normalizeDomain lowercases a domain and strips "www." and surrounding dots
+func normalizeDomain(domain string) string {
+	domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), ".")
+	return strings.TrimPrefix(domain, "www.")
+}
+
+// domainMatches reports whether a domain is the vendor's domain or a subdomain of it
+func domainMatches(domain, vendorDomain string) bool {
+	return domain == vendorDomain || strings.HasSuffix(domain, "."+vendorDomain)
+}
+
+// vendorNameKeys returns the cleaned forms of the vendor's name and aliases
+func vendorNameKeys(vendor Vendor) []string {
+	var keys []string
+	for _, name := range append([]string{vendor.Name}, vendor.Aliases...) {
+		if key := cleanTextForComparison(name); key != "" && !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// assignVendor links a scanned invoice to its vendor and applies the vendor's
+// defaults, or puts the vendor name on the review list if no vendor matches.
+// Failures are logged; the invoice is kept unlinked.
+func assignVendor(ctx context.Context, vendors VendorRepository, invoice *Invoice, textLines []TextLine) {
+	known, err := vendors.List(ctx)
+	if err != nil {
+		log.Printf("Warning: Failed to load vendors: %v", err)
+		return
+	}
+
+	domains := extractDomains(textLines)
+	if !linkVendor(known, invoice, textLines, domains) {
+		recordUnmatchedVendor(ctx, vendors, invoice.VendorName, domains)
+	}
+}
+
+// linkVendor links an invoice to the known vendor its vendor name and domains
+// match and applies the vendor's defaults, reporting whether one matched
+func linkVendor(known []Vendor, invoice *Invoice, textLines []TextLine, domains []string) bool {
+	match := matchVendor(known, invoice.VendorName, domains)
+	vendor := match.Vendor
+	if vendor == nil {
+		if len(match.Candidates) > 0 {
+			best := match.Candidates[0]
+			log.Printf("Vendor %q not resolved; closest is vendor %d (%s) at %.2f", invoice.VendorName, best.Vendor.ID, best.Vendor.Name, best.Score)
+		}
+		return false
+	}
+
+	log.Printf("Vendor %q resolved to vendor %d (%s) by %s", invoice.VendorName, vendor.ID, vendor.Name, match.Method)
+	invoice.VendorID = &vendor.ID
+	invoice.Vendor = vendor
+	invoice.GLCode = vendor.DefaultGLCode
+	if vendor.DefaultCurrency != "" && statedCurrency(textLines) == "" {
+		invoice.Currency = vendor.DefaultCurrency
+	}
+	return true
+}
+
+// recordUnmatchedVendor adds a scanned vendor name to the review list
+func recordUnmatchedVendor(ctx context.Context, vendors VendorRepository, name string, domains []string) {
+	key := cleanTextForComparison(name)
+	if !knownValue(name) || key == "" {
+		return
+	}
+	if err := vendors.RecordUnmatched(ctx, key, name, domains); err != nil {
+		log.Printf("Warning: Failed to add vendor %q to the review list: %v", name, err)
+	}
+}
+
+// vendorCreate is the body of a vendor registration
+type vendorCreate struct {
+	Name            string   `json:"name" binding:"required,max=200"`
+	Aliases         []string `json:"aliases" binding:"max=100,dive,required,max=200"`
+	Domains         []string `json:"domains" binding:"max=100,dive,fqdn,max=253"`
+	TaxID           string   `json:"tax_id" binding:"max=50"`
+	Address         string   `json:"address" binding:"max=500"`
+	DefaultCurrency string   `json:"default_currency" binding:"omitempty,len=3,alpha"`
+	DefaultGLCode   string   `json:"default_gl_code" binding:"max=50"`
+}
+
+// vendorUpdate changes the fields that are present; lists are replaced whole
+type vendorUpdate struct {
+	Name            *string   `json:"name" binding:"omitempty,min=1,max=200"`
+	Aliases         *[]string `json:"aliases" binding:"omitempty,max=100,dive,required,max=200"`
+	Domains         *[]string `json:"domains" binding:"omitempty,max=100,dive,fqdn,max=253"`
+	TaxID           *string   `json:"tax_id" binding:"omitempty,max=50"`
+	Address         *string   `json:"address" binding:"omitempty,max=500"`
+	DefaultCurrency *string   `json:"default_currency" binding:"omitempty,len=0|len=3,len=0|alpha"` // empty clears it
+	DefaultGLCode   *string   `json:"default_gl_code" binding:"omitempty,max=50"`
+}
+
+// normalizeDomains normalizes and deduplicates a vendor's domains
+func normalizeDomains(domains []string) []string {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		if domain = normalizeDomain(domain); domain != "" && !slices.Contains(normalized, domain) {
+			normalized = append(normalized, domain)
+		}
+	}
+	return normalized
+}
+
+// checkVendorDomains rejects domains that already belong to another vendor,
+// since an invoice showing them could not be resolved
+func (h *invoiceHandlers) checkVendorDomains(c *gin.Context, vendor Vendor) bool {
+	others, err := h.vendors.List(tenantContext(c))
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to check vendor domains")
+		return false
+	}
+	for _, other := range others {
+		if other.ID == vendor.ID {
+			continue
+		}
+		for _, domain := range vendor.Domains {
+			if slices.Contains(other.Domains, domain) {
+				respondError(c, 409, ErrCodeConflict, fmt.Sprintf("Domain %s already belongs to vendor %d", domain, other.ID))
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// createVendor registers a vendor
+func (h *invoiceHandlers) createVendor(c *gin.Context) {
+	var request vendorCreate
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	vendor := Vendor{
+		Name:            strings.TrimSpace(request.Name),
+		Aliases:         request.Aliases,
+		Domains:         normalizeDomains(request.Domains),
+		TaxID:           request.TaxID,
+		Address:         request.Address,
+		DefaultCurrency: strings.ToUpper(request.DefaultCurrency),
+		DefaultGLCode:   request.DefaultGLCode,
+	}
+	if !h.checkVendorDomains(c, vendor) {
+		return
+	}
+	if err := h.vendors.Create(tenantContext(c), &vendor); err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to create vendor")
+		return
+	}
+
+	log.Printf("Created vendor %d (%s)", vendor.ID, vendor.Name)
+	c.JSON(201, toVendorDTO(vendor))
+}
+
+// listVendors returns the organization's vendors by name
+func (h *invoiceHandlers) listVendors(c *gin.Context) {
+	vendors, err := h.vendors.List(tenantContext(c))
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to list vendors")
+		return
+	}
+	slices.SortStableFunc(vendors, func(a, b Vendor) int { return cmp.Compare(a.Name, b.Name) })
+
+	dtos := make([]VendorDTO, 0, len(vendors))
+	for _, vendor := range vendors {
+		dtos = append(dtos, toVendorDTO(vendor))
+	}
+	c.JSON(200, VendorListDTO{Vendors: dtos})
+}
+
+// loadVendor fetches the vendor named by the path, responding with an error and
+// returning nil if there is none
+func (h *invoiceHandlers) loadVendor(c *gin.Context) *Vendor {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		respondError(c, 404, ErrCodeNotFound, "Vendor not found")
+		return nil
+	}
+	vendor, err := h.vendors.Get(tenantContext(c), uint(id))
+	if errors.Is(err, ErrVendorNotFound) {
+		respondError(c, 404, ErrCodeNotFound, "Vendor not found")
+		return nil
+	}
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to load vendor")
+		return nil
+	}
+	return vendor
+}
+
+// getVendor returns one vendor
+func (h *invoiceHandlers) getVendor(c *gin.Context) {
+	if vendor := h.loadVendor(c); vendor != nil {
+		c.JSON(200, toVendorDTO(*vendor))
+	}
+}
+
+// updateVendor changes a vendor's master data. Invoices already linked keep
+// the values they were given.
+func (h *invoiceHandlers) updateVendor(c *gin.Context) {
+	vendor := h.loadVendor(c)
+	if vendor == nil {
+		return
+	}
+
+	var update vendorUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if update.Name != nil {
+		vendor.Name = strings.TrimSpace(*update.Name)
+	}
+	if update.Aliases != nil {
+		vendor.Aliases = *update.Aliases
+	}
+	if update.Domains != nil {
+		vendor.Domains = normalizeDomains(*update.Domains)
+	}
+	if update.TaxID != nil {
+		vendor.TaxID = *update.TaxID
+	}
+	if update.Address != nil {
+		vendor.Address = *update.Address
+	}
+	if update.DefaultCurrency != nil {
+		vendor.DefaultCurrency = strings.ToUpper(*update.DefaultCurrency)
+	}
+	if update.DefaultGLCode != nil {
+		vendor.DefaultGLCode = *update.DefaultGLCode
+	}
+
+	if !h.checkVendorDomains(c, *vendor) {
+		return
+	}
+	if err := h.vendors.Update(tenantContext(c), vendor); err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to update vendor")
+		return
+	}
+	c.JSON(200, toVendorDTO(*vendor))
+}
+
+// matchVendors scores the vendors against a vendor name and domains as a scan
+// would, for trying out names and aliases
+func (h *invoiceHandlers) matchVendors(c *gin.Context) {
+	name := strings.TrimSpace(c.Query("name"))
+	domains := c.QueryArray("domain")
+	if name == "" && len(domains) == 0 {
+		respondInvalidParameter(c, "name", "name or domain is required")
+		return
+	}
+
+	vendors, err := h.vendors.List(tenantContext(c))
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to load vendors")
+		return
+	}
+	c.JSON(200, toVendorMatchDTO(matchVendor(vendors, name, normalizeDomains(domains))))
+}
+
+// unmatchedCandidates ranks the vendors a review list entry may belong to,
+// scoring each vendor by the entry's name that comes closest
+func unmatchedCandidates(vendors []Vendor, entry UnmatchedVendor) []vendorCandidate {
+	var candidates []vendorCandidate
+	for _, name := range entry.Names {
+		for _, candidate := range rankVendors(vendors, name, entry.Domains) {
+			i := slices.IndexFunc(candidates, func(other vendorCandidate) bool {
+				return other.Vendor.ID == candidate.Vendor.ID
+			})
+			if i < 0 {
+				candidates = append(candidates, candidate)
+			} else if candidate.Score > candidates[i].Score {
+				candidates[i] = candidate
+			}
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b vendorCandidate) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+	if len(candidates) > maxVendorCandidates {
+		candidates = candidates[:maxVendorCandidates]
+	}
+	return candidates
+}
+
+// listUnmatchedVendors returns the vendor review list, most frequent first,
+// with the vendors each entry may belong to
+func (h *invoiceHandlers) listUnmatchedVendors(c *gin.Context) {
+	entries, err := h.vendors.ListUnmatched(tenantContext(c))
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to list unmatched vendors")
+		return
+	}
+	vendors, err := h.vendors.List(tenantContext(c))
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to load vendors")
+		return
+	}
+
+	dtos := make([]UnmatchedVendorDTO, 0, len(entries))
+	for _, entry := range entries {
+		dtos = append(dtos, toUnmatchedVendorDTO(entry, unmatchedCandidates(vendors, entry)))
+	}
+	c.JSON(200, UnmatchedVendorListDTO{UnmatchedVendors: dtos})
+}
+
+// loadUnmatchedVendor fetches the review list entry named by the path,
+// responding with an error and returning nil if there is none
+func (h *invoiceHandlers) loadUnmatchedVendor(c *gin.Context) *UnmatchedVendor {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		respondError(c, 404, ErrCodeNotFound, "Unmatched vendor not found")
+		return nil
+	}
+	entry, err := h.vendors.GetUnmatched(tenantContext(c), uint(id))
+	if errors.Is(err, ErrUnmatchedVendorNotFound) {
+		respondError(c, 404, ErrCodeNotFound, "Unmatched vendor not found")
+		return nil
+	}
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to load unmatched vendor")
+		return nil
+	}
+	return entry
+}
+
+// vendorLink is the body of a request resolving a review list entry
+type vendorLink struct {
+	VendorID uint `json:"vendor_id" binding:"required"`
+}
+
+// linkUnmatchedVendor resolves a review list entry to a vendor: its names become
+// aliases of the vendor, so later scans match, and the invoices scanned under
+// them are linked. Domains are not copied, since invoices also show the
+// customer's own; add the vendor's domains to the vendor instead.
+func (h *invoiceHandlers) linkUnmatchedVendor(c *gin.Context) {
+	entry := h.loadUnmatchedVendor(c)
+	if entry == nil {
+		return
+	}
+
+	var request vendorLink
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	vendor, err := h.vendors.Get(tenantContext(c), request.VendorID)
+	if errors.Is(err, ErrVendorNotFound) {
+		respondError(c, 422, ErrCodeValidationFailed, "Request body failed validation",
+			FieldError{Field: "vendor_id", Message: "no such vendor"})
+		return
+	}
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to load vendor")
+		return
+	}
+
+	keys := vendorNameKeys(*vendor)
+	for _, name := range entry.Names {
+		if key := cleanTextForComparison(name); !slices.Contains(keys, key) {
+			vendor.Aliases = append(vendor.Aliases, name)
+			keys = append(keys, key)
+		}
+	}
+	if err := h.vendors.UpdateAliases(tenantContext(c), vendor); err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to update vendor")
+		return
+	}
+
+	linked, err := h.invoices.AssignVendor(tenantContext(c), entry.Names, *vendor)
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to link invoices")
+		return
+	}
+	if err := h.vendors.DeleteUnmatched(tenantContext(c), entry.ID); err != nil {
+		log.Printf("Warning: Failed to remove unmatched vendor %d: %v", entry.ID, err)
+	}
+
+	log.Printf("Linked unmatched vendor %v to vendor %d (%s): %d invoices", entry.Names, vendor.ID, vendor.Name, linked)
+	c.JSON(200, VendorLinkDTO{Vendor: toVendorDTO(*vendor), InvoicesLinked: linked})
+}
+
+// dismissUnmatchedVendor removes an entry from the review list without linking it
+func (h *invoiceHandlers) dismissUnmatchedVendor(c *gin.Context) {
+	entry := h.loadUnmatchedVendor(c)
+	if entry == nil {
+		return
+	}
+	if err := h.vendors.DeleteUnmatched(tenantContext(c), entry.ID); err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to dismiss unmatched vendor")
+		return
+	}
+	c.Status(204)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRecordUnmatchedVendor(t *testing.T) {
+	vendors := newGormVendorRepository(openTestDB(t))
+	acme, other := withTenant(t.Context(), 1), withTenant(t.Context(), 2)
+
+	recordUnmatchedVendor(acme, vendors, "ACME Corp", []string{"acme.example"})
+	recordUnmatchedVendor(acme, vendors, "Acme, Corp", []string{"acme.example", "mail.example"})
+	recordUnmatchedVendor(acme, vendors, "UNKNOWN", nil)
+	recordUnmatchedVendor(other, vendors, "Acme Corp", nil)
+
+	entries, err := vendors.ListUnmatched(acme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("review list holds %d entries, want 1: %+v", len(entries), entries)
+	}
+	entry := entries[0]
+	if entry.InvoiceCount != 2 || !slices.Equal(entry.Names, []string{"ACME Corp", "Acme, Corp"}) ||
+		!slices.Equal(entry.Domains, []string{"acme.example", "mail.example"}) {
+		t.Errorf("entry counts %d invoices of names %v and domains %v", entry.InvoiceCount, entry.Names, entry.Domains)
+	}
+
+	// Each organization has its own entry for the name
+	if entries, _ := vendors.ListUnmatched(other); len(entries) != 1 || entries[0].InvoiceCount != 1 {
+		t.Errorf("other organization's review list: %+v", entries)
+	}
+
+	// Names seen again are counted but not repeated
+	recordUnmatchedVendor(acme, vendors, "ACME Corp", nil)
+	if entries, _ := vendors.ListUnmatched(acme); entries[0].InvoiceCount != 3 || len(entries[0].Names) != 2 {
+		t.Errorf("entry counts %d invoices of names %v", entries[0].InvoiceCount, entries[0].Names)
+	}
+
+	// The variants kept are capped, the count is not
+	for i := 0; i < maxUnmatchedVariants+5; i++ {
+		recordUnmatchedVendor(acme, vendors, "Globex"+strings.Repeat(".", i+1)+"Corp", nil)
+	}
+	entries, _ = vendors.ListUnmatched(acme)
+	if len(entries) != 2 || entries[0].InvoiceCount != maxUnmatchedVariants+5 || len(entries[0].Names) != maxUnmatchedVariants {
+		t.Errorf("review list after many variants: %+v", entries)
+	}
+}
+
+func TestRecordUnmatchedVendorConcurrently(t *testing.T) {
+	vendors := newGormVendorRepository(openTestDB(t))
+	ctx := withTenant(t.Context(), 1)
+
+	const scans = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, scans)
+	for i := 0; i < scans; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- vendors.RecordUnmatched(ctx, "acmecorp", fmt.Sprintf("ACME Corp %d", i%3), nil)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("RecordUnmatched: %v", err)
+		}
+	}
+
+	entries, err := vendors.ListUnmatched(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].InvoiceCount != scans || len(entries[0].Names) != 3 {
+		t.Errorf("review list after %d concurrent scans: %+v", scans, entries)
+	}
+}
+
+func TestLinkAndDismissUnmatchedVendors(t *testing.T) {
+	conn := openTestDB(t)
+	h := newTestHandlers(t)
+	h.invoices = newGormInvoiceRepository(conn)
+	h.vendors = newGormVendorRepository(conn)
+	vendor := Vendor{OrganizationID: 1, Name: "Acme Corporation", DefaultGLCode: "6100"}
+	if err := conn.Create(&vendor).Error; err != nil {
+		t.Fatal(err)
+	}
+	h.ocrService.page(800, invoiceText("Roadrunner Supplies", "100234", "03/05/2024", 250)...)
+	h.ocrService.page(810, invoiceText("Wile E Coyote", "200345", "03/06/2024", 80)...)
+	r := h.testRouter(1)
+	r.POST("/api/vendors/unmatched/:id/link", h.linkUnmatchedVendor)
+	r.DELETE("/api/vendors/unmatched/:id", h.dismissUnmatchedVendor)
+
+	invoice := scanInvoice(t, h, 1, testPage(t, 800, 1))
+	scanInvoice(t, h, 1, testPage(t, 810, 2))
+	if invoice.Vendor != nil {
+		t.Fatalf("invoice resolved to vendor %+v", invoice.Vendor)
+	}
+
+	var list UnmatchedVendorListDTO
+	decode(t, serve(r, httptest.NewRequest("GET", "/api/vendors/unmatched", nil)), 200, &list)
+	if len(list.UnmatchedVendors) != 2 {
+		t.Fatalf("review list: %+v", list.UnmatchedVendors)
+	}
+	byName := make(map[string]uint)
+	for _, entry := range list.UnmatchedVendors {
+		byName[entry.Names[0]] = entry.ID
+	}
+	roadrunner, coyote := byName[invoice.VendorName], byName["Wile E Coyote"]
+	if roadrunner == 0 || coyote == 0 {
+		t.Fatalf("review list names: %v", byName)
+	}
+
+	link := func(id, vendorID uint) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", fmt.Sprintf("/api/vendors/unmatched/%d/link", id), bytes.NewBufferString(fmt.Sprintf(`{"vendor_id": %d}`, vendorID)))
+		req.Header.Set("Content-Type", "application/json")
+		return serve(r, req)
+	}
+	if w := link(roadrunner, 999); w.Code != 422 {
+		t.Errorf("link to an unknown vendor: %d %s", w.Code, w.Body)
+	}
+	var linked VendorLinkDTO
+	decode(t, link(roadrunner, vendor.ID), 200, &linked)
+	if linked.InvoicesLinked != 1 || !slices.Contains(linked.Vendor.Aliases, invoice.VendorName) {
+		t.Errorf("link: %+v", linked)
+	}
+
+	var got InvoiceDTO
+	decode(t, serve(r, httptest.NewRequest("GET", fmt.Sprintf("/api/invoices/%d", invoice.ID), nil)), 200, &got)
+	if got.Vendor == nil || got.Vendor.ID != vendor.ID || got.GLCode != "6100" {
+		t.Errorf("linked invoice has vendor %+v and GL code %q", got.Vendor, got.GLCode)
+	}
+
+	// The name is now an alias, so a rescan resolves
+	h.ocrService.page(820, invoiceText(invoice.VendorName, "100999", "04/05/2024", 40)...)
+	if rescanned := scanInvoice(t, h, 1, testPage(t, 820, 3)); rescanned.Vendor == nil || rescanned.Vendor.ID != vendor.ID {
+		t.Errorf("rescan resolved to vendor %+v", rescanned.Vendor)
+	}
+
+	// Another organization can neither see nor dismiss the entries
+	path := fmt.Sprintf("/api/vendors/unmatched/%d", coyote)
+	other := h.testRouter(2)
+	other.DELETE("/api/vendors/unmatched/:id", h.dismissUnmatchedVendor)
+	if w := serve(other, httptest.NewRequest("DELETE", path, nil)); w.Code != 404 {
+		t.Errorf("other organization dismissing an entry: %d", w.Code)
+	}
+	if w := serve(r, httptest.NewRequest("DELETE", path, nil)); w.Code != 204 {
+		t.Errorf("dismiss: %d %s", w.Code, w.Body)
+	}
+	if w := serve(r, httptest.NewRequest("DELETE", path, nil)); w.Code != 404 {
+		t.Errorf("second dismiss: %d", w.Code)
+	}
+	decode(t, serve(r, httptest.NewRequest("GET", "/api/vendors/unmatched", nil)), 200, &list)
+	if len(list.UnmatchedVendors) != 0 {
+		t.Errorf("review list after linking and dismissing: %+v", list.UnmatchedVendors)
+	}
+
+	// A dismissed name is listed afresh when it recurs
+	scanInvoice(t, h, 1, testPage(t, 810, 2))
+	decode(t, serve(r, httptest.NewRequest("GET", "/api/vendors/unmatched", nil)), 200, &list)
+	if len(list.UnmatchedVendors) != 1 || list.UnmatchedVendors[0].InvoiceCount != 1 {
+		t.Errorf("review list after the dismissed name recurred: %+v", list.UnmatchedVendors)
+	}
+}
@@ -21,6 +21,7 @@ document.addEventListener('DOMContentLoaded', function() {
     const fileInput = document.getElementById('file-input');
     const progressContainer = document.getElementById('progress-container');
     const progressBar = document.getElementById('progress-bar');
+    const scanStatus = document.getElementById('scan-status');
     const resultContainer = document.getElementById('result-container');
     const documentPreview = document.getElementById('document-preview');
     const documentImage = document.getElementById('document-image');
@@ -30,8 +31,15 @@ document.addEventListener('DOMContentLoaded', function() {
     const invoiceDateField = document.getElementById('invoice-date');
     const totalAmountField = document.getElementById('total-amount');
     const currencyField = document.getElementById('currency');
+    const pageCountField = document.getElementById('page-count');
     const browseLink = document.querySelector('.browse-link');
 
+    // Roles that may not scan get the page without the upload section
+    if (!uploadArea) {
+        animateHeroSection();
+        return;
+    }
+
     // Prevent default drag behaviors
     ['dragenter', 'dragover', 'dragleave', 'drop'].forEach(eventName => {
         uploadArea.addEventListener(eventName, preventDefaults, false);
@@ -83,25 +91,29 @@ document.addEventListener('DOMContentLoaded', function() {
         const files = dt.files;
         
         if (files.length > 0) {
-            const file = files[0];
-            if (file.type.startsWith('image/')) {
+            const allImages = Array.from(files).every(isSupportedImage);
+            if (allImages) {
                 handleFiles(files);
             } else {
-                showError('Please upload an image file');
+                showError('Please upload image or PDF files only');
             }
         }
     }
 
+    // Browsers often report HEIC and TIFF files with an empty MIME type, so fall back to the extension
+    function isSupportedImage(file) {
+        return file.type.startsWith('image/') || file.type === 'application/pdf' ||
+            /\.(heic|heif|tiff?|webp|bmp|pdf)$/i.test(file.name);
+    }
+
     function handleFiles(files) {
-        const file = files[0];
-        
         // Show progress
         uploadArea.style.display = 'none';
         progressContainer.classList.remove('d-none');
         
-        // Create FormData
+        // Create FormData; each selected image is one page of the same invoice
         const formData = new FormData();
-        formData.append('invoice', file);
+        Array.from(files).forEach(file => formData.append('invoice', file));
         
         // Upload file
         uploadFile(formData);
@@ -119,15 +131,20 @@ document.addEventListener('DOMContentLoaded', function() {
         });
         
         xhr.addEventListener('load', function() {
-            if (xhr.status === 200) {
+            if (xhr.status === 202) {
                 try {
-                    const response = JSON.parse(xhr.responseText);
-                    displayResults(response);
+                    const job = JSON.parse(xhr.responseText);
+                    showStatus('queued');
+                    watchScanJob(job.url);
                 } catch (e) {
                     showError('Error parsing response');
                 }
             } else {
-                showError('Error uploading file');
+                if (xhr.status === 401) {
+                    window.location.href = '/login';
+                    return;
+                }
+                showError(errorMessage(xhr.responseText, 'Error uploading file'));
             }
         });
         
@@ -135,10 +152,125 @@ document.addEventListener('DOMContentLoaded', function() {
             showError('Network error');
         });
         
-        xhr.open('POST', '/scan-invoice');
+        xhr.open('POST', '/api/scans');
         xhr.send(formData);
     }
 
+    // Follow the scan job's progress events, falling back to polling when the
+    // browser or a proxy does not support Server-Sent Events
+    function watchScanJob(url) {
+        if (!window.EventSource) {
+            pollScanJob(url);
+            return;
+        }
+
+        const source = new EventSource(url + '/events');
+        let finished = false;
+
+        source.addEventListener('status', e => showStatus(JSON.parse(e.data).status));
+        ['decoded', 'enhanced', 'sections_detected', 'ocr_started', 'ocr_done', 'field_extracted'].forEach(name => {
+            source.addEventListener(name, e => showEvent(JSON.parse(e.data)));
+        });
+        source.addEventListener('done', () => {
+            finished = true;
+            source.close();
+            pollScanJob(url);
+        });
+        source.addEventListener('failed', e => {
+            finished = true;
+            source.close();
+            scanStatus.textContent = '';
+            showError(JSON.parse(e.data).detail.error_message || 'Scan failed');
+        });
+        source.onerror = () => {
+            if (finished) return;
+            source.close();
+            pollScanJob(url);
+        };
+    }
+
+    // Pull the message out of an API error envelope
+    function errorMessage(responseText, fallback) {
+        try {
+            return JSON.parse(responseText).error.message || fallback;
+        } catch (e) {
+            return fallback;
+        }
+    }
+
+    // Poll the scan job until it finishes, showing the pipeline stage meanwhile
+    function pollScanJob(url) {
+        fetch(url)
+            .then(response => {
+                if (!response.ok) {
+                    throw new Error('Error checking scan status');
+                }
+                return response.json();
+            })
+            .then(job => {
+                if (job.status === 'done') {
+                    scanStatus.textContent = '';
+                    displayResults(job);
+                } else if (job.status === 'failed') {
+                    scanStatus.textContent = '';
+                    showError(job.error_message || 'Scan failed');
+                } else {
+                    showStatus(job.status);
+                    setTimeout(() => pollScanJob(url), 1000);
+                }
+            })
+            .catch(e => showError(e.message));
+    }
+
+    function showStatus(status) {
+        const labels = {
+            queued: 'Waiting in queue...',
+            preprocessing: 'Enhancing image...',
+            ocr: 'Reading text...',
+            extracting: 'Extracting invoice details...'
+        };
+        progressBar.style.width = '100%';
+        scanStatus.textContent = labels[status] || status;
+    }
+
+    // Describe a single pipeline step, including partial results as they arrive
+    function showEvent(event) {
+        const detail = event.detail || {};
+        const page = event.page ? ' (page ' + event.page + ')' : '';
+        const fieldLabels = {
+            vendor_name: 'Vendor',
+            invoice_number: 'Invoice number',
+            date: 'Date',
+            total_amount: 'Total',
+            currency: 'Currency',
+            line_items: 'Line items'
+        };
+
+        progressBar.style.width = '100%';
+        switch (event.event) {
+            case 'decoded':
+                scanStatus.textContent = 'Loaded ' + detail.filename + ' (' + detail.frames + ' page(s))';
+                break;
+            case 'enhanced':
+                scanStatus.textContent = 'Image enhanced' + page;
+                break;
+            case 'sections_detected':
+                scanStatus.textContent = 'Found ' + detail.sections + ' section(s) and ' + detail.tables + ' table(s)' + page;
+                break;
+            case 'ocr_started':
+                scanStatus.textContent = 'Reading text' + page + '...';
+                break;
+            case 'ocr_done':
+                scanStatus.textContent = 'Read ' + detail.lines + ' line(s) of text' + page;
+                break;
+            case 'field_extracted':
+                if (detail.value) {
+                    scanStatus.textContent = (fieldLabels[detail.field] || detail.field) + ': ' + detail.value;
+                }
+                break;
+        }
+    }
+
     function displayResults(data) {
         // Hide progress
         progressContainer.classList.add('d-none');
@@ -147,16 +279,19 @@ document.addEventListener('DOMContentLoaded', function() {
         resultContainer.classList.remove('d-none');
         
         // Populate data
-        vendorNameField.textContent = data.invoice.VendorName || 'Not detected';
-        invoiceNumberField.textContent = data.invoice.InvoiceNumber || 'Not detected';
-        invoiceDateField.textContent = data.invoice.Date || 'Not detected';
+        vendorNameField.textContent = data.invoice.vendor_name || 'Not detected';
+        invoiceNumberField.textContent = data.invoice.invoice_number || 'Not detected';
+        invoiceDateField.textContent = data.invoice.date || 'Not detected';
         
         // Format the total amount with 2 decimal places
-        const amount = parseFloat(data.invoice.TotalAmount);
+        const amount = parseFloat(data.invoice.total_amount);
         totalAmountField.textContent = amount ? amount.toFixed(2) : 'Not detected';
         
         // Display the currency
-        currencyField.textContent = data.invoice.Currency || 'Not detected';
+        currencyField.textContent = data.invoice.currency || 'Not detected';
+        
+        // Display the page count
+        pageCountField.textContent = data.invoice.page_count || 1;
         
         // Show document preview if available
         if (data.processed_image_url) {
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrWebhookNotFound is returned when no endpoint of the context's organization has the ID
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// ErrWebhookDeliveryNotFound is returned when the endpoint has no delivery with the ID
+var ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+
+// WebhookRepository stores webhook endpoints and their deliveries. Calls are
+// scoped to the context's organization like those of InvoiceRepository; the
+// delivery loop uses an unscoped context.
+type WebhookRepository interface {
+	// CreateEndpoint stores a new endpoint
+	CreateEndpoint(ctx context.Context, endpoint *WebhookEndpoint) error
+	// GetEndpoint returns an endpoint, deleted or not
+	GetEndpoint(ctx context.Context, id uint) (*WebhookEndpoint, error)
+	// ListEndpoints returns the endpoints that are not deleted, in the order
+	// they were registered
+	ListEndpoints(ctx context.Context) ([]WebhookEndpoint, error)
+	// DeleteEndpoint deletes an endpoint, keeping its deliveries
+	DeleteEndpoint(ctx context.Context, id uint) error
+	// CreateDeliveries stores new deliveries
+	CreateDeliveries(ctx context.Context, deliveries []WebhookDelivery) error
+	// GetDelivery returns a delivery to the endpoint
+	GetDelivery(ctx context.Context, endpointID, id uint) (*WebhookDelivery, error)
+	// ListDeliveries returns up to limit deliveries to the endpoint, newest first
+	ListDeliveries(ctx context.Context, endpointID uint, limit int) ([]WebhookDelivery, error)
+	// ClaimDue leases to owner until the given time up to limit pending
+	// deliveries whose next attempt is due and whose lease has lapsed, and
+	// returns them with their endpoints, the longest due first. A delivery is
+	// claimed by one caller only, however many instances claim at once. The
+	// endpoint of a delivery is left zero if it was deleted.
+	ClaimDue(ctx context.Context, owner string, until time.Time, limit int) ([]WebhookDelivery, error)
+	// SaveAttempt records the outcome of a delivery attempt and lets its lease
+	// lapse
+	SaveAttempt(ctx context.Context, delivery *WebhookDelivery) error
+	// Postpone moves the next attempt of the pending deliveries with the IDs
+	// to the time, without counting an attempt, and lets their leases lapse
+	Postpone(ctx context.Context, ids []uint, at time.Time) error
+	// Release lets the leases on the deliveries with the IDs lapse, so they
+	// can be claimed again at once
+	Release(ctx context.Context, ids []uint) error
+}
+
+// gormWebhookRepository keeps webhooks in the SQL database
+type gormWebhookRepository struct {
+	db *gorm.DB
+}
+
+// newGormWebhookRepository returns a repository on the database. Tenant scoping
+// relies on the callbacks of registerTenantCallbacks.
+func newGormWebhookRepository(db *gorm.DB) *gormWebhookRepository {
+	return &gormWebhookRepository{db: db}
+}
+
+// CreateEndpoint inserts the endpoint
+func (r *gormWebhookRepository) CreateEndpoint(ctx context.Context, endpoint *WebhookEndpoint) error {
+	return r.db.WithContext(ctx).Create(endpoint).Error
+}
+
+// GetEndpoint loads one endpoint, including soft-deleted ones
+func (r *gormWebhookRepository) GetEndpoint(ctx context.Context, id uint) (*WebhookEndpoint, error) {
+	var endpoint WebhookEndpoint
+	err := r.db.WithContext(ctx).Unscoped().First(&endpoint, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &endpoint, nil
+}
+
+// ListEndpoints loads the endpoints in ID order
+func (r *gormWebhookRepository) ListEndpoints(ctx context.Context) ([]WebhookEndpoint, error) {
+	var endpoints []WebhookEndpoint
+	err := r.db.WithContext(ctx).Order("id").Find(&endpoints).Error
+	return endpoints, err
+}
+
+// DeleteEndpoint soft-deletes the endpoint
+func (r *gormWebhookRepository) DeleteEndpoint(ctx context.Context, id uint) error {
+	result := r.db.WithContext(ctx).Delete(&WebhookEndpoint{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// CreateDeliveries inserts the deliveries in one statement
+func (r *gormWebhookRepository) CreateDeliveries(ctx context.Context, deliveries []WebhookDelivery) error {
+	return r.db.WithContext(ctx).Create(&deliveries).Error
+}
+
+// GetDelivery loads one delivery
+func (r *gormWebhookRepository) GetDelivery(ctx context.Context, endpointID, id uint) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	err := r.db.WithContext(ctx).Where("endpoint_id = ?", endpointID).First(&delivery, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrWebhookDeliveryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// ListDeliveries loads the endpoint's deliveries by descending ID
+func (r *gormWebhookRepository) ListDeliveries(ctx context.Context, endpointID uint, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := r.db.WithContext(ctx).Where("endpoint_id = ?", endpointID).
+		Order("id DESC").
+		Limit(limit).
+		Find(&deliveries).Error
+	return deliveries, err
+}
+
+// dueWebhookDeliveries scopes a query to the pending deliveries that are due
+// and whose lease has lapsed by now
+func dueWebhookDeliveries(now time.Time) func(tx *gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("status = ? AND next_attempt_at <= ?", DeliveryPending, now).
+			Where("lease_expires_at IS NULL OR lease_expires_at < ?", now)
+	}
+}
+
+// ClaimDue finds the due deliveries, then takes each one with an update that
+// checks again that it is due and unleased, like ScanJobRepository.Claim. When
+// instances race for a delivery, the database applies one update first and the
+// others no longer match it.
+func (r *gormWebhookRepository) ClaimDue(ctx context.Context, owner string, until time.Time, limit int) ([]WebhookDelivery, error) {
+	now := time.Now()
+	var ids []uint
+	err := r.db.WithContext(ctx).Model(&WebhookDelivery{}).
+		Scopes(dueWebhookDeliveries(now)).
+		Order("next_attempt_at").
+		Limit(limit).
+		Pluck("id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var claimed []uint
+	for _, id := range ids {
+		result := r.db.WithContext(ctx).Model(&WebhookDelivery{}).
+			Scopes(dueWebhookDeliveries(now)).
+			Where("id = ?", id).
+			UpdateColumns(map[string]interface{}{"lease_owner": owner, "lease_expires_at": until})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			claimed = append(claimed, id)
+		}
+	}
+	if len(claimed) == 0 {
+		return nil, nil
+	}
+
+	var deliveries []WebhookDelivery
+	err = r.db.WithContext(ctx).Preload("Endpoint").
+		Where("id IN ?", claimed).
+		Order("next_attempt_at").
+		Find(&deliveries).Error
+	return deliveries, err
+}
+
+// SaveAttempt writes the columns an attempt changes and clears the lease expiry
+func (r *gormWebhookRepository) SaveAttempt(ctx context.Context, delivery *WebhookDelivery) error {
+	delivery.LeaseExpiresAt = nil
+	return r.db.WithContext(ctx).Model(delivery).
+		Select("status", "attempts", "response_status", "last_error", "next_attempt_at", "delivered_at", "lease_expires_at").
+		Updates(delivery).Error
+}
+
+// Postpone writes next_attempt_at of the deliveries that are still pending and
+// clears their lease expiry
+func (r *gormWebhookRepository) Postpone(ctx context.Context, ids []uint, at time.Time) error {
+	return r.db.WithContext(ctx).Model(&WebhookDelivery{}).
+		Where("id IN ? AND status = ?", ids, DeliveryPending).
+		UpdateColumns(map[string]interface{}{"next_attempt_at": at, "lease_expires_at": nil}).Error
+}
+
+// Release clears the lease expiry of the deliveries
+func (r *gormWebhookRepository) Release(ctx context.Context, ids []uint) error {
+	return r.db.WithContext(ctx).Model(&WebhookDelivery{}).
+		Where("id IN ?", ids).
+		UpdateColumn("lease_expires_at", nil).Error
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Webhook event types
+const (
+	EventInvoiceScanned   = "invoice.scanned"
+	EventInvoiceCorrected = "invoice.corrected"
+	EventInvoiceApproved  = "invoice.approved"
+	EventInvoiceDuplicate = "invoice.duplicate_suspected"
+	EventScanFailed       = "scan.failed"
+)
+
+// Delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// webhookRetryDelays is how long to wait after each failed attempt. A delivery
+// is given up once every delay has been used.
+var webhookRetryDelays = []time.Duration{
+	1 * time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+	2 * time.Hour,
+	12 * time.Hour,
+}
+
+// webhookSecretPrefix marks signing secrets so they are easy to recognise
+const webhookSecretPrefix = "whsec_"
+
+// webhookTimeout bounds a single delivery attempt
+const webhookTimeout = 10 * time.Second
+
+// Bounds on the delivery loop, so a slow or failing endpoint cannot hold up
+// the deliveries of other organizations or keep the loop spinning
+const (
+	webhookBatchSize      = 50               // due deliveries loaded per pass
+	webhookMaxPasses      = 20               // passes per wake-up before waiting for the next tick
+	webhookConcurrency    = 8                // endpoints delivered to at once
+	webhookEndpointBudget = 30 * time.Second // time one endpoint may take in a pass
+)
+
+// webhookLeaseDuration is how long an instance's claim on the deliveries of a
+// pass holds. It outlasts the longest pass, with every endpoint of a batch
+// using its whole budget and a timeout, so a delivery is only claimed again by
+// another instance if the one sending it stopped.
+const webhookLeaseDuration = 10 * time.Minute
+
+// WebhookEndpoint is a URL that receives the organization's events. The secret
+// signs every delivery and is shown once when the endpoint is registered.
+type WebhookEndpoint struct {
+	gorm.Model
+	OrganizationID uint `gorm:"index"`
+	URL            string
+	Description    string
+	Events         []string `gorm:"serializer:json"`
+	Secret         string
+}
+
+// WebhookDelivery is one event sent to one endpoint, with the outcome of the
+// latest attempt. The payload is stored so retries send the same body.
+type WebhookDelivery struct {
+	gorm.Model
+	OrganizationID uint `gorm:"index"`
+	EndpointID     uint `gorm:"index"`
+	Endpoint       WebhookEndpoint
+	EventID        string `gorm:"index"`
+	Event          string
+	Payload        []byte
+	Status         string
+	Attempts       int
+	ResponseStatus int
+	LastError      string
+	NextAttemptAt  *time.Time `gorm:"index"`
+	DeliveredAt    *time.Time
+	LeaseOwner     string // instance sending the delivery
+	LeaseExpiresAt *time.Time
+}
+
+// webhookEvent is the JSON body of a delivery
+type webhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// webhookWake nudges the delivery loop when new deliveries are queued
+var webhookWake = make(chan struct{}, 1)
+
+var webhookClient = newWebhookClient(webhookTimeout)
+
+// nonPublicPrefixes are the ranges, beyond those netip classifies as private,
+// loopback or link-local, that webhooks may not be sent to
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// webhookPrivateNetworksAllowed reports whether WEBHOOK_ALLOW_PRIVATE_NETWORKS
+// lets endpoints resolve to loopback, link-local and private addresses, for
+// receivers inside the deployment's own network
+func webhookPrivateNetworksAllowed() bool {
+	return os.Getenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS") == "true"
+}
+
+// publicAddress reports whether webhooks may be sent to addr. Anything that
+// could reach the server itself, cloud metadata services or internal hosts is
+// refused.
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// newWebhookClient returns a client that refuses to connect to non-public
+// addresses. The check is made on the address being dialled, after DNS
+// resolution, so a host that resolved to a public address when the endpoint
+// was registered cannot be rebound to an internal one later, and redirects
+// are covered too. Deliveries never go through a proxy, which would hide the
+// address.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: webhookDialControl}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConnsPerHost: 2,
+		},
+	}
+}
+
+// webhookDialControl refuses connections to non-public addresses unless
+// private networks are allowed
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	if webhookPrivateNetworksAllowed() {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !publicAddress(addr) {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// validateWebhookURL checks that an endpoint URL is http or https and, unless
+// private networks are allowed, that its host resolves only to public
+// addresses. It returns why the URL is refused, or "" if it is accepted.
+func validateWebhookURL(ctx context.Context, raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return "must be an http or https URL"
+	}
+	if webhookPrivateNetworksAllowed() {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", parsed.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return "host does not resolve"
+	}
+	for _, addr := range addrs {
+		if !publicAddress(addr) {
+			return "must not point at a loopback, link-local or private address"
+		}
+	}
+	return ""
+}
+
+// randomToken returns prefix followed by n random bytes, URL-safe encoded
+func randomToken(prefix string, n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// signWebhook returns the signature header value for a delivery: an HMAC-SHA256
+// of "<timestamp>.<body>" keyed with the endpoint secret
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookEmitter sends an organization's events to its webhook endpoints.
+// Emitting never fails the caller; failures are logged.
+type WebhookEmitter interface {
+	Emit(orgID uint, eventType string, data interface{})
+}
+
+// queuedWebhookEmitter stores deliveries for the delivery loop of webhookHandlers
+type queuedWebhookEmitter struct {
+	webhooks WebhookRepository
+}
+
+// newQueuedWebhookEmitter returns an emitter storing deliveries in the repository
+func newQueuedWebhookEmitter(webhooks WebhookRepository) *queuedWebhookEmitter {
+	return &queuedWebhookEmitter{webhooks: webhooks}
+}
+
+// Emit queues a delivery of the event for every endpoint of the organization
+// that subscribes to it
+func (e *queuedWebhookEmitter) Emit(orgID uint, eventType string, data interface{}) {
+	ctx := withTenant(context.Background(), orgID)
+	endpoints, err := e.webhooks.ListEndpoints(ctx)
+	if err != nil {
+		log.Printf("Warning: Failed to load webhook endpoints for %s: %v", eventType, err)
+		return
+	}
+	endpoints = slices.DeleteFunc(endpoints, func(endpoint WebhookEndpoint) bool {
+		return !slices.Contains(endpoint.Events, eventType)
+	})
+	if len(endpoints) == 0 {
+		return
+	}
+
+	eventID, err := randomToken("evt_", 16)
+	if err != nil {
+		log.Printf("Warning: Failed to generate webhook event ID: %v", err)
+		return
+	}
+	payload, err := json.Marshal(webhookEvent{ID: eventID, Type: eventType, CreatedAt: time.Now().UTC(), Data: data})
+	if err != nil {
+		log.Printf("Warning: Failed to encode %s webhook: %v", eventType, err)
+		return
+	}
+
+	deliveries := make([]WebhookDelivery, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		deliveries = append(deliveries, newWebhookDelivery(endpoint.ID, eventID, eventType, payload))
+	}
+	if err := e.webhooks.CreateDeliveries(ctx, deliveries); err != nil {
+		log.Printf("Warning: Failed to queue %s webhooks: %v", eventType, err)
+		return
+	}
+	wakeWebhookDelivery()
+}
+
+// newWebhookDelivery returns a delivery that is due immediately
+func newWebhookDelivery(endpointID uint, eventID, eventType string, payload []byte) WebhookDelivery {
+	now := time.Now()
+	return WebhookDelivery{
+		EndpointID:    endpointID,
+		EventID:       eventID,
+		Event:         eventType,
+		Payload:       payload,
+		Status:        DeliveryPending,
+		NextAttemptAt: &now,
+	}
+}
+
+// wakeWebhookDelivery tells the delivery loop there is work without blocking
+func wakeWebhookDelivery() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// webhookHandlers serves the webhook admin endpoints and runs the delivery loop
+type webhookHandlers struct {
+	webhooks WebhookRepository
+	instance string // owner of the deliveries this instance claims
+}
+
+// newWebhookHandlers returns handlers backed by the given repository
+func newWebhookHandlers(webhooks WebhookRepository) *webhookHandlers {
+	return &webhookHandlers{webhooks: webhooks, instance: scanInstanceID()}
+}
+
+// startDelivery runs the delivery loop. Pending deliveries live in the
+// database, so retries scheduled before a restart are picked up afterwards.
+// Every replica runs the loop; each delivery is claimed by one of them before
+// it is sent.
+func (h *webhookHandlers) startDelivery() {
+	go func() {
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+		for {
+			h.deliverDue()
+			select {
+			case <-webhookWake:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// deliverDue claims the pending deliveries whose retry time has come and
+// attempts them, a batch at a time. It stops after webhookMaxPasses batches,
+// or as soon as an outcome cannot be saved; the delivery then keeps its lease
+// until it lapses rather than being sent again straight away. The next tick
+// picks up whatever is left.
+func (h *webhookHandlers) deliverDue() {
+	for pass := 0; pass < webhookMaxPasses; pass++ {
+		deliveries, err := h.webhooks.ClaimDue(context.Background(), h.instance, time.Now().Add(webhookLeaseDuration), webhookBatchSize)
+		if err != nil {
+			log.Printf("Warning: Failed to claim due webhook deliveries: %v", err)
+			return
+		}
+		if len(deliveries) == 0 || !h.deliverBatch(deliveries) {
+			return
+		}
+	}
+}
+
+// deliverBatch attempts a batch of deliveries, those of each endpoint in order
+// and up to webhookConcurrency endpoints at once. It reports whether every
+// outcome was saved.
+func (h *webhookHandlers) deliverBatch(deliveries []WebhookDelivery) bool {
+	var endpointIDs []uint
+	byEndpoint := make(map[uint][]*WebhookDelivery)
+	for i := range deliveries {
+		id := deliveries[i].EndpointID
+		if _, ok := byEndpoint[id]; !ok {
+			endpointIDs = append(endpointIDs, id)
+		}
+		byEndpoint[id] = append(byEndpoint[id], &deliveries[i])
+	}
+
+	var wg sync.WaitGroup
+	var saveFailed atomic.Bool
+	slots := make(chan struct{}, webhookConcurrency)
+	for _, id := range endpointIDs {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(deliveries []*WebhookDelivery) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := h.deliverToEndpoint(deliveries); err != nil {
+				log.Printf("Warning: Failed to record webhook deliveries to endpoint %d: %v", deliveries[0].EndpointID, err)
+				saveFailed.Store(true)
+			}
+		}(byEndpoint[id])
+	}
+	wg.Wait()
+	return !saveFailed.Load()
+}
+
+// deliverToEndpoint attempts one endpoint's deliveries in order. Once one
+// fails the endpoint is likely down, so the rest wait for its retry rather
+// than each timing out in turn, without using up an attempt. Deliveries left
+// when the endpoint has had webhookEndpointBudget are released for the next pass.
+func (h *webhookHandlers) deliverToEndpoint(deliveries []*WebhookDelivery) error {
+	deadline := time.Now().Add(webhookEndpointBudget)
+	for i, delivery := range deliveries {
+		if time.Now().After(deadline) {
+			return h.webhooks.Release(context.Background(), deliveryIDs(deliveries[i:]))
+		}
+		if err := h.attemptDelivery(delivery); err != nil {
+			return err
+		}
+		if delivery.Status != DeliveryPending {
+			continue
+		}
+
+		rest := deliveryIDs(deliveries[i+1:])
+		if len(rest) == 0 {
+			return nil
+		}
+		return h.webhooks.Postpone(context.Background(), rest, *delivery.NextAttemptAt)
+	}
+	return nil
+}
+
+// deliveryIDs returns the IDs of the deliveries
+func deliveryIDs(deliveries []*WebhookDelivery) []uint {
+	ids := make([]uint, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		ids = append(ids, delivery.ID)
+	}
+	return ids
+}
+
+// attemptDelivery posts a delivery to its endpoint once and records the
+// outcome, scheduling a retry with backoff if it failed
+func (h *webhookHandlers) attemptDelivery(delivery *WebhookDelivery) error {
+	delivery.Attempts++
+	delivery.ResponseStatus = 0
+	delivery.LastError = ""
+
+	if delivery.Endpoint.ID == 0 {
+		delivery.LastError = "endpoint was deleted"
+	} else {
+		delivery.ResponseStatus, delivery.LastError = postWebhook(delivery)
+	}
+
+	now := time.Now()
+	switch {
+	case delivery.LastError == "":
+		delivery.Status = DeliverySucceeded
+		delivery.DeliveredAt = &now
+		delivery.NextAttemptAt = nil
+	case delivery.Endpoint.ID == 0 || delivery.Attempts > len(webhookRetryDelays):
+		delivery.Status = DeliveryFailed
+		delivery.NextAttemptAt = nil
+		log.Printf("Webhook delivery %d (%s) failed after %d attempts: %s", delivery.ID, delivery.Event, delivery.Attempts, delivery.LastError)
+	default:
+		next := now.Add(webhookRetryDelays[delivery.Attempts-1])
+		delivery.NextAttemptAt = &next
+	}
+
+	return h.webhooks.SaveAttempt(context.Background(), delivery)
+}
+
+// postWebhook sends a delivery's payload, returning the response status and an
+// error message if the endpoint did not accept it
+func postWebhook(delivery *WebhookDelivery) (int, string) {
+	request, err := http.NewRequest(http.MethodPost, delivery.Endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err.Error()
+	}
+	timestamp := time.Now().Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "scan-in-webhooks/1.0")
+	request.Header.Set("X-Webhook-Id", delivery.EventID)
+	request.Header.Set("X-Webhook-Event", delivery.Event)
+	request.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	request.Header.Set("X-Webhook-Signature", signWebhook(delivery.Endpoint.Secret, timestamp, delivery.Payload))
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Sprintf("endpoint responded %s", response.Status)
+	}
+	return response.StatusCode, ""
+}
+
+// webhookCreate is the body of a request to register an endpoint
+type webhookCreate struct {
+	URL         string   `json:"url" binding:"required,url,max=2000"`
+	Description string   `json:"description" binding:"max=200"`
+	Events      []string `json:"events" binding:"required,min=1,dive,oneof=invoice.scanned invoice.corrected invoice.approved invoice.duplicate_suspected scan.failed"`
+}
+
+// createWebhook registers an endpoint. The signing secret is only ever
+// returned by this call.
+func (h *webhookHandlers) createWebhook(c *gin.Context) {
+	var request webhookCreate
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if message := validateWebhookURL(c.Request.Context(), request.URL); message != "" {
+		respondError(c, 422, ErrCodeValidationFailed, "Request body failed validation",
+			FieldError{Field: "url", Message: message})
+		return
+	}
+
+	secret, err := randomToken(webhookSecretPrefix, 32)
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to generate webhook secret")
+		return
+	}
+
+	endpoint := WebhookEndpoint{
+		URL:         request.URL,
+		Description: request.Description,
+		Events:      request.Events,
+		Secret:      secret,
+	}
+	if err := h.webhooks.CreateEndpoint(tenantContext(c), &endpoint); err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to create webhook")
+		return
+	}
+
+	log.Printf("Registered webhook %d (%s) for %v", endpoint.ID, endpoint.URL, endpoint.Events)
+	c.JSON(201, WebhookCreatedDTO{WebhookDTO: toWebhookDTO(endpoint), Secret: secret})
+}
+
+// listWebhooks returns the organization's endpoints
+func (h *webhookHandlers) listWebhooks(c *gin.Context) {
+	endpoints, err := h.webhooks.ListEndpoints(tenantContext(c))
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to list webhooks")
+		return
+	}
+
+	dtos := make([]WebhookDTO, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		dtos = append(dtos, toWebhookDTO(endpoint))
+	}
+	c.JSON(200, WebhookListDTO{Webhooks: dtos})
+}
+
+// webhookID reads a webhook or delivery ID path parameter, responding 404 if it is not one
+func webhookID(c *gin.Context, param, notFound string) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param(param), 10, 0)
+	if err != nil {
+		respondError(c, 404, ErrCodeNotFound, notFound)
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// deleteWebhook stops sending events to an endpoint. Pending deliveries to it
+// are marked failed on their next attempt; the delivery log is kept.
+func (h *webhookHandlers) deleteWebhook(c *gin.Context) {
+	id, ok := webhookID(c, "id", "Webhook not found")
+	if !ok {
+		return
+	}
+	err := h.webhooks.DeleteEndpoint(tenantContext(c), id)
+	if errors.Is(err, ErrWebhookNotFound) {
+		respondError(c, 404, ErrCodeNotFound, "Webhook not found")
+		return
+	}
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to delete webhook")
+		return
+	}
+	c.Status(204)
+}
+
+// listWebhookDeliveries returns the most recent deliveries to an endpoint
+func (h *webhookHandlers) listWebhookDeliveries(c *gin.Context) {
+	id, ok := webhookID(c, "id", "Webhook not found")
+	if !ok {
+		return
+	}
+	endpoint, err := h.webhooks.GetEndpoint(tenantContext(c), id)
+	if errors.Is(err, ErrWebhookNotFound) {
+		respondError(c, 404, ErrCodeNotFound, "Webhook not found")
+		return
+	}
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to load webhook")
+		return
+	}
+
+	limit := 50
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 200 {
+			respondInvalidParameter(c, "limit", "must be an integer between 1 and 200")
+			return
+		}
+		limit = n
+	}
+
+	deliveries, err := h.webhooks.ListDeliveries(tenantContext(c), endpoint.ID, limit)
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to list webhook deliveries")
+		return
+	}
+
+	dtos := make([]WebhookDeliveryDTO, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		dtos = append(dtos, toWebhookDeliveryDTO(delivery))
+	}
+	c.JSON(200, WebhookDeliveryListDTO{Deliveries: dtos})
+}
+
+// redeliverWebhook sends a delivery's event again as a new delivery, with the
+// same event ID so receivers can tell it is a repeat
+func (h *webhookHandlers) redeliverWebhook(c *gin.Context) {
+	endpointID, ok := webhookID(c, "id", "Webhook delivery not found")
+	if !ok {
+		return
+	}
+	id, ok := webhookID(c, "delivery_id", "Webhook delivery not found")
+	if !ok {
+		return
+	}
+	ctx := tenantContext(c)
+	original, err := h.webhooks.GetDelivery(ctx, endpointID, id)
+	if errors.Is(err, ErrWebhookDeliveryNotFound) {
+		respondError(c, 404, ErrCodeNotFound, "Webhook delivery not found")
+		return
+	}
+	if err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to load webhook delivery")
+		return
+	}
+
+	endpoint, err := h.webhooks.GetEndpoint(ctx, original.EndpointID)
+	if err != nil && !errors.Is(err, ErrWebhookNotFound) {
+		respondError(c, 500, ErrCodeInternal, "Failed to load webhook")
+		return
+	}
+	if err != nil || endpoint.DeletedAt.Valid {
+		respondError(c, 409, ErrCodeConflict, "The webhook has been deleted")
+		return
+	}
+
+	deliveries := []WebhookDelivery{newWebhookDelivery(original.EndpointID, original.EventID, original.Event, original.Payload)}
+	if err := h.webhooks.CreateDeliveries(ctx, deliveries); err != nil {
+		respondError(c, 500, ErrCodeInternal, "Failed to queue redelivery")
+		return
+	}
+	wakeWebhookDelivery()
+
+	delivery := deliveries[0]
+	log.Printf("Redelivering %s event %s to webhook %d", delivery.Event, delivery.EventID, delivery.EndpointID)
+	c.JSON(202, toWebhookDeliveryDTO(delivery))
+}
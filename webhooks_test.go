@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receivedWebhook is a request a webhookReceiver was sent
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver is an endpoint that answers deliveries with the statuses it
+// is given, in turn, and then with 200
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	received []receivedWebhook
+	delay    time.Duration
+}
+
+// newWebhookReceiver starts a receiver. It listens on loopback, so private
+// networks are allowed for the rest of the test.
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS", "true")
+	receiver := &webhookReceiver{statuses: statuses}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receiver.mu.Lock()
+		receiver.received = append(receiver.received, receivedWebhook{header: r.Header.Clone(), body: body})
+		status, delay := 200, receiver.delay
+		if len(receiver.statuses) > 0 {
+			status, receiver.statuses = receiver.statuses[0], receiver.statuses[1:]
+		}
+		receiver.mu.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+// requests returns what the receiver has been sent so far
+func (r *webhookReceiver) requests() []receivedWebhook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.received)
+}
+
+// withWebhookRetries gives the test its own retry schedule and client timeout
+func withWebhookRetries(t *testing.T, timeout time.Duration, delays ...time.Duration) {
+	savedDelays, savedClient := webhookRetryDelays, webhookClient
+	webhookRetryDelays, webhookClient = delays, newWebhookClient(timeout)
+	t.Cleanup(func() { webhookRetryDelays, webhookClient = savedDelays, savedClient })
+}
+
+// registerWebhook registers the receiver for invoice.scanned events through
+// the API and returns the endpoint with its secret
+func (s *testServer) registerWebhook(t *testing.T, key string, receiver *webhookReceiver) WebhookCreatedDTO {
+	t.Helper()
+	var endpoint WebhookCreatedDTO
+	body := fmt.Sprintf(`{"url": %q, "events": [%q]}`, receiver.URL, EventInvoiceScanned)
+	decode(t, s.call(key, request("POST", "/api/admin/webhooks", body)), 201, &endpoint)
+	return endpoint
+}
+
+// emit queues an event the way the scan and invoice handlers do outside tests
+func (s *testServer) emit(orgID uint, eventType string, data interface{}) {
+	newQueuedWebhookEmitter(s.webhookHandlers.webhooks).Emit(orgID, eventType, data)
+}
+
+// delivery reads a delivery back from the database
+func (s *testServer) delivery(t *testing.T, eventID string, nth int) WebhookDelivery {
+	t.Helper()
+	var deliveries []WebhookDelivery
+	if err := s.db.Where("event_id = ?", eventID).Order("id").Find(&deliveries).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) <= nth {
+		t.Fatalf("%d deliveries of event %s, want at least %d", len(deliveries), eventID, nth+1)
+	}
+	return deliveries[nth]
+}
+
+// makeDue brings every pending retry forward to now
+func (s *testServer) makeDue(t *testing.T) {
+	t.Helper()
+	err := s.db.Model(&WebhookDelivery{}).Where("status = ?", DeliveryPending).
+		Update("next_attempt_at", time.Now().Add(-time.Second)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkSignature verifies a delivery the way a receiver would, without signWebhook
+func checkSignature(t *testing.T, secret string, webhook receivedWebhook) {
+	t.Helper()
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(webhook.header.Get("X-Webhook-Timestamp") + "."))
+	mac.Write(webhook.body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := webhook.header.Get("X-Webhook-Signature"); !hmac.Equal([]byte(got), []byte(want)) {
+		t.Errorf("signature %s, want %s", got, want)
+	}
+}
+
+func TestWebhookDeliveryRetries(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.issueKey(t, 1, ScopeAdmin)
+	withWebhookRetries(t, 5*time.Second, time.Hour, 2*time.Hour)
+	receiver := newWebhookReceiver(t, 500, 503)
+	endpoint := s.registerWebhook(t, admin, receiver)
+
+	s.emit(1, EventInvoiceScanned, map[string]int{"invoice_id": 7})
+	s.emit(1, EventInvoiceApproved, map[string]int{"invoice_id": 7})
+	s.emit(2, EventInvoiceScanned, map[string]int{"invoice_id": 8})
+	s.webhookHandlers.deliverDue()
+
+	// Only the subscribed event of the endpoint's organization is sent, signed
+	sent := receiver.requests()
+	if len(sent) != 1 {
+		t.Fatalf("receiver got %d requests, want 1", len(sent))
+	}
+	first := sent[0]
+	eventID := first.header.Get("X-Webhook-Id")
+	if first.header.Get("X-Webhook-Event") != EventInvoiceScanned || !strings.Contains(string(first.body), `"invoice_id":7`) {
+		t.Errorf("delivered %s: %s", first.header.Get("X-Webhook-Event"), first.body)
+	}
+	checkSignature(t, endpoint.Secret, first)
+
+	// A 5xx schedules a retry after the first delay, and nothing is sent before then
+	delivery := s.delivery(t, eventID, 0)
+	if delivery.Status != DeliveryPending || delivery.Attempts != 1 || delivery.ResponseStatus != 500 || delivery.NextAttemptAt == nil {
+		t.Fatalf("after a 500: %s, %d attempts, status %d, next %v", delivery.Status, delivery.Attempts, delivery.ResponseStatus, delivery.NextAttemptAt)
+	}
+	if wait := time.Until(*delivery.NextAttemptAt); wait < 59*time.Minute || wait > time.Hour {
+		t.Errorf("first retry in %v, want an hour", wait)
+	}
+	s.webhookHandlers.deliverDue()
+	if len(receiver.requests()) != 1 {
+		t.Fatal("retried before the delay was up")
+	}
+
+	s.makeDue(t)
+	s.webhookHandlers.deliverDue()
+	delivery = s.delivery(t, eventID, 0)
+	if wait := time.Until(*delivery.NextAttemptAt); delivery.Attempts != 2 || wait < 119*time.Minute || wait > 2*time.Hour {
+		t.Errorf("after the second failure: %d attempts, retry in %v; want 2 and two hours", delivery.Attempts, wait)
+	}
+
+	// Retries send the same event and body, freshly signed
+	s.makeDue(t)
+	s.webhookHandlers.deliverDue()
+	sent = receiver.requests()
+	if len(sent) != 3 {
+		t.Fatalf("receiver got %d requests, want 3", len(sent))
+	}
+	if last := sent[2]; last.header.Get("X-Webhook-Id") != eventID || string(last.body) != string(first.body) {
+		t.Errorf("retry sent event %s with %s", last.header.Get("X-Webhook-Id"), last.body)
+	} else {
+		checkSignature(t, endpoint.Secret, last)
+	}
+	delivery = s.delivery(t, eventID, 0)
+	if delivery.Status != DeliverySucceeded || delivery.Attempts != 3 || delivery.DeliveredAt == nil || delivery.NextAttemptAt != nil {
+		t.Errorf("after a 200: %s, %d attempts, delivered %v, next %v", delivery.Status, delivery.Attempts, delivery.DeliveredAt, delivery.NextAttemptAt)
+	}
+}
+
+func TestWebhookDeliveryGivesUp(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.issueKey(t, 1, ScopeAdmin)
+	withWebhookRetries(t, 100*time.Millisecond, time.Hour)
+	receiver := newWebhookReceiver(t)
+	receiver.delay = 5 * time.Second
+	s.registerWebhook(t, admin, receiver)
+
+	s.emit(1, EventInvoiceScanned, map[string]int{"invoice_id": 7})
+	s.webhookHandlers.deliverDue()
+
+	// An endpoint that does not answer in time is retried like a 5xx
+	sent := receiver.requests()
+	if len(sent) != 1 {
+		t.Fatalf("receiver got %d requests, want 1", len(sent))
+	}
+	eventID := sent[0].header.Get("X-Webhook-Id")
+	delivery := s.delivery(t, eventID, 0)
+	if delivery.Status != DeliveryPending || delivery.ResponseStatus != 0 || !strings.Contains(delivery.LastError, "Timeout") {
+		t.Errorf("after a timeout: %s, status %d, error %q", delivery.Status, delivery.ResponseStatus, delivery.LastError)
+	}
+
+	// With every retry used up the delivery fails for good
+	s.makeDue(t)
+	s.webhookHandlers.deliverDue()
+	delivery = s.delivery(t, eventID, 0)
+	if delivery.Status != DeliveryFailed || delivery.Attempts != 2 || delivery.NextAttemptAt != nil {
+		t.Errorf("after the last retry: %s, %d attempts, next %v", delivery.Status, delivery.Attempts, delivery.NextAttemptAt)
+	}
+	s.makeDue(t)
+	s.webhookHandlers.deliverDue()
+	if len(receiver.requests()) != 2 {
+		t.Errorf("receiver got %d requests after the delivery failed, want 2", len(receiver.requests()))
+	}
+}
+
+func TestWebhookRedelivery(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.issueKey(t, 1, ScopeAdmin)
+	other, _ := s.issueKey(t, 2, ScopeAdmin)
+	withWebhookRetries(t, 5*time.Second)
+	receiver := newWebhookReceiver(t, 500)
+	endpoint := s.registerWebhook(t, admin, receiver)
+
+	s.emit(1, EventInvoiceScanned, map[string]int{"invoice_id": 7})
+	s.webhookHandlers.deliverDue()
+	eventID := receiver.requests()[0].header.Get("X-Webhook-Id")
+	failed := s.delivery(t, eventID, 0)
+	if failed.Status != DeliveryFailed {
+		t.Fatalf("delivery %s with no retries left", failed.Status)
+	}
+
+	path := fmt.Sprintf("/api/admin/webhooks/%d/deliveries/%d/redeliver", endpoint.ID, failed.ID)
+	if w := s.call(other, request("POST", path, "")); w.Code != 404 {
+		t.Errorf("redelivery by another organization: %d", w.Code)
+	}
+	var redelivery WebhookDeliveryDTO
+	decode(t, s.call(admin, request("POST", path, "")), 202, &redelivery)
+	if redelivery.ID == failed.ID || redelivery.EventID != eventID || redelivery.Status != DeliveryPending || redelivery.Attempts != 0 {
+		t.Errorf("redelivery %+v", redelivery)
+	}
+
+	// The receiver gets the event again under the same ID, so it can tell a repeat
+	s.webhookHandlers.deliverDue()
+	sent := receiver.requests()
+	if len(sent) != 2 || sent[1].header.Get("X-Webhook-Id") != eventID || string(sent[1].body) != string(sent[0].body) {
+		t.Fatalf("redelivered %d requests", len(sent))
+	}
+	checkSignature(t, endpoint.Secret, sent[1])
+
+	var deliveries WebhookDeliveryListDTO
+	decode(t, s.call(admin, request("GET", fmt.Sprintf("/api/admin/webhooks/%d/deliveries", endpoint.ID), "")), 200, &deliveries)
+	if len(deliveries.Deliveries) != 2 || deliveries.Deliveries[0].ID != redelivery.ID || deliveries.Deliveries[0].Status != DeliverySucceeded || deliveries.Deliveries[1].Status != DeliveryFailed {
+		t.Errorf("delivery log %+v", deliveries.Deliveries)
+	}
+
+	// A deleted endpoint's deliveries cannot be sent again
+	decode(t, s.call(admin, request("DELETE", fmt.Sprintf("/api/admin/webhooks/%d", endpoint.ID), "")), 204, nil)
+	if w := s.call(admin, request("POST", path, "")); w.Code != 409 {
+		t.Errorf("redelivery to a deleted webhook: %d", w.Code)
+	}
+}
+
+// failingSaveWebhookRepository cannot record delivery attempts
+type failingSaveWebhookRepository struct {
+	WebhookRepository
+}
+
+func (failingSaveWebhookRepository) SaveAttempt(ctx context.Context, delivery *WebhookDelivery) error {
+	return errors.New("database is read-only")
+}
+
+func TestWebhookDeliveryIsolatesEndpoints(t *testing.T) {
+	s := newTestServer(t)
+	acme, _ := s.issueKey(t, 1, ScopeAdmin)
+	globex, _ := s.issueKey(t, 2, ScopeAdmin)
+	withWebhookRetries(t, 5*time.Second, time.Hour)
+	slow := newWebhookReceiver(t)
+	slow.delay = 500 * time.Millisecond
+	fast := newWebhookReceiver(t)
+	s.registerWebhook(t, acme, slow)
+	s.registerWebhook(t, globex, fast)
+
+	for i := 0; i < 3; i++ {
+		s.emit(1, EventInvoiceScanned, map[string]int{"invoice_id": i})
+		s.emit(2, EventInvoiceScanned, map[string]int{"invoice_id": i})
+	}
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		s.webhookHandlers.deliverDue()
+		close(done)
+	}()
+
+	// The fast endpoint gets all of its events while the slow one is still
+	// answering the first
+	for len(fast.requests()) < 3 && time.Since(start) < 450*time.Millisecond {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(fast.requests()); n != 3 {
+		t.Errorf("fast endpoint got %d events while the slow one answered its first", n)
+	}
+	<-done
+	if n := len(slow.requests()); n != 3 {
+		t.Errorf("slow endpoint got %d events, want 3", n)
+	}
+}
+
+func TestWebhookFailurePostponesTheEndpointsOtherDeliveries(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.issueKey(t, 1, ScopeAdmin)
+	withWebhookRetries(t, 5*time.Second, time.Hour)
+	receiver := newWebhookReceiver(t, 500)
+	s.registerWebhook(t, admin, receiver)
+
+	for i := 0; i < 3; i++ {
+		s.emit(1, EventInvoiceScanned, map[string]int{"invoice_id": i})
+	}
+	s.webhookHandlers.deliverDue()
+
+	// The endpoint failed once; the other events wait for its retry without
+	// using up an attempt
+	if n := len(receiver.requests()); n != 1 {
+		t.Fatalf("receiver got %d requests, want 1", n)
+	}
+	var deliveries []WebhookDelivery
+	if err := s.db.Order("id").Find(&deliveries).Error; err != nil {
+		t.Fatal(err)
+	}
+	retry := deliveries[0].NextAttemptAt
+	if deliveries[0].Attempts != 1 || retry == nil || time.Until(*retry) < 59*time.Minute {
+		t.Fatalf("failed delivery: %d attempts, next %v", deliveries[0].Attempts, retry)
+	}
+	for _, delivery := range deliveries[1:] {
+		if delivery.Status != DeliveryPending || delivery.Attempts != 0 || delivery.NextAttemptAt == nil || !delivery.NextAttemptAt.Equal(*retry) {
+			t.Errorf("delivery waiting on the endpoint: %s, %d attempts, next %v, want %v", delivery.Status, delivery.Attempts, delivery.NextAttemptAt, retry)
+		}
+	}
+
+	// At the retry every event is sent
+	s.makeDue(t)
+	s.webhookHandlers.deliverDue()
+	if n := len(receiver.requests()); n != 4 {
+		t.Errorf("receiver got %d requests after the retry, want 4", n)
+	}
+}
+
+func TestWebhookDeliveryStopsWhenAttemptsCannotBeSaved(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.issueKey(t, 1, ScopeAdmin)
+	withWebhookRetries(t, 5*time.Second, time.Hour)
+	receiver := newWebhookReceiver(t)
+	s.registerWebhook(t, admin, receiver)
+	s.emit(1, EventInvoiceScanned, map[string]int{"invoice_id": 7})
+
+	// The delivery stays due, so without a stop it would be sent over and over
+	handlers := newWebhookHandlers(failingSaveWebhookRepository{s.webhookHandlers.webhooks})
+	handlers.deliverDue()
+	if n := len(receiver.requests()); n != 1 {
+		t.Errorf("receiver got %d requests, want 1", n)
+	}
+}
+
+func TestWebhookDeliveryLeases(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.issueKey(t, 1, ScopeAdmin)
+	s.registerWebhook(t, admin, newWebhookReceiver(t))
+	for i := 0; i < 3; i++ {
+		s.emit(1, EventInvoiceScanned, map[string]int{"invoice_id": i})
+	}
+	a, b := newGormWebhookRepository(s.db), newGormWebhookRepository(s.db)
+	ctx := context.Background()
+	later := time.Now().Add(time.Minute)
+
+	// A claimed delivery is not claimed again until its lease lapses or is released
+	claimed, err := a.ClaimDue(ctx, "a", later, 2)
+	if err != nil || len(claimed) != 2 || claimed[0].Endpoint.ID == 0 {
+		t.Fatalf("first claim: %d deliveries (%v)", len(claimed), err)
+	}
+	rest, err := b.ClaimDue(ctx, "b", later, 10)
+	if err != nil || len(rest) != 1 || rest[0].ID == claimed[0].ID || rest[0].ID == claimed[1].ID {
+		t.Fatalf("second claim took %d deliveries (%v)", len(rest), err)
+	}
+	if again, _ := b.ClaimDue(ctx, "b", later, 10); len(again) != 0 {
+		t.Errorf("claimed %d leased deliveries", len(again))
+	}
+	if err := a.Release(ctx, []uint{claimed[1].ID}); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := b.ClaimDue(ctx, "b", later, 10); len(again) != 1 || again[0].ID != claimed[1].ID || again[0].LeaseOwner != "b" {
+		t.Errorf("released delivery not claimed again: %+v", again)
+	}
+
+	// A lease left by an instance that stopped lapses
+	if err := s.db.Model(&WebhookDelivery{}).Where("id = ?", claimed[0].ID).
+		Update("lease_expires_at", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := b.ClaimDue(ctx, "b", later, 10); len(again) != 1 || again[0].ID != claimed[0].ID {
+		t.Errorf("lapsed delivery not claimed again: %+v", again)
+	}
+}
+
+func TestWebhookDeliveredOnceByReplicas(t *testing.T) {
+	s := newTestServer(t)
+	acme, _ := s.issueKey(t, 1, ScopeAdmin)
+	globex, _ := s.issueKey(t, 2, ScopeAdmin)
+	withWebhookRetries(t, 5*time.Second, time.Hour)
+	receiver := newWebhookReceiver(t)
+	receiver.delay = 20 * time.Millisecond
+	s.registerWebhook(t, acme, receiver)
+	s.registerWebhook(t, globex, receiver)
+
+	const events = 10
+	for i := 0; i < events; i++ {
+		s.emit(1, EventInvoiceScanned, map[string]int{"invoice_id": i})
+		s.emit(2, EventInvoiceScanned, map[string]int{"invoice_id": i})
+	}
+
+	// Two replicas, each with a repository of its own on the shared database,
+	// run their delivery loops at once
+	var wg sync.WaitGroup
+	for _, instance := range []string{"replica-1", "replica-2"} {
+		replica := newWebhookHandlers(newGormWebhookRepository(s.db))
+		replica.instance = instance
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replica.deliverDue()
+		}()
+	}
+	wg.Wait()
+
+	sent := make(map[string]int)
+	for _, webhook := range receiver.requests() {
+		sent[webhook.header.Get("X-Webhook-Id")]++
+	}
+	for eventID, n := range sent {
+		if n != 1 {
+			t.Errorf("event %s sent %d times", eventID, n)
+		}
+	}
+	var deliveries []WebhookDelivery
+	if err := s.db.Find(&deliveries).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2*events || len(deliveries) != 2*events {
+		t.Errorf("receiver got %d events for %d deliveries, want %d", len(sent), len(deliveries), 2*events)
+	}
+	for _, delivery := range deliveries {
+		if delivery.Status != DeliverySucceeded || delivery.Attempts != 1 {
+			t.Errorf("delivery %d: %s after %d attempts", delivery.ID, delivery.Status, delivery.Attempts)
+		}
+	}
+}
+
+func TestWebhookPrivateAddressesRefused(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.issueKey(t, 1, ScopeAdmin)
+
+	for _, url := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.5/hook",
+		"http://192.168.1.1/hook",
+		"http://[::1]/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+		"http://0.0.0.0/hook",
+		"ftp://203.0.113.7/hook",
+	} {
+		body := fmt.Sprintf(`{"url": %q, "events": [%q]}`, url, EventInvoiceScanned)
+		if w := s.call(admin, request("POST", "/api/admin/webhooks", body)); w.Code != 422 {
+			t.Errorf("registering %s: %d %s", url, w.Code, w.Body)
+		}
+	}
+
+	// A host that passed the check but now resolves to a private address is
+	// refused when the delivery dials it
+	withWebhookRetries(t, 5*time.Second, time.Hour)
+	receiver := newWebhookReceiver(t)
+	s.registerWebhook(t, admin, receiver)
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS", "")
+
+	s.emit(1, EventInvoiceScanned, map[string]int{"invoice_id": 7})
+	s.webhookHandlers.deliverDue()
+	if len(receiver.requests()) != 0 {
+		t.Fatal("delivery reached a loopback address")
+	}
+	var delivery WebhookDelivery
+	if err := s.db.First(&delivery).Error; err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Status != DeliveryPending || !strings.Contains(delivery.LastError, "not public") {
+		t.Errorf("delivery to loopback: %s, %q", delivery.Status, delivery.LastError)
+	}
+}
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		{"203.0.113.7", true},
+		{"8.8.8.8", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.0.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:10.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddress(netip.MustParseAddr(tt.addr)); got != tt.public {
+			t.Errorf("publicAddress(%s) = %v, want %v", tt.addr, got, tt.public)
+		}
+	}
+}